@@ -0,0 +1,379 @@
+// Package bus is the producer/consumer pipeline cut down to something an
+// application can embed as an asynchronous in-process event bus. Publishers
+// are the producers and each subscription is a pipeline of its own, whose
+// consumers handle its events off a bounded buffer, so a slow or failing
+// subscriber only holds up the publishers once its own queue is full and
+// never affects the others.
+//
+//	b := bus.New(bus.Options{QueueSize: 100})
+//	b.Subscribe("orders.*", func(ctx context.Context, e bus.Event) error {
+//		return ship(ctx, e.Payload.(Order))
+//	})
+//	b.Publish(ctx, "orders.created", order)
+//	...
+//	b.Close(ctx) // handles what's queued, then returns
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgreenblatt/go_producer_consumer/pipeline"
+)
+
+var (
+	// ErrClosed is returned when publishing to or subscribing on a closed bus
+	ErrClosed = errors.New("bus: closed")
+	// ErrQueueFull is returned by TryPublish when a subscriber had no room
+	ErrQueueFull = errors.New("bus: subscriber queue full")
+)
+
+// Event is one published message, as its subscribers see it
+type Event struct {
+	Topic     string
+	Payload   any
+	Published time.Time
+}
+
+// Handler handles an event for a subscriber. An error, or a panic, counts
+// the event as failed for that subscriber and is passed to its OnError.
+// The handler publishes, unsubscribes or closes the bus with the ctx it is
+// given, which tells the bus not to wait on the handler itself.
+type Handler func(ctx context.Context, e Event) error
+
+// Options are the defaults for every subscription on a bus
+type Options struct {
+	// QueueSize is how many events each subscriber can have waiting,
+	// 64 if zero
+	QueueSize int
+	// Workers is how many goroutines handle each subscriber's events, 1 if
+	// zero. With more than one events may be handled out of order.
+	Workers int
+	// OnError hears about events a subscriber failed to handle. By default
+	// they are logged.
+	OnError func(sub *Subscription, e Event, err error)
+}
+
+// Bus delivers published events to the subscriptions whose pattern matches
+// their topic. It is safe to use from any number of goroutines.
+type Bus struct {
+	opts Options
+
+	mu     sync.RWMutex
+	subs   []*Subscription
+	closed bool
+}
+
+// New makes a bus with the given defaults
+func New(opts Options) *Bus {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 64
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(sub *Subscription, e Event, err error) {
+			log.Printf("bus: subscriber %s failed on %s: %v", sub.Pattern, e.Topic, err)
+		}
+	}
+	return &Bus{opts: opts}
+}
+
+// Subscription is one subscriber's pipeline
+type Subscription struct {
+	// Pattern is the topic pattern given to Subscribe
+	Pattern string
+
+	bus     *Bus
+	handler Handler
+	onError func(*Subscription, Event, error)
+	// kept open for the events produced on it until the subscription closes
+	p *pipeline.Pipeline
+	// closed once p's run is over
+	done chan struct{}
+	// the events on their way through p, by the ID of the item each rides
+	// on, as an item's payload is JSON and an event's can be anything
+	events sync.Map
+	nextID atomic.Int64
+
+	// done as the subscription starts closing, letting go of publishers
+	// waiting for room
+	quit    context.Context
+	stopped context.CancelFunc
+	closing sync.Once
+
+	queued, delivered, failed, dropped atomic.Int64
+}
+
+// SubscribeOption overrides one of the bus's Options for a subscription
+type SubscribeOption func(*Options)
+
+// WithQueueSize gives the subscription a queue of its own size
+func WithQueueSize(n int) SubscribeOption {
+	return func(o *Options) {
+		if n > 0 {
+			o.QueueSize = n
+		}
+	}
+}
+
+// WithWorkers gives the subscription its own number of workers
+func WithWorkers(n int) SubscribeOption {
+	return func(o *Options) {
+		if n > 0 {
+			o.Workers = n
+		}
+	}
+}
+
+// WithErrorHandler gives the subscription its own error handler
+func WithErrorHandler(fn func(*Subscription, Event, error)) SubscribeOption {
+	return func(o *Options) {
+		if fn != nil {
+			o.OnError = fn
+		}
+	}
+}
+
+// Subscribe calls handler for every event whose topic matches pattern,
+// using the syntax of path.Match, so "orders.*" matches "orders.created"
+// and "*" matches any topic without a slash in it. An exact topic is just
+// a pattern without wildcards.
+func (b *Bus) Subscribe(pattern string, handler Handler, opts ...SubscribeOption) (*Subscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bus: bad pattern %q: %v", pattern, err)
+	}
+	o := b.opts
+	s := &Subscription{Pattern: pattern, bus: b, handler: handler, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s.onError = o.OnError
+	s.quit, s.stopped = context.WithCancel(context.Background())
+
+	// no producers of its own, the publishers produce on it
+	cfg, err := pipeline.ParseConfig([]string{
+		"-name", "bus " + pattern,
+		"-producers", "0",
+		"-consumers", strconv.Itoa(o.Workers),
+		"-buffer", strconv.Itoa(o.QueueSize),
+		"-delay", "0",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bus: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if s.p, err = pipeline.New(cfg, pipeline.WithHandler(subscriber{s}),
+		pipeline.WithSummary(io.Discard), pipeline.KeepOpen()); err != nil {
+		return nil, fmt.Errorf("bus: %v", err)
+	}
+	b.subs = append(b.subs, s)
+	go func() {
+		defer close(s.done)
+		s.p.Run()
+	}()
+	return s, nil
+}
+
+// Publish queues an event for every matching subscriber, waiting for room
+// in the queues that are full until ctx is done. It returns once the event
+// is queued, not once it has been handled. A handler publishing to its own
+// subscription with the ctx it was given doesn't wait, as it would be
+// waiting for itself to make the room. The subscribers it didn't wait for
+// miss the event, which is counted as dropped for them, and the result is
+// ErrQueueFull.
+func (b *Bus) Publish(ctx context.Context, topic string, payload any) error {
+	return b.publish(ctx, topic, payload, true)
+}
+
+// TryPublish is Publish without the waiting: subscribers whose queues are
+// full miss the event, which is counted as dropped for them, and the
+// result is ErrQueueFull.
+func (b *Bus) TryPublish(ctx context.Context, topic string, payload any) error {
+	return b.publish(ctx, topic, payload, false)
+}
+
+func (b *Bus) publish(ctx context.Context, topic string, payload any, wait bool) error {
+	// no bus lock is held while queueing, so a handler can publish too
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrClosed
+	}
+	subs := b.subs
+	b.mu.RUnlock()
+	e := Event{Topic: topic, Payload: payload, Published: time.Now()}
+	var err error
+	for _, s := range subs {
+		if ok, _ := path.Match(s.Pattern, topic); ok && !s.offer(ctx, e, wait) {
+			s.dropped.Add(1)
+			err = ErrQueueFull
+		}
+	}
+	return err
+}
+
+// the subscription a handler's ctx says it is handling an event for
+type handlingKey struct{}
+
+// whether ctx is that of one of the subscription's handler calls
+func (s *Subscription) handling(ctx context.Context) bool {
+	return ctx.Value(handlingKey{}) == s
+}
+
+// queue an event unless the subscription is going away, reporting false
+// only if it was full and we weren't to wait, or gave up waiting
+func (s *Subscription) offer(ctx context.Context, e Event, wait bool) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(s.quit, cancel)()
+	if !wait || s.handling(ctx) {
+		// a done ctx only stops the pipeline waiting for room
+		cancel()
+	}
+	id := int(s.nextID.Add(1))
+	s.events.Store(id, e)
+	s.queued.Add(1)
+	err := s.p.Produce(ctx, pipeline.Item{ID: id})
+	if err == nil {
+		return true
+	}
+	s.events.Delete(id)
+	s.queued.Add(-1)
+	// one closing, or closed, just doesn't take the event
+	return !errors.Is(err, pipeline.ErrBufferFull) || s.quit.Err() != nil
+}
+
+// the handler of a subscription's pipeline, which hands each of its items'
+// events to the subscriber and gives back nothing to write
+type subscriber struct{ s *Subscription }
+
+func (h subscriber) Handle(item *pipeline.Item) (*pipeline.Item, error) {
+	_, err := h.SplitContext(context.Background(), item)
+	return nil, err
+}
+
+func (h subscriber) Split(item *pipeline.Item) ([]pipeline.Item, error) {
+	return h.SplitContext(context.Background(), item)
+}
+
+func (h subscriber) SplitContext(ctx context.Context, item *pipeline.Item) ([]pipeline.Item, error) {
+	s := h.s
+	v, ok := s.events.LoadAndDelete(item.ID)
+	if !ok {
+		return nil, nil
+	}
+	s.queued.Add(-1)
+	e := v.(Event)
+	if err := s.call(context.WithValue(ctx, handlingKey{}, s), e); err != nil {
+		s.failed.Add(1)
+		s.onError(s, e, err)
+		return nil, nil
+	}
+	s.delivered.Add(1)
+	return nil, nil
+}
+
+// run the handler, turning a panic into an error so one bad event can't
+// take the subscriber, or the application, down with it
+func (s *Subscription) call(ctx context.Context, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler(ctx, e)
+}
+
+// Unsubscribe stops new events reaching the subscription, then waits for
+// the ones already queued to be handled. Called from the subscription's
+// own handler with its ctx it doesn't wait, as the handler's worker goes
+// on to handle them once the handler returns.
+func (s *Subscription) Unsubscribe(ctx context.Context) {
+	b := s.bus
+	b.mu.Lock()
+	for i, other := range b.subs {
+		if other == s {
+			// copied rather than shifted, publishers may be holding the old slice
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+	s.close()
+	s.wait(ctx)
+}
+
+// stop taking events, letting go of the publishers waiting for room, and
+// have the pipeline finish once it has handled those queued
+func (s *Subscription) close() {
+	s.closing.Do(func() {
+		s.stopped()
+		s.p.Drain()
+	})
+}
+
+// wait for the queued events to be handled, unless it's one of the workers
+// handling them that asks
+func (s *Subscription) wait(ctx context.Context) {
+	if !s.handling(ctx) {
+		<-s.done
+	}
+}
+
+// SubscriptionStats counts what has happened to a subscription's events
+type SubscriptionStats struct {
+	Queued    int
+	Delivered int64
+	Failed    int64
+	Dropped   int64
+}
+
+// Stats reports the subscription's counts so far
+func (s *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Queued:    int(s.queued.Load()),
+		Delivered: s.delivered.Load(),
+		Failed:    s.failed.Load(),
+		Dropped:   s.dropped.Load(),
+	}
+}
+
+// Close stops the bus taking new events and subscriptions, and returns
+// once every subscriber has handled what was already queued for it. That
+// includes refusing events that handlers publish while they are draining.
+// Called from a handler with its ctx it doesn't wait for that handler's
+// subscription.
+func (b *Bus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.mu.Unlock()
+	// every subscription is closed before any is waited on, so a handler
+	// waiting for room in another's is let go
+	for _, s := range subs {
+		s.close()
+	}
+	for _, s := range subs {
+		s.wait(ctx)
+	}
+	return nil
+}
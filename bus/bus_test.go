@@ -0,0 +1,114 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// every matching subscriber gets each event once, in order with a single
+// worker, and hears about the ones it failed on, panics included
+func TestPublishDelivers(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var got []int
+	var failures []error
+	b := New(Options{QueueSize: 4, OnError: func(_ *Subscription, _ Event, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, err)
+	}})
+	orders, err := b.Subscribe("orders.*", func(_ context.Context, e Event) error {
+		n := e.Payload.(int)
+		switch n {
+		case 3:
+			return errors.New("no stock")
+		case 4:
+			panic("out of paper")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, n)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("invoices", func(context.Context, Event) error {
+		t.Error("an order reached the invoices")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		if err := b.Publish(ctx, "orders.created", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, "orders.created", 21); !errors.Is(err, ErrClosed) {
+		t.Fatalf("publishing on a closed bus gave %v", err)
+	}
+	if len(got) != 18 || len(failures) != 2 {
+		t.Fatalf("handled %v with %d failures, expected 18 and 2", got, len(failures))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			t.Fatalf("events handled out of order: %v", got)
+		}
+	}
+	if st := orders.Stats(); st.Delivered != 18 || st.Failed != 2 || st.Queued != 0 || st.Dropped != 0 {
+		t.Fatalf("stats are %+v", st)
+	}
+}
+
+// a handler publishing to its own full queue, unsubscribing or closing
+// the bus with its ctx doesn't wait on itself
+func TestHandlerCallsBack(t *testing.T) {
+	ctx := context.Background()
+	b := New(Options{QueueSize: 1})
+	release := make(chan struct{})
+	var dropped error
+	sub, err := b.Subscribe("echo", func(ctx context.Context, e Event) error {
+		if e.Payload == "first" {
+			<-release
+			b.Publish(ctx, "echo", "again")
+			dropped = b.Publish(ctx, "echo", "and again")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("stop", func(ctx context.Context, e Event) error {
+		return b.Close(ctx)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b.Publish(ctx, "echo", "first")
+	close(release)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sub.Stats().Delivered < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		b.Publish(ctx, "stop", nil)
+		b.Close(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the bus didn't close")
+	}
+	if !errors.Is(dropped, ErrQueueFull) {
+		t.Fatalf("publishing to the handler's own full queue gave %v", dropped)
+	}
+	if st := sub.Stats(); st.Dropped != 1 {
+		t.Fatalf("stats are %+v", st)
+	}
+}
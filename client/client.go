@@ -0,0 +1,621 @@
+// Package client talks to a running go_producer_consumer over HTTP, with an
+// Ingest client for putting items on a pipeline run with -ingest and an
+// Admin client for its admin API, so a service can feed and steer a
+// pipeline without building the requests itself.
+//
+//	in := client.NewIngest("localhost:8082", client.Options{Token: os.Getenv("INGEST_TOKEN")})
+//	err := in.Produce(ctx, client.Item{Payload: json.RawMessage(`{"order": 42}`)})
+//
+//	admin := client.NewAdmin("unix:/run/pc/admin.sock", client.Options{Token: os.Getenv("ADMIN_TOKEN")})
+//	st, err := admin.Stats(ctx)
+//	_, err = admin.Scale(ctx, -1, st.Consumers*2)
+//
+// Addresses are host:port, http:// or https:// urls, or unix:<path> for a
+// socket. Requests that fail on the network, or that the server answers
+// with 429, 502, 503 or 504, are tried again after a backoff that doubles
+// each time, or the Retry-After the server answered with if that is
+// longer, until Options.Retries runs out or the context ends. The
+// clients keep their connections open between requests, and are safe to
+// share between goroutines.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDraining is what producing fails with once the pipeline is draining
+// and takes no more items, which trying again won't change
+var ErrDraining = errors.New("client: pipeline is draining")
+
+// ErrShed is what producing fails with when a pipeline run with
+// -ingest-full shed drops items it has no room for. It isn't retried, as
+// the pipeline chose to drop them.
+var ErrShed = errors.New("client: the pipeline had no room and shed items")
+
+// Options are the settings shared by the Ingest and Admin clients. The zero
+// value works against a server with no authentication.
+type Options struct {
+	// Token is sent as a bearer token, for -ingest-auth and -admin-auth
+	// token
+	Token string
+	// TLS is used for https:// addresses, e.g. with a client certificate
+	// for -ingest-auth mtls. The system roots are used when it is nil.
+	TLS *tls.Config
+	// Retries is how many more times a request is tried once it fails in
+	// a way that may pass, 3 if zero and none if negative
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling after,
+	// 100ms if zero
+	RetryBackoff time.Duration
+	// MaxConns is the most connections kept open to the server, 16 if
+	// zero
+	MaxConns int
+	// Pipeline is the admin API's name for the pipeline, "default" if
+	// empty, as -name is
+	Pipeline string
+	// HTTPClient, when set, is used as it is instead of one made from
+	// the settings above
+	HTTPClient *http.Client
+}
+
+// Item is an item to put on a pipeline, as the pipeline encodes it. A
+// zero Timestamp is set by the pipeline as a producer takes the item.
+type Item struct {
+	// Id and Timestamp are always sent, as they are how the pipeline tells
+	// an item from a bare payload
+	ID             int               `json:"Id"`
+	Timestamp      time.Time         `json:"Timestamp"`
+	ProducerID     int               `json:"ProducerId,omitempty"`
+	IdempotencyKey string            `json:"IdempotencyKey,omitempty"`
+	Metadata       map[string]string `json:"Metadata,omitempty"`
+	Payload        json.RawMessage   `json:"Payload,omitempty"`
+	Schema         string            `json:"Schema,omitempty"`
+	SchemaVersion  int               `json:"SchemaVersion,omitempty"`
+}
+
+// Status is what the admin API reports about a pipeline
+type Status struct {
+	Name          string           `json:"name"`
+	State         string           `json:"state"`
+	Producers     int              `json:"producers"`
+	Consumers     int              `json:"consumers"`
+	Buffered      int              `json:"buffered"`
+	Capacity      int              `json:"capacity"`
+	Rate          float64          `json:"rate"`
+	Produced      int64            `json:"produced"`
+	Consumed      int64            `json:"consumed"`
+	Errors        int64            `json:"errors"`
+	Filtered      int64            `json:"filtered"`
+	Dead          int64            `json:"dead_lettered"`
+	P50           string           `json:"p50"`
+	P99           string           `json:"p99"`
+	Routes        map[string]int64 `json:"routes,omitempty"`
+	BufferedBytes int64            `json:"buffered_bytes,omitempty"`
+	ByteLimit     int64            `json:"byte_limit,omitempty"`
+	Memory        int64            `json:"memory_bytes,omitempty"`
+	Dropped       map[string]int64 `json:"dropped,omitempty"`
+	Watermark     string           `json:"watermark,omitempty"`
+	Prefetched    int64            `json:"prefetched,omitempty"`
+}
+
+// Error is a request the server turned down
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked for before the request is
+	// sent again, as a 429 from -ingest-full reject does, or 0
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// whether a try failing with the status may pass next time
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// conn is what both clients send their requests with
+type conn struct {
+	http    *http.Client
+	base    string
+	token   string
+	retries int
+	backoff time.Duration
+}
+
+func newConn(addr string, opts Options) *conn {
+	c := &conn{token: opts.Token, retries: opts.Retries, backoff: opts.RetryBackoff}
+	if c.retries == 0 {
+		c.retries = 3
+	}
+	if c.backoff <= 0 {
+		c.backoff = 100 * time.Millisecond
+	}
+	maxConns := opts.MaxConns
+	if maxConns <= 0 {
+		maxConns = 16
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost, t.MaxIdleConns = maxConns, maxConns
+	t.TLSClientConfig = opts.TLS
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		var d net.Dialer
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		}
+		c.base = "http://pipeline"
+	case strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://"):
+		c.base = strings.TrimSuffix(addr, "/")
+	default:
+		c.base = "http://" + addr
+	}
+	c.http = opts.HTTPClient
+	if c.http == nil {
+		c.http = &http.Client{Transport: t}
+	}
+	return c
+}
+
+// send a request, trying it again while it fails in a way that may pass,
+// and decode the answer into out if it is set
+func (c *conn) do(ctx context.Context, method, path string, body []byte, out any) error {
+	for try := 0; ; try++ {
+		err := c.once(ctx, method, path, nil, body, out)
+		if err == nil || !c.again(ctx, try, err) {
+			return err
+		}
+	}
+}
+
+// whether to try a request again that failed with err on its try'th go,
+// having waited for the backoff
+func (c *conn) again(ctx context.Context, try int, err error) bool {
+	var e *Error
+	if ctx.Err() != nil || try >= c.retries || errors.Is(err, ErrDraining) || errors.As(err, &e) && !retryable(e.StatusCode) {
+		return false
+	}
+	wait := c.backoff << try
+	if e != nil {
+		wait = max(wait, e.RetryAfter)
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// send a request once. header, if set, adds to the request's headers. The
+// error of a request turned down is an *Error, and what its answer says
+// is still decoded into out.
+func (c *conn) once(ctx context.Context, method, path string, header http.Header, body []byte, out any) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if out != nil && len(b) > 0 {
+		// an answer turned down may still say something, such as how
+		// many items got in
+		if err := json.Unmarshal(b, out); err != nil && resp.StatusCode < 300 {
+			return fmt.Errorf("client: decoding the answer to %s %s: %v", method, path, err)
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return answerError(resp.StatusCode, resp.Header, b)
+	}
+	return nil
+}
+
+// the error of an answer turning a request down, from its status, headers
+// and body
+func answerError(code int, header http.Header, b []byte) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(b, &e)
+	if e.Error == "" {
+		e.Error = strings.TrimSpace(string(b))
+	}
+	if code == http.StatusServiceUnavailable && strings.Contains(e.Error, "draining") {
+		return ErrDraining
+	}
+	err := &Error{StatusCode: code, Message: e.Error}
+	if secs, _ := strconv.Atoi(header.Get("Retry-After")); secs > 0 {
+		err.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return err
+}
+
+// Ingest puts items on a pipeline run with -ingest
+type Ingest struct {
+	c *conn
+}
+
+// NewIngest makes a client for the -ingest endpoint at addr
+func NewIngest(addr string, opts Options) *Ingest {
+	return &Ingest{c: newConn(addr, opts)}
+}
+
+// Produce puts an item on the pipeline, returning once a producer has
+// taken it
+func (in *Ingest) Produce(ctx context.Context, item Item) error {
+	_, err := in.ProduceBatch(ctx, []Item{item}, false)
+	return err
+}
+
+// ProduceBatch puts items on the pipeline in one request, returning how
+// many of them got in. With atomic they all get in or none do, see the
+// pipeline's ProducerBatch. Without it, a request cut short took the
+// items before the one it stopped at, and a retry sends only the rest.
+// Each request carries an Idempotency-Key header, kept across its
+// retries, so a pipeline run with -dedup-window drops the items of a
+// request sent again after its answer was lost.
+func (in *Ingest) ProduceBatch(ctx context.Context, items []Item, atomic bool) (int, error) {
+	values := make([]json.RawMessage, len(items))
+	for i := range items {
+		b, err := json.Marshal(&items[i])
+		if err != nil {
+			return 0, err
+		}
+		values[i] = b
+	}
+	return in.post(ctx, values, atomic)
+}
+
+// ProduceRaw puts json values on the pipeline as ProduceBatch does, each
+// used as an item if it is one as the pipeline encodes them, with an Id
+// and a Timestamp, and made the payload of a new item otherwise
+func (in *Ingest) ProduceRaw(ctx context.Context, values []json.RawMessage, atomic bool) (int, error) {
+	return in.post(ctx, values, atomic)
+}
+
+func (in *Ingest) post(ctx context.Context, values []json.RawMessage, atomic bool) (int, error) {
+	if len(values) == 0 {
+		return 0, nil
+	}
+	path := "/items"
+	if atomic {
+		path += "?atomic=true"
+	}
+	key := newKey()
+	accepted := 0
+	for try := 0; ; try++ {
+		batch := values[accepted:]
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return accepted, err
+		}
+		// keyed by where the batch starts, so that sending the same batch
+		// again gives its items the same keys
+		header := http.Header{"Idempotency-Key": {fmt.Sprintf("%s-%d", key, accepted)}}
+		var answer struct {
+			Accepted int `json:"accepted"`
+			Shed     int `json:"shed"`
+		}
+		err = in.c.once(ctx, http.MethodPost, path, header, body, &answer)
+		switch {
+		case !atomic:
+			accepted += min(answer.Accepted, len(batch))
+		case err == nil:
+			accepted = len(values) - answer.Shed
+		}
+		if err == nil && answer.Shed > 0 {
+			return accepted, fmt.Errorf("%w: %d of the %d items sent", ErrShed, answer.Shed, len(batch))
+		}
+		if err == nil || !in.c.again(ctx, try, err) {
+			return accepted, err
+		}
+	}
+}
+
+// ProduceStream puts the json lines read from r on the pipeline in one
+// streamed request, each an item or a payload as ProduceRaw takes them,
+// for more items than are worth holding in memory or sending a request
+// at a time. The pipeline reads the lines only as its producers take the
+// items, so r is read no faster than the pipeline goes. progress, if set,
+// is told every second or so how many items have got in. It returns how
+// many did, and isn't retried, as what r had can't be read again.
+func (in *Ingest) ProduceStream(ctx context.Context, r io.Reader, progress func(accepted int)) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, in.c.base+"/items", r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if in.c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+in.c.token)
+	}
+	resp, err := in.c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// a short request is answered the once, a longer one line by line
+	// ending with one that is done
+	type answer struct {
+		Accepted int  `json:"accepted"`
+		Shed     int  `json:"shed"`
+		Done     bool `json:"done"`
+		Status   int  `json:"status"`
+	}
+	var last answer
+	var line json.RawMessage
+	dec := json.NewDecoder(resp.Body)
+	for {
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return last.Accepted, err
+		}
+		last = answer{}
+		json.Unmarshal(line, &last)
+		if !last.Done && progress != nil && resp.StatusCode == http.StatusOK {
+			progress(last.Accepted)
+		}
+	}
+	code := resp.StatusCode
+	if code == http.StatusOK {
+		if !last.Done {
+			return last.Accepted, fmt.Errorf("client: the answer to a streamed request ended before it was done: %w", io.ErrUnexpectedEOF)
+		}
+		code = last.Status
+	}
+	if code >= 300 {
+		return last.Accepted, answerError(code, resp.Header, line)
+	}
+	if last.Shed > 0 {
+		return last.Accepted, fmt.Errorf("%w: %d of the items sent", ErrShed, last.Shed)
+	}
+	return last.Accepted, nil
+}
+
+// Ready reports nil while the pipeline is taking items, and why not
+// otherwise, from its /readyz probe. It isn't retried.
+func (in *Ingest) Ready(ctx context.Context) error {
+	var answer struct {
+		Reason string `json:"reason"`
+	}
+	err := in.c.once(ctx, http.MethodGet, "/readyz", nil, nil, &answer)
+	var e *Error
+	if errors.As(err, &e) && answer.Reason != "" {
+		e.Message = answer.Reason
+	}
+	return err
+}
+
+// Admin steers a pipeline through its admin API
+type Admin struct {
+	c    *conn
+	name string
+}
+
+// NewAdmin makes a client for the admin API at addr, for the pipeline
+// Options.Pipeline names
+func NewAdmin(addr string, opts Options) *Admin {
+	name := opts.Pipeline
+	if name == "" {
+		name = "default"
+	}
+	return &Admin{c: newConn(addr, opts), name: name}
+}
+
+func (a *Admin) path(action string) string {
+	return "/pipelines/" + url.PathEscape(a.name) + "/" + action
+}
+
+// send a request about the pipeline, answered with its status
+func (a *Admin) status(ctx context.Context, method, action string, req any) (*Status, error) {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return nil, err
+		}
+	}
+	st := &Status{}
+	if err := a.c.do(ctx, method, a.path(action), body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Pipelines lists every pipeline the admin API serves
+func (a *Admin) Pipelines(ctx context.Context) ([]Status, error) {
+	var out []Status
+	if err := a.c.do(ctx, http.MethodGet, "/pipelines", nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Stats is the pipeline's counters, latencies and pool sizes
+func (a *Admin) Stats(ctx context.Context) (*Status, error) {
+	return a.status(ctx, http.MethodGet, "stats", nil)
+}
+
+// Pause stops the producers and consumers where they are
+func (a *Admin) Pause(ctx context.Context) (*Status, error) {
+	return a.status(ctx, http.MethodPost, "pause", nil)
+}
+
+// Resume carries on after a Pause
+func (a *Admin) Resume(ctx context.Context) (*Status, error) {
+	return a.status(ctx, http.MethodPost, "resume", nil)
+}
+
+// Drain stops the producers and lets the consumers finish what is
+// buffered
+func (a *Admin) Drain(ctx context.Context) (*Status, error) {
+	return a.status(ctx, http.MethodPost, "drain", nil)
+}
+
+// Flush waits until what is buffered now has been handled, for as long as
+// ctx allows
+func (a *Admin) Flush(ctx context.Context) (*Status, error) {
+	action := "flush"
+	if deadline, ok := ctx.Deadline(); ok {
+		action += "?timeout=" + time.Until(deadline).Round(time.Millisecond).String()
+	}
+	return a.status(ctx, http.MethodPost, action, nil)
+}
+
+// Scale sets how many producers and consumers the pipeline runs, leaving
+// either as it is when given as -1
+func (a *Admin) Scale(ctx context.Context, producers, consumers int) (*Status, error) {
+	req := map[string]int{}
+	if producers >= 0 {
+		req["producers"] = producers
+	}
+	if consumers >= 0 {
+		req["consumers"] = consumers
+	}
+	return a.status(ctx, http.MethodPost, "scale", req)
+}
+
+// SetRate caps the producers at rate items a second together, or lets
+// them go as fast as they can with 0
+func (a *Admin) SetRate(ctx context.Context, rate float64) (*Status, error) {
+	return a.status(ctx, http.MethodPost, "rate", map[string]float64{"rate": rate})
+}
+
+// Peek is the next items waiting on the pipeline's buffer, up to n of
+// them and at most 100, which are left there for the consumers
+func (a *Admin) Peek(ctx context.Context, n int) ([]Item, error) {
+	var out []Item
+	if err := a.c.do(ctx, http.MethodGet, a.path("peek")+"?n="+strconv.Itoa(n), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Consumed calls fn with the last items the pipeline's consumers handed
+// its sink, as many as last, up to the hundred it keeps, and with follow,
+// with each one consumed after that too until the pipeline finishes, fn
+// returns an error or ctx ends. A follower that can't keep up misses
+// items rather than holding the pipeline up; missed is then called with
+// how many went by, if it is set. The pipeline needs -admin set to keep
+// them. It is only retried until the stream starts.
+func (a *Admin) Consumed(ctx context.Context, last int, follow bool, fn func(ConsumedItem) error, missed func(int64)) error {
+	path := a.path("consumed") + "?last=" + strconv.Itoa(last)
+	if follow {
+		path += "&follow=true"
+	}
+	var resp *http.Response
+	for try := 0; ; try++ {
+		var err error
+		resp, err = a.c.stream(ctx, path)
+		if err == nil {
+			break
+		}
+		if !a.c.again(ctx, try, err) {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line struct {
+			ConsumedItem
+			Missed int64 `json:"missed"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if line.Missed > 0 {
+			if missed != nil {
+				missed(line.Missed)
+			}
+			continue
+		}
+		if err := fn(line.ConsumedItem); err != nil {
+			return err
+		}
+	}
+}
+
+// ConsumedItem is an item a pipeline consumed, with what its handler made
+// of it, as the pipeline's Result has it
+type ConsumedItem struct {
+	Item
+	Result json.RawMessage `json:"Result,omitempty"`
+}
+
+// start a GET whose answer is read as it comes
+func (c *conn) stream(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, &Error{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return resp, nil
+}
+
+// a key for a request's items, unique enough not to meet another's
+func newKey() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
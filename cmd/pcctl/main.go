@@ -0,0 +1,180 @@
+// pcctl talks to a go_producer_consumer daemon over its network APIs, for
+// an operator to put test items on a running pipeline and watch what it
+// consumes without writing code:
+//
+//	pcctl produce -ingest localhost:8082 -file items.ndjson
+//	pcctl consume -admin localhost:8081 -follow | jq .Payload
+//	pcctl shell -admin localhost:8081
+//
+// produce posts each line of the file, or stdin for -, to the -ingest
+// endpoint in batches, or with -stream all in one request read as the
+// pipeline takes the items: a line that is an item as the pipeline
+// encodes it is put on as it is, and any other line becomes the payload
+// of a new item. consume prints the last items the consumers handed the sink as
+// json lines, and with -follow the rest as they come, until the pipeline
+// finishes or pcctl is interrupted. shell takes commands such as stats,
+// peek 5, inject {"order": 42} and scale consumers 8 a line at a time,
+// for poking at a live pipeline; help lists them. The tokens come from
+// -token, or $INGEST_TOKEN for produce and $ADMIN_TOKEN for consume and
+// shell, whose inject uses -ingest-token.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/bgreenblatt/go_producer_consumer/client"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(pcctl(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func pcctl(ctx context.Context, args []string, in io.Reader, out, errs io.Writer) int {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	switch args[0] {
+	case "produce":
+		return produce(ctx, args[1:], in, errs)
+	case "consume":
+		return consume(ctx, args[1:], out, errs)
+	case "shell":
+		return shell(ctx, args[1:], in, out, errs)
+	}
+	fmt.Fprintln(errs, "usage: pcctl produce|consume|shell [flags]")
+	return 2
+}
+
+func produce(ctx context.Context, args []string, stdin io.Reader, errs io.Writer) int {
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	fs.SetOutput(errs)
+	addr := fs.String("ingest", "localhost:8082", "the daemon's -ingest endpoint, as host:port, https://host:port or unix:<path>")
+	token := fs.String("token", os.Getenv("INGEST_TOKEN"), "ingest bearer token (default $INGEST_TOKEN)")
+	file := fs.String("file", "-", "file of items or payloads, one per line, or - for stdin")
+	batch := fs.Int("batch", 100, "lines posted in each request")
+	atomic := fs.Bool("atomic", false, "have each request's items taken all together or none of them")
+	stream := fs.Bool("stream", false, "send the lot in one streamed request rather than in batches")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *batch < 1 {
+		fmt.Fprintln(errs, "-batch must be at least 1")
+		return 2
+	}
+	if *stream && *atomic {
+		fmt.Fprintln(errs, "-stream and -atomic can't be used together, as a stream's items are taken as they come")
+		return 2
+	}
+	r := stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintf(errs, "produce: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	ingest := client.NewIngest(*addr, client.Options{Token: *token})
+	if *stream {
+		n, err := ingest.ProduceStream(ctx, r, func(accepted int) {
+			fmt.Fprintf(errs, "%d items in\n", accepted)
+		})
+		if err != nil {
+			fmt.Fprintf(errs, "produce: %v, after %d items\n", err, n)
+			return 1
+		}
+		fmt.Fprintf(errs, "produced %d items\n", n)
+		return 0
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	var values []json.RawMessage
+	produced := 0
+	send := func() error {
+		n, err := ingest.ProduceRaw(ctx, values, *atomic)
+		produced += n
+		values = values[:0]
+		return err
+	}
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		values = append(values, itemValue(line))
+		if len(values) == *batch {
+			if err := send(); err != nil {
+				fmt.Fprintf(errs, "produce: %v, after %d items\n", err, produced)
+				return 1
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintf(errs, "produce: reading %s: %v, after %d items\n", *file, err, produced)
+		return 1
+	}
+	if err := send(); err != nil {
+		fmt.Fprintf(errs, "produce: %v, after %d items\n", err, produced)
+		return 1
+	}
+	fmt.Fprintf(errs, "produced %d items\n", produced)
+	return 0
+}
+
+// a line as the ingest endpoint would take it, json as it is and
+// anything else as a string payload
+func itemValue(line []byte) json.RawMessage {
+	v := json.RawMessage(append([]byte(nil), line...))
+	if !json.Valid(v) {
+		v, _ = json.Marshal(string(line))
+	}
+	return v
+}
+
+func consume(ctx context.Context, args []string, out, errs io.Writer) int {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	fs.SetOutput(errs)
+	addr := fs.String("admin", "localhost:8081", "the daemon's admin API, as host:port, https://host:port or unix:<path>")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin API bearer token (default $ADMIN_TOKEN)")
+	name := fs.String("pipeline", "default", "name of the pipeline")
+	last := fs.Int("last", 10, "how many of the latest consumed items to start with, up to the 100 kept")
+	follow := fs.Bool("follow", false, "keep printing items as they are consumed")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	admin := client.NewAdmin(*addr, client.Options{Token: *token, Pipeline: *name})
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	err := admin.Consumed(ctx, *last, *follow, func(item client.ConsumedItem) error {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+		return w.Flush()
+	}, func(n int64) {
+		fmt.Fprintf(errs, "missed %d items, falling behind the consumers\n", n)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintf(errs, "consume: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bgreenblatt/go_producer_consumer/client"
+)
+
+const shellHelp = `commands:
+  stats                          the pipeline's counters, latencies and pool sizes
+  peek [n]                       the next n items waiting on the buffer, 5 by default, left there
+  consumed [n]                   the last n items consumed, 10 by default
+  inject <item or payload>       put an item on through -ingest, a bare payload getting a new one
+  scale producers|consumers <n>  run n of them
+  rate <items/sec>               cap the producers, 0 for no cap
+  pause, resume, flush, drain    as the admin API has them
+  help, quit`
+
+// shell reads commands a line at a time and runs each against the admin
+// API, or the ingest endpoint for inject, printing what comes back. A
+// command that fails says why and the shell carries on.
+func shell(ctx context.Context, args []string, in io.Reader, out, errs io.Writer) int {
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	fs.SetOutput(errs)
+	addr := fs.String("admin", "localhost:8081", "the daemon's admin API, as host:port, https://host:port or unix:<path>")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin API bearer token (default $ADMIN_TOKEN)")
+	name := fs.String("pipeline", "default", "name of the pipeline")
+	ingestAddr := fs.String("ingest", "localhost:8082", "the daemon's -ingest endpoint, for inject")
+	ingestToken := fs.String("ingest-token", os.Getenv("INGEST_TOKEN"), "ingest bearer token (default $INGEST_TOKEN)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	sh := &shellSession{
+		admin:  client.NewAdmin(*addr, client.Options{Token: *token, Pipeline: *name}),
+		ingest: client.NewIngest(*ingestAddr, client.Options{Token: *ingestToken}),
+		out:    out,
+	}
+	prompt := ""
+	if f, ok := in.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			prompt = *name + "> "
+		}
+	}
+	// read in the background so an interrupt ends the shell even while it
+	// waits for a line
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		sc.Buffer(make([]byte, 64<<10), 16<<20)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	for {
+		fmt.Fprint(out, prompt)
+		var line string
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				if prompt != "" {
+					fmt.Fprintln(out)
+				}
+				return 0
+			}
+			line = strings.TrimSpace(l)
+		case <-ctx.Done():
+			fmt.Fprintln(out)
+			return 0
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, rest, _ := strings.Cut(line, " ")
+		if cmd == "quit" || cmd == "exit" {
+			return 0
+		}
+		if err := sh.run(ctx, cmd, strings.TrimSpace(rest)); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return 0
+			}
+			fmt.Fprintf(errs, "%s: %v\n", cmd, err)
+		}
+	}
+}
+
+type shellSession struct {
+	admin  *client.Admin
+	ingest *client.Ingest
+	out    io.Writer
+}
+
+func (sh *shellSession) run(ctx context.Context, cmd, rest string) error {
+	words := strings.Fields(rest)
+	switch cmd {
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+		return nil
+	case "stats":
+		st, err := sh.admin.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		return sh.print(st)
+	case "peek":
+		n, err := count(words, 5)
+		if err != nil {
+			return err
+		}
+		items, err := sh.admin.Peek(ctx, n)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			fmt.Fprintln(sh.out, "the buffer is empty")
+		}
+		for _, item := range items {
+			sh.line(item)
+		}
+		return nil
+	case "consumed":
+		n, err := count(words, 10)
+		if err != nil {
+			return err
+		}
+		return sh.admin.Consumed(ctx, n, false, func(item client.ConsumedItem) error {
+			sh.line(item)
+			return nil
+		}, nil)
+	case "inject":
+		if rest == "" {
+			return fmt.Errorf("expected an item or a payload to put on")
+		}
+		if _, err := sh.ingest.ProduceRaw(ctx, []json.RawMessage{itemValue([]byte(rest))}, false); err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, "injected 1 item")
+		return nil
+	case "scale":
+		if len(words) != 2 || (words[0] != "producers" && words[0] != "consumers") {
+			return fmt.Errorf("expected scale producers|consumers <n>")
+		}
+		n, err := strconv.Atoi(words[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad count %q", words[1])
+		}
+		producers, consumers := n, -1
+		if words[0] == "consumers" {
+			producers, consumers = -1, n
+		}
+		return sh.status(sh.admin.Scale(ctx, producers, consumers))
+	case "rate":
+		if len(words) != 1 {
+			return fmt.Errorf("expected rate <items/sec>")
+		}
+		rate, err := strconv.ParseFloat(words[0], 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("bad rate %q", words[0])
+		}
+		return sh.status(sh.admin.SetRate(ctx, rate))
+	case "pause":
+		return sh.status(sh.admin.Pause(ctx))
+	case "resume":
+		return sh.status(sh.admin.Resume(ctx))
+	case "flush":
+		return sh.status(sh.admin.Flush(ctx))
+	case "drain":
+		return sh.status(sh.admin.Drain(ctx))
+	}
+	return fmt.Errorf("unknown command, try help")
+}
+
+// the optional count a command takes
+func count(words []string, def int) (int, error) {
+	switch len(words) {
+	case 0:
+		return def, nil
+	case 1:
+		n, err := strconv.Atoi(words[0])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("bad count %q", words[0])
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected at most one count")
+}
+
+// sum up the status a command that steers the pipeline answers with
+func (sh *shellSession) status(st *client.Status, err error) error {
+	if err != nil {
+		return err
+	}
+	rate := "no rate cap"
+	if st.Rate > 0 {
+		rate = fmt.Sprintf("capped at %g items/s", st.Rate)
+	}
+	fmt.Fprintf(sh.out, "%s: %d producers, %d consumers, %d of %d buffered, %s\n",
+		st.State, st.Producers, st.Consumers, st.Buffered, st.Capacity, rate)
+	return nil
+}
+
+func (sh *shellSession) print(v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%s\n", b)
+	return nil
+}
+
+func (sh *shellSession) line(v any) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(sh.out, "%s\n", b)
+}
@@ -0,0 +1,13 @@
+// This program creates three producer threads using goroutines, and six
+// consumer threads also using goroutines. They communicate using the standard
+// go channel mechanism, so no external locking code is needed. The counts,
+// channel size and consumer delay can be changed with command line flags.
+//
+// The pipeline itself is in the pipeline package, for a program to embed.
+package main
+
+import "github.com/bgreenblatt/go_producer_consumer/pipeline"
+
+func main() {
+	pipeline.Main()
+}
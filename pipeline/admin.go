@@ -0,0 +1,349 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// adminServer is the HTTP admin API for controlling pipelines while they
+// run. By default every request must carry the admin token as a bearer
+// token; see endpointSecurity for TLS and client certificate options.
+//
+//	GET  /pipelines                  list pipelines and their state
+//	GET  /pipelines/{name}/stats     counters, latencies and pool sizes
+//	POST /pipelines/{name}/pause     stop producers and consumers in place
+//	POST /pipelines/{name}/resume    carry on after a pause
+//	POST /pipelines/{name}/drain     stop producing, finish what is buffered
+//	POST /pipelines/{name}/flush     wait until what is buffered now is handled, ?timeout=30s
+//	POST /pipelines/{name}/scale     {"producers": 4, "consumers": 8}
+//	POST /pipelines/{name}/rate      {"rate": 5000}, 0 for unlimited
+//	POST /pipelines/{name}/canary    {"percent": 5}, the -canary-handler's share
+//	POST /pipelines/{name}/buffer    {"capacity": 500}, resizing the buffer
+//	GET  /pipelines/{name}/dlq       dead letters held in memory, ?filter=<expression>&reason=<text>
+//	POST /pipelines/{name}/dlq/requeue  put those dead letters back on the buffers
+//	POST /pipelines/{name}/consumers/{id}/resume  end a consumer's -consumer-pause-after pause
+//	GET  /pipelines/{name}/where     where an item is, ?id=42 or by trace number, ?trace=7, with -trace
+//	GET  /pipelines/{name}/consumed  the items consumed as json lines, ?last=10, and as they come with &follow=true
+//	GET  /pipelines/{name}/peek      the next items waiting on the buffer, ?n=5, left on it
+//	GET  /metrics                    every pipeline's stats for Prometheus
+type adminServer struct {
+	security *endpointSecurity
+	srv      *http.Server
+	mu       sync.Mutex
+	pipes    map[string]*Pipeline
+}
+
+func newAdminServer(security *endpointSecurity) *adminServer {
+	return &adminServer{security: security, pipes: make(map[string]*Pipeline)}
+}
+
+func (a *adminServer) register(p *Pipeline) {
+	a.mu.Lock()
+	a.pipes[p.name] = p
+	a.mu.Unlock()
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pipelines", a.list)
+	mux.HandleFunc("GET /metrics", a.metrics)
+	mux.HandleFunc("GET /pipelines/{name}/stats", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("GET /pipelines/{name}/where", a.withPipeline(a.where))
+	mux.HandleFunc("GET /pipelines/{name}/consumed", a.withPipeline(a.consumed))
+	mux.HandleFunc("GET /pipelines/{name}/peek", a.withPipeline(a.peek))
+	mux.HandleFunc("POST /pipelines/{name}/consumers/{id}/resume", a.withPipeline(a.resumeConsumer))
+	mux.HandleFunc("GET /pipelines/{name}/dlq", a.withPipeline(a.dlqList))
+	mux.HandleFunc("POST /pipelines/{name}/dlq/requeue", a.withPipeline(a.dlqRequeue))
+	mux.HandleFunc("POST /pipelines/{name}/pause", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		p.gate.pause()
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/resume", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		p.gate.unpause()
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/drain", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		p.drain()
+		writeJSON(w, http.StatusAccepted, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/flush", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		ctx := r.Context()
+		if t := r.URL.Query().Get("timeout"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("bad timeout: %v", err))
+				return
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		if err := p.Flush(ctx); err != nil {
+			code := http.StatusConflict
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = http.StatusGatewayTimeout
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/scale", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		req := struct {
+			Producers *int `json:"producers"`
+			Consumers *int `json:"consumers"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		producers, consumers := -1, -1
+		if req.Producers != nil {
+			producers = *req.Producers
+		}
+		if req.Consumers != nil {
+			consumers = *req.Consumers
+		}
+		if producers < -1 || consumers < -1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("worker counts can't be negative"))
+			return
+		}
+		if err := p.scale(producers, consumers); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if p.auto != nil {
+			p.auto.override(producers >= 0, consumers >= 0)
+		}
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/rate", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		req := struct {
+			Rate *float64 `json:"rate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Rate == nil || *req.Rate < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf(`expected {"rate": <items/sec>}`))
+			return
+		}
+		p.gov.setRate(*req.Rate)
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/canary", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		if p.canary == nil {
+			writeError(w, http.StatusConflict, fmt.Errorf("pipeline %s has no -canary-handler", p.name))
+			return
+		}
+		req := struct {
+			Percent *float64 `json:"percent"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Percent == nil || *req.Percent < 0 || *req.Percent > 100 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf(`expected {"percent": <0 to 100>}`))
+			return
+		}
+		p.canary.setPercent(*req.Percent)
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	mux.HandleFunc("POST /pipelines/{name}/buffer", a.withPipeline(func(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+		req := struct {
+			Capacity *int `json:"capacity"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Capacity == nil || *req.Capacity < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf(`expected {"capacity": <items>}`))
+			return
+		}
+		if err := p.resizeBuffer(*req.Capacity); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p.status())
+	}))
+	return a.security.wrap(mux)
+}
+
+func (a *adminServer) list(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	var out []PipelineStatus
+	for _, p := range a.pipes {
+		out = append(out, p.status())
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *adminServer) withPipeline(fn func(http.ResponseWriter, *http.Request, *Pipeline)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		p := a.pipes[r.PathValue("name")]
+		a.mu.Unlock()
+		if p == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no pipeline named %q", r.PathValue("name")))
+			return
+		}
+		fn(w, r, p)
+	}
+}
+
+// start serving the admin API in the background. The listener is opened
+// straight away so that a bad address is reported before the run starts.
+func (a *adminServer) listen(addr string, socketMode os.FileMode) error {
+	ln, err := a.security.listen(addr, socketMode)
+	if err != nil {
+		return err
+	}
+	a.srv = &http.Server{Handler: a.handler()}
+	go func() {
+		if err := a.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "admin api: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// stop serving, which also removes the socket file of a unix listener
+func (a *adminServer) close() {
+	if a.srv != nil {
+		a.srv.Close()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// PipelineStatus is what the admin API reports about a pipeline
+type PipelineStatus struct {
+	Name      string  `json:"name"`
+	State     string  `json:"state"`
+	Producers int     `json:"producers"`
+	Consumers int     `json:"consumers"`
+	Buffered  int     `json:"buffered"`
+	Capacity  int     `json:"capacity"`
+	Rate      float64 `json:"rate"`
+	Produced  int64   `json:"produced"`
+	Consumed  int64   `json:"consumed"`
+	Errors    int64   `json:"errors"`
+	Filtered  int64   `json:"filtered"`
+	Dead      int64   `json:"dead_lettered"`
+	P50       string  `json:"p50"`
+	P99       string  `json:"p99"`
+	// routing rule hits per pool
+	Routes map[string]int64 `json:"routes,omitempty"`
+	// bytes of items in the buffers, and the -buffer-bytes limit on them
+	BufferedBytes int64 `json:"buffered_bytes,omitempty"`
+	ByteLimit     int64 `json:"byte_limit,omitempty"`
+	// memory use as the -memory-limit guard last measured it
+	Memory int64 `json:"memory_bytes,omitempty"`
+	// items discarded by the drop policy, by reason. Filtered repeats the
+	// filtered count from here.
+	Dropped map[DropReason]int64 `json:"dropped,omitempty"`
+	// the batch size and how it got there, with -batch
+	Batch *BatchStatus `json:"batch,omitempty"`
+	// how auto sizing sees the work, when a pool is auto
+	Auto *AutoStatus `json:"auto,omitempty"`
+	// how far behind each consumer group is, with -lag-max-items or
+	// -lag-max-age
+	Lag map[string]GroupLag `json:"lag,omitempty"`
+	// the buffer's watermark, high or low, with -watermark-high
+	Watermark string `json:"watermark,omitempty"`
+	// items the consumers have taken off the buffers ahead of handling
+	// them, with -prefetch
+	Prefetched int64 `json:"prefetched,omitempty"`
+	// the canary's share and how it is doing against the default pool,
+	// with -canary-handler
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// consumers paused by their failures, with -consumer-pause-after
+	PausedConsumers []PausedConsumer `json:"paused_consumers,omitempty"`
+	// the topics' queues and how the consumers have served them, busiest
+	// first, with -fair-topics
+	Topics []TopicStatus `json:"topics,omitempty"`
+}
+
+func (p *Pipeline) status() PipelineStatus {
+	p.mu.Lock()
+	st := PipelineStatus{
+		Name:      p.name,
+		State:     "running",
+		Producers: active(p.producers),
+		Consumers: active(p.consumers),
+	}
+	switch {
+	case p.closed && len(p.consumers) == 0:
+		st.State = "finished"
+	case p.draining || p.closed:
+		st.State = "draining"
+	}
+	p.mu.Unlock()
+	if st.State == "running" && p.gate.paused() {
+		st.State = "paused"
+	}
+	st.Buffered = p.buffered()
+	st.Capacity = p.bufferCap()
+	if p.budget != nil {
+		st.BufferedBytes = p.budget.inUse()
+		st.ByteLimit = p.budget.limit
+	}
+	st.Rate = p.gov.currentRate()
+	if p.memory != nil {
+		st.Memory = p.memory.used.Load()
+	}
+	if p.batcher != nil {
+		st.Batch = p.batcher.status()
+	}
+	if p.auto != nil {
+		st.Auto = p.auto.snapshot()
+	}
+	if p.lag != nil {
+		st.Lag = p.lag.snapshot()
+	}
+	if p.marks != nil {
+		st.Watermark = p.marks.state()
+	}
+	if p.canary != nil {
+		st.Canary = p.canary.status()
+	}
+	if p.pauses != nil {
+		st.PausedConsumers = p.pauses.paused()
+	}
+	if p.prefetch != nil {
+		st.Prefetched = p.prefetch.held.Load()
+	}
+	if p.fair != nil {
+		st.Topics = p.fair.status()
+	}
+	p.stats.mu.Lock()
+	st.Produced = p.stats.produced
+	st.Consumed = p.stats.consumed
+	st.Errors = p.stats.errors
+	st.Filtered = p.stats.dropped[DropFiltered]
+	st.Dead = p.stats.dead
+	if len(p.stats.dropped) > 0 {
+		st.Dropped = make(map[DropReason]int64, len(p.stats.dropped))
+		for reason, n := range p.stats.dropped {
+			st.Dropped[reason] = n
+		}
+	}
+	if len(p.stats.routes) > 0 {
+		st.Routes = make(map[string]int64, len(p.stats.routes))
+		for pool, n := range p.stats.routes {
+			st.Routes[pool] = n
+		}
+	}
+	st.P50 = p.stats.queue.quantile(0.50).String()
+	st.P99 = p.stats.queue.quantile(0.99).String()
+	p.stats.mu.Unlock()
+	return st
+}
@@ -0,0 +1,27 @@
+//go:build goexperiment.arenas
+
+package pipeline
+
+import "arena"
+
+// whether the binary was built with GOEXPERIMENT=arenas, which -item-arena
+// needs
+const arenasBuilt = true
+
+// memArena is memory that is freed all at once rather than by the
+// garbage collector
+type memArena struct {
+	a *arena.Arena
+}
+
+func newMemArena() *memArena {
+	return &memArena{arena.NewArena()}
+}
+
+func (m *memArena) newItem() *Item {
+	return arena.New[Item](m.a)
+}
+
+func (m *memArena) free() {
+	m.a.Free()
+}
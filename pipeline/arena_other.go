@@ -0,0 +1,18 @@
+//go:build !goexperiment.arenas
+
+package pipeline
+
+const arenasBuilt = false
+
+// without arenas items come from the heap as usual
+type memArena struct{}
+
+func newMemArena() *memArena {
+	return &memArena{}
+}
+
+func (m *memArena) newItem() *Item {
+	return new(Item)
+}
+
+func (m *memArena) free() {}
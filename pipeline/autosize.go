@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerCount is the value of -producers and -consumers: a number of
+// goroutines, or auto to let the pipeline size the pool itself
+type workerCount struct {
+	n    *int
+	auto *bool
+}
+
+func (w workerCount) String() string {
+	switch {
+	case w.n == nil:
+		return ""
+	case *w.auto:
+		return "auto"
+	}
+	return strconv.Itoa(*w.n)
+}
+
+func (w workerCount) Set(s string) error {
+	if s == "auto" {
+		*w.auto = true
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a number of workers or auto")
+	}
+	*w.n, *w.auto = n, false
+	return nil
+}
+
+// autoSizer sizes the auto pools every -auto-interval. Consumers are sized
+// from how much of the time they spend handling items is CPU: work that is
+// all CPU wants one consumer per GOMAXPROCS, and work that mostly waits on
+// IO wants more, GOMAXPROCS divided by the CPU share, so that some are
+// always running while the rest wait. That many are used while there's a
+// backlog; with none, the pool shrinks to the consumers actually kept busy,
+// plus a margin. Producers reading a source are added while the consumers
+// go short of items and taken away while the buffer stays nearly full.
+// Random producers each make a fixed number of items, so their count is
+// only set once, at GOMAXPROCS.
+type autoSizer struct {
+	p         *Pipeline
+	producers bool
+	consumers bool
+	every     time.Duration
+	max       int
+
+	// time consumers have spent handling items, in nanoseconds
+	busy atomic.Int64
+
+	mu       sync.Mutex
+	lastAt   time.Time
+	lastCPU  float64
+	lastBusy int64
+	status   AutoStatus
+	done     chan struct{}
+}
+
+// AutoStatus is what the admin API reports about auto sizing
+type AutoStatus struct {
+	Producers   bool    `json:"producers"`
+	Consumers   bool    `json:"consumers"`
+	CPURatio    float64 `json:"cpu_ratio"`   // share of handling time that was CPU
+	Utilization float64 `json:"utilization"` // share of the consumers' time spent handling
+	Changes     int64   `json:"changes"`
+	Last        string  `json:"last_change,omitempty"`
+}
+
+func newAutoSizer(p *Pipeline, cfg *Config) *autoSizer {
+	procs := runtime.GOMAXPROCS(0)
+	a := &autoSizer{
+		p:         p,
+		producers: cfg.AutoProducers && p.source != nil,
+		consumers: cfg.AutoConsumers,
+		every:     cfg.AutoInterval,
+		max:       cfg.AutoMax,
+		done:      make(chan struct{}),
+	}
+	if a.max <= 0 {
+		a.max = 16 * procs
+	}
+	if a.every <= 0 {
+		a.every = 5 * time.Second
+	}
+	if cfg.AutoProducers {
+		cfg.Producers = procs
+		if p.source != nil {
+			cfg.Producers = max(1, procs/2)
+		}
+	}
+	if cfg.AutoConsumers {
+		cfg.Consumers = procs
+	}
+	a.status.Producers, a.status.Consumers = a.producers, a.consumers
+	return a
+}
+
+func (a *autoSizer) start() {
+	if !a.producers && !a.consumers {
+		return
+	}
+	a.lastAt, a.lastCPU = time.Now(), cpuSeconds()
+	go func() {
+		t := time.NewTicker(a.every)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-t.C:
+				a.resize()
+			}
+		}
+	}()
+}
+
+func (a *autoSizer) stop() {
+	close(a.done)
+}
+
+// count time a consumer spent handling an item. Safe on a nil sizer.
+func (a *autoSizer) handled(d time.Duration) {
+	if a != nil {
+		a.busy.Add(int64(d))
+	}
+}
+
+// stop sizing a pool that has been scaled by hand
+func (a *autoSizer) override(producers, consumers bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.producers = a.producers && !producers
+	a.consumers = a.consumers && !consumers
+	a.status.Producers, a.status.Consumers = a.producers, a.consumers
+}
+
+func (a *autoSizer) resize() {
+	p := a.p
+	now, cpu, busy := time.Now(), cpuSeconds(), a.busy.Load()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	elapsed := now.Sub(a.lastAt).Seconds()
+	busySecs := float64(busy-a.lastBusy) / 1e9
+	usedCPU := cpu - a.lastCPU
+	a.lastAt, a.lastCPU, a.lastBusy = now, cpu, busy
+	if elapsed <= 0 {
+		return
+	}
+	p.mu.Lock()
+	producers, consumers := active(p.producers), active(p.consumers)
+	p.mu.Unlock()
+	fill := 0.0
+	if c := p.bufferCap(); c > 0 {
+		fill = float64(p.buffered()) / float64(c)
+	}
+	procs := runtime.GOMAXPROCS(0)
+	if busySecs > 0 {
+		a.status.CPURatio = math.Min(1, math.Max(0.01, usedCPU/busySecs))
+	}
+	if consumers > 0 {
+		a.status.Utilization = math.Min(1, busySecs/(elapsed*float64(consumers)))
+	}
+
+	wantProducers, wantConsumers := -1, -1
+	if a.consumers && busySecs > 0 {
+		// the consumers the work can keep running at once
+		ideal := int(math.Ceil(float64(procs) / a.status.CPURatio))
+		want := ideal
+		if fill < 0.1 {
+			// no backlog, so only as many as are busy, with room to grow
+			want = min(ideal, int(math.Ceil(busySecs/elapsed*1.25)))
+		}
+		want = max(1, min(want, a.max))
+		if want != consumers {
+			wantConsumers = want
+		}
+	}
+	if a.producers {
+		switch {
+		case fill < 0.25 && a.status.Utilization < 0.5 && producers < procs:
+			wantProducers = producers + 1
+		case fill > 0.9 && producers > 1:
+			wantProducers = producers - 1
+		}
+	}
+	if wantProducers < 0 && wantConsumers < 0 {
+		return
+	}
+	if err := p.scale(wantProducers, wantConsumers); err != nil {
+		return
+	}
+	a.status.Changes++
+	a.status.Last = fmt.Sprintf("producers %d -> %d, consumers %d -> %d (cpu %.0f%%, utilization %.0f%%, buffer %.0f%% full)",
+		producers, pick(wantProducers, producers), consumers, pick(wantConsumers, consumers),
+		100*a.status.CPURatio, 100*a.status.Utilization, 100*fill)
+	fmt.Printf("auto sizing: %s\n", a.status.Last)
+}
+
+func (a *autoSizer) snapshot() *AutoStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.status
+	return &st
+}
+
+// n unless it is -1, meaning left alone
+func pick(n, current int) int {
+	if n < 0 {
+		return current
+	}
+	return n
+}
@@ -0,0 +1,267 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sized is a Source that can tell how far through its data it has read,
+// in bytes or whatever unit suits it, so a backfill can report percent
+// complete
+type Sized interface {
+	Source
+	Progress() (done, total int64)
+}
+
+// backfill runs a source far bigger than memory through the pipeline in one
+// bounded pass. Memory is already bounded by the channels, since producers
+// only read ahead of the consumers by as much as the buffers hold; what
+// backfill adds is keeping everything else on disk:
+//
+//   - progress is checkpointed to the -backfill file, so a stopped backfill
+//     resumes where it was
+//   - items the handler or sink fail on are appended to <file>.retry rather
+//     than held in memory, and once the source is done the retry file is
+//     run through again as many as -backfill-retries times, with what still
+//     fails being dead-lettered
+//   - progress is reported every -backfill-report, as a percentage when the
+//     source is Sized
+type backfill struct {
+	p         *Pipeline
+	sized     Sized // nil if the source can't say
+	spillPath string
+	retries   int
+	interval  time.Duration
+
+	mu      sync.Mutex
+	spill   *os.File
+	spilled int64 // items in the current spill file
+	retried int64
+
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newBackfill(p *Pipeline, cfg *Config) (*backfill, error) {
+	if p.source == nil {
+		return nil, fmt.Errorf("-backfill needs a -source")
+	}
+	b := &backfill{
+		p:         p,
+		spillPath: cfg.Backfill + ".retry",
+		retries:   cfg.BackfillRetries,
+		interval:  cfg.BackfillReport,
+		done:      make(chan struct{}),
+	}
+	b.sized, _ = p.source.(Sized)
+	// a retry pass that was cut short goes back in with the rest
+	pass := b.spillPath + ".pass"
+	if _, err := os.Stat(pass); err == nil {
+		if err := appendFile(b.spillPath, pass); err != nil {
+			return nil, err
+		}
+		os.Remove(pass)
+	}
+	if err := b.openSpill(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// open the retry file for appending, counting what's in it already
+func (b *backfill) openSpill() error {
+	n, err := countLines(b.spillPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(b.spillPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	b.spill, b.spilled = f, n
+	return nil
+}
+
+func (b *backfill) begin() {
+	b.start = time.Now()
+	if b.interval <= 0 {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		last, lastAt := int64(0), b.start
+		for {
+			select {
+			case <-b.done:
+				return
+			case now := <-ticker.C:
+				consumed := b.p.stats.consumedCount()
+				rate := float64(consumed-last) / now.Sub(lastAt).Seconds()
+				last, lastAt = consumed, now
+				b.report(consumed, rate)
+			}
+		}
+	}()
+}
+
+func (b *backfill) report(consumed int64, rate float64) {
+	b.mu.Lock()
+	spilled := b.spilled
+	b.mu.Unlock()
+	if b.sized == nil {
+		fmt.Printf("backfill: %d items handled, %.0f items/sec, %d to retry\n", consumed, rate, spilled)
+		return
+	}
+	done, total := b.sized.Progress()
+	if total <= 0 {
+		return
+	}
+	pct := 100 * float64(done) / float64(total)
+	left := ""
+	if elapsed := time.Since(b.start); done > 0 && done < total {
+		eta := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+		left = fmt.Sprintf(", about %s left", eta.Round(time.Second))
+	}
+	fmt.Printf("backfill: %.1f%% of %s read, %.0f items/sec, %d to retry%s\n",
+		pct, formatBytes(total), rate, spilled, left)
+}
+
+// put an item aside to be tried again at the end. It goes straight to the
+// file, unbuffered, so that it is safe before the checkpoint moves past it.
+func (b *backfill) spillItem(item Item) {
+	line, err := json.Marshal(item)
+	if err != nil {
+		fmt.Printf("error saving item %d for retry: %v\n", item.ID, err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.spill.Write(append(line, '\n')); err != nil {
+		fmt.Printf("error saving item %d for retry: %v\n", item.ID, err)
+		return
+	}
+	b.spilled++
+}
+
+// once the source is done, run the retry file through the handler and
+// sink again, a pass at a time, then dead-letter what never went through
+func (b *backfill) finish() {
+	close(b.done)
+	b.wg.Wait()
+	pass := b.spillPath + ".pass"
+	for attempt := 1; attempt <= b.retries && b.spilled > 0; attempt++ {
+		fmt.Printf("backfill: retrying %d items, pass %d of %d\n", b.spilled, attempt, b.retries)
+		b.spill.Close()
+		if err := os.Rename(b.spillPath, pass); err != nil {
+			fmt.Printf("error starting retry pass: %v\n", err)
+			return
+		}
+		if err := b.openSpill(); err != nil {
+			fmt.Printf("error starting retry pass: %v\n", err)
+			return
+		}
+		err := eachSpilled(pass, func(item Item) {
+			b.retried++
+			b.p.process(item, 0)
+		})
+		if err != nil {
+			fmt.Printf("error reading %s: %v\n", pass, err)
+			return
+		}
+		os.Remove(pass)
+	}
+	b.spill.Close()
+	if b.spilled > 0 {
+		err := eachSpilled(b.spillPath, func(item Item) {
+			b.p.deadLetter(item, fmt.Sprintf("still failing after %d retries", b.retries))
+		})
+		if err != nil {
+			fmt.Printf("error reading %s: %v\n", b.spillPath, err)
+			return
+		}
+	}
+	os.Remove(b.spillPath)
+	fmt.Printf("backfill complete in %s: %d items handled, %d retries, %d given up on\n",
+		time.Since(b.start).Round(time.Second), b.p.stats.consumedCount(), b.retried, b.spilled)
+}
+
+// call fn with each item in a retry file
+func eachSpilled(path string, fn func(Item)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		var item Item
+		if err := json.Unmarshal(sc.Bytes(), &item); err != nil {
+			fmt.Printf("skipping bad retry line: %v\n", err)
+			continue
+		}
+		fn(item)
+	}
+	return sc.Err()
+}
+
+func countLines(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var n int64
+	buf := make([]byte, 64<<10)
+	for {
+		k, err := f.Read(buf)
+		n += int64(bytes.Count(buf[:k], []byte{'\n'}))
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// append the contents of src to dst
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
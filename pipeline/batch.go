@@ -0,0 +1,302 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BatchSink is a Sink that can take several items at once more cheaply
+// than one at a time, such as a database inserting them in a single
+// transaction. WriteBatch writes either all of the items or none of them.
+type BatchSink interface {
+	Sink
+	WriteBatch(items []Item) error
+}
+
+// batchSizer decides how many items a batching consumer takes off its
+// buffer at a time. A consumer takes whatever is waiting up to the limit
+// and doesn't wait for more, so when the pipeline is quiet batches are
+// small and items go straight out, and under load they fill up. With
+// -batch auto the limit itself adapts to the sink: it doubles while full
+// batches are coming back quickly with more waiting behind them, and
+// shrinks by a quarter whenever a batch takes longer than -batch-latency.
+type batchSizer struct {
+	auto    bool
+	max     int
+	latency time.Duration
+
+	mu      sync.Mutex
+	size    int
+	batches int64
+	items   int64
+	grew    int64
+	shrank  int64
+	last    time.Duration // how long the last batch took to write
+}
+
+func newBatchSizer(cfg *Config) (*batchSizer, error) {
+	s := &batchSizer{max: cfg.BatchMax, latency: cfg.BatchLatency}
+	if cfg.Batch == "auto" {
+		s.auto, s.size = true, 1
+	} else {
+		n, err := strconv.Atoi(cfg.Batch)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("-batch %q: expected a batch size or auto", cfg.Batch)
+		}
+		s.size = n
+	}
+	if s.auto && (s.max < 1 || s.latency <= 0) {
+		return nil, fmt.Errorf("-batch auto needs a positive -batch-max and -batch-latency")
+	}
+	return s, nil
+}
+
+func (s *batchSizer) limit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// the most items a batch can ever take
+func (s *batchSizer) most() int {
+	if s.auto {
+		return s.max
+	}
+	return s.size
+}
+
+// learn from a batch of n items that took took to write, with depth items
+// still waiting on the buffer afterwards
+func (s *batchSizer) observe(n int, took time.Duration, depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches++
+	s.items += int64(n)
+	s.last = took
+	if !s.auto {
+		return
+	}
+	switch {
+	case took > s.latency && s.size > 1:
+		s.size = max(1, s.size*3/4)
+		s.shrank++
+	case n >= s.size && depth > 0 && took <= s.latency/2 && s.size < s.max:
+		s.size = min(s.max, s.size*2)
+		s.grew++
+	}
+}
+
+// BatchStatus is what the admin API reports about batching
+type BatchStatus struct {
+	Auto     bool    `json:"auto"`
+	Size     int     `json:"size"`
+	Batches  int64   `json:"batches"`
+	AvgItems float64 `json:"avg_items"`
+	Grew     int64   `json:"grew"`
+	Shrank   int64   `json:"shrank"`
+	Last     string  `json:"last_write"`
+}
+
+func (s *batchSizer) status() *BatchStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &BatchStatus{Auto: s.auto, Size: s.size, Batches: s.batches,
+		Grew: s.grew, Shrank: s.shrank, Last: s.last.String()}
+	if s.batches > 0 {
+		st.AvgItems = float64(s.items) / float64(s.batches)
+	}
+	return st
+}
+
+func (s *batchSizer) printSummary(w io.Writer) {
+	st := s.status()
+	fmt.Fprintf(w, "batches: %d, %.1f items on average", st.Batches, st.AvgItems)
+	if st.Auto {
+		fmt.Fprintf(w, ", size settled at %d after growing %d times and shrinking %d", st.Size, st.Grew, st.Shrank)
+	}
+	fmt.Fprintln(w)
+}
+
+// consumerBatch holds what a batching consumer's items came to, until it
+// writes them to the sink together
+type consumerBatch struct {
+	mu      sync.Mutex
+	entries []batchEntry
+	closed  bool
+	// with -strict-memory, the entries and items of the batch before,
+	// made once at the largest a batch can be and written over by each,
+	// so a BatchSink mustn't keep the items it is given
+	spare []batchEntry
+	items []Item
+}
+
+// an item for the sink, with the item it was handled from so a failure
+// can be put down to the right one. Pieces of a split item aren't retried
+// or spilled on their own.
+type batchEntry struct {
+	item, original Item
+	piece          bool
+}
+
+// add an entry unless the consumer has finished with the batch
+func (b *consumerBatch) add(e batchEntry) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.entries = append(b.entries, e)
+	return true
+}
+
+func (b *consumerBatch) take() []batchEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.entries
+	b.entries, b.spare = b.spare, nil
+	return entries
+}
+
+// hand back the entries of a batch written, for the next to reuse when the
+// batch is preallocated
+func (b *consumerBatch) recycle(entries []batchEntry) {
+	if b.items == nil {
+		return
+	}
+	clear(entries)
+	clear(b.items)
+	b.mu.Lock()
+	b.spare = entries[:0]
+	b.mu.Unlock()
+}
+
+// consume like consume, only taking as many items as are waiting, up to
+// the batch size, handling them all and writing them to the sink in one go
+// before settling them, so their checkpoint only moves once the sink has
+// them
+func (p *Pipeline) consumeBatches(channel <-chan Item, myId int, stop <-chan struct{}) {
+	b := &consumerBatch{}
+	var taken []Item
+	if p.strict != nil {
+		most := p.batcher.most()
+		b.entries, b.spare, b.items = make([]batchEntry, 0, most), make([]batchEntry, 0, most), make([]Item, most)
+		taken = make([]Item, 0, most)
+	}
+	p.batches.Store(myId, b)
+	defer func() {
+		p.batches.Delete(myId)
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		p.flushBatch(b, 0, myId)
+	}()
+	for {
+		p.gate.wait(stop)
+		select {
+		case <-stop:
+			return
+		case element, ok := <-channel:
+			if !ok {
+				if next := p.replaced(channel); next != nil {
+					channel = next
+					continue
+				}
+				return
+			}
+			p.lag.taken(channel)
+			taken = append(taken[:0], element)
+		fill:
+			for limit := p.batcher.limit(); len(taken) < limit; {
+				select {
+				case element, ok := <-channel:
+					if !ok {
+						break fill
+					}
+					p.lag.taken(channel)
+					taken = append(taken, element)
+				default:
+					break fill
+				}
+			}
+			started := time.Now()
+			for i := range taken {
+				element := &taken[i]
+				p.budget.release(element.size)
+				if err := unpack(element); err != nil {
+					p.drops.drop(*element, DropInvalid, err.Error())
+					continue
+				}
+				p.trace.record(traceDequeue, element, myId)
+				p.trace.record(traceStart, element, myId)
+				done := p.working(myId, *element)
+				p.handle(*element, myId)
+				done()
+				p.trace.record(traceEnd, element, myId)
+			}
+			p.flushBatch(b, len(channel), myId)
+			p.pauses.handled(myId, stop)
+			p.auto.handled(time.Since(started))
+			for i := range taken {
+				p.settle(&taken[i])
+			}
+			time.Sleep(p.cfg.ConsumeDelay * time.Duration(len(taken)))
+		}
+	}
+}
+
+// write what a batch came to. If the sink turns the batch down the items
+// are tried one at a time, so only the ones it objects to count as failed.
+func (p *Pipeline) flushBatch(b *consumerBatch, depth, myId int) {
+	entries := b.take()
+	if len(entries) == 0 {
+		return
+	}
+	defer b.recycle(entries)
+	items := b.items
+	if len(entries) <= len(items) {
+		items = items[:len(entries)]
+	} else {
+		items = make([]Item, len(entries))
+	}
+	for i, e := range entries {
+		items[i] = e.item
+	}
+	start := time.Now()
+	var err error
+	if bs, ok := p.sink.(BatchSink); ok {
+		err = p.limits.writeBatch(bs, items)
+	} else {
+		// without a batch write a failure part way leaves the rest to retry
+		for i := range items {
+			if err = p.limits.write(p.sink, &items[i]); err != nil {
+				entries = entries[i:]
+				break
+			}
+		}
+	}
+	p.batcher.observe(len(items), time.Since(start), depth)
+	p.health.wrote(err)
+	if err == nil {
+		return
+	}
+	for _, e := range entries {
+		if err := p.retry(&e.original, 0, func() error { return p.deliver(e.item, 0) }); err != nil {
+			p.pauses.failed(myId)
+			p.deliverFailed(err, e.original, e.piece)
+		}
+	}
+}
+
+// the batch that deliveries for a consumer go into, nil if it isn't
+// batching
+func (p *Pipeline) batchOf(myId int) *consumerBatch {
+	if p.batcher == nil || p.sink == nil {
+		return nil
+	}
+	b, _ := p.batches.Load(myId)
+	batch, _ := b.(*consumerBatch)
+	return batch
+}
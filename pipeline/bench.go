@@ -0,0 +1,447 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// benchResult is a set of runs of one configuration, as saved by bench
+// compare -save and read back in place of running it again
+type benchResult struct {
+	Name  string   `json:"name"`
+	Flags []string `json:"flags,omitempty"`
+	Runs  []Report `json:"runs"`
+}
+
+// benchMain runs go_producer_consumer bench compare, returning the exit
+// code. Each side of the comparison is either name=flags, a configuration
+// that is run -runs times, or a .json file of earlier results: one saved by
+// -save, or a single run's -report.
+//
+//	go_producer_consumer bench compare -runs 5 'base=-consumers 4 -delay 0' 'wide=-consumers 16 -delay 0'
+//
+// bench payload measures what big payloads cost, see benchPayload, and
+// bench cluster what running across processes does, see benchCluster.
+func benchMain(args []string, out io.Writer) int {
+	if len(args) > 0 && args[0] == "payload" {
+		return benchPayload(args[1:], out)
+	}
+	if len(args) > 0 && args[0] == "cluster" {
+		return benchCluster(args[1:], out)
+	}
+	if len(args) == 0 || args[0] != "compare" {
+		fmt.Fprintln(out, "usage: go_producer_consumer bench compare [flags] <name=flags|result.json> <name=flags|result.json>")
+		fmt.Fprintln(out, "       go_producer_consumer bench payload [-size 1MB] [-items 500]")
+		fmt.Fprintln(out, "       go_producer_consumer bench cluster -redis <url> [-producer-procs 2] [-consumer-procs 2] -- <flags>")
+		return 2
+	}
+	fs := flag.NewFlagSet("bench compare", flag.ContinueOnError)
+	fs.SetOutput(out)
+	runs := fs.Int("runs", 5, "how many times to run each configuration, alternating between them")
+	save := fs.String("save", "", "directory to save the results of each configuration to, as <name>.json")
+	log := fs.String("log", "", "file the runs' own output is appended to (default discarded)")
+	level := fs.Float64("significance", 0.05, "p-value below which a difference counts as significant")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(out, "bench compare needs exactly two configurations or result files")
+		return 2
+	}
+	if *runs < 1 {
+		fmt.Fprintln(out, "-runs must be at least 1")
+		return 2
+	}
+	var sides [2]*benchResult
+	for i, arg := range fs.Args() {
+		r, err := loadBench(arg)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 2
+		}
+		sides[i] = r
+	}
+	if sides[0].Name == sides[1].Name {
+		sides[0].Name, sides[1].Name = sides[0].Name+" (a)", sides[1].Name+" (b)"
+	}
+
+	var logTo io.Writer = io.Discard
+	if *log != "" {
+		f, err := os.OpenFile(*log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		defer f.Close()
+		logTo = f
+	}
+	// alternate the runs so a machine that slows down part way through
+	// doesn't count against only one side
+	for n := 0; n < *runs; n++ {
+		for _, side := range sides {
+			if side.Flags == nil {
+				continue
+			}
+			fmt.Fprintf(out, "run %d/%d of %s\n", n+1, *runs, side.Name)
+			r, err := benchRun(side.Flags, logTo)
+			if err != nil {
+				fmt.Fprintf(out, "%s: %v\n", side.Name, err)
+				return 1
+			}
+			side.Runs = append(side.Runs, r)
+		}
+	}
+	if *save != "" {
+		for _, side := range sides {
+			if side.Flags == nil {
+				continue
+			}
+			if err := saveBench(filepath.Join(*save, side.Name+".json"), side); err != nil {
+				fmt.Fprintf(out, "error saving results: %v\n", err)
+			}
+		}
+	}
+	printComparison(out, sides[0], sides[1], *level)
+	return 0
+}
+
+// read a side of the comparison from the command line
+func loadBench(arg string) (*benchResult, error) {
+	if name, flags, ok := strings.Cut(arg, "="); ok && !strings.HasSuffix(arg, ".json") {
+		if name == "" {
+			return nil, fmt.Errorf("configuration %q has no name", arg)
+		}
+		fields := strings.Fields(flags)
+		// make sure the flags parse before spending time on the other side
+		if _, err := parseConfig(fields); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return &benchResult{Name: name, Flags: fields}, nil
+	}
+	b, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	r := &benchResult{}
+	if err := json.Unmarshal(b, r); err != nil || r.Runs == nil {
+		// a single run's -report
+		var one Report
+		if err := json.Unmarshal(b, &one); err != nil {
+			return nil, fmt.Errorf("%s: not a bench result or report: %v", arg, err)
+		}
+		r.Runs = []Report{one}
+	}
+	if r.Name == "" {
+		r.Name = strings.TrimSuffix(filepath.Base(arg), ".json")
+	}
+	r.Flags = nil
+	return r, nil
+}
+
+func saveBench(path string, r *benchResult) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// run the pipeline once with the given flags, in a process of its own so
+// runs can't disturb each other, and read back its report
+func benchRun(flags []string, log io.Writer) (Report, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return Report{}, err
+	}
+	dir, err := os.MkdirTemp("", "bench")
+	if err != nil {
+		return Report{}, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+	cmd := exec.Command(self, append(append([]string{}, flags...), "-report", path)...)
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Run(); err != nil {
+		return Report{}, err
+	}
+	var r Report
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &r)
+	}
+	if err != nil {
+		return Report{}, fmt.Errorf("reading the run's report: %v", err)
+	}
+	return r, nil
+}
+
+// a measurement to compare, taken from each run
+type benchMetric struct {
+	name   string
+	higher bool // whether higher is better
+	value  func(Report) float64
+	format func(float64) string
+}
+
+func durationMetric(name string, get func(Report) time.Duration) benchMetric {
+	return benchMetric{
+		name:   name,
+		value:  func(r Report) float64 { return float64(get(r)) },
+		format: func(v float64) string { return time.Duration(v).Round(time.Microsecond).String() },
+	}
+}
+
+var benchMetrics = []benchMetric{
+	{name: "throughput", higher: true,
+		value:  func(r Report) float64 { return r.Throughput },
+		format: func(v float64) string { return fmt.Sprintf("%.1f/sec", v) }},
+	durationMetric("p50 latency", func(r Report) time.Duration { return r.P50 }),
+	durationMetric("p90 latency", func(r Report) time.Duration { return r.P90 }),
+	durationMetric("p99 latency", func(r Report) time.Duration { return r.P99 }),
+	durationMetric("max latency", func(r Report) time.Duration { return r.Max }),
+	{name: "gc cycles",
+		value:  func(r Report) float64 { return float64(r.GCCycles) },
+		format: func(v float64) string { return fmt.Sprintf("%.0f", v) }},
+	durationMetric("gc pause", func(r Report) time.Duration { return r.GCPause }),
+	{name: "allocs",
+		value:  func(r Report) float64 { return float64(r.Allocs) },
+		format: func(v float64) string { return fmt.Sprintf("%.0f", v) }},
+}
+
+// print each metric's mean on both sides, how b differs from a, and
+// whether the difference is more than run to run noise, by Welch's t-test
+func printComparison(w io.Writer, a, b *benchResult, level float64) {
+	fmt.Fprintf(w, "\n%s: %d runs, %s: %d runs\n\n", a.Name, len(a.Runs), b.Name, len(b.Runs))
+	fmt.Fprintf(w, "%-12s  %-22s  %-22s  %8s  %s\n", "", a.Name, b.Name, "delta", "")
+	for _, m := range benchMetrics {
+		as, bs := make([]float64, len(a.Runs)), make([]float64, len(b.Runs))
+		for i, r := range a.Runs {
+			as[i] = m.value(r)
+		}
+		for i, r := range b.Runs {
+			bs[i] = m.value(r)
+		}
+		am, asd := meanStddev(as)
+		bm, bsd := meanStddev(bs)
+		delta := "n/a"
+		if am != 0 {
+			delta = fmt.Sprintf("%+.1f%%", 100*(bm-am)/am)
+		}
+		verdict := "need 2 runs a side to tell"
+		if p, err := welch(as, bs); err == nil {
+			switch {
+			case p >= level:
+				verdict = fmt.Sprintf("p=%.3f, within noise", p)
+			case (bm > am) == m.higher:
+				verdict = fmt.Sprintf("p=%.3f, better", p)
+			default:
+				verdict = fmt.Sprintf("p=%.3f, worse", p)
+			}
+		}
+		fmt.Fprintf(w, "%-12s  %-22s  %-22s  %8s  %s\n", m.name,
+			spread(m.format, am, asd), spread(m.format, bm, bsd), delta, verdict)
+	}
+}
+
+func spread(format func(float64) string, mean, sd float64) string {
+	if mean == 0 || sd == 0 {
+		return format(mean)
+	}
+	return fmt.Sprintf("%s ±%.1f%%", format(mean), 100*sd/math.Abs(mean))
+}
+
+func meanStddev(xs []float64) (mean, sd float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	if len(xs) < 2 {
+		return mean, 0
+	}
+	for _, x := range xs {
+		sd += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sd / float64(len(xs)-1))
+}
+
+// the two-sided p-value of Welch's t-test that a and b have the same mean
+func welch(a, b []float64) (float64, error) {
+	if len(a) < 2 || len(b) < 2 {
+		return 0, errors.New("too few runs")
+	}
+	am, asd := meanStddev(a)
+	bm, bsd := meanStddev(b)
+	va, vb := asd*asd/float64(len(a)), bsd*bsd/float64(len(b))
+	if va+vb == 0 {
+		if am == bm {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	t := (am - bm) / math.Sqrt(va+vb)
+	df := (va + vb) * (va + vb) / (va*va/float64(len(a)-1) + vb*vb/float64(len(b)-1))
+	// P(|T| > t) for Student's t with df degrees of freedom
+	return incompleteBeta(df/2, 0.5, df/(df+t*t)), nil
+}
+
+// the regularized incomplete beta function I_x(a, b), by its continued
+// fraction
+func incompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	if x > (a+1)/(a+b+2) {
+		return 1 - incompleteBeta(b, a, 1-x)
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab-la-lb+a*math.Log(x)+b*math.Log(1-x)) / a
+
+	const tiny = 1e-30
+	f, c, d := 1.0, 1.0, 0.0
+	for i := 0; i <= 200; i++ {
+		m := float64(i / 2)
+		var num float64
+		switch {
+		case i == 0:
+			num = 1
+		case i%2 == 0:
+			num = m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		default:
+			num = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		}
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		d = 1 / d
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		f *= c * d
+		if math.Abs(1-c*d) < 1e-12 {
+			break
+		}
+	}
+	return front * (f - 1)
+}
+
+// benchPayload runs go_producer_consumer bench payload, which puts items
+// with -size payloads through a pipeline, first copying each payload out
+// of a buffer the producer reuses, as it must when it can't know when the
+// pipeline is done with it, then reading each into a pooled buffer handed
+// over with OwnPayload, and prints the allocations per item of each.
+//
+//	go_producer_consumer bench payload -size 1MB
+func benchPayload(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench payload", flag.ContinueOnError)
+	fs.SetOutput(out)
+	size := byteSize(1 << 20)
+	fs.Var(&size, "size", "bytes in each item's payload")
+	items := fs.Int("items", 500, "items put through the pipeline each way")
+	consumers := fs.Int("consumers", 2, "consumers taking the items")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if size < 2 || *items < 1 || *consumers < 1 {
+		fmt.Fprintln(out, "-size must be at least 2, and -items and -consumers at least 1")
+		return 2
+	}
+	fmt.Fprintf(out, "%d items with %s payloads:\n", *items, formatBytes(int64(size)))
+	for _, owned := range []bool{false, true} {
+		r, err := runPayloadBench(owned, int(size), *items, *consumers)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		name := "copied"
+		if owned {
+			name = "handed over"
+		}
+		fmt.Fprintf(out, "  %-11s %8.1f allocs/item %10s/item %10s/item\n", name,
+			float64(r.allocs)/float64(*items), formatBytes(int64(r.bytes)/int64(*items)), (r.took / time.Duration(*items)).Round(time.Microsecond))
+	}
+	return 0
+}
+
+type payloadBenchResult struct {
+	allocs, bytes uint64
+	took          time.Duration
+}
+
+// a sink that writes nowhere, so only the pipeline's own costs count
+type discardSink struct{}
+
+func (discardSink) Write(*Item) error { return nil }
+
+func runPayloadBench(owned bool, size, items, consumers int) (payloadBenchResult, error) {
+	var r payloadBenchResult
+	cfg, err := parseConfig([]string{"-producers", "0", "-consumers", fmt.Sprint(consumers), "-delay", "0", "-container-limits=false"})
+	if err != nil {
+		return r, err
+	}
+	p, err := newPipeline(cfg)
+	if err != nil {
+		return r, err
+	}
+	p.sink = discardSink{}
+	p.scale(0, consumers)
+	defer p.scale(0, 0)
+	// what the producer reads, a json string
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = 'x'
+	}
+	data[0], data[size-1] = '"', '"'
+	scratch := make([]byte, size)
+	ctx := context.Background()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := range items {
+		item := Item{ID: i, Timestamp: time.Now()}
+		if owned {
+			buf := NewPayloadBuffer(size)
+			copy(buf, data)
+			item.OwnPayload(buf, ReleasePayloadBuffer)
+		} else {
+			copy(scratch, data)
+			item.Payload = append(json.RawMessage(nil), scratch...)
+		}
+		if err := p.Produce(ctx, item); err != nil {
+			return r, err
+		}
+	}
+	if err := p.Flush(ctx); err != nil {
+		return r, err
+	}
+	r.took = time.Since(start)
+	runtime.ReadMemStats(&after)
+	r.allocs = after.Mallocs - before.Mallocs
+	r.bytes = after.TotalAlloc - before.TotalAlloc
+	return r, nil
+}
@@ -0,0 +1,269 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// benchCluster runs go_producer_consumer bench cluster, which measures what
+// taking the buffer out of the process costs. It runs the pipeline the
+// flags after -- describe as -producer-procs processes that only produce
+// and -consumer-procs that only consume, all on this machine and sharing a
+// queue in redis, then as one process with as many producers and consumers
+// as the lot of them, and compares the two as bench compare does:
+//
+//	go_producer_consumer bench cluster -redis redis://localhost:6379 -producer-procs 2 -consumer-procs 4 -- -producers 2 -consumers 4 -items 5000 -delay 0
+//
+// The consumer processes start first, and each stops once it has had an
+// end-of-stream marker from every producer process. If any process fails
+// the rest are killed. The cluster's report adds up the processes'
+// counts, takes its elapsed time from the first process starting to the
+// last one finishing, so starting the processes counts against it, and
+// its latencies from the slowest consumer process, as the quantiles of
+// different processes can't be merged.
+func benchCluster(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench cluster", flag.ContinueOnError)
+	fs.SetOutput(out)
+	redis := fs.String("redis", "", "redis:// url of the redis the processes share their queue through")
+	producerProcs := fs.Int("producer-procs", 2, "how many processes only produce")
+	consumerProcs := fs.Int("consumer-procs", 2, "how many processes only consume")
+	runs := fs.Int("runs", 3, "how many times to run the cluster and the single process, alternating between them")
+	timeout := fs.Duration("timeout", 10*time.Minute, "kill a cluster run's processes once it has taken this long")
+	save := fs.String("save", "", "directory to save the results to, as in-process.json and cluster.json, for bench compare")
+	log := fs.String("log", "", "file the processes' own output is appended to (default discarded)")
+	level := fs.Float64("significance", 0.05, "p-value below which a difference counts as significant")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	switch {
+	case *redis == "":
+		fmt.Fprintln(out, "bench cluster needs -redis for the processes to share a queue through")
+		return 2
+	case *producerProcs < 1 || *consumerProcs < 1:
+		fmt.Fprintln(out, "bench cluster needs at least 1 producer and 1 consumer process")
+		return 2
+	case *runs < 1:
+		fmt.Fprintln(out, "-runs must be at least 1")
+		return 2
+	}
+	flags := fs.Args()
+	cfg, err := parseConfig(flags)
+	if err != nil {
+		fmt.Fprintf(out, "bench cluster: %v\n", err)
+		return 2
+	}
+	switch {
+	case cfg.AutoProducers || cfg.AutoConsumers:
+		fmt.Fprintln(out, "bench cluster needs set -producers and -consumers, not auto, to match them in one process")
+		return 2
+	case cfg.Redis != "":
+		fmt.Fprintln(out, "give -redis to bench cluster rather than to the pipeline, which it runs with and without it")
+		return 2
+	case cfg.Admin != "" || cfg.Ingest != "":
+		fmt.Fprintln(out, "bench cluster can't pass on -admin or -ingest, as every process would listen on the same address")
+		return 2
+	case cfg.Source != "":
+		fmt.Fprintln(out, "bench cluster runs the built-in producers; each producer process would read all of a -source")
+		return 2
+	}
+	c := &benchClusterRun{
+		flags:     flags,
+		redis:     *redis,
+		producers: *producerProcs,
+		consumers: *consumerProcs,
+		timeout:   *timeout,
+		log:       io.Discard,
+	}
+	if *log != "" {
+		f, err := os.OpenFile(*log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		defer f.Close()
+		c.log = f
+	}
+
+	// the one process has every producer and consumer the cluster has
+	single := &benchResult{Name: "in-process", Flags: append(append([]string{}, flags...),
+		"-producers", strconv.Itoa(cfg.Producers**producerProcs),
+		"-consumers", strconv.Itoa(cfg.Consumers**consumerProcs))}
+	cluster := &benchResult{Name: "cluster", Flags: flags}
+	for n := 0; n < *runs; n++ {
+		fmt.Fprintf(out, "run %d/%d in one process\n", n+1, *runs)
+		r, err := benchRun(single.Flags, c.log)
+		if err != nil {
+			fmt.Fprintf(out, "in-process: %v\n", err)
+			return 1
+		}
+		single.Runs = append(single.Runs, r)
+		fmt.Fprintf(out, "run %d/%d as %d producer and %d consumer processes\n", n+1, *runs, c.producers, c.consumers)
+		if r, err = c.run(n); err != nil {
+			fmt.Fprintf(out, "cluster: %v\n", err)
+			return 1
+		}
+		cluster.Runs = append(cluster.Runs, r)
+	}
+	if *save != "" {
+		for _, side := range []*benchResult{single, cluster} {
+			if err := saveBench(filepath.Join(*save, side.Name+".json"), side); err != nil {
+				fmt.Fprintf(out, "error saving results: %v\n", err)
+			}
+		}
+	}
+	printComparison(out, single, cluster, *level)
+	return 0
+}
+
+// how to run the cluster's processes
+type benchClusterRun struct {
+	flags                []string
+	redis                string
+	producers, consumers int
+	timeout              time.Duration
+	log                  io.Writer
+}
+
+// a process of the cluster, running with its report written to path
+type benchProc struct {
+	name     string
+	consumer bool
+	cmd      *exec.Cmd
+	path     string
+}
+
+// run the cluster once, returning the report of its processes together
+func (c *benchClusterRun) run(n int) (Report, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return Report{}, err
+	}
+	dir, err := os.MkdirTemp("", "bench-cluster")
+	if err != nil {
+		return Report{}, err
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	// a queue of the run's own, so nothing left from an earlier one is in it
+	key := fmt.Sprintf("bench-cluster-%d-%d-%d", os.Getpid(), time.Now().UnixNano(), n)
+	var procs []*benchProc
+	add := func(name string, consumer bool, extra ...string) {
+		path := filepath.Join(dir, name+".json")
+		args := append(append([]string{}, c.flags...), "-redis", c.redis, "-redis-key", key, "-redis-consumer", name, "-report", path)
+		cmd := exec.CommandContext(ctx, self, append(args, extra...)...)
+		cmd.Stdout, cmd.Stderr = c.log, c.log
+		procs = append(procs, &benchProc{name: name, consumer: consumer, cmd: cmd, path: path})
+	}
+	// the consumers first, to be waiting when the items come
+	for i := range c.consumers {
+		add(fmt.Sprintf("consumer-%d", i+1), true, "-producers", "0", "-redis-upstream", strconv.Itoa(c.producers))
+	}
+	for i := range c.producers {
+		add(fmt.Sprintf("producer-%d", i+1), false, "-consumers", "0", "-redis-downstream", strconv.Itoa(c.consumers))
+	}
+
+	start := time.Now()
+	errs := make(chan error, len(procs))
+	var first error
+	started := 0
+	for _, p := range procs {
+		if err := p.cmd.Start(); err != nil {
+			first = fmt.Errorf("%s: %v", p.name, err)
+			cancel()
+			break
+		}
+		started++
+		go func() {
+			err := p.cmd.Wait()
+			if err != nil {
+				err = fmt.Errorf("%s: %v", p.name, err)
+			}
+			errs <- err
+		}()
+	}
+	for range started {
+		if err := <-errs; err != nil && first == nil {
+			// stop the rest, which would otherwise wait for markers that
+			// won't come
+			first = err
+			cancel()
+		}
+	}
+	if first != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return Report{}, fmt.Errorf("still running after -timeout %s, killed: %v", c.timeout, first)
+		}
+		return Report{}, first
+	}
+	wall := time.Since(start)
+
+	var producers, consumers []Report
+	for _, p := range procs {
+		var r Report
+		b, err := os.ReadFile(p.path)
+		if err == nil {
+			err = json.Unmarshal(b, &r)
+		}
+		if err != nil {
+			return Report{}, fmt.Errorf("reading %s's report: %v", p.name, err)
+		}
+		if p.consumer {
+			consumers = append(consumers, r)
+		} else {
+			producers = append(producers, r)
+		}
+	}
+	return clusterReport(producers, consumers, wall), nil
+}
+
+// the report of a cluster run, from those of its processes
+func clusterReport(producers, consumers []Report, wall time.Duration) Report {
+	r := Report{Elapsed: wall.Round(time.Millisecond), Timeline: &Timeline{}}
+	for _, p := range producers {
+		r.Produced += p.Produced
+	}
+	for _, c := range consumers {
+		r.Consumed += c.Consumed
+		r.P50, r.P90, r.P99 = max(r.P50, c.P50), max(r.P90, c.P90), max(r.P99, c.P99)
+		r.Max = max(r.Max, c.Max)
+	}
+	for _, p := range append(append([]Report{}, producers...), consumers...) {
+		r.Errors += p.Errors
+		r.GCCycles += p.GCCycles
+		r.GCPause += p.GCPause
+		r.Allocs += p.Allocs
+		if p.Timeline != nil {
+			// the processes start within moments of each other, so their
+			// seconds line up near enough
+			r.Timeline.Produced = addSeconds(r.Timeline.Produced, p.Timeline.Produced)
+			r.Timeline.Consumed = addSeconds(r.Timeline.Consumed, p.Timeline.Consumed)
+		}
+	}
+	if wall > 0 {
+		r.Throughput = float64(r.Consumed) / wall.Seconds()
+	}
+	return r
+}
+
+func addSeconds(sum, counts []int64) []int64 {
+	for len(sum) < len(counts) {
+		sum = append(sum, 0)
+	}
+	for i, n := range counts {
+		sum[i] += n
+	}
+	return sum
+}
@@ -0,0 +1,63 @@
+package pipeline
+
+import "sync"
+
+// rough fixed cost of an item on top of its payload and metadata: the
+// struct itself, its timestamp and the map header
+const itemOverhead = 96
+
+// byteBudget bounds the total size of the items sitting in the pipeline's
+// buffers, on top of the channels' limit on how many there can be. A
+// producer takes an item's size out of the budget before queueing it and
+// the size is given back once a consumer, or the redis pusher, has taken
+// the item off the queue. An item bigger than the whole budget is still let
+// through, on its own, rather than blocking forever.
+type byteBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+	// closed and replaced whenever room is given back
+	wake chan struct{}
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	return &byteBudget{limit: limit, wake: make(chan struct{})}
+}
+
+// wait for room for n bytes, giving up if stop is closed first
+func (b *byteBudget) acquire(n int64, stop <-chan struct{}) bool {
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return true
+		}
+		wake := b.wake
+		b.mu.Unlock()
+		select {
+		case <-wake:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// bytes currently accounted for in the buffers
+func (b *byteBudget) inUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
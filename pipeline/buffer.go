@@ -0,0 +1,710 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// alias for int32 so that I can create an atomic inc wrapper
+// function
+type count32 int32
+
+// Atomic increment wrapper for count32 data. The new incremented value
+// is returned
+func (c *count32) inc() int32 {
+	return atomic.AddInt32((*int32)(c), 1)
+}
+
+type Item struct {
+	ID         int       `json:"Id"`
+	Timestamp  time.Time `json:"Timestamp"`
+	ProducerID int       `json:"ProducerId"`
+	// numbers a producer's items in order from 1, for -check-sequence
+	Seq int64 `json:"Seq,omitempty"`
+	// unique to the item however often it is sent, so that -dedup-window
+	// can drop the copies a retrying producer sends
+	IdempotencyKey string `json:"IdempotencyKey,omitempty"`
+	// free form string attributes, visible to filter expressions as
+	// Metadata.<key>
+	Metadata map[string]string `json:"Metadata,omitempty"`
+	// the item's data, in the format given by its schema name and version
+	Payload       json.RawMessage `json:"Payload,omitempty"`
+	Schema        string          `json:"Schema,omitempty"`
+	SchemaVersion int             `json:"SchemaVersion,omitempty"`
+	// what handling the item came to, see Result
+	Result *Result `json:"Result,omitempty"`
+	// where the item came in the source, for checkpointing
+	seq int64
+	// set by transports that need to hear when the item has been handled
+	ack func()
+	// what the item was charged against the byte budget while queued
+	size int64
+	// the flush barrier's epoch, once the item is on a buffer
+	epoch int64
+	// numbers the item in a -trace
+	trace uint64
+	// its ticket with -sink-order-key
+	order uint64
+	// sent to the -canary-handler's pool
+	canary bool
+	// gives back a payload handed over with OwnPayload
+	release func()
+	// waits for the item's outcome when it was submitted with Submit
+	pending *Pending
+	// the payload, compressed while the item is queued
+	packed []byte
+	// shared by the pieces of a split item, set once one of them has
+	// failed to be written and taken the item through the error policy
+	split *atomic.Bool
+}
+
+// how much memory an item takes, more or less: its encoded payload and
+// metadata plus a fixed overhead, which is what the byte budget counts
+func (item *Item) memSize() int64 {
+	n := int64(itemOverhead + len(item.Payload) + len(item.packed) + len(item.Schema))
+	for k, v := range item.Metadata {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// create a new item for inserting into the channel
+func NewItem(id int, producerID int) *Item {
+	i := Item{
+		ID:         id,
+		Timestamp:  time.Now(),
+		ProducerID: producerID,
+	}
+	return &i
+}
+
+// produce items one at a time and insert into the pipeline's channel. The
+// items are just timestamps and random numbers, along with a tag to indicate
+// which producer created the item, unless the pipeline has a source in which
+// case items are pulled from it until it runs dry. This function is thread
+// safe and the pipeline starts one goroutine running it per producer. It
+// returns early if stop is closed, which is how producers are scaled down
+// or drained. If the pipeline has a governor each item waits for its
+// permission first, so that all producers together stay at the governor's
+// target rate.
+func (p *Pipeline) produce(myId int, stop <-chan struct{}) {
+	defer p.arenas.finish(myId)
+	for i := 0; p.source != nil || i < p.cfg.ItemsPerProducer; i++ {
+		p.gate.wait(stop)
+		if !p.gov.wait(stop) {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		item, err := p.nextItem(myId)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.stats.errorf("error reading from source: %v", err)
+			return
+		}
+		if p.source == nil && p.seqs != nil {
+			p.seqs.number(item, int64(i)+1)
+		}
+		if p.source == nil && p.dedup != nil {
+			item.IdempotencyKey = fmt.Sprintf("%s-%d-%d", p.name, myId, i+1)
+		}
+		if !p.dedup.admit(item) {
+			p.drops.drop(*item, DropDuplicate, "")
+			p.settle(item)
+			continue
+		}
+		if p.record != nil {
+			if err := p.record.Write(item); err != nil {
+				fmt.Printf("error recording produced item: %v\n", err)
+			}
+		}
+		if p.memory.shedding(item) {
+			p.drops.drop(*item, DropShed, "")
+			p.settle(item)
+			continue
+		}
+		if why := p.strict.oversized(item); why != "" {
+			p.drops.drop(*item, DropInvalid, why)
+			p.settle(item)
+			continue
+		}
+		p.memory.wait(stop)
+		p.marks.wait(stop)
+		ch := p.route(item)
+		if p.budget != nil {
+			item.size = item.memSize()
+			if !p.budget.acquire(item.size, stop) {
+				return
+			}
+		}
+		if p.merge != nil {
+			if !p.merge.put(ch, myId, *item, stop) {
+				return
+			}
+			continue
+		}
+		if !p.enqueue(ch, *item, stop) {
+			return
+		}
+	}
+}
+
+// put an item on a buffer, waiting for room unless -buffer-full says to
+// drop an item instead. It reports false if stop was closed first.
+func (p *Pipeline) enqueue(ch chan Item, item Item, stop <-chan struct{}) bool {
+	// hold off a resize of the buffer until the item is on it
+	if !p.lockInput(stop) {
+		p.budget.release(item.size)
+		item.releasePayload()
+		return false
+	}
+	defer p.bufMu.RUnlock()
+	ok, _ := p.enqueueLocked(ch, item, stop)
+	return ok
+}
+
+// enqueue with p.bufMu held, which a batch holds for all its items. The
+// item goes on the new buffer if a resize came between routing it and here.
+// It also reports whether -buffer-full drop had the item dropped.
+func (p *Pipeline) enqueueLocked(ch chan Item, item Item, stop <-chan struct{}) (ok, dropped bool) {
+	if p.retired[ch] {
+		ch = p.input
+	}
+	if p.sums != nil || p.compress != nil {
+		p.sums.stamp(&item, false)
+		p.compress.pack(&item)
+		// the budget was charged for the item as it came
+		if item.size > 0 {
+			size := item.memSize()
+			p.budget.release(item.size - size)
+			item.size = size
+		}
+	}
+	item.epoch = p.barrier.enter()
+	p.ordered.register(&item)
+	if p.trace != nil {
+		p.trace.enqueue(&item, item.ProducerID, p.bufferName(ch))
+	}
+	// copied for peek before a consumer can take it
+	var peeked Item
+	keep := p.queued != nil && ch == p.channel
+	if keep {
+		peeked = copyItem(&item)
+	}
+	for p.cfg.BufferFull != fullBlock {
+		select {
+		case ch <- item:
+			p.lag.queued(ch)
+			if keep {
+				p.queued.add(peeked)
+			}
+			p.stats.recordProduced()
+			p.logf("producer %d queued item %d", item.ProducerID, item.ID)
+			return true, false
+		default:
+		}
+		if p.cfg.BufferFull == fullDropNewest {
+			p.budget.release(item.size)
+			p.drops.drop(item, DropFull, "")
+			p.settle(&item)
+			return true, true
+		}
+		// a consumer may beat us to the oldest, in which case there's room
+		select {
+		case old := <-ch:
+			p.lag.taken(ch)
+			p.budget.release(old.size)
+			unpack(&old)
+			p.drops.drop(old, DropFull, "dropped to make room for a newer item")
+			p.settle(&old)
+		default:
+		}
+	}
+	select {
+	case ch <- item:
+		p.lag.queued(ch)
+		if keep {
+			p.queued.add(peeked)
+		}
+		p.stats.recordProduced()
+		p.logf("producer %d queued item %d", item.ProducerID, item.ID)
+		return true, false
+	default:
+	}
+	// the buffer is full
+	waited := time.Now()
+	defer func() { p.stats.recordBlocked(time.Since(waited)) }()
+	select {
+	case ch <- item:
+		p.lag.queued(ch)
+		if keep {
+			p.queued.add(peeked)
+		}
+		p.stats.recordProduced()
+		p.logf("producer %d queued item %d after waiting %s", item.ProducerID, item.ID, time.Since(waited).Round(time.Microsecond))
+		return true, false
+	case <-stop:
+		p.budget.release(item.size)
+		p.barrier.leave(item.epoch)
+		p.ordered.finished(&item)
+		item.releasePayload()
+		return false, false
+	}
+}
+
+// the random numbers of a built-in producer, which only it uses
+func (p *Pipeline) random(myId int) *rand.Rand {
+	if r, ok := p.rands.Load(myId); ok {
+		return r.(*rand.Rand)
+	}
+	r := rand.New(rand.NewSource(p.cfg.Seed + int64(myId)))
+	p.rands.Store(myId, r)
+	return r
+}
+
+// make the next item for a producer, either at random or from the source
+func (p *Pipeline) nextItem(myId int) (*Item, error) {
+	if p.source == nil {
+		r := p.random(myId)
+		item := p.arenas.newItem(myId, r.Intn(100))
+		if v := p.cfg.SchemaVersion; v > 0 {
+			item.Schema = "reading"
+			item.SchemaVersion = v
+			item.Payload = samplePayload(v, item.ID)
+		}
+		if p.payloads != nil {
+			p.payloads.fill(item, r)
+		}
+		return item, nil
+	}
+	var item *Item
+	var err error
+	if p.checkpoint != nil {
+		item, err = p.checkpoint.next()
+	} else {
+		item, err = p.source.Next()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.Timestamp.IsZero() {
+		item.Timestamp = time.Now()
+	}
+	return item, nil
+}
+
+// consume items one at a time that are pulled from a channel until it is
+// closed, or until stop is closed when the consumer is scaled down. As with
+// produce, this function is thread safe and the pipeline starts one
+// goroutine running it per consumer, reading the default channel or the
+// channel of the routed pool the consumer belongs to.
+func (p *Pipeline) consume(channel <-chan Item, myId int, stop <-chan struct{}) {
+	if p.batcher != nil && p.sink != nil {
+		p.consumeBatches(channel, myId, stop)
+		return
+	}
+	if p.prefetch != nil {
+		channel = p.prefetch.start(p, channel, myId, stop)
+		defer p.prefetch.stopped(myId)
+		// what was fetched is handled before the consumer stops, which
+		// happens once the fetching stops and closes its buffer
+		stop = nil
+	}
+	for {
+		p.gate.wait(stop)
+		ready := len(channel) > 0
+		var element Item
+		var ok bool
+		taken := channel
+		switch {
+		case p.shards != nil && channel == p.channel:
+			element, taken, ok = p.shards.take(p, myId, stop)
+		case p.fair != nil && channel == p.channel:
+			element, taken, ok = p.fair.take(stop)
+		default:
+			element, ok = p.take(channel, stop)
+		}
+		if !ok {
+			if next := p.replaced(channel); next != nil {
+				channel = next
+				continue
+			}
+			return
+		}
+		p.prefetch.took(ready)
+		p.consumeTaken(element, taken, myId)
+		p.pauses.handled(myId, stop)
+	}
+}
+
+// handle an item just taken off the buffer taken, and settle it
+func (p *Pipeline) consumeTaken(element Item, taken <-chan Item, myId int) {
+	p.lag.taken(taken)
+	p.budget.release(element.size)
+	if !p.unpacked(&element) {
+		return
+	}
+	p.trace.record(traceDequeue, &element, myId)
+	started := time.Now()
+	done := p.working(myId, element)
+	p.trace.record(traceStart, &element, myId)
+	hold := p.holdFor(myId, element)
+	p.handle(element, myId)
+	p.trace.record(traceEnd, &element, myId)
+	if hold != nil {
+		p.doneWith(myId, hold)
+	} else {
+		p.settle(&element)
+	}
+	time.Sleep(p.cfg.ConsumeDelay)
+	done()
+	took := time.Since(started)
+	p.auto.handled(took)
+	p.fair.handled(taken, took)
+	p.stats.recordService(1, took)
+}
+
+// let the checkpoint and the transport know that we are done with an item,
+// whether it was handled or dropped
+func (p *Pipeline) settle(item *Item) {
+	if p.checkpoint != nil {
+		p.checkpoint.finish(item.seq)
+	}
+	if item.ack != nil {
+		item.ack()
+	}
+	p.trace.record(traceAck, item, 0)
+	p.barrier.leave(item.epoch)
+	p.ordered.finished(item)
+	item.releasePayload()
+	item.pending.settle()
+}
+
+// handle a single item for a consumer. The items are just printed out using
+// the standard json marshalling routine. If we didn't want to use the json
+// marshalling code, we'd have to print out the elements of the Item
+// individually as in the commented out Printf. Items that have been
+// waiting longer than the ttl, whose payload doesn't fit its schema or that
+// don't match the pipeline's filter, when it has one, go to the drop
+// policy, which dead-letters the invalid ones by default. With a join
+// configured the rest waits in the joiner for a partner, otherwise it is
+// processed straight away.
+func (p *Pipeline) handle(element Item, myId int) {
+	p.seqs.observe(&element)
+	age := time.Since(element.Timestamp)
+	p.stats.recordConsumed(age)
+	p.keyed.consumed(&element, age)
+	p.health.took()
+	p.logf("consumer %d took item %d of producer %d, queued for %s", myId, element.ID, element.ProducerID, age.Round(time.Microsecond))
+	if p.cfg.TTL > 0 && age > p.cfg.TTL {
+		p.drops.drop(element, DropExpired, fmt.Sprintf("waited %s, over the %s ttl", age.Round(time.Millisecond), p.cfg.TTL))
+		return
+	}
+	if p.memory.shedding(&element) {
+		p.drops.drop(element, DropShed, "")
+		return
+	}
+	if err := p.sums.verify(&element); err != nil {
+		p.drops.drop(element, DropCorrupt, err.Error())
+		return
+	}
+	if err := p.schemas.Upgrade(&element); err != nil {
+		p.drops.drop(element, DropInvalid, err.Error())
+		return
+	}
+	if p.filter != nil {
+		keep, err := p.filter.match(&element)
+		if err != nil {
+			err = fmt.Errorf("error evaluating filter: %w", err)
+			p.stats.errorf("%v", err)
+			element.pending.failed(err, false)
+			return
+		}
+		if !keep {
+			p.drops.drop(element, DropFiltered, "")
+			return
+		}
+	}
+	if p.joiner != nil {
+		// the joiner keeps the item after the consumer settles it
+		element.detachPayload()
+		if err := p.joiner.left(element, myId); err != nil {
+			p.stats.errorf("error joining item %d: %v", element.ID, err)
+		}
+		return
+	}
+	p.process(element, myId)
+}
+
+// finish off an item. If there is a handler it gets the item first and may
+// replace it, or split it into several, and if there is a sink the items
+// are written there instead of being printed. A split item's pieces are
+// written one after another by this consumer, so it doesn't take its next
+// item off the channel until the sink has accepted them all and a handler
+// that explodes items slows the producers down rather than piling up a
+// backlog in memory. What the handler made of the item goes on with its
+// Result, see passResult.
+func (p *Pipeline) process(element Item, myId int) {
+	started, attempts := time.Now(), 0
+	handler := p.handlerFor(&element)
+	if s, ok := handler.(Splitter); ok {
+		var items []Item
+		err := p.retry(&element, myId, func() (err error) {
+			attempts++
+			defer p.limits.acquire(stageHandle, &element)()
+			items, err = splitWith(handlerContext(&element, attempts), s, &element)
+			return err
+		})
+		p.canary.handled(&element, time.Since(started), err)
+		p.shadow.offer(element, items, err)
+		if err != nil {
+			p.pauses.failed(myId)
+			p.failed(element, fmt.Errorf("error handling item %d: %w", element.ID, err))
+			return
+		}
+		p.stats.recordSplit(len(items))
+		// a handler that gave back the one item, as exec and wasm ones do
+		// when they don't split it, made an ordinary item of it
+		piece := len(items) > 1
+		if piece {
+			element.split = new(atomic.Bool)
+		}
+		for _, item := range items {
+			if item.Timestamp.IsZero() {
+				item.Timestamp = element.Timestamp
+			}
+			// the pieces are committed with the item they came from
+			item.seq = element.seq
+			p.sums.stamp(&item, true)
+			p.passResult(&item, &element, myId, started, attempts)
+			p.output(item, element, piece, myId)
+		}
+		return
+	}
+	if handler != nil {
+		var out *Item
+		err := p.retry(&element, myId, func() (err error) {
+			attempts++
+			defer p.limits.acquire(stageHandle, &element)()
+			out, err = handleWith(handlerContext(&element, attempts), handler, &element)
+			return err
+		})
+		p.canary.handled(&element, time.Since(started), err)
+		if err != nil {
+			p.shadow.offer(element, nil, err)
+			p.pauses.failed(myId)
+			p.failed(element, fmt.Errorf("error handling item %d: %w", element.ID, err))
+			return
+		}
+		if out == nil {
+			kept := element
+			out = &kept
+		}
+		p.shadow.offer(element, []Item{*out}, nil)
+		p.sums.stamp(out, true)
+		p.passResult(out, &element, myId, started, attempts)
+		p.output(*out, element, false, myId)
+		return
+	}
+	p.canary.handled(&element, time.Since(started), nil)
+	p.shadow.offer(element, []Item{element}, nil)
+	p.output(element, element, false, myId)
+}
+
+// deliver an item handled from original, or add it to the consumer's batch
+// when it is batching, or to the sink's write-behind buffer, which deliver
+// it later
+func (p *Pipeline) output(item, original Item, piece bool, myId int) {
+	if err := p.sums.verify(&item); err != nil {
+		p.drops.drop(item, DropCorrupt, err.Error()+", before writing it to the sink")
+		return
+	}
+	original.pending.output(item)
+	p.golden.add(&item, p.routed)
+	p.tail.add(&item)
+	if b := p.batchOf(myId); b != nil && b.add(batchEntry{item, original, piece}) {
+		return
+	}
+	write := func() error { return p.deliver(item, myId) }
+	if bs, ok := p.sink.(behindSink); ok {
+		if hold := p.holdOf(myId); hold != nil {
+			write = func() error {
+				err := bs.queue(batchEntry{item, original, piece}, hold)
+				p.health.wrote(err)
+				if err != nil {
+					return fmt.Errorf("error writing item %d to sink: %w", item.ID, err)
+				}
+				return nil
+			}
+		}
+	}
+	if err := p.retry(&original, myId, write); err != nil {
+		p.pauses.failed(myId)
+		p.deliverFailed(err, original, piece)
+	}
+}
+
+// count a failed delivery against the item it was handled from. For one
+// piece of a split item the other pieces are kept with the error, and the
+// first piece to fail takes the item through the error policy, which may
+// dead-letter it; those failing after are only counted.
+func (p *Pipeline) deliverFailed(err error, original Item, piece bool) {
+	if !piece {
+		p.failed(original, err)
+		return
+	}
+	original.pending.failed(err, true)
+	p.stats.errorf("%v", err)
+	class := p.classify(err)
+	if class == "" {
+		return
+	}
+	p.stats.recordErrorClass(class)
+	if p.errs.action(class) == classDLQ && original.split.CompareAndSwap(false, true) {
+		p.deadLetter(original, fmt.Sprintf("%s error on a piece of it: %v", class, err))
+	}
+}
+
+// count an item the handler or sink failed on. An error with a class goes
+// where the error policy says, and the rest are only counted. In a
+// backfill those are kept to be retried at the end; a split item's pieces
+// aren't, since retrying the item would write the pieces that did succeed
+// all over again.
+func (p *Pipeline) failed(element Item, err error) {
+	element.pending.failed(err, false)
+	p.stats.errorf("%v", err)
+	p.keyed.failed(&element)
+	if class := p.classify(err); class != "" {
+		p.stats.recordErrorClass(class)
+		if p.errs.action(class) == classDLQ {
+			p.deadLetter(element, fmt.Sprintf("%s error: %v", class, err))
+			return
+		}
+	}
+	p.trace.nack(&element, 0, nackFailed)
+	if p.backfill != nil {
+		p.backfill.spillItem(element)
+	}
+}
+
+// write a handled item to the sink, or print it
+func (p *Pipeline) deliver(element Item, myId int) error {
+	if p.sink != nil {
+		err := p.limits.write(p.sink, &element)
+		p.health.wrote(err)
+		if err != nil {
+			return fmt.Errorf("error writing item %d to sink: %w", element.ID, err)
+		}
+		return nil
+	}
+	j := p.printed.inc()
+	b, err := json.Marshal(element)
+	if err != nil {
+		p.stats.errorf("error formatting json: %v", err)
+	} else {
+		fmt.Printf("element %d is: %s, consumed by %d\n", j, string(b), myId)
+	}
+	// fmt.Printf("element %d consumed is %d, produced at %s, by producer %d\n",
+	// j, element.ID, element.Timestamp.Format(time.RFC850),
+	// element.ProducerID)
+	return nil
+}
+
+// Main runs the go_producer_consumer command with os.Args, one of its
+// subcommands or a pipeline as the flags say, and exits with its code
+func Main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(benchMain(os.Args[2:], os.Stdout))
+		case "trace":
+			os.Exit(traceMain(os.Args[2:], os.Stdout))
+		case "verify":
+			os.Exit(verifyMain(os.Args[2:], os.Stdout))
+		case "service":
+			os.Exit(serviceMain(os.Args[2:], os.Stdout))
+		case "dlq":
+			os.Exit(dlqMain(os.Args[2:], os.Stdout))
+		case "graph":
+			os.Exit(graphMain(os.Args[2:], os.Stdout))
+		}
+	}
+	os.Exit(run(os.Args[1:], nil))
+}
+
+// run a pipeline as the flags in args say, returning the exit code.
+// started, if set, is given the pipeline just before it runs, for a service
+// manager to stop it by.
+func run(args []string, started func(*Pipeline)) int {
+	cfg, err := parseConfig(args)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Println(err)
+		}
+		return 2
+	}
+	applyRuntimeLimits(cfg)
+	summaryOut := summaryOnStdout(cfg)
+	if cfg.containerNote != "" {
+		fmt.Println(cfg.containerNote)
+	}
+	if cfg.DryRun {
+		return dryRun(cfg, os.Stdout)
+	}
+	if cfg.Simulate {
+		if err := simulate(cfg, os.Stdout); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		return 0
+	}
+	if !cfg.SkipPreflight {
+		if err := preflight(cfg); err != nil {
+			fmt.Printf("preflight failed, -skip-preflight to start anyway:\n%v\n", err)
+			return 1
+		}
+	}
+	p, err := newPipeline(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	p.summaryOut = summaryOut
+	if cfg.Admin != "" {
+		security, err := newEndpointSecurity(cfg, "admin", cfg.AdminTLS, cfg.AdminAuth, cfg.AdminToken)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		admin := newAdminServer(security)
+		admin.register(p)
+		if err := admin.listen(cfg.Admin, os.FileMode(cfg.SocketMode)); err != nil {
+			fmt.Printf("error starting admin api: %v\n", err)
+			return 1
+		}
+		defer admin.close()
+	}
+	if cfg.Daemon {
+		fmt.Printf("daemon: taking items on %s\n", cfg.Ingest)
+	}
+	p.handleSignals()
+	if started != nil {
+		started(p)
+	}
+	p.Run()
+	if p.golden != nil && p.golden.mismatch {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type permanentError struct{ error }
+
+func (permanentError) ErrorClass() ErrorClass { return ClassPermanent }
+
+// refuses every item for good
+type refusingSink struct{}
+
+func (refusingSink) Write(*Item) error {
+	return permanentError{errors.New("no room at the inn")}
+}
+
+// an item an exec handler gives back whole, or splits, is dead-lettered
+// once when the sink refuses it for good, as it would be with no handler
+func TestExecHandlerSinkFailureDeadLetters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the handlers are shell scripts")
+	}
+	replies := map[string]string{
+		"whole": `{}`,
+		"split": `{"items":[{"Id":1,"Timestamp":"2026-01-01T00:00:00Z"},{"Id":2,"Timestamp":"2026-01-01T00:00:00Z"}]}`,
+		"none":  ``,
+	}
+	for _, name := range []string{"none", "whole", "split"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := []string{"-producers", "1", "-items", "3", "-consumers", "1", "-delay", "0",
+				"-retries", "0", "-dlq", filepath.Join(dir, "dlq.ndjson")}
+			if reply := replies[name]; reply != "" {
+				script := filepath.Join(dir, "handler.sh")
+				body := "#!/bin/sh\nwhile read -r line; do echo '" + reply + "'; done\n"
+				if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "-handler", "exec:"+script)
+			}
+			cfg, err := ParseConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.sink = refusingSink{}
+			p.Run()
+			if n := p.dlq.size(); n != 3 {
+				t.Fatalf("%d items were dead-lettered, expected 3", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+)
+
+// how long a buffer being shrunk may take to drain down to its new size
+// before the resize is given up on
+const resizeDrainWait = 10 * time.Second
+
+// resizeBuffer swaps the default pool's buffer for one with room for
+// capacity items, moving the items waiting on the old one over in order,
+// so the buffer can be tuned through the admin API without a restart.
+// The producers are held off while it happens, those already waiting for
+// room getting their items on first. Shrinking below the items waiting
+// holds them off until the consumers have taken enough for the rest to
+// fit, or gives up after resizeDrainWait. The consumers find the new
+// buffer once the old one is closed under them.
+func (p *Pipeline) resizeBuffer(capacity int) error {
+	switch {
+	case capacity < 1:
+		return fmt.Errorf("the buffer needs room for at least 1 item")
+	case p.shards != nil:
+		return fmt.Errorf("a buffer split with -buffer-shards can't be resized")
+	case p.fair != nil:
+		return fmt.Errorf("a buffer split into topics with -fair-topics can't be resized")
+	case p.strict != nil:
+		return fmt.Errorf("-strict-memory holds the buffer at the %d items it started with", cap(p.channel))
+	case p.redis != nil:
+		return fmt.Errorf("a -redis pipeline's buffer is its queue, which can't be resized")
+	case p.gate.paused():
+		// the producers waiting for room would never get it
+		return fmt.Errorf("pipeline %s is paused, resume it first", p.name)
+	}
+	p.bufMu.Lock()
+	if p.inputClosed {
+		p.bufMu.Unlock()
+		return fmt.Errorf("%w: %s is draining, can't resize its buffer", ErrPipelineClosed, p.name)
+	}
+	if p.holdOff != nil {
+		p.bufMu.Unlock()
+		return fmt.Errorf("the buffer of %s is already being resized", p.name)
+	}
+	old := p.channel
+	if capacity == cap(old) {
+		p.bufMu.Unlock()
+		return nil
+	}
+	held := make(chan struct{})
+	p.holdOff = held
+	p.bufMu.Unlock()
+	// the consumers take from the old buffer meanwhile, and those it was
+	// closed under before need p.bufMu to find the new one, so the drain is
+	// waited for without it
+	for deadline := time.Now().Add(resizeDrainWait); len(old) > capacity; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			p.bufMu.Lock()
+			p.releaseHoldOff(held)
+			p.bufMu.Unlock()
+			return fmt.Errorf("%d items still wait on the buffer after %s, more than %d fit", len(old), resizeDrainWait, capacity)
+		}
+	}
+	p.bufMu.Lock()
+	defer p.bufMu.Unlock()
+	defer p.releaseHoldOff(held)
+	if p.inputClosed {
+		return fmt.Errorf("%w: %s is draining, can't resize its buffer", ErrPipelineClosed, p.name)
+	}
+	moved := p.swapBuffer(capacity)
+	fmt.Printf("buffer resized from %d to %d items, %d moved over\n", cap(old), capacity, moved)
+	return nil
+}
+
+// let the producers held off by a resize go on, called with p.bufMu held
+func (p *Pipeline) releaseHoldOff(held chan struct{}) {
+	p.holdOff = nil
+	close(held)
+}
+
+// take p.bufMu for reading to put items on the buffers, first waiting out
+// a resize holding the producers off. It reports false, without the lock,
+// if stop was closed first.
+func (p *Pipeline) lockInput(stop <-chan struct{}) bool {
+	for {
+		p.bufMu.RLock()
+		held := p.holdOff
+		if held == nil {
+			return true
+		}
+		p.bufMu.RUnlock()
+		select {
+		case <-held:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// swap the default pool's buffer for a new one with room for capacity
+// items, moving those waiting on the old one over in order. It is called
+// with p.bufMu held, so nothing else puts items on either, and the
+// consumers only take them, so the new buffer has room for every item
+// still on the old one as long as it has room for the items on it now.
+func (p *Pipeline) swapBuffer(capacity int) int {
+	old := p.channel
+	ch := make(chan Item, capacity)
+	moved := 0
+move:
+	for {
+		select {
+		case item := <-old:
+			ch <- item
+			moved++
+		default:
+			break move
+		}
+	}
+	p.lag.rewatch(old, ch)
+	p.swapMu.Lock()
+	if p.retired == nil {
+		p.retired = make(map[<-chan Item]bool)
+	}
+	p.retired[old] = true
+	p.channel, p.input = ch, ch
+	p.swapMu.Unlock()
+	close(old)
+	return moved
+}
+
+// the buffer that replaced a consumer's when a resize closed it, or nil
+// when it was closed because the pipeline is finishing. It doesn't wait
+// for p.bufMu, which a resize may be waiting for along with a producer
+// that holds it until the consumers make room.
+func (p *Pipeline) replaced(ch <-chan Item) <-chan Item {
+	p.swapMu.Lock()
+	defer p.swapMu.Unlock()
+	if p.retired[ch] {
+		return p.channel
+	}
+	return nil
+}
+
+// the default pool's buffer, for a consumer starting on it
+func (p *Pipeline) defaultBuffer() chan Item {
+	p.swapMu.Lock()
+	defer p.swapMu.Unlock()
+	return p.channel
+}
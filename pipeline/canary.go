@@ -0,0 +1,233 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the pool the canary's share of the items goes to, and the event sent
+// when it is rolled back
+const (
+	canaryPool          = "canary"
+	EventCanaryRollback = "canary_rollback"
+)
+
+// canary sends -canary-percent of the items that would go to the default
+// pool to a pool of -canary-consumers running -canary-handler instead, so
+// a new handler can take a little of the live traffic, for real, before
+// it takes all of it. The error rate and handling time of both are kept
+// apart. Once the canary has handled -canary-min-items and failed on more
+// than -canary-max-error-rate of them it is rolled back: its share goes
+// to 0% and everything goes to the default pool again, with an event
+// sent to say so. The items already on its buffer are still handled by
+// it. The admin API sets the share again, which starts the judging over.
+type canary struct {
+	handler  Handler
+	hooks    *eventHooks
+	maxRate  float64
+	minItems int64
+
+	// the share in hundredths of a percent, and the items it has been
+	// applied to
+	share atomic.Int64
+	seen  atomic.Uint64
+
+	mu      sync.Mutex
+	arms    [2]canaryArm // the default pool's, then the canary's
+	judged  canaryCounts // the canary's since its share was last set
+	rolled  bool
+	because string
+}
+
+type canaryArm struct {
+	canaryCounts
+	took histogram
+}
+
+type canaryCounts struct {
+	handled, failed int64
+}
+
+// CanaryStatus is how the canary is doing, for the admin API
+type CanaryStatus struct {
+	Percent        float64     `json:"percent"`
+	RolledBack     bool        `json:"rolled_back,omitempty"`
+	RollbackReason string      `json:"rollback_reason,omitempty"`
+	Default        CanaryStats `json:"default"`
+	Canary         CanaryStats `json:"canary"`
+}
+
+// CanaryStats are the handling counts and times of one side of a canary
+type CanaryStats struct {
+	Handled   int64   `json:"handled"`
+	Failed    int64   `json:"failed"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       string  `json:"p50"`
+	P99       string  `json:"p99"`
+}
+
+func newCanary(cfg *Config, hooks *eventHooks) (*canary, error) {
+	if cfg.CanaryPercent < 0 || cfg.CanaryPercent > 100 {
+		return nil, fmt.Errorf("-canary-percent must be between 0 and 100")
+	}
+	if cfg.CanaryConsumers < 1 {
+		return nil, fmt.Errorf("-canary-consumers must be at least 1")
+	}
+	if cfg.CanaryMaxErrorRate < 0 || cfg.CanaryMaxErrorRate > 1 {
+		return nil, fmt.Errorf("-canary-max-error-rate must be between 0 and 1")
+	}
+	h, err := loadHandler(cfg.CanaryHandler, cfg.WasmRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("canary handler: %v", err)
+	}
+	if cfg.HandlerTimeout > 0 {
+		h = withTimeout(h, cfg.HandlerTimeout)
+	}
+	c := &canary{handler: h, hooks: hooks, maxRate: cfg.CanaryMaxErrorRate, minItems: int64(cfg.CanaryMinItems)}
+	c.share.Store(int64(math.Round(cfg.CanaryPercent * 100)))
+	return c, nil
+}
+
+// whether an item bound for the default pool goes to the canary instead,
+// spreading the canary's items out evenly rather than at random. Safe on
+// a nil canary.
+func (c *canary) pick(item *Item) bool {
+	if c == nil {
+		return false
+	}
+	share := uint64(c.share.Load())
+	if share == 0 {
+		return false
+	}
+	n := c.seen.Add(1)
+	if n*share/10000 == (n-1)*share/10000 {
+		return false
+	}
+	item.canary = true
+	return true
+}
+
+// the handler an item is handled by, which is the pipeline's own unless
+// the item was sent to the canary
+func (p *Pipeline) handlerFor(item *Item) Handler {
+	if item.canary && p.canary != nil {
+		return p.canary.handler
+	}
+	return p.handler
+}
+
+// count how an item's handling went, on the canary's side or the default
+// pool's, rolling the canary back when it fails too often. Safe on a nil
+// canary.
+func (c *canary) handled(item *Item, took time.Duration, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	arm := &c.arms[0]
+	if item.canary {
+		arm = &c.arms[1]
+	}
+	arm.handled++
+	arm.took.record(took)
+	if err != nil {
+		arm.failed++
+	}
+	if !item.canary {
+		c.mu.Unlock()
+		return
+	}
+	c.judged.handled++
+	if err != nil {
+		c.judged.failed++
+	}
+	j := c.judged
+	if c.rolled || j.handled < c.minItems || float64(j.failed)/float64(j.handled) <= c.maxRate {
+		c.mu.Unlock()
+		return
+	}
+	c.share.Store(0)
+	c.rolled = true
+	c.because = fmt.Sprintf("failed on %d of its %d items, over the %g error rate", j.failed, j.handled, c.maxRate)
+	because := c.because
+	c.mu.Unlock()
+
+	fmt.Printf("canary rolled back: %s\n", because)
+	c.hooks.emit(newEvent(EventCanaryRollback,
+		map[string]any{"handled": j.handled, "failed": j.failed, "max_error_rate": c.maxRate},
+		"canary rolled back: %s", because))
+}
+
+// give the canary a new share of the items, as after rolling it back or
+// to promote it, judging it afresh from here
+func (c *canary) setPercent(percent float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.share.Store(int64(math.Round(percent * 100)))
+	c.judged = canaryCounts{}
+	c.rolled = false
+	c.because = ""
+}
+
+func (c *canary) percent() float64 {
+	return float64(c.share.Load()) / 100
+}
+
+func (c *canary) status() *CanaryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CanaryStatus{
+		Percent:        c.percent(),
+		RolledBack:     c.rolled,
+		RollbackReason: c.because,
+		Default:        c.arms[0].stats(),
+		Canary:         c.arms[1].stats(),
+	}
+}
+
+// called with c.mu held
+func (a *canaryArm) stats() CanaryStats {
+	s := CanaryStats{
+		Handled: a.handled,
+		Failed:  a.failed,
+		P50:     a.took.quantile(0.5).String(),
+		P99:     a.took.quantile(0.99).String(),
+	}
+	if a.handled > 0 {
+		s.ErrorRate = float64(a.failed) / float64(a.handled)
+	}
+	return s
+}
+
+// the handling time at a quantile of the default pool, arm 0, or the
+// canary, arm 1, for /metrics
+func (c *canary) quantile(arm int, q float64) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.arms[arm].took.quantile(q)
+}
+
+func (c *canary) Close() error {
+	if cl, ok := c.handler.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+func (c *canary) printSummary(w io.Writer) {
+	st := c.status()
+	for _, arm := range []struct {
+		name string
+		s    CanaryStats
+	}{{defaultPool, st.Default}, {canaryPool, st.Canary}} {
+		fmt.Fprintf(w, "canary %s: %d items handled, %d failed (%.1f%%), p50 %s, p99 %s\n",
+			arm.name, arm.s.Handled, arm.s.Failed, arm.s.ErrorRate*100, arm.s.P50, arm.s.P99)
+	}
+	if st.RolledBack {
+		fmt.Fprintf(w, "canary rolled back: %s\n", st.RollbackReason)
+	}
+}
@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable is a Source that can report how far it has got as an opaque
+// resume token, and pick up again from a token after a restart
+type Resumable interface {
+	Source
+	Position() (string, error)
+	Resume(token string) error
+}
+
+// checkpointer persists the position of a resumable source so that a
+// restarted run carries on where the last one stopped instead of starting
+// over. The token saved is the source's position after the last item that
+// a consumer has finished with, counting only the run of items with nothing
+// unfinished before them, so a crash can repeat a few items but never skips
+// any.
+//
+// The checkpoint normally lives in a file, but it can be kept by a
+// TransactionalSink instead, which commits it along with the items.
+type checkpointer struct {
+	path     string
+	sink     TransactionalSink // keeps the checkpoint in place of the file
+	source   Resumable
+	interval time.Duration
+
+	// read serializes fetching an item with taking the position after it
+	read sync.Mutex
+
+	mu        sync.Mutex
+	nextSeq   int64
+	tokens    map[int64]string // position after each unfinished item
+	finished  map[int64]bool
+	committed int64 // every item up to and including this one is finished
+	token     string
+	saved     string
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// set up checkpointing for a source, resuming it from the checkpoint file
+// if there is one
+func newCheckpointer(path string, src Source, interval time.Duration) (*checkpointer, error) {
+	c, err := makeCheckpointer(src, interval)
+	if err != nil {
+		return nil, err
+	}
+	c.path = path
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, err
+	}
+	return c, c.resume(strings.TrimSpace(string(data)), path)
+}
+
+// set up checkpointing for a source into a sink, resuming the source from
+// the position the sink last committed
+func newSinkCheckpointer(sink TransactionalSink, src Source, interval time.Duration) (*checkpointer, error) {
+	c, err := makeCheckpointer(src, interval)
+	if err != nil {
+		return nil, err
+	}
+	c.sink = sink
+	token, err := sink.Committed()
+	if err != nil {
+		return nil, fmt.Errorf("reading the sink's checkpoint: %v", err)
+	}
+	if token == "" {
+		return c, nil
+	}
+	return c, c.resume(token, "the sink")
+}
+
+func makeCheckpointer(src Source, interval time.Duration) (*checkpointer, error) {
+	r, ok := src.(Resumable)
+	if !ok {
+		return nil, fmt.Errorf("-checkpoint needs a source that supports resume tokens")
+	}
+	return &checkpointer{
+		source:   r,
+		interval: interval,
+		tokens:   make(map[int64]string),
+		finished: make(map[int64]bool),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (c *checkpointer) resume(token, from string) error {
+	c.token = token
+	c.saved = token
+	if err := c.source.Resume(token); err != nil {
+		return fmt.Errorf("resuming from %s: %v", from, err)
+	}
+	fmt.Printf("resuming source from checkpoint %q\n", token)
+	return nil
+}
+
+// fetch the next item from the source, numbering it so that finish can
+// tell when everything before it is done
+func (c *checkpointer) next() (*Item, error) {
+	c.read.Lock()
+	defer c.read.Unlock()
+	item, err := c.source.Next()
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.source.Position()
+	if err != nil {
+		return nil, fmt.Errorf("getting source position: %v", err)
+	}
+	c.mu.Lock()
+	c.nextSeq++
+	item.seq = c.nextSeq
+	c.tokens[item.seq] = token
+	c.mu.Unlock()
+	return item, nil
+}
+
+// mark an item as finished with, moving the checkpoint on if it was the
+// oldest one outstanding
+func (c *checkpointer) finish(seq int64) {
+	if seq == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished[seq] = true
+	for c.finished[c.committed+1] {
+		c.committed++
+		c.token = c.tokens[c.committed]
+		delete(c.finished, c.committed)
+		delete(c.tokens, c.committed)
+	}
+}
+
+func (c *checkpointer) start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		t := time.NewTicker(c.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-t.C:
+				if err := c.save(); err != nil {
+					fmt.Printf("error saving checkpoint: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop the periodic saves and write the final position
+func (c *checkpointer) stop() {
+	close(c.done)
+	c.wg.Wait()
+	if err := c.save(); err != nil {
+		fmt.Printf("error saving checkpoint: %v\n", err)
+	}
+}
+
+// write the token if it has moved, going through a temporary file so that
+// a crash mid-write can't leave a truncated checkpoint behind
+func (c *checkpointer) save() error {
+	c.mu.Lock()
+	token, through := c.token, c.committed
+	c.mu.Unlock()
+	if token == c.saved {
+		return nil
+	}
+	if c.sink != nil {
+		if err := c.sink.Commit(through, token); err != nil {
+			return err
+		}
+		c.saved = token
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(token + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.saved = token
+	return nil
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"strings"
+	"sync/atomic"
+)
+
+// the metadata key an item's checksum goes in, as <algorithm>:<hex>
+const checksumKey = "checksum"
+
+// the algorithms -checksum can use
+const (
+	checksumSHA256 = "sha256"
+	checksumCRC32C = "crc32c" // quicker, but only good against accidents
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums put a checksum of each item's payload in its metadata as it
+// goes on a buffer, keeping one it came with, and check it when a consumer
+// takes the item and again before the sink writes what the handler made
+// of it, which is checksummed afresh. The checksum goes along with the
+// item through a -redis queue, an exec plugin or a file, so a pipeline
+// reading them checks what this one wrote. An item whose payload no longer
+// matches is dropped as corrupt, which dead-letters it unless -drop says
+// otherwise.
+type checksums struct {
+	algo string
+
+	// items checked and found sound, and found corrupt
+	sound, corrupt atomic.Int64
+}
+
+func newChecksums(cfg *Config) (*checksums, error) {
+	switch cfg.Checksum {
+	case checksumSHA256, checksumCRC32C:
+	default:
+		return nil, fmt.Errorf("unknown -checksum %q, expected %s or %s", cfg.Checksum, checksumSHA256, checksumCRC32C)
+	}
+	return &checksums{algo: cfg.Checksum}, nil
+}
+
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case checksumSHA256:
+		return sha256.New()
+	case checksumCRC32C:
+		return crc32.New(castagnoli)
+	}
+	return nil
+}
+
+// the checksum of a payload, as it goes in the metadata
+func checksumOf(algo string, payload []byte) string {
+	h := newChecksumHash(algo)
+	h.Write(payload)
+	return algo + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// give an item a checksum unless it has one, or a new one when fresh is
+// set, as for what a handler made of an item. Safe on nil, as are the rest.
+func (c *checksums) stamp(item *Item, fresh bool) {
+	if c == nil || (!fresh && item.Metadata[checksumKey] != "") {
+		return
+	}
+	// the metadata may be shared with the item it came from
+	md := maps.Clone(item.Metadata)
+	if md == nil {
+		md = make(map[string]string, 1)
+	}
+	md[checksumKey] = checksumOf(c.algo, item.Payload)
+	item.Metadata = md
+}
+
+// check an item's payload against its checksum, if it has one
+func (c *checksums) verify(item *Item) error {
+	if c == nil {
+		return nil
+	}
+	sum := item.Metadata[checksumKey]
+	if sum == "" {
+		return nil
+	}
+	algo, _, _ := strings.Cut(sum, ":")
+	if newChecksumHash(algo) == nil {
+		c.corrupt.Add(1)
+		return fmt.Errorf("checksum %q has an unknown algorithm", sum)
+	}
+	if got := checksumOf(algo, item.Payload); got != sum {
+		c.corrupt.Add(1)
+		return fmt.Errorf("payload checksum is %s, expected %s", got, sum)
+	}
+	c.sound.Add(1)
+	return nil
+}
+
+func (c *checksums) printSummary(w io.Writer) {
+	fmt.Fprintf(w, "checksums: %d payloads checked sound, %d corrupt\n", c.sound.Load(), c.corrupt.Load())
+}
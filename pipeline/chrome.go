@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chromeEvent is one entry of the Chrome trace_event format, which
+// chrome://tracing and ui.perfetto.dev both open
+type chromeEvent struct {
+	Name  string         `json:"name"`
+	Cat   string         `json:"cat,omitempty"`
+	Phase string         `json:"ph"`
+	TS    float64        `json:"ts"` // microseconds
+	Dur   float64        `json:"dur,omitempty"`
+	PID   int            `json:"pid"`
+	TID   int            `json:"tid"`
+	ID    string         `json:"id,omitempty"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// the processes the tracks are grouped into
+const (
+	chromeProducers = 1
+	chromeConsumers = 2
+	chromeBuffer    = 3
+)
+
+func chromeMain(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("trace chrome", flag.ContinueOnError)
+	fs.SetOutput(out)
+	to := fs.String("o", "", "file to write the json to (default the trace's name with .json)")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(out, "trace chrome needs a trace file")
+		return 2
+	}
+	path := fs.Arg(0)
+	if *to == "" {
+		*to = strings.TrimSuffix(path, ".trace") + ".json"
+	}
+	start, records, err := readTrace(path)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	f, err := os.Create(*to)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	w := bufio.NewWriter(f)
+	n, err := writeChrome(w, start, records)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(out, "error writing %s: %v\n", *to, err)
+		return 1
+	}
+	fmt.Fprintf(out, "wrote %d events to %s, open it in chrome://tracing or ui.perfetto.dev\n", n, *to)
+	return 0
+}
+
+// write a trace as trace_event json, returning how many events it came
+// to. Each producer and consumer gets a track: producers show an instant
+// for each item they enqueue, consumers a slice for each item they handle
+// with its ack or nack, and the time items spend queued shows as async
+// slices under the buffer.
+func writeChrome(w io.Writer, start time.Time, records []traceRecord) (int, error) {
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	var events []chromeEvent
+	producers, consumers := map[int]bool{}, map[int]bool{}
+	enqueued := map[uint64]time.Duration{}
+	started := map[uint64]time.Duration{}
+	handledBy := map[uint64]int{} // the consumer that last had each item
+	for _, rec := range records {
+		item := fmt.Sprintf("item %d", rec.item)
+		id := fmt.Sprint(rec.item)
+		switch rec.kind {
+		case traceEnqueue:
+			producers[rec.worker] = true
+			enqueued[rec.item] = rec.at
+			events = append(events, chromeEvent{Name: item, Cat: "enqueue", Phase: "i", Scope: "t",
+				TS: us(rec.at), PID: chromeProducers, TID: rec.worker})
+		case traceDequeue:
+			consumers[rec.worker] = true
+			handledBy[rec.item] = rec.worker
+			if at, ok := enqueued[rec.item]; ok {
+				delete(enqueued, rec.item)
+				events = append(events,
+					chromeEvent{Name: "queued", Cat: "buffer", Phase: "b", ID: id, TS: us(at), PID: chromeBuffer,
+						Args: map[string]any{"item": rec.item}},
+					chromeEvent{Name: "queued", Cat: "buffer", Phase: "e", ID: id, TS: us(rec.at), PID: chromeBuffer})
+			}
+		case traceStart:
+			started[rec.item] = rec.at
+		case traceEnd:
+			if at, ok := started[rec.item]; ok {
+				delete(started, rec.item)
+				events = append(events, chromeEvent{Name: item, Cat: "handle", Phase: "X",
+					TS: us(at), Dur: us(rec.at - at), PID: chromeConsumers, TID: rec.worker})
+			}
+		case traceAck, traceNack, traceRetry:
+			// acks and nacks don't say which worker they were on, so they
+			// go on the track of the consumer that had the item, or the
+			// producer when it never reached one
+			e := chromeEvent{Name: traceKindNames[rec.kind] + " " + item, Cat: traceKindNames[rec.kind],
+				Phase: "i", Scope: "t", TS: us(rec.at), PID: chromeConsumers}
+			if c, ok := handledBy[rec.item]; ok {
+				e.TID = c
+			} else {
+				e.PID = chromeProducers
+			}
+			if rec.kind == traceNack && int(rec.why) < len(nackNames) {
+				e.Args = map[string]any{"why": nackNames[rec.why]}
+			}
+			if rec.kind == traceAck {
+				delete(handledBy, rec.item)
+			}
+			events = append(events, e)
+		}
+	}
+
+	// name the processes and threads so the tracks read as workers
+	meta := []chromeEvent{
+		{Name: "process_name", Phase: "M", PID: chromeProducers, Args: map[string]any{"name": "producers"}},
+		{Name: "process_name", Phase: "M", PID: chromeConsumers, Args: map[string]any{"name": "consumers"}},
+		{Name: "process_name", Phase: "M", PID: chromeBuffer, Args: map[string]any{"name": "buffer"}},
+	}
+	for _, pool := range []struct {
+		pid     int
+		role    string
+		workers map[int]bool
+	}{{chromeProducers, "producer", producers}, {chromeConsumers, "consumer", consumers}} {
+		ids := make([]int, 0, len(pool.workers))
+		for id := range pool.workers {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			meta = append(meta, chromeEvent{Name: "thread_name", Phase: "M", PID: pool.pid, TID: id,
+				Args: map[string]any{"name": fmt.Sprintf("%s %d", pool.role, id)}})
+		}
+	}
+	events = append(meta, events...)
+
+	// one event a line, so big traces stay easy to look through
+	if _, err := fmt.Fprintf(w, "{\"displayTimeUnit\":\"ms\",\"otherData\":{\"start\":%q},\"traceEvents\":[\n",
+		start.Format(time.RFC3339Nano)); err != nil {
+		return 0, err
+	}
+	for i, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		sep := ",\n"
+		if i == len(events)-1 {
+			sep = "\n"
+		}
+		if _, err := fmt.Fprintf(w, "%s%s", b, sep); err != nil {
+			return 0, err
+		}
+	}
+	_, err := io.WriteString(w, "]}\n")
+	return len(events), err
+}
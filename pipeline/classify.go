@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrorClass is the kind of failure a handler or sink error is, which
+// decides what becomes of the item
+type ErrorClass string
+
+const (
+	ClassTransient ErrorClass = "transient"     // may well work if tried again
+	ClassThrottled ErrorClass = "throttled"     // tried too often, try again more slowly
+	ClassPermanent ErrorClass = "permanent"     // won't ever work
+	ClassInvalid   ErrorClass = "invalid-input" // the item itself is at fault
+)
+
+var errorClasses = []ErrorClass{ClassTransient, ClassThrottled, ClassPermanent, ClassInvalid}
+
+// what is done with an item whose error is of a class
+const (
+	classRetry = "retry" // try again, up to -retries times, then dead-letter
+	classDLQ   = "dlq"   // dead-letter it straight away
+	classFail  = "fail"  // count it as failed, as unclassified errors are
+)
+
+// ErrorClassifier sorts errors into classes. Classify returns "" for an
+// error it can't place, which is then counted as failed without being
+// retried or dead-lettered, as every error was before there were classes.
+type ErrorClassifier interface {
+	Classify(err error) ErrorClass
+}
+
+// ClassedError is an error that knows its own class, for handlers built
+// into the program to return
+type ClassedError interface {
+	error
+	ErrorClass() ErrorClass
+}
+
+// errorPolicy classifies errors and says what to do about each class.
+// Errors that carry a class go by it, and the rest by the -error-class
+// rules matched against the message, which is all the exec and wasm
+// handlers have to go on.
+type errorPolicy struct {
+	rules   []classRule
+	actions map[ErrorClass]string
+	retries int
+	backoff time.Duration
+}
+
+type classRule struct {
+	class ErrorClass
+	re    *regexp.Regexp
+}
+
+func newErrorPolicy(cfg *Config) (*errorPolicy, error) {
+	e := &errorPolicy{
+		actions: map[ErrorClass]string{
+			ClassTransient: classRetry, ClassThrottled: classRetry,
+			ClassPermanent: classDLQ, ClassInvalid: classDLQ,
+		},
+		retries: cfg.Retries,
+		backoff: cfg.RetryBackoff,
+	}
+	for _, rule := range cfg.ErrorClasses {
+		class, pattern, ok := strings.Cut(rule, ":")
+		if !ok || !knownClass(ErrorClass(class)) {
+			return nil, fmt.Errorf("-error-class %q: expected <class>:<regexp> with a class of %s", rule, joinClasses())
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("-error-class %q: %v", rule, err)
+		}
+		e.rules = append(e.rules, classRule{ErrorClass(class), re})
+	}
+	if cfg.ErrorPolicy != "" {
+		for _, rule := range strings.Split(cfg.ErrorPolicy, ",") {
+			class, action, ok := strings.Cut(strings.TrimSpace(rule), "=")
+			if !ok || (action != classRetry && action != classDLQ && action != classFail) {
+				return nil, fmt.Errorf("error policy %q: expected <class>=retry, dlq or fail", rule)
+			}
+			if !knownClass(ErrorClass(class)) {
+				return nil, fmt.Errorf("error policy %q: unknown class, expected one of %s", rule, joinClasses())
+			}
+			e.actions[ErrorClass(class)] = action
+		}
+	}
+	return e, nil
+}
+
+func knownClass(c ErrorClass) bool {
+	for _, known := range errorClasses {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+func joinClasses() string {
+	names := make([]string, len(errorClasses))
+	for i, c := range errorClasses {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ", ")
+}
+
+// the class of an error, "" if nothing can place it
+func (e *errorPolicy) classify(err error) ErrorClass {
+	var classed ClassedError
+	if errors.As(err, &classed) {
+		return classed.ErrorClass()
+	}
+	msg := err.Error()
+	for _, r := range e.rules {
+		if r.re.MatchString(msg) {
+			return r.class
+		}
+	}
+	return ""
+}
+
+// the class of an error, asking the pipeline's Classifier first
+func (p *Pipeline) classify(err error) ErrorClass {
+	if p.Classifier != nil {
+		if c := p.Classifier.Classify(err); c != "" {
+			return c
+		}
+	}
+	return p.errs.classify(err)
+}
+
+// run fn for an item on a consumer, trying it again while it fails with an
+// error whose class is retried. Throttled errors wait four times as long.
+// The wait doubles each attempt.
+func (p *Pipeline) retry(item *Item, worker int, fn func() error) error {
+	e := p.errs
+	err := fn()
+	for attempt := 0; err != nil && attempt < e.retries; attempt++ {
+		class := p.classify(err)
+		if e.actions[class] != classRetry {
+			break
+		}
+		wait := e.backoff << attempt
+		if class == ClassThrottled {
+			wait *= 4
+		}
+		time.Sleep(wait)
+		p.stats.recordRetry()
+		p.trace.record(traceRetry, item, worker)
+		err = fn()
+	}
+	return err
+}
+
+// what to do with an item whose error is of class, once any retries are
+// used up. Items given up on after retrying are dead-lettered.
+func (e *errorPolicy) action(class ErrorClass) string {
+	switch a := e.actions[class]; a {
+	case classRetry:
+		return classDLQ
+	case "":
+		return classFail
+	default:
+		return a
+	}
+}
+
+// format per-class error counts for the summary
+func formatClasses(counts map[ErrorClass]int64) string {
+	classes := make([]string, 0, len(counts))
+	for c := range counts {
+		classes = append(classes, string(c))
+	}
+	sort.Strings(classes)
+	parts := make([]string, len(classes))
+	for i, c := range classes {
+		parts[i] = fmt.Sprintf("%s %d", c, counts[ErrorClass(c)])
+	}
+	return strings.Join(parts, ", ")
+}
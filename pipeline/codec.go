@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// the output formats the file and s3 sinks can write
+const (
+	formatNDJSON  = "ndjson"
+	formatParquet = "parquet"
+)
+
+// itemEncoder writes items to a stream in some file format. Close writes
+// anything the format needs at the end, but doesn't close the stream.
+type itemEncoder interface {
+	Encode(item *Item) error
+	Close() error
+}
+
+// start encoding items to w in the named format
+func newItemEncoder(format string, w io.Writer) (itemEncoder, error) {
+	switch format {
+	case formatNDJSON:
+		return &ndjsonEncoder{enc: json.NewEncoder(w)}, nil
+	case formatParquet:
+		return newParquetEncoder(w), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, expected ndjson or parquet", format)
+}
+
+// ndjsonEncoder writes one json encoded item per line
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) Encode(item *Item) error {
+	return e.enc.Encode(item)
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// compressor shrinks the payloads of more than -compress-above bytes
+// while their items wait on a buffer, and gives them back as they were
+// once a consumer takes them, before anything else looks at them. It
+// trades the CPU for both for the memory of buffers full of big payloads,
+// and the byte budget counts what the items take compressed.
+type compressor struct {
+	above   int
+	writers sync.Pool
+
+	// payloads compressed, their bytes before and after, and those that
+	// came out no smaller so were left alone
+	packed, in, out, kept atomic.Int64
+}
+
+func newCompressor(cfg *Config) (*compressor, error) {
+	if cfg.Redis != "" {
+		return nil, fmt.Errorf("-compress-above doesn't work with -redis, which sends the items on as they are")
+	}
+	return &compressor{above: int(cfg.CompressAbove)}, nil
+}
+
+// compress a queued item's payload if it is big enough and gets smaller.
+// Safe on a nil compressor.
+func (c *compressor) pack(item *Item) {
+	if c == nil || len(item.Payload) <= c.above {
+		return
+	}
+	var buf bytes.Buffer
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	} else {
+		w.Reset(&buf)
+	}
+	w.Write(item.Payload)
+	w.Close()
+	c.writers.Put(w)
+	if buf.Len() >= len(item.Payload) {
+		c.kept.Add(1)
+		return
+	}
+	c.packed.Add(1)
+	c.in.Add(int64(len(item.Payload)))
+	c.out.Add(int64(buf.Len()))
+	item.packed = buf.Bytes()
+	item.Payload = nil
+	// a payload handed over with OwnPayload isn't needed any more
+	item.releasePayload()
+}
+
+// give an item taken off a buffer its payload back
+func unpack(item *Item) error {
+	if item.packed == nil {
+		return nil
+	}
+	r := flate.NewReader(bytes.NewReader(item.packed))
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error decompressing the payload of item %d: %v", item.ID, err)
+	}
+	item.Payload = json.RawMessage(b)
+	item.packed = nil
+	return nil
+}
+
+// unpack an item a consumer took, dropping it as invalid if it can't be,
+// reporting whether it can be handled
+func (p *Pipeline) unpacked(item *Item) bool {
+	if err := unpack(item); err != nil {
+		p.drops.drop(*item, DropInvalid, err.Error())
+		p.settle(item)
+		return false
+	}
+	return true
+}
+
+func (c *compressor) printSummary(w io.Writer) {
+	in, out := c.in.Load(), c.out.Load()
+	ratio := 0.0
+	if in > 0 {
+		ratio = float64(out) / float64(in) * 100
+	}
+	fmt.Fprintf(w, "compression: %d payloads over %s compressed from %s to %s (%.1f%%), %d left alone as they didn't shrink\n",
+		c.packed.Load(), formatBytes(int64(c.above)), formatBytes(in), formatBytes(out), ratio, c.kept.Load())
+}
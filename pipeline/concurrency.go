@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the stages -concurrency can limit
+const (
+	stageHandle = "handle"
+	stageSink   = "sink"
+)
+
+// weightedSem caps how much of a stage runs at once across every consumer
+// and pool, however many goroutines there are: -concurrency handle=8 lets
+// at most 8 handler calls run together even with 64 consumers. An
+// acquisition can weigh more than one, so with -handler-weight a handler
+// that fans each item out into sub-work can be charged for all of it.
+// Waiters are served in order, so a heavy item isn't passed over for
+// ever by light ones, and one heavier than the whole limit gets it all.
+type weightedSem struct {
+	stage string
+	limit int64
+
+	mu      sync.Mutex
+	used    int64
+	waiters []semWaiter
+	// for the summary
+	peak     int64
+	acquired int64
+	waited   time.Duration
+}
+
+type semWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// stageLimits are the -concurrency semaphores by stage, with the
+// -handler-weight expression
+type stageLimits struct {
+	byStage map[string]*weightedSem
+	weight  *expr
+}
+
+func newStageLimits(cfg *Config) (*stageLimits, error) {
+	l := &stageLimits{byStage: make(map[string]*weightedSem)}
+	for _, s := range cfg.Concurrency {
+		stage, n, ok := strings.Cut(s, "=")
+		stage = strings.TrimSpace(stage)
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if !ok || err != nil || limit < 1 {
+			return nil, fmt.Errorf("concurrency %q: expected <stage>=<limit> with a positive limit", s)
+		}
+		if stage != stageHandle && stage != stageSink {
+			return nil, fmt.Errorf("concurrency %q: unknown stage %s, expected %s or %s", s, stage, stageHandle, stageSink)
+		}
+		l.byStage[stage] = &weightedSem{stage: stage, limit: int64(limit)}
+	}
+	if cfg.HandlerWeight != "" {
+		if l.byStage[stageHandle] == nil {
+			return nil, fmt.Errorf("-handler-weight needs a -concurrency %s=<limit> to count against", stageHandle)
+		}
+		var err error
+		if l.weight, err = compileExpr(cfg.HandlerWeight); err != nil {
+			return nil, fmt.Errorf("-handler-weight: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// take a stage's share for an item, returning what gives it back. Safe on
+// nil limits, and for stages without a limit.
+func (l *stageLimits) acquire(stage string, item *Item) func() {
+	if l == nil || l.byStage[stage] == nil {
+		return func() {}
+	}
+	s := l.byStage[stage]
+	n := int64(1)
+	if stage == stageHandle && l.weight != nil && item != nil {
+		v, err := l.weight.eval(item)
+		if f, ok := toNumber(v); err == nil && ok && f > 1 {
+			n = int64(f)
+		}
+	}
+	n = min(n, s.limit)
+	s.acquire(n)
+	return func() { s.release(n) }
+}
+
+func (s *weightedSem) acquire(n int64) {
+	s.mu.Lock()
+	s.acquired++
+	if len(s.waiters) == 0 && s.used+n <= s.limit {
+		s.take(n)
+		s.mu.Unlock()
+		return
+	}
+	w := semWaiter{n: n, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+	start := time.Now()
+	<-w.ready
+	s.mu.Lock()
+	s.waited += time.Since(start)
+	s.mu.Unlock()
+}
+
+// called with s.mu held
+func (s *weightedSem) take(n int64) {
+	s.used += n
+	s.peak = max(s.peak, s.used)
+}
+
+func (s *weightedSem) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	for len(s.waiters) > 0 && s.used+s.waiters[0].n <= s.limit {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.take(w.n)
+		close(w.ready)
+	}
+}
+
+// how much of the limit is taken now
+func (s *weightedSem) inUse() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// the limited stages, in order
+func (l *stageLimits) stages() []*weightedSem {
+	var sems []*weightedSem
+	for _, s := range l.byStage {
+		sems = append(sems, s)
+	}
+	sort.Slice(sems, func(i, j int) bool { return sems[i].stage < sems[j].stage })
+	return sems
+}
+
+func (l *stageLimits) printSummary(w io.Writer) {
+	for _, s := range l.stages() {
+		s.mu.Lock()
+		fmt.Fprintf(w, "concurrency %s: at most %d of %d in use, waited %s over %d acquisitions\n",
+			s.stage, s.peak, s.limit, s.waited.Round(time.Millisecond), s.acquired)
+		s.mu.Unlock()
+	}
+}
+
+// write an item to a sink, within the sink stage's limit when the sink is
+// one that does the writing rather than one of the pipeline's own that
+// hands it on: the router, a write-behind buffer or the ordered writers.
+// Those take the limit where they write, so it is never taken twice, which
+// could leave every holder waiting on another.
+func (l *stageLimits) write(s Sink, item *Item) error {
+	switch s.(type) {
+	case *sinkRouter, *writeBehind, *orderedSink:
+		return s.Write(item)
+	}
+	defer l.acquire(stageSink, item)()
+	return s.Write(item)
+}
+
+// write a batch within the sink stage's limit, as one write
+func (l *stageLimits) writeBatch(s BatchSink, items []Item) error {
+	defer l.acquire(stageSink, nil)()
+	return s.WriteBatch(items)
+}
@@ -0,0 +1,749 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config holds the knobs for a run. The defaults reproduce the original
+// hardcoded sample: three producers making 20 items each, six consumers
+// sleeping a second per item, and a channel that holds 10 items.
+type Config struct {
+	// Name identifies the pipeline in the admin API
+	Name string
+	// ConfigFile is a file of flags read before the command line's, and
+	// read again on SIGHUP, see configfile.go
+	ConfigFile string
+	// Preset names a bundle of flags set before the file's and the
+	// command line's, see preset.go
+	Preset string
+	// Verbose logs every item as it is produced and consumed, and can be
+	// switched with SIGUSR2
+	Verbose bool
+	// DrainTimeout is how long a drain started by SIGINT or SIGTERM may
+	// take before the process exits anyway, 0 for as long as it takes
+	DrainTimeout time.Duration
+	// Salvage is a file the items an aborted drain leaves unhandled are
+	// written to, in the dlq's format
+	Salvage string
+	// RunID identifies this particular run, e.g. in object keys. It is
+	// random unless given.
+	RunID     string
+	Producers int
+	Consumers int
+	// AutoProducers and AutoConsumers, set by giving auto as the count,
+	// size the pools from GOMAXPROCS and how CPU bound the handling is,
+	// looking again every AutoInterval, with at most AutoMax consumers
+	AutoProducers    bool
+	AutoConsumers    bool
+	AutoInterval     time.Duration
+	AutoMax          int
+	ItemsPerProducer int
+	BufferSize       int
+	ConsumeDelay     time.Duration
+	// BufferBytes, when set, also bounds the buffers by the total size of
+	// the items in them. ContainerLimits sets it from the container's
+	// cgroup by default, and the command GOMAXPROCS too, see container.go.
+	BufferBytes     byteSize
+	ContainerLimits bool
+	// CompressAbove, when set, has payloads bigger than it compressed
+	// while they wait on the buffers
+	CompressAbove byteSize
+	// Checksum is the algorithm items' payloads are checksummed with
+	// to catch them being corrupted on the way, sha256 or crc32c
+	Checksum string
+	// MemoryLimit, when set, is the memory use, as MemoryMeasure measures
+	// it every MemoryInterval, past which items matching MemoryShed are
+	// dropped and producers are held back
+	MemoryLimit    byteSize
+	MemoryMeasure  string
+	MemoryInterval time.Duration
+	MemoryShed     string
+	// StrictMemory sets aside the memory for the items when the pipeline
+	// starts and holds it there, with the buffers bound by BufferBytes and
+	// payloads by PayloadMax, see strict.go
+	StrictMemory bool
+	PayloadMax   byteSize
+	// LagMaxItems and LagMaxAge, when set, are how many items may wait for
+	// a consumer group and how long its oldest may have waited before the
+	// group counts as behind and a consumer_lag event is sent
+	LagMaxItems int
+	LagMaxAge   time.Duration
+	// WatermarkHigh and WatermarkLow, when the high one is set, are the
+	// shares of the buffer it counts as filled up and drained at, and
+	// WatermarkAction what happens when it does: pause and scale, adding
+	// WatermarkScale consumers
+	WatermarkHigh   float64
+	WatermarkLow    float64
+	WatermarkAction string
+	WatermarkScale  int
+	// BufferFull is what producers do when their buffer has no room: block,
+	// drop the new item or drop the oldest queued one. TTL, when set, drops
+	// items that have waited longer than it by the time a consumer gets to
+	// them.
+	BufferFull string
+	TTL        time.Duration
+	// EvictAfter, when set, has the items on the buffers checked as they
+	// wait, evicting those older than it before a consumer gets to them
+	EvictAfter time.Duration
+	// Prefetch is how many items each consumer takes off its buffer ahead
+	// of handling them
+	Prefetch int
+	// BufferShards splits the default pool's buffer into this many
+	// channels, for less contention between many producers and consumers
+	BufferShards int
+	// FairTopics splits the default pool's buffer into a queue for each
+	// topic, by FairKey or the item's topic metadata, that its consumers
+	// take from in turn, round-robin or deficit, so one topic's flood
+	// can't starve the rest. FairWeights give topics bigger turns, as
+	// <topic>=<weight>, FairQuantum is the bytes a turn of weight 1 is
+	// worth with deficit, and past FairMaxTopics topics the rest share a
+	// queue.
+	FairTopics    string
+	FairKey       string
+	FairWeights   stringList
+	FairQuantum   byteSize
+	FairMaxTopics int
+	// ConsumerSpin is how long a consumer polls its buffer for the next
+	// item before it blocks on it
+	ConsumerSpin time.Duration
+	// ItemArena, in a binary built with GOEXPERIMENT=arenas, is how many
+	// items each built-in producer makes in an arena before freeing it
+	ItemArena int
+	// Batch, when set, makes consumers write to the sink in batches of up
+	// to that many items, or with auto of a size that adapts between 1
+	// and BatchMax to keep each write within BatchLatency
+	Batch        string
+	BatchMax     int
+	BatchLatency time.Duration
+	// Drops sets what the drop policy does for each reason an item can be
+	// discarded, as reason=drop or reason=dlq pairs, and dropped items are
+	// written to DropLog when it's set
+	Drops   string
+	DropLog string
+	// Rate is the aggregate number of items per second that all of the
+	// producers together should hit. Zero means produce as fast as the
+	// channel allows.
+	Rate float64
+	// Simulate models the run instead of doing it, on a virtual clock, so
+	// sleeps and the rate cost nothing. SimulateDelays is fixed, for every
+	// item to take ConsumeDelay, or exponential, for them to take that on
+	// average.
+	Simulate       bool
+	SimulateDelays string
+	// DryRun prints the plan of the run the flags describe instead of
+	// doing it, see dryrun.go
+	DryRun bool
+	// SkipPreflight starts without first checking that the files, commands
+	// and hosts the other flags name are there, see preflight.go
+	SkipPreflight bool
+	// SchemaVersion, when set, makes the built-in producers attach a
+	// payload of that version of the "reading" schema
+	SchemaVersion int
+	// PayloadSize gives the built-in producers' items payloads of sizes
+	// drawn as it says, filled with PayloadFill, see payloadgen.go
+	PayloadSize string
+	PayloadFill string
+	// CheckSequence numbers the built-in producers' items and has the
+	// consumers report gaps, duplicates and reordering in the numbers
+	CheckSequence bool
+	// Provenance has each handled item's Result say which handler had
+	// it, on which consumer, when, for how long and in how many attempts
+	Provenance bool
+	// DedupWindow, when set, is how long an item's IdempotencyKey is
+	// remembered for, dropping any item produced with it again as a
+	// duplicate. The built-in producers give their items keys of their own.
+	DedupWindow time.Duration
+	// ErrorLogFirst errors are printed, and after that one in every
+	// ErrorLogEvery, so errors in bulk don't flood the output
+	ErrorLogFirst int
+	ErrorLogEvery int
+	// ErrorClasses sort handler and sink errors into classes by their
+	// message, each as <class>:<regexp>, and ErrorPolicy says what each
+	// class gets, as class=retry, dlq or fail pairs. Retried errors are
+	// tried Retries more times, waiting RetryBackoff and then twice as
+	// long each time.
+	ErrorClasses stringList
+	ErrorPolicy  string
+	Retries      int
+	RetryBackoff time.Duration
+	// ConsumerPauseAfter, when set, is how many items in a row a consumer
+	// may fail before it pauses itself for ConsumerPauseFor
+	ConsumerPauseAfter int
+	ConsumerPauseFor   time.Duration
+	// MetricsKey is an expression, such as Metadata.mqtt_topic, the
+	// consumers' counts on /metrics are broken down by, for at most
+	// MetricsMaxKeys different values before the rest count as other
+	MetricsKey     string
+	MetricsMaxKeys int
+	// RecordProduced, if set, is a file every item the producers make is
+	// written to as json lines, for the verify subcommand to check the
+	// sink's output against
+	RecordProduced string
+	// Golden is a file of what a seeded run hands its sink, recorded there
+	// with GoldenUpdate, in the order written with GoldenOrdered, and
+	// otherwise checked against, see golden.go
+	Golden        string
+	GoldenUpdate  bool
+	GoldenOrdered bool
+	// DLQ is a file that dead-lettered items are appended to, and
+	// DLQAlert the dead-letter count that fires a dlq_threshold event
+	DLQ      string
+	DLQAlert int64
+	// Filter is an expression such as `ID > 50 && ProducerID != 2`; items
+	// it doesn't match are dropped by the consumers
+	Filter string
+	// Routes send matching items to named consumer pools instead of the
+	// default one, each given as <pool>:<expression>. Pools sets how many
+	// consumers a pool gets, as <pool>=<consumers>.
+	Routes stringList
+	Pools  stringList
+	// ProducerLanes, when set, gives each built-in producer a channel of
+	// this many items of its own, which a stage for each buffer merges onto
+	// it as Merge says, fair or priority
+	ProducerLanes int
+	Merge         string
+	// JoinSource is a second stream of items, loaded like Source, that
+	// items are joined with when their JoinKey expressions are equal.
+	// Items wait up to JoinWindow for a match; JoinType is inner or left
+	// and JoinLate says whether join source items that turn up after
+	// their match gave up are dropped or dead-lettered.
+	JoinSource string
+	JoinKey    string
+	JoinWindow time.Duration
+	JoinType   string
+	JoinLate   string
+	// Source, Handler and Sink load extensions at runtime, given as
+	// plugin:<file.so> or exec:<command line>. Handlers may also be
+	// wasm:<file.wasm> or starlark:<file.star>
+	Source  string
+	Handler string
+	Sink    string
+	// HandlerTimeout gives up on a handler call, the canary's too, that
+	// takes longer, failing it with ErrHandlerTimeout
+	HandlerTimeout time.Duration
+	// NamedSinks are more sinks, each as <name>=<sink>, that SinkRoutes
+	// send items to by the Status in their Result, as
+	// <status>=<sink>[,<sink>...]
+	NamedSinks stringList
+	SinkRoutes stringList
+	// WriteBehind buffers the writes to sinks, each as
+	// <sink>=<items>[,<interval>], with default naming the -sink
+	WriteBehind stringList
+	// SinkOrderKey, when set, has SinkWriters goroutines write to the sink,
+	// keeping the writes for items whose key comes out the same in order
+	SinkOrderKey string
+	SinkWriters  int
+	// Concurrency caps how many handler calls, or sink writes, run at once
+	// across all the consumers, as handle=<limit> or sink=<limit>, and
+	// HandlerWeight is an expression giving how much of the handle limit
+	// an item's handling takes
+	Concurrency   stringList
+	HandlerWeight string
+	// ShadowHandler, loaded like Handler, is tried on every item the
+	// handler handles by ShadowWorkers goroutines of its own, with up to
+	// ShadowBuffer items waiting for them, and where what it does
+	// differently is written to ShadowLog
+	ShadowHandler string
+	ShadowWorkers int
+	ShadowBuffer  int
+	ShadowLog     string
+	// CanaryHandler, loaded like Handler, handles CanaryPercent of the
+	// items bound for the default pool on CanaryConsumers consumers of its
+	// own, until it has failed on more than CanaryMaxErrorRate of at least
+	// CanaryMinItems items
+	CanaryHandler      string
+	CanaryPercent      float64
+	CanaryConsumers    int
+	CanaryMaxErrorRate float64
+	CanaryMinItems     int
+	// the query paged through by a sql:<driver>:<dsn> source, the column
+	// it is paged on, the rows per page, and how often to poll for new
+	// rows once caught up, zero meaning stop instead
+	SQLQuery string
+	SQLKey   string
+	SQLBatch int
+	SQLTail  time.Duration
+	// SQLTable is the table a sql sink inserts into, and SQLOffsets the
+	// table it keeps the checkpoint in with -checkpoint-in-sink
+	SQLTable   string
+	SQLOffsets string
+	// Redis, a redis://[:password@]host[:port][/db] url, puts a redis list
+	// or stream named RedisKey between the producers and consumers so that
+	// several processes can share it. In stream mode they read it as the
+	// consumer group RedisGroup, each under its own RedisConsumer name.
+	// The consumers stop once redis has been empty for RedisIdle after the
+	// local producers have finished.
+	Redis         string
+	RedisKey      string
+	RedisMode     string
+	RedisGroup    string
+	RedisConsumer string
+	RedisIdle     time.Duration
+	// RedisDownstream is how many consumer processes each process sends an
+	// end-of-stream marker to once its producers are done, and a process
+	// with RedisUpstream set stops consuming once it has had markers from
+	// that many processes rather than after RedisIdle
+	RedisDownstream int
+	RedisUpstream   int
+	// settings for an mqtt:<host>[:port] source or sink: the topic filter
+	// subscribed to, the topic published to, the QoS used for both, the
+	// client id, which makes the source's session persistent, and how long
+	// the source waits for a message before stopping, zero meaning forever.
+	// MQTTUser logs in with the password in $MQTT_PASSWORD.
+	MQTTSubscribe string
+	MQTTPublish   string
+	MQTTQoS       int
+	MQTTClientID  string
+	MQTTIdle      time.Duration
+	MQTTUser      string
+	MQTTTLS       bool
+	// SinkFormat is what the file and s3 sinks write, ndjson or parquet
+	SinkFormat string
+	// settings for an s3:<bucket> sink: the endpoint of an S3 compatible
+	// store, empty meaning AWS itself, the region, a text/template for
+	// object keys, and when to start a new object. Objects bigger than
+	// S3PartSize are uploaded in parts of that size.
+	S3Endpoint      string
+	S3Region        string
+	S3Key           string
+	S3PartSize      int
+	S3ObjectSize    int64
+	S3FlushInterval time.Duration
+	// Checkpoint is a file the source's resume token is saved to every
+	// CheckpointInterval, so that a restarted run resumes from it
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	// CheckpointInSink keeps the checkpoint in the sink instead, committed
+	// in the same transaction as the items, for sinks that can
+	CheckpointInSink bool
+	// Backfill is a progress file that turns on backfill mode, for sources
+	// far bigger than memory: it is used as the checkpoint, failed items
+	// are kept on disk next to it and retried BackfillRetries times at the
+	// end, and progress is reported every BackfillReport
+	Backfill        string
+	BackfillRetries int
+	BackfillReport  time.Duration
+	// Shard, as <index>/<count>, makes this run one of several that split
+	// the source between them. ShardDir finds the index and count instead
+	// by joining the group of runs sharing that directory, which waits
+	// ShardSettle for the others to start. Sources that can't split
+	// themselves are shared out item by item on ShardKey.
+	Shard       string
+	ShardDir    string
+	ShardKey    string
+	ShardSettle time.Duration
+	// Lock is an extra lock file to hold for the run, on top of those
+	// guarding the checkpoint, dlq and file sink. With Standby a run that
+	// finds them held waits to take over instead of failing.
+	Lock    string
+	Standby bool
+	// WasmRuntime is the WASI runtime used to run wasm:<file> handlers
+	WasmRuntime string
+	// SLOs are latency objectives checked every SLOWindow, e.g. p99<200ms
+	SLOs      sloList
+	SLOWindow time.Duration
+	// Webhooks receive pipeline events, optionally filtered to the comma
+	// separated WebhookEvents, rendered with WebhookTemplate and signed
+	// with WebhookSecret
+	Webhooks        stringList
+	WebhookEvents   string
+	WebhookTemplate string
+	WebhookSecret   string
+	WebhookRetries  int
+	// Admin is the listen address of the admin API, which is off unless
+	// set. AdminAuth picks how clients authenticate: with AdminToken as a
+	// bearer token, with a client certificate, or not at all.
+	Admin      string
+	AdminToken string
+	AdminAuth  string
+	AdminTLS   bool
+	// Ingest is the listen address of the HTTP ingest endpoint, which then
+	// takes the place of the built-in producers' items, authenticated as
+	// IngestAuth says like the admin API. Daemon runs the pipeline until
+	// it is signalled to stop, taking items only from the ingest.
+	Ingest      string
+	IngestToken string
+	IngestAuth  string
+	IngestTLS   bool
+	Daemon      bool
+	// IngestFull is what a request does with items the pipeline can't
+	// take: block until it can, reject answering 429 with a Retry-After,
+	// or shed, dropping them as DropFull
+	IngestFull string
+	// the thresholds of the -ingest probes: consumers that take nothing
+	// for StallTimeout with items buffered fail both, and a buffer more
+	// than ReadyBuffer full or ReadySinkFailures sink writes failing in a
+	// row fail readiness
+	StallTimeout      time.Duration
+	ReadyBuffer       float64
+	ReadySinkFailures int
+	// DeadlockAfter, when set, is how long producers may put nothing on a
+	// buffer that consumers take nothing off, while it is neither empty nor
+	// full, before the deadlock watchdog dumps the goroutines to
+	// DeadlockDump, or stderr
+	DeadlockAfter time.Duration
+	DeadlockDump  string
+	// SocketMode is the file mode given to unix:<path> listener sockets
+	SocketMode uint
+	// TLS settings shared by every network listener that enables TLS.
+	// TLSClientCA verifies client certificates for mtls auth.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// Report, if set, is a file the end-of-run report is written to,
+	// as HTML if the name ends in .html, json for .json, the per-second
+	// timeline for .csv and Markdown otherwise
+	Report string
+	// Output is text, or json for the end-of-run summary in one json
+	// document, written to OutputFile or otherwise stdout, see output.go
+	Output     string
+	OutputFile string
+	// Manifest, if set, is where the record of the run is written, see
+	// manifest.go, and Seed seeds the random items the built-in producers
+	// make, picked at random when it isn't given
+	Manifest string
+	Seed     int64
+	// Trace, if set, is a file every item's lifecycle is recorded to
+	Trace string
+	// the report is also sent to Slack and/or by email if these are set
+	NotifySlack    string
+	NotifySMTP     string
+	NotifySMTPUser string
+	NotifyFrom     string
+	NotifyTo       string
+
+	// the command line the config was parsed from, to parse again on a
+	// reload
+	args []string
+	// the container's limits, what ContainerLimits changed to suit them,
+	// and that put as it is told at the start of a run
+	container     containerLimits
+	containerDid  []string
+	containerNote string
+	// every flag's value, and the names of those given, for the manifest
+	flagValues map[string]string
+	flagsSet   []string
+}
+
+// stringList is a flag that can be repeated to build up a list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// byteSize is a flag for a number of bytes, given plainly or with a unit
+// such as 64MB or 1GiB. The units are powers of 1024 either way.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	num := strings.TrimRight(strings.TrimSpace(s), "BbIi")
+	mult := int64(1)
+	if num != "" {
+		switch unicode.ToUpper(rune(num[len(num)-1])) {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad size %q, expected e.g. 512KB, 64MB or 2GiB", s)
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+
+// ParseConfig parses flags as the command takes them into a Config for
+// New, with the defaults for those args leave out. The args don't include
+// the program name.
+func ParseConfig(args []string) (*Config, error) {
+	return parseConfig(args)
+}
+
+// parse the command line arguments into a Config. The args should not
+// include the program name.
+func parseConfig(args []string) (*Config, error) {
+	cfg := &Config{args: args}
+	if path := configFileArg(args); path != "" {
+		fileArgs, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// so the command line has the last word
+		args = append(fileArgs, args...)
+	}
+	pre, err := presetArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	args = append(pre, args...)
+	fs := flag.NewFlagSet("go_producer_consumer", flag.ContinueOnError)
+	fs.StringVar(&cfg.Name, "name", "default", "name of the pipeline in the admin API")
+	fs.StringVar(&cfg.ConfigFile, "config", "", "read flags from this file first, one per line, and again on SIGHUP")
+	fs.StringVar(&cfg.Preset, "preset", "", "start from a set of flags tuned for "+presetNames()+", which any flags given override")
+	fs.BoolVar(&cfg.Verbose, "verbose", false, "log every item produced and consumed (SIGUSR2 switches it)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 0, "abort if a drain on SIGINT or SIGTERM takes longer than this (0 = wait)")
+	fs.StringVar(&cfg.Salvage, "salvage", "", "append the items an aborted drain leaves unhandled to this file as json lines")
+	fs.StringVar(&cfg.RunID, "run-id", "", "identifies this run, e.g. in object keys (default random)")
+	cfg.Producers, cfg.Consumers = 3, 6
+	fs.Var(workerCount{&cfg.Producers, &cfg.AutoProducers}, "producers", "number of producer goroutines, or auto")
+	fs.Var(workerCount{&cfg.Consumers, &cfg.AutoConsumers}, "consumers", "number of consumer goroutines, or auto")
+	fs.DurationVar(&cfg.AutoInterval, "auto-interval", 5*time.Second, "how often auto producer and consumer counts are reconsidered")
+	fs.IntVar(&cfg.AutoMax, "auto-max", 0, "most consumers auto sizing will run (default 16 per GOMAXPROCS)")
+	fs.IntVar(&cfg.ItemsPerProducer, "items", 20, "items created by each producer")
+	fs.IntVar(&cfg.BufferSize, "buffer", 10, "number of items the channel can hold")
+	fs.StringVar(&cfg.Checksum, "checksum", "", "checksum each payload as it's produced, with sha256 or crc32c, and check it as it's consumed and written, dead-lettering corrupt items (default off)")
+	fs.Var(&cfg.CompressAbove, "compress-above", "compress the payloads bigger than this while they wait on the buffers, e.g. 64KB, for less memory at the cost of CPU (0 = never)")
+	fs.Var(&cfg.BufferBytes, "buffer-bytes", "also limit the buffers to this many bytes of items, e.g. 64MB (0 = no limit, or a quarter of a container's memory limit)")
+	fs.BoolVar(&cfg.ContainerLimits, "container-limits", true, "size GOMAXPROCS, -buffer-bytes and the GC's memory limit from the container's cgroup limits when they aren't set")
+	fs.BoolVar(&cfg.StrictMemory, "strict-memory", false, "set aside the memory for the buffers, payloads and batches at startup and don't let it grow, needing -buffer-bytes and -payload-max")
+	fs.Var(&cfg.PayloadMax, "payload-max", "with -strict-memory, the largest payload taken, e.g. 1MB; bigger ones are dropped as invalid")
+	fs.Var(&cfg.MemoryLimit, "memory-limit", "shed low priority items and hold producers back while memory use is over this, e.g. 512MB")
+	fs.StringVar(&cfg.MemoryMeasure, "memory-measure", memoryHeap, "what -memory-limit measures: heap or rss")
+	fs.DurationVar(&cfg.MemoryInterval, "memory-interval", 100*time.Millisecond, "how often memory use is checked")
+	fs.StringVar(&cfg.MemoryShed, "memory-shed", "", "expression for the items that may be dropped under memory pressure, e.g. 'Metadata.priority == \"low\"'")
+	fs.IntVar(&cfg.LagMaxItems, "lag-max-items", 0, "send a consumer_lag event when more items than this wait for a consumer group (0 = no limit)")
+	fs.DurationVar(&cfg.LagMaxAge, "lag-max-age", 0, "send a consumer_lag event when a consumer group's oldest item has waited longer than this (0 = no limit)")
+	fs.Float64Var(&cfg.WatermarkHigh, "watermark-high", 0, "the share of the buffer, e.g. 0.8, that counts as filled up, sending a high_watermark event (0 = off)")
+	fs.Float64Var(&cfg.WatermarkLow, "watermark-low", 0.2, "the share the buffer must drain to after the high watermark before it counts as low again, sending a low_watermark event")
+	fs.StringVar(&cfg.WatermarkAction, "watermark-action", "", "what to do between the high watermark and the low one: pause (the producers) and/or scale (the consumers), e.g. pause,scale")
+	fs.IntVar(&cfg.WatermarkScale, "watermark-scale", 2, "consumers -watermark-action scale adds at the high watermark, and takes away at the low")
+	fs.StringVar(&cfg.BufferFull, "buffer-full", fullBlock, "what producers do when the buffer is full: block, drop (the new item) or drop-oldest")
+	fs.IntVar(&cfg.ItemArena, "item-arena", 0, "experimental: make the built-in producers' items in arenas of this many, freed all at once, in a binary built with GOEXPERIMENT=arenas (0 = off)")
+	fs.StringVar(&cfg.FairTopics, "fair-topics", "", "give each topic a queue of -buffer items that the consumers take from in turn: round-robin, each topic's weight in items, or deficit, its weight in -fair-quantum bytes")
+	fs.StringVar(&cfg.FairKey, "fair-key", "", "expression for an item's topic with -fair-topics, e.g. Metadata.tenant (default its mqtt_topic or topic metadata)")
+	fs.Var(&cfg.FairWeights, "fair-weight", "a topic's share of the consumers with -fair-topics, as <topic>=<weight> (repeatable, default 1)")
+	fs.Var(&cfg.FairQuantum, "fair-quantum", "bytes of items a topic of weight 1 gets in each turn with -fair-topics deficit (default 4KB)")
+	fs.IntVar(&cfg.FairMaxTopics, "fair-max-topics", 100, "most topics given a queue of their own with -fair-topics, the rest share one")
+	fs.IntVar(&cfg.BufferShards, "buffer-shards", 0, "split the buffer into this many channels, each producer putting its items on one and each consumer taking from its own first, to cut contention with many of them (0 = one channel)")
+	fs.DurationVar(&cfg.ConsumerSpin, "consumer-spin", 0, "poll the buffer for the next item for this long before blocking on it, for the lowest latency at the cost of busy cores, e.g. 50us (0 = block straight away)")
+	fs.IntVar(&cfg.Prefetch, "prefetch", 0, "items each consumer takes off the buffer ahead of the one it is handling (0 = none)")
+	fs.DurationVar(&cfg.TTL, "ttl", 0, "drop items that have waited longer than this for a consumer (0 = never)")
+	fs.DurationVar(&cfg.EvictAfter, "evict-after", 0, "evict items older than this from the buffers while they wait, rather than when a consumer takes them (0 = never)")
+	fs.StringVar(&cfg.Drops, "drop", "", "what to do with discarded items by reason, e.g. expired=dlq,invalid=drop; reasons are "+joinReasons(dropReasons))
+	fs.StringVar(&cfg.DropLog, "drop-log", "", "file to append dropped items to as json lines")
+	fs.StringVar(&cfg.Batch, "batch", "", "write to the sink in batches of this many items, or auto to adapt the size to the sink")
+	fs.IntVar(&cfg.BatchMax, "batch-max", 1000, "largest batch -batch auto will use")
+	fs.DurationVar(&cfg.BatchLatency, "batch-latency", 100*time.Millisecond, "how long -batch auto lets a batch write take before using smaller batches")
+	fs.DurationVar(&cfg.ConsumeDelay, "delay", time.Second, "time each consumer sleeps per item")
+	fs.Float64Var(&cfg.Rate, "rate", 0, "target items/sec for all producers combined (0 = unlimited)")
+	fs.BoolVar(&cfg.Simulate, "simulate", false, "simulate the run on a virtual clock instead of running it")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "check the flags and print the plan of the run, its stages, rates, sinks and most memory, without running it")
+	fs.BoolVar(&cfg.SkipPreflight, "skip-preflight", false, "start without checking that the files, commands and hosts the flags name are there")
+	fs.StringVar(&cfg.SimulateDelays, "simulate-delays", "fixed", "how long simulated items take to consume: fixed at -delay, or exponential around it")
+	fs.IntVar(&cfg.SchemaVersion, "schema-version", 0, "attach payloads of this version of the reading schema to produced items")
+	fs.StringVar(&cfg.PayloadSize, "payload-size", "", "attach payloads of these sizes to produced items: fixed:<size>, uniform:<min>..<max> or lognormal:<median>[,<sigma>], e.g. lognormal:4KB,1.5")
+	fs.StringVar(&cfg.PayloadFill, "payload-fill", fillCompressible, "what -payload-size payloads are filled with: compressible words or random characters")
+	fs.StringVar(&cfg.RecordProduced, "record-produced", "", "write every produced item to this file as json lines, for verify")
+	fs.StringVar(&cfg.Golden, "golden", "", "check what the run hands its sink against this golden file, exiting 1 if it differs")
+	fs.BoolVar(&cfg.GoldenUpdate, "golden-update", false, "record what the run hands its sink to the -golden file instead of checking it")
+	fs.BoolVar(&cfg.GoldenOrdered, "golden-ordered", false, "with -golden-update, have the check compare the items in the order they were written, for a run that always writes them in the same order")
+	fs.IntVar(&cfg.ErrorLogFirst, "error-log-first", 20, "print this many errors before sampling them")
+	fs.IntVar(&cfg.ErrorLogEvery, "error-log-every", 100, "after -error-log-first, print one error in this many (0 = none)")
+	fs.Var(&cfg.ErrorClasses, "error-class", "class errors whose message matches, as <class>:<regexp> (repeatable)")
+	fs.StringVar(&cfg.ErrorPolicy, "error-policy", "", "what each error class gets, as class=retry|dlq|fail pairs (default transient and throttled retry, permanent and invalid-input dlq)")
+	fs.IntVar(&cfg.Retries, "retries", 3, "how many more times to try an item whose error class is retried")
+	fs.DurationVar(&cfg.RetryBackoff, "retry-backoff", 100*time.Millisecond, "wait before the first retry, doubling after")
+	fs.IntVar(&cfg.ConsumerPauseAfter, "consumer-pause-after", 0, "pause a consumer that fails this many items in a row, leaving the others to carry on (0 = never)")
+	fs.DurationVar(&cfg.ConsumerPauseFor, "consumer-pause-for", 10*time.Second, "how long a consumer pauses for after -consumer-pause-after failures, doubling while it keeps failing")
+	fs.StringVar(&cfg.MetricsKey, "metrics-key", "", "break the admin api's /metrics down by this expression, e.g. Metadata.mqtt_topic")
+	fs.IntVar(&cfg.MetricsMaxKeys, "metrics-max-keys", 100, "most -metrics-key values given series of their own, the rest go in other")
+	fs.BoolVar(&cfg.CheckSequence, "check-sequence", false, "number produced items and report gaps, duplicates and reordering seen by the consumers")
+	fs.BoolVar(&cfg.Provenance, "provenance", false, "record in each handled item's Result which handler had it, where, when and in how many attempts")
+	fs.DurationVar(&cfg.DedupWindow, "dedup-window", 0, "drop items whose IdempotencyKey was already produced within this long (0 = off)")
+	fs.StringVar(&cfg.DLQ, "dlq", "", "append dead-lettered items to this file as json lines")
+	fs.Int64Var(&cfg.DLQAlert, "dlq-alert", 0, "send a dlq_threshold event once this many items are dead-lettered")
+	fs.StringVar(&cfg.Filter, "filter", "", "only handle items matching this expression, e.g. 'ID > 50 && ProducerID != 2'")
+	fs.Var(&cfg.Routes, "route", "send items matching an expression to a consumer pool, as <pool>:<expression> (repeatable)")
+	fs.Var(&cfg.Pools, "pool", "number of consumers in a routed pool, as <pool>=<consumers> (repeatable, default 1)")
+	fs.IntVar(&cfg.ProducerLanes, "producer-lanes", 0, "give each producer a channel of this many items of its own for each buffer, merged onto the buffers, so a slow pool only holds up the producers feeding it (0 = producers share the buffers)")
+	fs.StringVar(&cfg.Merge, "merge", mergeFair, "how the producers' lanes are merged onto a buffer: fair, in turn, or priority, lowest numbered producer first")
+	fs.StringVar(&cfg.JoinSource, "join-source", "", "join items with a second stream read from this source, as for -source")
+	fs.StringVar(&cfg.JoinKey, "join-key", "", "expression giving the key that joined items must share")
+	fs.DurationVar(&cfg.JoinWindow, "join-window", 5*time.Second, "how long items wait for a match to join with")
+	fs.StringVar(&cfg.JoinType, "join-type", joinInner, "join type: inner drops unmatched items, left passes them on")
+	fs.StringVar(&cfg.JoinLate, "join-late", lateDrop, "what to do with join source items arriving after their match expired: drop or dlq")
+	fs.StringVar(&cfg.Source, "source", "", "load items from plugin:<file.so>, exec:<command>, file:<path>, sql:<driver>:<dsn> or mqtt:<host>[:port]")
+	fs.StringVar(&cfg.Handler, "handler", "", "handle items with plugin:<file.so>, exec:<command>, wasm:<file.wasm> or starlark:<file.star>")
+	fs.DurationVar(&cfg.HandlerTimeout, "handler-timeout", 0, "fail a handler call that takes longer than this as a transient error, which is retried (0 = wait)")
+	fs.StringVar(&cfg.Sink, "sink", "", "write items to plugin:<file.so>, exec:<command>, file:<path>, s3:<bucket> or mqtt:<host>[:port]")
+	fs.Var(&cfg.NamedSinks, "named-sink", "another sink for -sink-route to send items to, as <name>=<sink> (repeatable)")
+	fs.Var(&cfg.SinkRoutes, "sink-route", "send items whose handler gave them a status to named sinks, as <status>=<sink>[,<sink>...] (repeatable)")
+	fs.Var(&cfg.WriteBehind, "write-behind", "buffer up to this many writes to a sink, default for the -sink or a -named-sink, flushing them at least every interval (default 1s) before acking their items, as <sink>=<items>[,<interval>] (repeatable)")
+	fs.StringVar(&cfg.SinkOrderKey, "sink-order-key", "", "write to the sink from -sink-writers goroutines, keeping items for which this expression comes out the same in the order they were queued")
+	fs.IntVar(&cfg.SinkWriters, "sink-writers", 4, "goroutines writing to the sink with -sink-order-key")
+	fs.Var(&cfg.Concurrency, "concurrency", "most handler calls or sink writes run at once, however many consumers there are, as handle=<limit> or sink=<limit> (repeatable)")
+	fs.StringVar(&cfg.HandlerWeight, "handler-weight", "", "expression giving how much of -concurrency handle= an item's handling takes, e.g. Metadata.parts for a handler that fans items out (default 1)")
+	fs.StringVar(&cfg.ShadowHandler, "shadow-handler", "", "also try this handler on every item, only comparing what it makes of them with what -handler does")
+	fs.IntVar(&cfg.ShadowWorkers, "shadow-workers", 1, "goroutines running the -shadow-handler")
+	fs.IntVar(&cfg.ShadowBuffer, "shadow-buffer", 1000, "items that can wait for the -shadow-handler before more are skipped")
+	fs.StringVar(&cfg.ShadowLog, "shadow-log", "", "append the items the -shadow-handler did differently to this file as json lines")
+	fs.StringVar(&cfg.CanaryHandler, "canary-handler", "", "handle -canary-percent of the default pool's items with this handler instead, on a pool of its own")
+	fs.Float64Var(&cfg.CanaryPercent, "canary-percent", 5, "percentage of the default pool's items sent to the -canary-handler")
+	fs.IntVar(&cfg.CanaryConsumers, "canary-consumers", 1, "consumers running the -canary-handler")
+	fs.Float64Var(&cfg.CanaryMaxErrorRate, "canary-max-error-rate", 0.05, "send nothing more to the -canary-handler once it has failed on more than this fraction of its items")
+	fs.IntVar(&cfg.CanaryMinItems, "canary-min-items", 20, "items the -canary-handler must have handled before its error rate is judged")
+	fs.StringVar(&cfg.SQLQuery, "sql-query", "", "query read by a sql:<driver>:<dsn> source")
+	fs.StringVar(&cfg.SQLKey, "sql-key", "id", "unique, ordered column the sql source pages on")
+	fs.IntVar(&cfg.SQLBatch, "sql-batch", 500, "rows fetched per page by the sql source")
+	fs.DurationVar(&cfg.SQLTail, "sql-tail", 0, "keep polling for new rows this often once the sql source has caught up")
+	fs.StringVar(&cfg.SQLTable, "sql-table", "", "table a sql:<driver>:<dsn> sink inserts items into")
+	fs.StringVar(&cfg.SQLOffsets, "sql-offsets", "pipeline_offsets", "table the sql sink keeps the source position in with -checkpoint-in-sink")
+	fs.StringVar(&cfg.Redis, "redis", "", "share the queue through redis at this redis:// url")
+	fs.StringVar(&cfg.RedisKey, "redis-key", "go_producer_consumer", "name of the redis list or stream")
+	fs.StringVar(&cfg.RedisMode, "redis-mode", redisList, "use a redis list or a stream with a consumer group")
+	fs.StringVar(&cfg.RedisGroup, "redis-group", "go_producer_consumer", "consumer group name in redis stream mode")
+	fs.StringVar(&cfg.RedisConsumer, "redis-consumer", "", "this process's name in the redis consumer group (default host-pid)")
+	fs.DurationVar(&cfg.RedisIdle, "redis-idle", time.Second, "stop consuming once redis has been empty this long and the local producers are done")
+	fs.IntVar(&cfg.RedisDownstream, "redis-downstream", 0, "send an end-of-stream marker for this many consumer processes when the producers finish")
+	fs.IntVar(&cfg.RedisUpstream, "redis-upstream", 0, "stop consuming once end-of-stream markers from this many producer processes have arrived (0 = use -redis-idle)")
+	fs.StringVar(&cfg.MQTTSubscribe, "mqtt-subscribe", "", "topic filter an mqtt source subscribes to, e.g. sensors/+/temp")
+	fs.StringVar(&cfg.MQTTPublish, "mqtt-publish", "", "topic an mqtt sink publishes items to")
+	fs.IntVar(&cfg.MQTTQoS, "mqtt-qos", 1, "mqtt QoS: 0 at most once, 1 at least once, 2 exactly once")
+	fs.StringVar(&cfg.MQTTClientID, "mqtt-client-id", "", "mqtt client id, which keeps the source's session across restarts (default per run)")
+	fs.DurationVar(&cfg.MQTTIdle, "mqtt-idle", 0, "stop the mqtt source after this long without a message (0 = never)")
+	fs.StringVar(&cfg.MQTTUser, "mqtt-user", "", "mqtt username (password comes from $MQTT_PASSWORD)")
+	fs.BoolVar(&cfg.MQTTTLS, "mqtt-tls", false, "connect to the mqtt broker over TLS")
+	fs.StringVar(&cfg.SinkFormat, "sink-format", formatNDJSON, "format written by the file and s3 sinks: ndjson or parquet")
+	fs.StringVar(&cfg.S3Endpoint, "s3-endpoint", "", "url of an S3 compatible store such as MinIO (default AWS)")
+	fs.StringVar(&cfg.S3Region, "s3-region", "us-east-1", "region used for the s3 sink")
+	fs.StringVar(&cfg.S3Key, "s3-key", `{{.RunID}}/{{.Time.Format "20060102T150405Z"}}-{{.Seq}}.{{.Ext}}`, "text/template for s3 object keys, given .RunID, .Time, .Seq and .Ext")
+	fs.IntVar(&cfg.S3PartSize, "s3-part-size", 8<<20, "bytes per part of a multipart upload (at least 5MiB)")
+	fs.Int64Var(&cfg.S3ObjectSize, "s3-object-size", 64<<20, "start a new s3 object once the current one reaches this many bytes")
+	fs.DurationVar(&cfg.S3FlushInterval, "s3-flush-interval", time.Minute, "start a new s3 object once the current one has been open this long")
+	fs.StringVar(&cfg.Checkpoint, "checkpoint", "", "save the source position to this file and resume from it on restart")
+	fs.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", 5*time.Second, "how often to save the checkpoint")
+	fs.BoolVar(&cfg.CheckpointInSink, "checkpoint-in-sink", false, "keep the source position in the sink, committed with the items, instead of in a -checkpoint file")
+	fs.StringVar(&cfg.Backfill, "backfill", "", "backfill a huge source, keeping progress in this file so it can be resumed")
+	fs.IntVar(&cfg.BackfillRetries, "backfill-retries", 3, "times a backfill retries the items that failed before dead-lettering them")
+	fs.DurationVar(&cfg.BackfillReport, "backfill-report", 10*time.Second, "how often a backfill reports its progress")
+	fs.StringVar(&cfg.Shard, "shard", "", "split the source with other runs, as <index>/<count> counting from 0")
+	fs.StringVar(&cfg.ShardDir, "shard-dir", "", "split the source with the other runs sharing this directory")
+	fs.StringVar(&cfg.ShardKey, "shard-key", "ID", "expression giving the key items are shared out on, when the source can't be split by partition")
+	fs.DurationVar(&cfg.ShardSettle, "shard-settle", 3*time.Second, "how long to wait for the other runs to join a -shard-dir group")
+	fs.StringVar(&cfg.Lock, "lock", "", "also hold this lock file for the run, e.g. for a plugin's own state")
+	fs.BoolVar(&cfg.Standby, "standby", false, "if another run holds the locks, wait for it to finish and take over instead of failing")
+	fs.StringVar(&cfg.WasmRuntime, "wasm-runtime", "wasmtime", "WASI runtime command used for wasm handlers")
+	fs.Var(&cfg.SLOs, "slo", "queue latency objective such as p99<200ms (repeatable)")
+	fs.DurationVar(&cfg.SLOWindow, "slo-window", time.Second, "window over which SLO compliance is evaluated")
+	fs.Var(&cfg.Webhooks, "webhook", "URL to post pipeline events to (repeatable)")
+	fs.StringVar(&cfg.WebhookEvents, "webhook-events", "", "comma separated event types to send (default all)")
+	fs.StringVar(&cfg.WebhookTemplate, "webhook-template", "", "text/template file used to render the webhook body")
+	fs.StringVar(&cfg.WebhookSecret, "webhook-secret", "", "secret used to sign webhook bodies with HMAC-SHA256")
+	fs.IntVar(&cfg.WebhookRetries, "webhook-retries", 3, "times a failed webhook delivery is retried")
+	fs.StringVar(&cfg.Admin, "admin", "", "listen address for the admin API, e.g. :8081 or unix:/run/pc/admin.sock")
+	fs.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required by the admin API (default $ADMIN_TOKEN)")
+	fs.StringVar(&cfg.AdminAuth, "admin-auth", authToken, "admin API authentication: token, mtls or none")
+	fs.StringVar(&cfg.Ingest, "ingest", "", "listen address to take items posted to /items on, e.g. :8082, instead of making them")
+	fs.StringVar(&cfg.IngestToken, "ingest-token", os.Getenv("INGEST_TOKEN"), "bearer token required to post items (default $INGEST_TOKEN)")
+	fs.StringVar(&cfg.IngestAuth, "ingest-auth", authToken, "ingest authentication: token, mtls or none")
+	fs.BoolVar(&cfg.IngestTLS, "ingest-tls", false, "serve the ingest endpoint over TLS")
+	fs.StringVar(&cfg.IngestFull, "ingest-full", ingestBlock, "what an ingest request does when the pipeline can't take its items: block, reject (429 with a Retry-After) or shed (drop them)")
+	fs.DurationVar(&cfg.DeadlockAfter, "deadlock-after", 0, "report a pipeline whose producers and idle consumers have moved no items for this long, with items buffered but room for more, dumping its goroutines (0 = never)")
+	fs.StringVar(&cfg.DeadlockDump, "deadlock-dump", "", "file the deadlock watchdog appends the pipeline graph and goroutine stacks to (default stderr)")
+	fs.DurationVar(&cfg.StallTimeout, "stall-timeout", time.Minute, "fail the health probes when consumers take no buffered item for this long (0 = never)")
+	fs.Float64Var(&cfg.ReadyBuffer, "ready-buffer", 0.9, "fail the readiness probe while the buffer is this full, as a fraction (0 = never)")
+	fs.IntVar(&cfg.ReadySinkFailures, "ready-sink-failures", 3, "fail the readiness probe after this many sink writes fail in a row (0 = never)")
+	fs.BoolVar(&cfg.Daemon, "daemon", false, "run until SIGINT or SIGTERM, taking items only from -ingest, then drain")
+	fs.UintVar(&cfg.SocketMode, "socket-mode", 0600, "permissions for unix socket listeners")
+	fs.BoolVar(&cfg.AdminTLS, "admin-tls", false, "serve the admin API over TLS")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "PEM certificate for TLS listeners")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "PEM private key for TLS listeners")
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", "", "PEM CA bundle used to verify client certificates")
+	fs.StringVar(&cfg.Report, "report", "", "write the end-of-run report to this .md, .html or .json file, or its per-second timeline to a .csv file")
+	fs.StringVar(&cfg.Output, "output", outputText, "text, or json for the end-of-run summary as one json document on stdout, with everything else printed going to stderr")
+	fs.StringVar(&cfg.OutputFile, "output-file", "", "write the -output json summary to this file instead of stdout")
+	fs.StringVar(&cfg.Manifest, "manifest", "", "write a manifest of the run, its config, seed, files, environment and report, to this .json file, or to <run-id>.json in this directory")
+	fs.Int64Var(&cfg.Seed, "seed", 0, "seed for the built-in producers' random items, so a run can be repeated (default random, recorded in the -manifest)")
+	fs.StringVar(&cfg.Trace, "trace", "", "record every item's lifecycle to this file, for trace view")
+	fs.StringVar(&cfg.NotifySlack, "notify-slack", "", "Slack incoming webhook URL to post the report to")
+	fs.StringVar(&cfg.NotifySMTP, "notify-smtp", "", "SMTP server host:port to email the report through")
+	fs.StringVar(&cfg.NotifySMTPUser, "notify-smtp-user", "", "SMTP username (password comes from $SMTP_PASSWORD)")
+	fs.StringVar(&cfg.NotifyFrom, "notify-from", "", "sender address for the report email")
+	fs.StringVar(&cfg.NotifyTo, "notify-to", "", "comma separated recipients for the report email")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	applyContainerLimits(cfg, set)
+	if cfg.RunID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		cfg.RunID = hex.EncodeToString(b)
+	}
+	if cfg.Golden != "" && !cfg.GoldenUpdate && !set["seed"] {
+		// replay the run the golden file recorded
+		cfg.Seed = goldenSeed(cfg.Golden)
+	}
+	if (cfg.GoldenUpdate || cfg.GoldenOrdered) && cfg.Golden == "" {
+		return nil, errors.New("-golden-update and -golden-ordered need a -golden file")
+	}
+	for cfg.Seed == 0 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		cfg.Seed = int64(n >> 1)
+	}
+	cfg.recordFlags(fs)
+	if cfg.Backfill != "" {
+		if cfg.Checkpoint != "" && cfg.Checkpoint != cfg.Backfill {
+			return nil, errors.New("-backfill keeps its progress in its own file, so it can't be used with a different -checkpoint")
+		}
+		cfg.Checkpoint = cfg.Backfill
+	}
+	if cfg.CheckpointInSink && cfg.Checkpoint != "" {
+		return nil, errors.New("-checkpoint-in-sink keeps the checkpoint in the sink, so it can't be used with -checkpoint or -backfill")
+	}
+	if err := validOutput(cfg.Output); err != nil {
+		return nil, err
+	}
+	if cfg.StrictMemory {
+		if err := checkStrictMemory(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Admin != "" && cfg.AdminAuth == authToken && cfg.AdminToken == "" {
+		return nil, errors.New("-admin needs -admin-token or $ADMIN_TOKEN to be set")
+	}
+	if cfg.Ingest != "" && cfg.IngestAuth == authToken && cfg.IngestToken == "" {
+		return nil, errors.New("-ingest needs -ingest-token or $INGEST_TOKEN to be set")
+	}
+	if cfg.Ingest != "" && cfg.Source != "" {
+		return nil, errors.New("-ingest is where items come from, so it can't be used with -source")
+	}
+	if cfg.Daemon && cfg.Ingest == "" {
+		return nil, errors.New("-daemon has no producers of its own, so it needs -ingest to take items from")
+	}
+	return cfg, nil
+}
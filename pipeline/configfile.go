@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A -config file holds flags one per line, each written as its name and
+// then its value, as on the command line but without the quoting, so a
+// value can have spaces in it. The leading dash is optional, a flag on its
+// own is a boolean set to true, and blank lines and lines starting with #
+// are skipped:
+//
+//	# nightly load
+//	rate 5000
+//	consumers 8
+//	filter ID > 50 && ProducerID != 2
+//	check-sequence
+//
+// Flags given on the command line override the file's.
+func readConfigFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var args []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, hasValue := line, "", false
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, value, hasValue = line[:i], line[i+1:], true
+		}
+		name = strings.TrimLeft(name, "-")
+		if name == "config" {
+			return nil, fmt.Errorf("%s line %d: a config file can't name another", path, n)
+		}
+		if !hasValue {
+			args = append(args, "-"+name)
+			continue
+		}
+		args = append(args, "-"+name+"="+strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return args, nil
+}
+
+// the -config file named in args, which has to be found before they are
+// parsed since the file's flags go first
+func configFileArg(args []string) string {
+	return flagArg(args, "config")
+}
+
+// the value args give the flag called name, the last of them if it's
+// given more than once, as the flag package would have it
+func flagArg(args []string, name string) string {
+	found := ""
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		n, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if n != name {
+			continue
+		}
+		if hasValue {
+			found = value
+		} else if i+1 < len(args) {
+			found = args[i+1]
+		}
+	}
+	return found
+}
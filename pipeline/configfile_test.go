@@ -0,0 +1,31 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func FuzzConfigFile(f *testing.F) {
+	f.Add("# nightly load\nrate 5000\nconsumers 8\nfilter ID > 50 && ProducerID != 2\ncheck-sequence\n")
+	f.Add("preset throughput\nbuffer 64\n")
+	f.Add("--buffer-bytes\t64MiB\nproducers auto\n")
+	f.Add("config other.conf\n")
+	f.Add("delay\nitems -1\n")
+	f.Fuzz(func(t *testing.T, file string) {
+		path := filepath.Join(t.TempDir(), "pc.conf")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args, err := readConfigFile(path)
+		if err != nil {
+			return
+		}
+		for _, arg := range args {
+			if len(arg) < 2 || arg[0] != '-' {
+				t.Fatalf("read %q from the file, which isn't a flag", arg)
+			}
+		}
+		parseConfig([]string{"-config", path})
+	})
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the events sent as a consumer pauses itself after failing in a row and
+// as it carries on
+const (
+	EventConsumerPaused  = "consumer_paused"
+	EventConsumerResumed = "consumer_resumed"
+)
+
+// how many times a pause doubles, as a consumer fails its way back into
+// one without a success between, to at most 16 times -consumer-pause-for
+const consumerPauseDoublings = 4
+
+// consumerPauses has a consumer that fails -consumer-pause-after items in
+// a row, in its handler or writing to the sink, stop taking items for
+// -consumer-pause-for rather than keep failing the rest against whatever
+// is broken. It sends a consumer_paused event and carries on once the
+// pause is over, or sooner when resumed over the admin API. A consumer
+// that goes straight back to failing pauses for twice as long each time.
+// Unlike pausing the pipeline, the other consumers keep going, so one
+// stuck on a bad connection stays out of the way while the rest take up
+// its share. Only the failures a consumer sees itself count, not those of
+// a write-behind buffer flushing on its own.
+type consumerPauses struct {
+	after   int
+	backoff time.Duration
+	hooks   *eventHooks
+
+	mu         sync.Mutex
+	byConsumer map[int]*failStreak
+	pauses     int64
+	resumed    int64 // by the admin API
+}
+
+// a consumer's run of failures
+type failStreak struct {
+	failures  int
+	failedNow bool // the item in hand failed
+	pauses    int  // in a row
+	until     time.Time
+	resume    chan struct{} // closed to end the pause early
+}
+
+// PausedConsumer is a consumer paused by its failures, for the admin API
+type PausedConsumer struct {
+	ID    int       `json:"id"`
+	Until time.Time `json:"until"`
+}
+
+func newConsumerPauses(cfg *Config, hooks *eventHooks) *consumerPauses {
+	return &consumerPauses{after: cfg.ConsumerPauseAfter, backoff: cfg.ConsumerPauseFor, hooks: hooks, byConsumer: make(map[int]*failStreak)}
+}
+
+func (c *consumerPauses) streak(myId int) *failStreak {
+	s := c.byConsumer[myId]
+	if s == nil {
+		s = &failStreak{}
+		c.byConsumer[myId] = s
+	}
+	return s
+}
+
+// note that the item a consumer is on failed. Safe when nil.
+func (c *consumerPauses) failed(myId int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.streak(myId).failedNow = true
+	c.mu.Unlock()
+}
+
+// count the item a consumer has finished with, pausing it there if that
+// was one failure too many. Safe when nil.
+func (c *consumerPauses) handled(myId int, stop <-chan struct{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	s := c.streak(myId)
+	if !s.failedNow {
+		s.failures, s.pauses = 0, 0
+		c.mu.Unlock()
+		return
+	}
+	s.failedNow = false
+	s.failures++
+	if s.failures < c.after {
+		c.mu.Unlock()
+		return
+	}
+	failures := s.failures
+	wait := c.backoff << min(s.pauses, consumerPauseDoublings)
+	s.failures = 0
+	s.pauses++
+	s.until = time.Now().Add(wait)
+	s.resume = make(chan struct{})
+	resume := s.resume
+	c.pauses++
+	c.mu.Unlock()
+
+	fields := map[string]any{"consumer": myId, "failures": failures, "pause_ms": wait.Milliseconds()}
+	fmt.Printf("consumer %d failed %d items in a row, pausing for %s\n", myId, failures, wait)
+	c.hooks.emit(newEvent(EventConsumerPaused, fields, "consumer %d failed %d items in a row, pausing for %s", myId, failures, wait))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	how := "after its pause"
+	select {
+	case <-timer.C:
+	case <-resume:
+		how = "by the admin API"
+	case <-stop:
+	}
+	c.mu.Lock()
+	s.until, s.resume = time.Time{}, nil
+	c.mu.Unlock()
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	fmt.Printf("consumer %d resumed %s\n", myId, how)
+	c.hooks.emit(newEvent(EventConsumerResumed, map[string]any{"consumer": myId, "how": how}, "consumer %d resumed %s", myId, how))
+}
+
+// end a consumer's pause early
+func (c *consumerPauses) resume(myId int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.byConsumer[myId]
+	if s == nil || s.resume == nil {
+		return fmt.Errorf("consumer %d isn't paused", myId)
+	}
+	close(s.resume)
+	s.until, s.resume = time.Time{}, nil
+	c.resumed++
+	return nil
+}
+
+// the consumers paused now, by id. Safe when nil.
+func (c *consumerPauses) paused() []PausedConsumer {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []PausedConsumer
+	for id, s := range c.byConsumer {
+		if !s.until.IsZero() {
+			out = append(out, PausedConsumer{ID: id, Until: s.until})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// POST /pipelines/{name}/consumers/{id}/resume
+func (a *adminServer) resumeConsumer(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	if p.pauses == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("pipeline %s has no -consumer-pause-after", p.name))
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad consumer id %q", r.PathValue("id")))
+		return
+	}
+	if err := p.pauses.resume(id); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p.status())
+}
+
+func (c *consumerPauses) printSummary(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "consumer pauses: %d after %d failures in a row, %d ended early over the admin API\n", c.pauses, c.after, c.resumed)
+}
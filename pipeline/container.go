@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// containerLimits are the CPUs and memory the process's container is
+// allowed, from its cgroup, zero where there is no limit
+type containerLimits struct {
+	CPUs   float64
+	Memory int64
+	From   string // which cgroup version said, empty if neither did
+}
+
+// the buffers get a quarter of a container's memory unless -buffer-bytes
+// says otherwise, leaving the rest for the handlers, the sink and the GC
+const containerBufferShare = 4
+
+// size the defaults from the container's limits rather than the host's
+// with -container-limits, which is on by default. In the config that is
+// the buffers, bounded by a share of the memory unless -buffer-bytes is
+// given. The limits are kept for applyRuntimeLimits, as ParseConfig
+// mustn't change a program embedding the pipeline behind its back.
+func applyContainerLimits(cfg *Config, set map[string]bool) {
+	if !cfg.ContainerLimits {
+		return
+	}
+	cfg.container = readContainerLimits()
+	if l := cfg.container; l.Memory > 0 && !set["buffer-bytes"] {
+		cfg.BufferBytes = byteSize(l.Memory / containerBufferShare)
+		cfg.containerDid = append(cfg.containerDid, "-buffer-bytes "+formatBytes(int64(cfg.BufferBytes)))
+	}
+	cfg.noteContainer()
+}
+
+// bring the runtime down to the container's limits, for the command to
+// call as it starts: GOMAXPROCS, which the auto sizing and -auto-max go
+// by, to the CPU quota, and the GC's memory limit to 90% of the memory.
+// What the GOMAXPROCS and GOMEMLIMIT variables set is left alone.
+func applyRuntimeLimits(cfg *Config) {
+	l := cfg.container
+	if l.CPUs > 0 {
+		procs := max(1, int(math.Ceil(l.CPUs)))
+		if os.Getenv("GOMAXPROCS") == "" && procs < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+			cfg.containerDid = append(cfg.containerDid, fmt.Sprintf("GOMAXPROCS %d", procs))
+		}
+	}
+	if l.Memory > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(l.Memory / 10 * 9)
+		cfg.containerDid = append(cfg.containerDid, "GOMEMLIMIT "+formatBytes(l.Memory/10*9))
+	}
+	cfg.noteContainer()
+}
+
+// say what the container's limits changed, for the start of a run
+func (cfg *Config) noteContainer() {
+	l := cfg.container
+	if len(cfg.containerDid) == 0 {
+		return
+	}
+	var limits []string
+	if l.CPUs > 0 {
+		limits = append(limits, fmt.Sprintf("%.2g CPUs", l.CPUs))
+	}
+	if l.Memory > 0 {
+		limits = append(limits, formatBytes(l.Memory)+" of memory")
+	}
+	cfg.containerNote = fmt.Sprintf("%s limits this container to %s, so using %s",
+		l.From, strings.Join(limits, " and "), strings.Join(cfg.containerDid, ", "))
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// where the cgroup filesystems are mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// the CPU and memory limits of the cgroup the process runs in, version 2
+// or version 1, looking in its own cgroup and then at the root, which is
+// what a container with its own cgroup namespace sees
+func readContainerLimits() containerLimits {
+	var l containerLimits
+	paths := cgroupPaths()
+	// version 2
+	if b, ok := readCgroupFile("", paths[""], "cpu.max"); ok {
+		if quota, period, ok := strings.Cut(strings.TrimSpace(b), " "); ok && quota != "max" {
+			q, err1 := strconv.ParseFloat(quota, 64)
+			p, err2 := strconv.ParseFloat(period, 64)
+			if err1 == nil && err2 == nil && q > 0 && p > 0 {
+				l.CPUs = q / p
+			}
+		}
+	}
+	if b, ok := readCgroupFile("", paths[""], "memory.max"); ok {
+		if n, err := strconv.ParseInt(strings.TrimSpace(b), 10, 64); err == nil {
+			l.Memory = n
+		}
+	}
+	if l.CPUs > 0 || l.Memory > 0 {
+		l.From = "cgroup v2"
+		return l
+	}
+	// version 1, where each controller has its own hierarchy
+	quota, ok1 := readCgroupFile("cpu", paths["cpu"], "cpu.cfs_quota_us")
+	period, ok2 := readCgroupFile("cpu", paths["cpu"], "cpu.cfs_period_us")
+	if ok1 && ok2 {
+		q, err1 := strconv.ParseFloat(strings.TrimSpace(quota), 64)
+		p, err2 := strconv.ParseFloat(strings.TrimSpace(period), 64)
+		if err1 == nil && err2 == nil && q > 0 && p > 0 {
+			l.CPUs = q / p
+		}
+	}
+	if b, ok := readCgroupFile("memory", paths["memory"], "memory.limit_in_bytes"); ok {
+		// no limit is the largest page aligned int64
+		if n, err := strconv.ParseInt(strings.TrimSpace(b), 10, 64); err == nil && n < math.MaxInt64/2 {
+			l.Memory = n
+		}
+	}
+	if l.CPUs > 0 || l.Memory > 0 {
+		l.From = "cgroup v1"
+	}
+	return l
+}
+
+// the process's cgroup path by controller from /proc/self/cgroup, with
+// the version 2 one under ""
+func cgroupPaths() map[string]string {
+	paths := make(map[string]string)
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return paths
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			paths[c] = parts[2]
+		}
+	}
+	return paths
+}
+
+// read a file of the process's cgroup in a hierarchy, or of the cgroup at
+// the top of the hierarchy when the process's own can't be seen
+func readCgroupFile(hierarchy, cgroup, name string) (string, bool) {
+	for _, path := range []string{filepath.Join(cgroupRoot, hierarchy, cgroup, name), filepath.Join(cgroupRoot, hierarchy, name)} {
+		if b, err := os.ReadFile(path); err == nil {
+			return string(b), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package pipeline
+
+// only linux has cgroups to limit the process
+func readContainerLimits() containerLimits {
+	return containerLimits{}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package pipeline
+
+import "runtime/metrics"
+
+// the CPU time the process has used so far. Without getrusage the runtime's
+// own estimate is used, which only moves on at each GC, so auto sizing
+// reacts more slowly.
+func cpuSeconds() float64 {
+	s := []metrics.Sample{{Name: "/cpu/classes/total:cpu-seconds"}}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return s[0].Value.Float64()
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package pipeline
+
+import "syscall"
+
+// the CPU time the process has used so far, user and system
+func cpuSeconds() float64 {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+}
@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the event sent when the watchdog finds the pipeline stuck
+const EventDeadlock = "deadlock"
+
+// deadlockWatch looks for the pipeline wedged the way a wiring bug leaves
+// it: producers still running but putting nothing on the buffers,
+// consumers taking nothing off them and none of them handling an item,
+// with the buffer neither empty, when the consumers would just be waiting
+// for work, nor full, when the producers would just be waiting for room.
+// That is nothing waiting on anything that will ever come. Once it has
+// gone on for -deadlock-after the watchdog says so, sends a deadlock event
+// and writes the pipeline's graph, its status and every goroutine's stack
+// to -deadlock-dump, or to stderr. It doesn't look again until the
+// pipeline has moved, so a stall is reported once.
+type deadlockWatch struct {
+	p     *Pipeline
+	after time.Duration
+	dump  string
+	done  chan struct{}
+
+	// the counts last seen, and when they last changed
+	produced, consumed int64
+	moved              time.Time
+	reported           bool
+	stalls             atomic.Int64
+}
+
+func newDeadlockWatch(p *Pipeline, cfg *Config) *deadlockWatch {
+	return &deadlockWatch{p: p, after: cfg.DeadlockAfter, dump: cfg.DeadlockDump, done: make(chan struct{})}
+}
+
+func (d *deadlockWatch) start() {
+	d.moved = time.Now()
+	go func() {
+		tick := time.NewTicker(d.after / 4)
+		defer tick.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case now := <-tick.C:
+				d.check(now)
+			}
+		}
+	}()
+}
+
+func (d *deadlockWatch) stop() {
+	close(d.done)
+}
+
+func (d *deadlockWatch) check(now time.Time) {
+	st := d.p.status()
+	if st.Produced != d.produced || st.Consumed != d.consumed {
+		d.produced, d.consumed = st.Produced, st.Consumed
+		d.moved, d.reported = now, false
+		return
+	}
+	stuck := now.Sub(d.moved)
+	if d.reported || stuck < d.after || st.State != "running" ||
+		st.Producers == 0 || st.Buffered == 0 || st.Buffered >= st.Capacity || d.p.handling() > 0 || len(d.p.pauses.paused()) > 0 {
+		return
+	}
+	d.reported = true
+	d.stalls.Add(1)
+	msg := fmt.Sprintf("deadlock: nothing produced or taken for %s with %d of %d items buffered, while %d producers run and no consumer has an item",
+		stuck.Round(time.Millisecond), st.Buffered, st.Capacity, st.Producers)
+	w, where := io.Writer(os.Stderr), "stderr"
+	if d.dump != "" {
+		f, err := os.OpenFile(d.dump, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Printf("deadlock: error opening -deadlock-dump: %v\n", err)
+		} else {
+			defer f.Close()
+			w, where = f, d.dump
+		}
+	}
+	fmt.Printf("%s, goroutines written to %s\n", msg, where)
+	fmt.Fprintf(w, "%s at %s\n", msg, now.Format(time.RFC3339))
+	d.p.writeGraph(w)
+	d.p.dumpState(w)
+	d.p.hooks.emit(newEvent(EventDeadlock,
+		map[string]any{"buffered": st.Buffered, "capacity": st.Capacity, "producers": st.Producers, "stuck_ms": stuck.Milliseconds()},
+		"nothing produced or taken for %s with %d items buffered", stuck.Round(time.Millisecond), st.Buffered))
+}
+
+// how many consumers are in the middle of an item
+func (p *Pipeline) handling() int {
+	n := 0
+	p.inflight.Range(func(any, any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// write out how the pipeline is wired, from the producers through the
+// buffers and consumer pools to the sinks, with what each holds just now
+func (p *Pipeline) writeGraph(w io.Writer) {
+	p.mu.Lock()
+	producers, consumers := active(p.producers), active(p.consumers)
+	pools := make(map[string]int, len(p.pools))
+	for name, pool := range p.pools {
+		pools[name] = active(pool.consumers)
+	}
+	p.mu.Unlock()
+
+	from := "built in"
+	if p.cfg.Source != "" {
+		from = p.cfg.Source
+	} else if p.cfg.Ingest != "" {
+		from = "ingest on " + p.cfg.Ingest
+	}
+	var held []string
+	if p.gate.paused() {
+		held = append(held, "paused")
+	}
+	if p.marks != nil && p.marks.gate.paused() {
+		held = append(held, "held at the high watermark")
+	}
+	fmt.Fprintf(w, "pipeline %s graph:\n", p.name)
+	fmt.Fprintf(w, "  producers: %d running, items %s", producers, from)
+	if len(held) > 0 {
+		fmt.Fprintf(w, ", %s", strings.Join(held, ", "))
+	}
+	fmt.Fprintln(w)
+	for _, r := range p.routes {
+		fmt.Fprintf(w, "  route: %s -> pool %s\n", r.cond, r.pool)
+	}
+	if p.merge != nil {
+		fmt.Fprintf(w, "  producer lanes: %d items waiting, merged %s\n", p.merge.waiting(), p.cfg.Merge)
+	}
+	p.bufMu.RLock()
+	if p.input != p.channel {
+		fmt.Fprintf(w, "  redis outbox: %d of %d -> %s -> buffer\n", len(p.input), cap(p.input), redactFlag("redis", p.cfg.Redis))
+	}
+	p.bufMu.RUnlock()
+	switch {
+	case p.shards != nil:
+		for i, ch := range p.shards.shards {
+			fmt.Fprintf(w, "  buffer shard %d: %d of %d\n", i, len(ch), cap(ch))
+		}
+	case p.fair != nil:
+		for _, q := range p.fair.all() {
+			fmt.Fprintf(w, "  buffer topic %s: %d of %d\n", q.name(), len(q.ch), cap(q.ch))
+		}
+	default:
+		fmt.Fprintf(w, "  buffer: %d of %d\n", p.buffered(), p.bufferCap())
+	}
+	fmt.Fprintf(w, "  pool %s: %d consumers\n", defaultPool, consumers)
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ch := p.pools[name].channel
+		fmt.Fprintf(w, "  pool %s: buffer %d of %d, %d consumers\n", name, len(ch), cap(ch), pools[name])
+	}
+	fmt.Fprintf(w, "  consumers handling an item: %d\n", p.handling())
+	switch {
+	case p.routed != nil:
+		for _, name := range p.routed.names {
+			fmt.Fprintf(w, "  -> sink %s\n", name)
+		}
+	case p.cfg.Sink != "":
+		fmt.Fprintf(w, "  -> sink %s\n", redactFlag("sink", p.cfg.Sink))
+	case p.stream != nil:
+		fmt.Fprintln(w, "  -> ranged over with Items")
+	default:
+		fmt.Fprintln(w, "  -> printed")
+	}
+}
+
+func (d *deadlockWatch) printSummary(w io.Writer) {
+	fmt.Fprintf(w, "deadlock watch: %d stalls of %s or more found\n", d.stalls.Load(), d.after)
+}
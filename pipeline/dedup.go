@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupWindow makes producing idempotent: an item whose IdempotencyKey was
+// already produced in the last -dedup-window is dropped as a duplicate
+// rather than put on the buffers again, so a producer that retries after a
+// lost response, over -ingest or any other transport that carries the key,
+// doesn't make the item twice. Items without a key always get through.
+// Keys are remembered for the window only, so the memory it takes grows
+// with the rate items are produced at times the window.
+type dedupWindow struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []dedupKey // oldest first, for forgetting keys
+}
+
+type dedupKey struct {
+	key string
+	at  time.Time
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{window: window, seen: make(map[string]time.Time)}
+}
+
+// admit reports whether an item may be produced, remembering its key if
+// so. Safe on a nil window, which admits everything.
+func (d *dedupWindow) admit(item *Item) bool {
+	if d == nil || item.IdempotencyKey == "" {
+		return true
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for ; n < len(d.order) && now.Sub(d.order[n].at) >= d.window; n++ {
+		delete(d.seen, d.order[n].key)
+	}
+	d.order = d.order[n:]
+	if _, ok := d.seen[item.IdempotencyKey]; ok {
+		return false
+	}
+	d.seen[item.IdempotencyKey] = now
+	d.order = append(d.order, dedupKey{item.IdempotencyKey, now})
+	return true
+}
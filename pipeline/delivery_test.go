@@ -0,0 +1,237 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// how many random runs TestExactlyOnce and TestAtLeastOnce make
+const deliveryRuns = 24
+
+// a built-in producer's item, numbered with -check-sequence
+type itemKey struct {
+	producer int
+	seq      int64
+}
+
+// fails each item transiently for its first few attempts, which the
+// pipeline retries
+type flakyHandler struct {
+	mu       sync.Mutex
+	r        *rand.Rand
+	failRate float64
+	fails    map[itemKey]int
+	attempts map[itemKey]int
+	// set once the run is over, after which nothing should be handled
+	closed bool
+	late   int
+}
+
+type transientError struct{ error }
+
+func (transientError) ErrorClass() ErrorClass { return ClassTransient }
+
+func (h *flakyHandler) Handle(item *Item) (*Item, error) {
+	k := itemKey{item.ProducerID, item.Seq}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		h.late++
+	}
+	h.attempts[k]++
+	if _, ok := h.fails[k]; !ok && h.r.Float64() < h.failRate {
+		// within the -retries the run has
+		h.fails[k] = 1 + h.r.Intn(3)
+	}
+	if h.attempts[k] <= h.fails[k] {
+		return nil, transientError{errors.New("not yet")}
+	}
+	return item, nil
+}
+
+// counts the items written to it, and the order each producer's came in.
+// With a failRate it fails some items for their first few writes once it
+// has written them, as a sink whose acknowledgements get lost does, so the
+// pipeline writes them again.
+type countingSink struct {
+	mu       sync.Mutex
+	r        *rand.Rand
+	failRate float64
+	fails    map[itemKey]int
+	written  map[itemKey]int
+	order    map[int][]int64
+	closed   bool
+	late     int
+}
+
+func (s *countingSink) Write(item *Item) error {
+	k := itemKey{item.ProducerID, item.Seq}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.late++
+	}
+	s.written[k]++
+	s.order[k.producer] = append(s.order[k.producer], k.seq)
+	if _, ok := s.fails[k]; !ok && s.failRate > 0 && s.r.Float64() < s.failRate {
+		s.fails[k] = 1 + s.r.Intn(3)
+	}
+	if s.written[k] <= s.fails[k] {
+		return transientError{errors.New("lost the ack")}
+	}
+	return nil
+}
+
+// every item produced is written to the sink once, whatever the buffer is
+// resized to meanwhile, however many of them are retried, and whether the
+// run finishes or is drained early
+func TestExactlyOnce(t *testing.T) {
+	for seed := int64(1); seed <= deliveryRuns; seed++ {
+		t.Run(strconv.FormatInt(seed, 10), func(t *testing.T) {
+			t.Parallel()
+			deliveryRun(t, rand.New(rand.NewSource(seed)), false)
+		})
+	}
+}
+
+// with a sink that fails after writing, every item produced is written to
+// it at least once, and only those
+func TestAtLeastOnce(t *testing.T) {
+	for seed := int64(1); seed <= deliveryRuns; seed++ {
+		t.Run(strconv.FormatInt(seed, 10), func(t *testing.T) {
+			t.Parallel()
+			deliveryRun(t, rand.New(rand.NewSource(seed)), true)
+		})
+	}
+}
+
+// a run with random counts, failures, resizes and maybe a drain. Besides
+// the delivery it checks that nothing is handled or written once Run has
+// returned, and with -sink-order-key that each producer's items are
+// written in the order it made them.
+func deliveryRun(t *testing.T, r *rand.Rand, atLeastOnce bool) {
+	args := []string{
+		"-producers", strconv.Itoa(1 + r.Intn(4)),
+		"-items", strconv.Itoa(5 + r.Intn(40)),
+		"-consumers", strconv.Itoa(1 + r.Intn(6)),
+		"-buffer", strconv.Itoa(1 + r.Intn(20)),
+		"-delay", fmt.Sprintf("%dus", r.Intn(2000)),
+		"-retries", "3",
+		"-retry-backoff", "100us",
+		"-check-sequence",
+	}
+	ordered := r.Intn(2) == 0
+	if ordered {
+		args = append(args, "-sink-order-key", "ProducerID", "-sink-writers", strconv.Itoa(1+r.Intn(3)))
+	}
+	cfg, err := ParseConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &flakyHandler{r: rand.New(rand.NewSource(r.Int63())), failRate: r.Float64() / 2,
+		fails: make(map[itemKey]int), attempts: make(map[itemKey]int)}
+	sink := &countingSink{r: rand.New(rand.NewSource(r.Int63())),
+		fails: make(map[itemKey]int), written: make(map[itemKey]int), order: make(map[int][]int64)}
+	if atLeastOnce {
+		sink.failRate = r.Float64() / 2
+	}
+	p, err := New(cfg, WithHandler(h), WithSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resizes := r.Intn(4)
+	sizes, waits := make([]int, resizes), make([]time.Duration, resizes)
+	for i := range sizes {
+		sizes[i] = 1 + r.Intn(20)
+		waits[i] = time.Duration(r.Intn(5000)) * time.Microsecond
+	}
+	drainAfter := time.Duration(-1)
+	if r.Intn(3) == 0 {
+		drainAfter = time.Duration(r.Intn(5000)) * time.Microsecond
+	}
+	t.Logf("%v, %.0f%% of items failing, %.0f%% of writes, resized to %v, drained after %v",
+		args, h.failRate*100, sink.failRate*100, sizes, drainAfter)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+	var resizing sync.WaitGroup
+	resizing.Add(1)
+	go func() {
+		defer resizing.Done()
+		for i, size := range sizes {
+			time.Sleep(waits[i])
+			// a resize may be turned down once the run is draining
+			p.resizeBuffer(size)
+		}
+	}()
+	defer resizing.Wait()
+	if drainAfter >= 0 {
+		time.Sleep(drainAfter)
+		p.drain()
+	}
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the pipeline didn't finish")
+	}
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	sink.mu.Lock()
+	sink.closed = true
+	sink.mu.Unlock()
+	if err := p.Produce(context.Background(), Item{ProducerID: -1}); !errors.Is(err, ErrPipelineClosed) {
+		t.Errorf("producing once the run was over gave %v", err)
+	}
+	// for anything left running to show itself
+	time.Sleep(10 * time.Millisecond)
+	h.mu.Lock()
+	if h.late > 0 {
+		t.Errorf("%d items were handled once the run was over", h.late)
+	}
+	h.mu.Unlock()
+
+	p.stats.mu.Lock()
+	produced, consumed := p.stats.produced, p.stats.consumed
+	p.stats.mu.Unlock()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.late > 0 {
+		t.Errorf("%d items were written once the run was over", sink.late)
+	}
+	for k, n := range sink.written {
+		if n != 1 && !atLeastOnce {
+			t.Errorf("item %d of producer %d was written %d times", k.seq, k.producer, n)
+		}
+	}
+	if ordered {
+		for producer, seqs := range sink.order {
+			for i := 1; i < len(seqs); i++ {
+				// an item written again follows itself
+				if seqs[i] < seqs[i-1] || seqs[i] == seqs[i-1] && !atLeastOnce {
+					t.Errorf("producer %d's items were written in the order %v", producer, seqs)
+					break
+				}
+			}
+		}
+	}
+	if int64(len(sink.written)) != produced {
+		t.Errorf("%d items were produced and %d written", produced, len(sink.written))
+	}
+	if drainAfter < 0 && produced != int64(cfg.Producers*cfg.ItemsPerProducer) {
+		t.Errorf("%d items were produced, expected %d", produced, cfg.Producers*cfg.ItemsPerProducer)
+	}
+	if consumed != produced {
+		t.Errorf("%d items were produced and %d consumed", produced, consumed)
+	}
+}
@@ -0,0 +1,253 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many dead letters are kept in memory for inspection
+const dlqMemoryLimit = 1000
+
+// EventDLQThreshold is sent once when the dead-letter queue grows past the
+// configured alert threshold
+const EventDLQThreshold = "dlq_threshold"
+
+// the Metadata key a requeued item carries the id of its first dead letter
+// under, which its redelivery history is kept by
+const dlqIDKey = "dlq_id"
+
+// DeadLetter is an item that couldn't be processed, along with why. ID
+// numbers it in the run's queue, and History is the times the item was
+// dead-lettered before, when it has been requeued.
+type DeadLetter struct {
+	ID      int64               `json:"id,omitempty"`
+	Item    Item                `json:"item"`
+	Reason  string              `json:"reason"`
+	Time    time.Time           `json:"time"`
+	History []DeadLetterAttempt `json:"history,omitempty"`
+}
+
+// DeadLetterAttempt is one earlier time a requeued item was dead-lettered
+type DeadLetterAttempt struct {
+	ID       int64     `json:"id"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+	Requeued time.Time `json:"requeued"`
+}
+
+// deadLetterQueue collects items that were rejected rather than handled.
+// The most recent ones are kept in memory, and every one is appended as a
+// json line to the dlq file when one is configured. Those in memory can be
+// listed and requeued through the admin API, and a requeued item that is
+// dead-lettered again comes back with the history of its earlier tries.
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	recent  []DeadLetter
+	count   int64
+	file    *os.File
+	enc     *json.Encoder
+	alertAt int64
+	alerted bool
+	hooks   *eventHooks
+	// the earlier dead letters of requeued items, by their dlq_id
+	histories map[string][]DeadLetterAttempt
+	requeued  int64
+}
+
+func newDeadLetterQueue(path string, alertAt int64, hooks *eventHooks) (*deadLetterQueue, error) {
+	q := &deadLetterQueue{alertAt: alertAt, hooks: hooks, histories: make(map[string][]DeadLetterAttempt)}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening dlq file: %v", err)
+		}
+		q.file = f
+		q.enc = json.NewEncoder(f)
+	}
+	return q, nil
+}
+
+// add an item to the queue, returning how many times it was dead-lettered
+// before
+func (q *deadLetterQueue) add(item Item, reason string) int {
+	dl := DeadLetter{Item: item, Reason: reason, Time: time.Now()}
+	q.mu.Lock()
+	q.count++
+	dl.ID = q.count
+	if id := item.Metadata[dlqIDKey]; id != "" {
+		dl.History = q.histories[id]
+	}
+	q.recent = append(q.recent, dl)
+	if len(q.recent) > dlqMemoryLimit {
+		q.recent = q.recent[1:]
+	}
+	if q.enc != nil {
+		if err := q.enc.Encode(dl); err != nil {
+			fmt.Printf("error writing dlq file: %v\n", err)
+		}
+	}
+	alert := q.alertAt > 0 && q.count >= q.alertAt && !q.alerted
+	if alert {
+		q.alerted = true
+	}
+	count := q.count
+	q.mu.Unlock()
+	if alert {
+		q.hooks.emit(newEvent(EventDLQThreshold, map[string]any{"count": count},
+			"dead-letter queue has reached %d items", count))
+	}
+	return len(dl.History)
+}
+
+// the dead letters in memory that keep says to, oldest first
+func (q *deadLetterQueue) list(keep func(*DeadLetter) bool) []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var found []DeadLetter
+	for i := range q.recent {
+		if keep(&q.recent[i]) {
+			found = append(found, q.recent[i])
+		}
+	}
+	return found
+}
+
+// take the dead letters that keep says to out of memory to requeue them,
+// noting each in its item's history. The items are returned ready to put
+// back on the buffers.
+func (q *deadLetterQueue) take(keep func(*DeadLetter) bool) ([]DeadLetter, []Item) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var taken, left []DeadLetter
+	var items []Item
+	now := time.Now()
+	for _, dl := range q.recent {
+		if !keep(&dl) {
+			left = append(left, dl)
+			continue
+		}
+		taken = append(taken, dl)
+		meta := make(map[string]string, len(dl.Item.Metadata)+1)
+		for k, v := range dl.Item.Metadata {
+			meta[k] = v
+		}
+		id := meta[dlqIDKey]
+		if id == "" {
+			id = strconv.FormatInt(dl.ID, 10)
+			meta[dlqIDKey] = id
+		}
+		q.histories[id] = append(dl.History, DeadLetterAttempt{ID: dl.ID, Reason: dl.Reason, Time: dl.Time, Requeued: now})
+		// only what was posted or read in goes back, as a new item
+		items = append(items, Item{
+			ID: dl.Item.ID, ProducerID: dl.Item.ProducerID, IdempotencyKey: dl.Item.IdempotencyKey, Metadata: meta, Payload: dl.Item.Payload,
+			Schema: dl.Item.Schema, SchemaVersion: dl.Item.SchemaVersion,
+		})
+	}
+	q.recent = left
+	q.requeued += int64(len(taken))
+	return taken, items
+}
+
+// put back dead letters that couldn't be requeued after all
+func (q *deadLetterQueue) restore(letters []DeadLetter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.recent = append(letters, q.recent...)
+	q.requeued -= int64(len(letters))
+	sort.Slice(q.recent, func(i, j int) bool { return q.recent[i].ID < q.recent[j].ID })
+}
+
+func (q *deadLetterQueue) size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+func (q *deadLetterQueue) Close() error {
+	if q == nil || q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
+
+// a filter over dead letters from a request's ?filter= expression on the
+// item and ?reason= text its reason has to contain
+func dlqFilter(r *http.Request) (func(*DeadLetter) bool, error) {
+	q := r.URL.Query()
+	var cond *expr
+	if src := q.Get("filter"); src != "" {
+		var err error
+		if cond, err = compileExpr(src); err != nil {
+			return nil, err
+		}
+	}
+	reason := q.Get("reason")
+	return func(dl *DeadLetter) bool {
+		if !strings.Contains(dl.Reason, reason) {
+			return false
+		}
+		if cond == nil {
+			return true
+		}
+		ok, err := cond.match(&dl.Item)
+		return ok && err == nil
+	}, nil
+}
+
+// GET /pipelines/{name}/dlq lists the dead letters held in memory
+func (a *adminServer) dlqList(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	keep, err := dlqFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	found := p.dlq.list(keep)
+	if found == nil {
+		found = []DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// POST /pipelines/{name}/dlq/requeue puts dead letters back on the buffers
+func (a *adminServer) dlqRequeue(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	keep, err := dlqFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := p.requeue(r.Context(), keep)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"requeued": n})
+}
+
+// put the dead letters keep picks back on the buffers as new items, all of
+// them or, when the pipeline is draining or ctx is done first, none
+func (p *Pipeline) requeue(ctx context.Context, keep func(*DeadLetter) bool) (int, error) {
+	letters, items := p.dlq.take(keep)
+	if len(items) == 0 {
+		return 0, nil
+	}
+	b := p.BeginBatch()
+	b.redeliver = true
+	for _, item := range items {
+		b.Add(item)
+	}
+	if err := b.CommitContext(ctx); err != nil {
+		b.Rollback()
+		p.dlq.restore(letters)
+		return 0, err
+	}
+	fmt.Printf("requeued %d dead letters\n", len(items))
+	return len(items), nil
+}
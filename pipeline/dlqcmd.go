@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dlqMain runs go_producer_consumer dlq, which looks at the dead letters
+// of a running pipeline and puts them back through it, over its admin API:
+//
+//	go_producer_consumer dlq list -admin localhost:8081 -filter 'Metadata.source == "billing"'
+//	go_producer_consumer dlq requeue -admin localhost:8081 -reason timeout
+//
+// Only the dead letters the pipeline still holds in memory, its most
+// recent ones, can be reached this way; the -dlq file keeps the rest. The
+// admin token comes from -token or $ADMIN_TOKEN.
+func dlqMain(args []string, out io.Writer) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "requeue") {
+		fmt.Fprintln(out, "usage: go_producer_consumer dlq list|requeue [flags]")
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("dlq "+cmd, flag.ContinueOnError)
+	fs.SetOutput(out)
+	admin := fs.String("admin", "localhost:8081", "the pipeline's admin API, as host:port, https://host:port or unix:<path>")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin API bearer token (default $ADMIN_TOKEN)")
+	name := fs.String("pipeline", "default", "name of the pipeline")
+	filter := fs.String("filter", "", "only dead letters whose item matches this expression")
+	reason := fs.String("reason", "", "only dead letters whose reason contains this")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	client, base := adminClient(*admin)
+	q := url.Values{}
+	if *filter != "" {
+		q.Set("filter", *filter)
+	}
+	if *reason != "" {
+		q.Set("reason", *reason)
+	}
+	method, path := http.MethodGet, "/dlq"
+	if cmd == "requeue" {
+		method, path = http.MethodPost, "/dlq/requeue"
+	}
+	req, err := http.NewRequest(method, base+"/pipelines/"+url.PathEscape(*name)+path+"?"+q.Encode(), nil)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(out, "dlq %s: %v\n", cmd, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		fmt.Fprintf(out, "dlq %s: %s: %s\n", cmd, resp.Status, e.Error)
+		return 1
+	}
+	if cmd == "requeue" {
+		var r struct{ Requeued int }
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			fmt.Fprintf(out, "dlq requeue: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(out, "requeued %d dead letters\n", r.Requeued)
+		return 0
+	}
+	var letters []DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letters); err != nil {
+		fmt.Fprintf(out, "dlq list: %v\n", err)
+		return 1
+	}
+	for _, dl := range letters {
+		printDeadLetter(out, dl)
+	}
+	fmt.Fprintf(out, "%d dead letters\n", len(letters))
+	return 0
+}
+
+// one line per dead letter, then one per earlier time it was
+// dead-lettered, so items that keep failing stand out
+func printDeadLetter(w io.Writer, dl DeadLetter) {
+	again := ""
+	if n := len(dl.History); n > 0 {
+		again = fmt.Sprintf(", dead-lettered %d times", n+1)
+	}
+	fmt.Fprintf(w, "%d: item %d of producer %d at %s%s: %s\n", dl.ID, dl.Item.ID, dl.Item.ProducerID,
+		dl.Time.Format(time.RFC3339), again, dl.Reason)
+	for _, h := range dl.History {
+		fmt.Fprintf(w, "    %d at %s, requeued at %s: %s\n", h.ID, h.Time.Format(time.RFC3339),
+			h.Requeued.Format(time.RFC3339), h.Reason)
+	}
+}
+
+// an HTTP client for an admin API address and the base url to use with it
+func adminClient(addr string) (*http.Client, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		var d net.Dialer
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, "unix", path)
+			},
+		}}, "http://admin"
+	}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return http.DefaultClient, strings.TrimSuffix(addr, "/")
+	}
+	return http.DefaultClient, "http://" + addr
+}
@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DropReason is why the pipeline discarded an item
+type DropReason string
+
+const (
+	DropFull      DropReason = "full"      // the buffer had no room and -buffer-full isn't block
+	DropExpired   DropReason = "expired"   // older than -ttl by the time a consumer got to it
+	DropShed      DropReason = "shed"      // shed by the -memory-limit guard
+	DropFiltered  DropReason = "filtered"  // didn't match -filter
+	DropInvalid   DropReason = "invalid"   // its payload didn't fit its schema
+	DropUnmatched DropReason = "unmatched" // found no partner in an inner join
+	DropLate      DropReason = "late"      // a join source item that came after its match gave up
+	DropDuplicate DropReason = "duplicate" // its IdempotencyKey was produced within -dedup-window
+	DropCorrupt   DropReason = "corrupt"   // its payload didn't match its -checksum
+	DropEvicted   DropReason = "evicted"   // older than -evict-after while still on a buffer
+)
+
+var dropReasons = []DropReason{DropFull, DropExpired, DropShed, DropFiltered, DropInvalid, DropUnmatched, DropLate, DropDuplicate, DropCorrupt, DropEvicted}
+
+// what can become of a discarded item
+const (
+	dropDiscard = "drop" // counted, and written to the drop log if there is one
+	dropDLQ     = "dlq"  // sent to the dead-letter queue
+)
+
+// how producers treat a full buffer
+const (
+	fullBlock      = "block"       // wait for room
+	fullDropNewest = "drop"        // drop the item that didn't fit
+	fullDropOldest = "drop-oldest" // make room by dropping the item that has waited longest
+)
+
+// DroppedItem is a line of the drop log
+type DroppedItem struct {
+	Item   Item       `json:"item"`
+	Reason DropReason `json:"reason"`
+	Detail string     `json:"detail,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+// DropPolicy is the one place the pipeline discards items, whatever the
+// reason. Every drop is counted by reason, and each reason can be set with
+// -drop to either drop the item, writing it to the -drop-log file when
+// there is one, or dead-letter it. Invalid and corrupt items are
+// dead-lettered unless told otherwise, and late join items follow
+// -join-late; everything else is dropped.
+type DropPolicy struct {
+	actions map[DropReason]string
+	stats   *Stats
+	dead    func(item Item, reason string)
+	trace   *tracer
+
+	mu  sync.Mutex
+	log *os.File
+	enc *json.Encoder
+}
+
+func newDropPolicy(cfg *Config, stats *Stats, dead func(Item, string)) (*DropPolicy, error) {
+	if cfg.JoinLate != lateDrop && cfg.JoinLate != lateDLQ {
+		return nil, fmt.Errorf("unknown late arrival handling %q, expected drop or dlq", cfg.JoinLate)
+	}
+	d := &DropPolicy{
+		actions: map[DropReason]string{DropInvalid: dropDLQ, DropCorrupt: dropDLQ, DropLate: cfg.JoinLate},
+		stats:   stats,
+		dead:    dead,
+	}
+	if cfg.Drops != "" {
+		for _, rule := range strings.Split(cfg.Drops, ",") {
+			reason, action, ok := strings.Cut(strings.TrimSpace(rule), "=")
+			if !ok || (action != dropDiscard && action != dropDLQ) {
+				return nil, fmt.Errorf("drop policy %q: expected <reason>=drop or <reason>=dlq", rule)
+			}
+			if !knownDropReason(DropReason(reason)) {
+				return nil, fmt.Errorf("drop policy %q: unknown reason, expected one of %s", rule, joinReasons(dropReasons))
+			}
+			d.actions[DropReason(reason)] = action
+		}
+	}
+	if cfg.DropLog != "" {
+		f, err := os.OpenFile(cfg.DropLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening drop log: %v", err)
+		}
+		d.log, d.enc = f, json.NewEncoder(f)
+	}
+	return d, nil
+}
+
+func knownDropReason(r DropReason) bool {
+	for _, known := range dropReasons {
+		if r == known {
+			return true
+		}
+	}
+	return false
+}
+
+func joinReasons(rs []DropReason) string {
+	s := make([]string, len(rs))
+	for i, r := range rs {
+		s[i] = string(r)
+	}
+	return strings.Join(s, ", ")
+}
+
+// discard an item, with detail saying more about why when there's more to
+// say. The caller still settles the item, as for one that was handled.
+func (d *DropPolicy) drop(item Item, reason DropReason, detail string) {
+	item.pending.failed(&DropError{ID: item.ID, Reason: reason, Detail: detail}, false)
+	d.stats.recordDrop(reason)
+	if d.actions[reason] == dropDLQ {
+		why := string(reason)
+		if detail != "" {
+			why = detail
+		}
+		d.dead(item, why)
+		return
+	}
+	d.trace.nack(&item, 0, nackDropped)
+	if d.enc == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.enc.Encode(DroppedItem{Item: item, Reason: reason, Detail: detail, Time: time.Now()}); err != nil {
+		fmt.Printf("error writing drop log: %v\n", err)
+	}
+}
+
+func (d *DropPolicy) Close() error {
+	if d == nil || d.log == nil {
+		return nil
+	}
+	return d.log.Close()
+}
+
+// the drop counts as "reason n" pairs, in a stable order
+func formatDrops(counts map[DropReason]int64) string {
+	reasons := make([]string, 0, len(counts))
+	for r := range counts {
+		reasons = append(reasons, string(r))
+	}
+	sort.Strings(reasons)
+	for i, r := range reasons {
+		reasons[i] = fmt.Sprintf("%s %d", r, counts[DropReason(r)])
+	}
+	return strings.Join(reasons, ", ")
+}
@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// dryRun is -dry-run: it checks the flags as a run would, draws the
+// pipeline they make as the graph command does, and prints the plan, the
+// stages with their workers, the rates, the sinks and the most memory the
+// items can take while they wait, then exits without making an item. It
+// opens nothing, so a sink or source that is only wrong once connected to
+// gets past it, though the preflight checks still look at what the flags
+// name unless -skip-preflight is set. It returns the exit code.
+func dryRun(cfg *Config, w io.Writer) int {
+	t, err := newTopology(cfg, nil)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 2
+	}
+	for _, spec := range []string{cfg.Source, cfg.JoinSource, cfg.Handler, cfg.CanaryHandler, cfg.ShadowHandler, cfg.Sink} {
+		if spec == "" {
+			continue
+		}
+		if _, _, err := splitPluginSpec(spec); err != nil {
+			fmt.Fprintln(w, err)
+			return 2
+		}
+	}
+
+	fmt.Fprintf(w, "dry run of pipeline %s, nothing is produced\n", cfg.Name)
+	if p, ok := presets[cfg.Preset]; ok {
+		fmt.Fprintf(w, "preset %s: %s\n", cfg.Preset, p.about)
+	}
+	fmt.Fprintln(w, "stages:")
+	for _, n := range t.nodes {
+		fmt.Fprintf(w, "  %s: %s\n", n.id, strings.Join(n.lines, ", "))
+	}
+	for _, e := range t.edges {
+		fmt.Fprintf(w, "  %s -> %s", e.from, e.to)
+		if e.label != "" {
+			fmt.Fprintf(w, " (%s)", e.label)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "rates:")
+	switch {
+	case cfg.Daemon:
+		fmt.Fprintf(w, "  items: as many as are posted to %s until stopped\n", cfg.Ingest)
+	case cfg.Source != "":
+		fmt.Fprintf(w, "  items: as many as %s has\n", redactFlag("source", cfg.Source))
+	case !cfg.AutoProducers:
+		fmt.Fprintf(w, "  items: %d, %d from each of %d producers\n", cfg.Producers*cfg.ItemsPerProducer, cfg.ItemsPerProducer, cfg.Producers)
+	}
+	if cfg.Rate > 0 {
+		fmt.Fprintf(w, "  produced: at most %.1f items/s", cfg.Rate)
+		if cfg.Producers > 0 && !cfg.AutoProducers {
+			fmt.Fprintf(w, ", %.1f from each producer", cfg.Rate/float64(cfg.Producers))
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintln(w, "  produced: as fast as the buffers take them")
+	}
+	if cfg.ConsumeDelay > 0 && !cfg.AutoConsumers {
+		most := float64(cfg.Consumers) / cfg.ConsumeDelay.Seconds()
+		fmt.Fprintf(w, "  consumed: at most %.1f items/s by the default pool, %d consumers at %s an item\n", most, cfg.Consumers, cfg.ConsumeDelay)
+		if cfg.Rate > most && len(cfg.Routes) == 0 {
+			fmt.Fprintf(w, "  the consumers can't keep up with -rate, the buffers will fill\n")
+		}
+	}
+
+	fmt.Fprintln(w, "sinks:")
+	for _, n := range t.nodes {
+		if n.kind == "sink" {
+			fmt.Fprintf(w, "  %s\n", strings.Join(n.lines, ", "))
+		}
+	}
+
+	fmt.Fprintln(w, "memory:")
+	for _, line := range planMemory(cfg) {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+
+	if !cfg.SkipPreflight {
+		if err := preflight(cfg); err != nil {
+			fmt.Fprintf(w, "preflight failed:\n%v\n", err)
+			return 1
+		}
+		fmt.Fprintln(w, "preflight: the files, commands and hosts the flags name are there")
+	}
+	return 0
+}
+
+// how much the items waiting in the pipeline can take at most: every slot
+// on every channel an item waits on full, at the largest an item can be,
+// as far as the flags say what that is
+func planMemory(cfg *Config) []string {
+	buffers := 1
+	pools := make(map[string]bool)
+	for _, s := range cfg.Routes {
+		if r, err := parseRoute(s); err == nil && r.pool != defaultPool && !pools[r.pool] {
+			pools[r.pool] = true
+			buffers++
+		}
+	}
+	consumers := cfg.Consumers
+	for _, s := range cfg.Pools {
+		if name, size, err := parsePoolSize(s); err == nil && pools[name] {
+			consumers += size
+		}
+	}
+	if cfg.CanaryHandler != "" {
+		buffers++
+		consumers += cfg.CanaryConsumers
+	}
+	slots := buffers * cfg.BufferSize
+	if cfg.Redis != "" {
+		// the outbox in front of redis
+		slots += cfg.BufferSize
+	}
+	if cfg.ProducerLanes > 0 {
+		slots += cfg.Producers * buffers * cfg.ProducerLanes
+	}
+	// the item each consumer has in hand, and those it fetched ahead
+	slots += consumers * (1 + cfg.Prefetch)
+	if cfg.ShadowHandler != "" {
+		slots += cfg.ShadowBuffer
+	}
+	if cfg.FairTopics != "" {
+		// a queue for each topic, and one each for the items of none and
+		// of the topics past the most
+		slots += (cfg.FairMaxTopics + 1) * cfg.BufferSize
+	}
+
+	var lines []string
+	var size int64
+	switch {
+	case cfg.PayloadMax > 0:
+		size = itemOverhead + int64(cfg.PayloadMax)
+	case cfg.PayloadSize != "":
+		if g, err := parsePayloadSize(cfg.PayloadSize); err == nil && g.most() > 0 && cfg.Ingest == "" {
+			size = itemOverhead + int64(g.most())
+		}
+	case cfg.Source == "" && cfg.Ingest == "" && cfg.SchemaVersion == 0:
+		// the built-in items have no payload
+		size = itemOverhead
+	}
+	switch {
+	case size > 0 && cfg.BufferBytes > 0:
+		most := min(int64(slots)*size, int64(cfg.BufferBytes)+int64(consumers)*size)
+		lines = append(lines, fmt.Sprintf("items: at most %s, %d slots of up to %s, the buffers bounded by -buffer-bytes %s",
+			formatBytes(most), slots, formatBytes(size), formatBytes(int64(cfg.BufferBytes))))
+	case size > 0:
+		lines = append(lines, fmt.Sprintf("items: at most %s, %d slots of up to %s", formatBytes(int64(slots)*size), slots, formatBytes(size)))
+	case cfg.BufferBytes > 0:
+		lines = append(lines, fmt.Sprintf("items: %d slots, the buffers bounded by -buffer-bytes %s, plus the payloads of the items in hand",
+			slots, formatBytes(int64(cfg.BufferBytes))))
+	default:
+		lines = append(lines, fmt.Sprintf("items: %d slots of %s plus their payloads, unbounded without -buffer-bytes or -payload-max",
+			slots, formatBytes(itemOverhead)))
+	}
+	if cfg.MemoryLimit > 0 {
+		lines = append(lines, fmt.Sprintf("held under -memory-limit %s by shedding and holding the producers back", formatBytes(int64(cfg.MemoryLimit))))
+	}
+	if cfg.DedupWindow > 0 {
+		lines = append(lines, fmt.Sprintf("and the keys of the items produced in the last %s, for -dedup-window", cfg.DedupWindow))
+	}
+	if cfg.JoinSource != "" {
+		lines = append(lines, fmt.Sprintf("and the items waiting up to %s for their partner, for -join-source", cfg.JoinWindow.Round(time.Millisecond)))
+	}
+	return lines
+}
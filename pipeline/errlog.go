@@ -0,0 +1,110 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+)
+
+// errorSampler keeps the error messages of a run from flooding the output
+// when a handler or sink fails in bulk. The first -error-log-first errors
+// are printed, then only one in every -error-log-every, and each is counted
+// by its type, the message with its numbers taken out, so the summary can
+// say what went wrong however much was left unprinted. It is guarded by
+// the Stats mutex.
+type errorSampler struct {
+	first, every int64
+	seen         int64
+	suppressed   int64
+	kinds        map[string]int64
+}
+
+// the most error types counted apart, beyond which they are lumped together
+const maxErrorKinds = 100
+
+var errorNumbers = regexp.MustCompile(`[0-9]+`)
+
+// ErrorCount is how many errors of one type a run had
+type ErrorCount struct {
+	Kind  string
+	Count int64
+}
+
+// how many errors to print before sampling starts, and then print one in
+// every. An every of 0 prints none after the first.
+func (s *Stats) sampleErrors(first, every int) {
+	s.mu.Lock()
+	s.errs.first, s.errs.every = int64(first), int64(every)
+	s.mu.Unlock()
+}
+
+// count an error and print it unless it is sampled out
+func (s *Stats) errorf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.mu.Lock()
+	s.errors++
+	e := &s.errs
+	if e.kinds == nil {
+		e.kinds = make(map[string]int64)
+	}
+	kind := errorNumbers.ReplaceAllString(msg, "N")
+	if len(kind) > 120 {
+		kind = kind[:120] + "..."
+	}
+	if _, ok := e.kinds[kind]; !ok && len(e.kinds) >= maxErrorKinds {
+		kind = "other"
+	}
+	e.kinds[kind]++
+	e.seen++
+	show := e.seen <= e.first || e.every > 0 && (e.seen-e.first)%e.every == 0
+	if !show {
+		e.suppressed++
+	}
+	seen, first, every, suppressed := e.seen, e.first, e.every, e.suppressed
+	s.mu.Unlock()
+	switch {
+	case show && seen > first:
+		fmt.Printf("%s (%d errors so far, %d not printed)\n", msg, seen, suppressed)
+	case show:
+		fmt.Println(msg)
+	case seen == first+1 && every > 0:
+		fmt.Printf("more than %d errors, printing only 1 in %d from now on\n", first, every)
+	case seen == first+1:
+		fmt.Printf("more than %d errors, printing no more\n", first)
+	}
+}
+
+// the run's errors by type, the commonest first, called with s.mu held
+func (s *Stats) errorKinds() []ErrorCount {
+	kinds := make([]ErrorCount, 0, len(s.errs.kinds))
+	for kind, n := range s.errs.kinds {
+		kinds = append(kinds, ErrorCount{kind, n})
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if kinds[i].Count != kinds[j].Count {
+			return kinds[i].Count > kinds[j].Count
+		}
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	return kinds
+}
+
+// print the commonest error types, called with s.mu held
+func (s *Stats) printErrors(w io.Writer) {
+	kinds := s.errorKinds()
+	if len(kinds) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "errors by type:\n")
+	for i, k := range kinds {
+		if i == 10 {
+			fmt.Fprintf(w, "  and %d more types\n", len(kinds)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %d x %s\n", k.Count, k.Kind)
+	}
+	if s.errs.suppressed > 0 {
+		fmt.Fprintf(w, "%d error messages were not printed\n", s.errs.suppressed)
+	}
+}
@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+)
+
+// The failures a program embedding a pipeline can tell apart with
+// errors.Is, whatever else the error returned says
+var (
+	// ErrBufferFull is returned when an item couldn't be put on a buffer
+	// for want of room, because the caller gave up waiting or -buffer-full
+	// had it dropped
+	ErrBufferFull = errors.New("buffer full")
+	// ErrPipelineClosed is returned when a pipeline that is draining or
+	// has finished is given more work
+	ErrPipelineClosed = errors.New("pipeline closed")
+	// ErrHandlerTimeout is what a handler call failed with when it took
+	// longer than -handler-timeout
+	ErrHandlerTimeout = errors.New("handler timed out")
+	// ErrDroppedByPolicy is returned for an item the pipeline discarded,
+	// see DropError for why
+	ErrDroppedByPolicy = errors.New("dropped by policy")
+	// ErrRequestTimeout is returned by a Requester's Call when the reply
+	// doesn't come in time
+	ErrRequestTimeout = errors.New("request timed out")
+)
+
+// DropError is an item being discarded by the drop policy, for the reason
+// given. It is ErrDroppedByPolicy, and one dropped for a full buffer is
+// ErrBufferFull too.
+type DropError struct {
+	ID     int
+	Reason DropReason
+	Detail string
+}
+
+func (e *DropError) Error() string {
+	s := fmt.Sprintf("item %d dropped: %s", e.ID, e.Reason)
+	if e.Detail != "" {
+		s += ", " + e.Detail
+	}
+	return s
+}
+
+func (e *DropError) Is(target error) bool {
+	return target == ErrDroppedByPolicy || (target == ErrBufferFull && e.Reason == DropFull)
+}
+
+// timeoutError is a handler call that went on too long. It is worth
+// trying again, as a slow dependency may well have recovered.
+type timeoutError struct {
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%v after %s", ErrHandlerTimeout, e.after)
+}
+
+func (e *timeoutError) Is(target error) bool { return target == ErrHandlerTimeout }
+
+func (e *timeoutError) ErrorClass() ErrorClass { return ClassTransient }
+
+// timeoutHandler gives up on calls to a handler that take longer than
+// -handler-timeout. A handler can't be interrupted, so a call given up on
+// goes on by itself with its own copy of the item, and whatever it comes
+// to is thrown away, though a ContextHandler is told through its context.
+// A handler that takes one item at a time, as an exec one does, is still
+// busy with it, so the calls after it may time out too.
+type timeoutHandler struct {
+	Handler
+	after time.Duration
+}
+
+// timeoutSplitter is a timeoutHandler for a handler that splits items
+type timeoutSplitter struct {
+	timeoutHandler
+	split Splitter
+}
+
+// limit a handler's calls to d, keeping it a Splitter if it is one
+func withTimeout(h Handler, d time.Duration) Handler {
+	t := timeoutHandler{Handler: h, after: d}
+	if s, ok := h.(Splitter); ok {
+		return &timeoutSplitter{t, s}
+	}
+	return &t
+}
+
+type handled struct {
+	items []Item
+	out   *Item
+	err   error
+}
+
+// run a call on a copy of the item, which becomes the item if the call
+// finishes in time
+func (t *timeoutHandler) call(ctx context.Context, item *Item, fn func(context.Context, *Item) handled) handled {
+	ctx, cancel := context.WithTimeout(ctx, t.after)
+	defer cancel()
+	c := *item
+	c.Metadata = maps.Clone(item.Metadata)
+	done := make(chan handled, 1)
+	go func() { done <- fn(ctx, &c) }()
+	select {
+	case h := <-done:
+		if h.err != nil && errors.Is(h.err, context.DeadlineExceeded) && ctx.Err() != nil {
+			h.err = &timeoutError{t.after}
+		}
+		*item = c
+		return h
+	case <-ctx.Done():
+		return handled{err: &timeoutError{t.after}}
+	}
+}
+
+func (t *timeoutHandler) Handle(item *Item) (*Item, error) {
+	return t.HandleContext(context.Background(), item)
+}
+
+func (t *timeoutHandler) HandleContext(ctx context.Context, item *Item) (*Item, error) {
+	h := t.call(ctx, item, func(ctx context.Context, c *Item) handled {
+		out, err := handleWith(ctx, t.Handler, c)
+		return handled{out: out, err: err}
+	})
+	return h.out, h.err
+}
+
+func (t *timeoutSplitter) Split(item *Item) ([]Item, error) {
+	return t.SplitContext(context.Background(), item)
+}
+
+func (t *timeoutSplitter) SplitContext(ctx context.Context, item *Item) ([]Item, error) {
+	h := t.call(ctx, item, func(ctx context.Context, c *Item) handled {
+		items, err := splitWith(ctx, t.split, c)
+		return handled{items: items, err: err}
+	})
+	return h.items, h.err
+}
+
+func (t *timeoutHandler) Close() error {
+	if c, ok := t.Handler.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the id an item the evictor hands on is handled under, as it isn't any
+// consumer's
+const evictorID = -1
+
+// evictor keeps the buffers fresh for work that is worthless once stale,
+// evicting items older than -evict-after while they still wait rather than
+// when a consumer gets to them, as -ttl does, so the consumers of a
+// backlog aren't left to wade through it. It goes by the lag monitor's
+// record of how long the oldest item on each buffer has waited, taking
+// items off the front of the buffer while that is over the limit. A
+// consumer may take the oldest first, leaving the evictor with the one
+// behind it; that one is checked against its own age, and one young enough
+// to keep is handled there and then rather than put back out of order.
+// Evicted items go to the drop policy and are counted by producer.
+type evictor struct {
+	p       *Pipeline
+	after   time.Duration
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu         sync.Mutex
+	byProducer map[int]int64
+	evicted    int64
+	handedOn   int64
+}
+
+func newEvictor(p *Pipeline, cfg *Config) (*evictor, error) {
+	if cfg.Batch != "" {
+		return nil, fmt.Errorf("-evict-after doesn't work with -batch")
+	}
+	return &evictor{p: p, after: cfg.EvictAfter, done: make(chan struct{}), stopped: make(chan struct{}), byProducer: make(map[int]int64)}, nil
+}
+
+func (e *evictor) start() {
+	// often enough that nothing stays much past the limit
+	every := min(max(e.after/4, 10*time.Millisecond), time.Second)
+	go func() {
+		defer close(e.stopped)
+		tick := time.NewTicker(every)
+		defer tick.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case <-tick.C:
+			}
+			for _, g := range e.p.lag.groups {
+				e.sweep(g)
+			}
+		}
+	}()
+}
+
+// stop, waiting for an item being handed on to be done with
+func (e *evictor) stop() {
+	close(e.done)
+	<-e.stopped
+}
+
+// evict what has waited too long from the front of a group's buffer
+func (e *evictor) sweep(g *lagGroup) {
+	p := e.p
+	for {
+		if _, oldest := g.lag(); oldest <= e.after {
+			return
+		}
+		g.mu.Lock()
+		ch := g.ch
+		g.mu.Unlock()
+		var item Item
+		var ok bool
+		select {
+		case item, ok = <-ch:
+		default:
+			return
+		}
+		if !ok {
+			return
+		}
+		if age := time.Since(item.Timestamp); age <= e.after {
+			e.mu.Lock()
+			e.handedOn++
+			e.mu.Unlock()
+			p.consumeTaken(item, ch, evictorID)
+			return
+		}
+		p.lag.taken(ch)
+		p.budget.release(item.size)
+		unpack(&item)
+		p.drops.drop(item, DropEvicted, fmt.Sprintf("%s old on %s, over the %s -evict-after",
+			time.Since(item.Timestamp).Round(time.Millisecond), g.name, e.after))
+		p.settle(&item)
+		e.mu.Lock()
+		e.evicted++
+		e.byProducer[item.ProducerID]++
+		e.mu.Unlock()
+	}
+}
+
+func (e *evictor) printSummary(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	producers := make([]int, 0, len(e.byProducer))
+	for id := range e.byProducer {
+		producers = append(producers, id)
+	}
+	sort.Ints(producers)
+	var by []string
+	for _, id := range producers {
+		by = append(by, fmt.Sprintf("producer %d: %d", id, e.byProducer[id]))
+	}
+	fmt.Fprintf(w, "eviction: %d items older than %s evicted from the buffers", e.evicted, e.after)
+	if len(by) > 0 {
+		fmt.Fprintf(w, " (%s)", strings.Join(by, ", "))
+	}
+	if e.handedOn > 0 {
+		fmt.Fprintf(w, ", %d taken after a consumer beat it to the oldest and handled instead", e.handedOn)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,397 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a compiled expression such as `ID > 50 && ProducerID != 2` that
+// can be evaluated against an item. The language is deliberately small:
+//
+//	literals     42, 1.5, "text", true, false
+//	fields       ID, ProducerID, Schema, SchemaVersion, Metadata.<key>
+//	operators    ! - * / % + - < <= > >= == != && || and parentheses
+//
+// Values are numbers, strings or booleans. Comparing a number with a string
+// works if the string parses as a number, which is handy because metadata
+// values are always strings.
+type expr struct {
+	src  string
+	root node
+}
+
+// compile an expression so it can be evaluated cheaply for every item
+func compileExpr(src string) (*expr, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", src, err)
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseBinary(0)
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", src, err)
+	}
+	return &expr{src: src, root: root}, nil
+}
+
+func (e *expr) String() string {
+	return e.src
+}
+
+// evaluate the expression against an item
+func (e *expr) eval(item *Item) (any, error) {
+	return e.root.eval(item)
+}
+
+// evaluate the expression as a predicate. Anything that isn't a boolean is
+// an error rather than being quietly treated as false.
+func (e *expr) match(item *Item) (bool, error) {
+	v, err := e.root.eval(item)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q: result %v is not a boolean", e.src, v)
+	}
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokNumber tokenKind = iota
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokNumber, string(rs[i:j])})
+			i = j
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text, err := strconv.Unquote(string(rs[i : j+1]))
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokString, text})
+			i = j + 1
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{tokIdent, string(rs[i:j])})
+			i = j
+		default:
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				switch two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					toks = append(toks, token{tokOp, two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("!<>+-*/%()", r) {
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+			toks = append(toks, token{tokOp, string(r)})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+// binary operators from loosest to tightest binding
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type exprParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *exprParser) peekOp(ops []string) (string, bool) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.toks[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseBinary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp(precedence[level])
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (node, error) {
+	if op, ok := p.peekOp([]string{"!", "-"}); ok {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (node, error) {
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", t.text)
+		}
+		return literalNode{f}, nil
+	case tokString:
+		return literalNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		}
+		return fieldNode(t.text), nil
+	}
+	if t.text == "(" {
+		n, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp([]string{")"}); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+type node interface {
+	eval(item *Item) (any, error)
+}
+
+type literalNode struct{ v any }
+
+func (n literalNode) eval(*Item) (any, error) { return n.v, nil }
+
+// fieldNode looks up a field of the item by name
+type fieldNode string
+
+func (n fieldNode) eval(item *Item) (any, error) {
+	name := string(n)
+	switch name {
+	case "ID":
+		return float64(item.ID), nil
+	case "ProducerID":
+		return float64(item.ProducerID), nil
+	case "Schema":
+		return item.Schema, nil
+	case "SchemaVersion":
+		return float64(item.SchemaVersion), nil
+	}
+	if key, ok := strings.CutPrefix(name, "Metadata."); ok {
+		return item.Metadata[key], nil
+	}
+	return nil, fmt.Errorf("unknown field %q", name)
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(item *Item) (any, error) {
+	v, err := n.operand.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs a boolean, got %v", v)
+		}
+		return !b, nil
+	}
+	f, ok := toNumber(v)
+	if !ok {
+		return nil, fmt.Errorf("- needs a number, got %v", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(item *Item) (any, error) {
+	l, err := n.left.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short circuit so the right side may be skipped
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, l)
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := n.right.eval(item)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, r)
+		}
+		return rb, nil
+	}
+	r, err := n.right.eval(item)
+	if err != nil {
+		return nil, err
+	}
+	lf, lnum := toNumber(l)
+	rf, rnum := toNumber(r)
+	numeric := lnum && rnum
+	switch n.op {
+	case "==", "!=":
+		var eq bool
+		if numeric {
+			eq = lf == rf
+		} else {
+			eq = fmt.Sprint(l) == fmt.Sprint(r)
+		}
+		return eq == (n.op == "=="), nil
+	case "<", "<=", ">", ">=":
+		var cmp int
+		if numeric {
+			cmp = compareFloat(lf, rf)
+		} else {
+			cmp = strings.Compare(fmt.Sprint(l), fmt.Sprint(r))
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	}
+	if n.op == "+" && !numeric {
+		return fmt.Sprint(l) + fmt.Sprint(r), nil
+	}
+	if !numeric {
+		return nil, fmt.Errorf("%s needs numbers, got %v and %v", n.op, l, r)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		if rf == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return lf / rf, nil
+	}
+	if int64(rf) == 0 {
+		return nil, fmt.Errorf("modulo by zero")
+	}
+	return float64(int64(lf) % int64(rf)), nil
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// convert a value to a number if it is one, or is a string holding one
+func toNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,26 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func FuzzCompileExpr(f *testing.F) {
+	f.Add(`ID > 50 && ProducerID != 2`)
+	f.Add(`Payload.order.total >= 10.5 || Metadata.region == "eu"`)
+	f.Add(`!(ID % 3 == 0)`)
+	f.Add(`((((`)
+	f.Add(`"unterminated`)
+	item := &Item{ID: 7, ProducerID: 2, Timestamp: time.Unix(0, 0),
+		Payload: json.RawMessage(`{"order":{"total":12},"tags":["a"]}`), Metadata: map[string]string{"region": "eu"}}
+	f.Fuzz(func(t *testing.T, src string) {
+		e, err := compileExpr(src)
+		if err != nil {
+			return
+		}
+		// whatever compiles evaluates, or says why it can't
+		e.eval(item)
+		e.match(item)
+	})
+}
@@ -0,0 +1,387 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how -fair-topics takes turns between the topics
+const (
+	fairRoundRobin = "round-robin" // a topic's weight in items each turn
+	fairDeficit    = "deficit"     // a topic's weight in -fair-quantum bytes each turn
+)
+
+// the bytes a turn of weight 1 is worth with -fair-topics deficit, unless
+// -fair-quantum says otherwise
+const fairQuantum = 4 << 10
+
+// the most topics the summary lists, busiest first
+const fairSummaryTopics = 20
+
+// fairBuffer splits the default pool's buffer with -fair-topics into a
+// queue for each topic, so a flood of items on one topic can't starve
+// the others of the consumers. Each queue holds -buffer items, so a
+// flooding topic fills a queue of its own rather than the one the rest
+// wait behind, and the consumers go round the queues taking a turn's
+// worth off each. A turn is the topic's -fair-weight in items with
+// round-robin, or in -fair-quantum bytes with deficit, items counted as
+// -buffer-bytes counts them, which takes fewer of a topic's big items
+// than of another's small ones. Items can't be
+// looked at before they are taken, so one bigger than what is left of a
+// turn is taken on credit, which the topic's next turns pay off. A topic
+// with its queue empty gives up the rest of its turn. The topic is
+// -fair-key, or the item's mqtt_topic or topic metadata; only the first
+// -fair-max-topics get queues of their own, the rest sharing the other
+// queue. Items on different queues can be handled out of the order they
+// were produced in.
+type fairBuffer struct {
+	key     *expr // nil for the item's topic
+	deficit bool
+	quantum int
+	weights map[string]int
+	size    int
+	max     int
+
+	mu      sync.Mutex
+	queues  []*topicQueue
+	byTopic map[string]*topicQueue
+	next    int           // the queue whose turn it is
+	added   chan struct{} // closed, and made again, once a queue is added
+	closed  bool
+
+	byChan sync.Map // the queues by their channel, for what is handled
+}
+
+// a topic's queue, and what became of its items
+type topicQueue struct {
+	topic  string
+	ch     chan Item
+	weight int
+	credit int // what is left of its turn, under the buffer's mu
+
+	taken   atomic.Int64
+	wait    atomic.Int64 // nanoseconds, the items' queue latency summed
+	service atomic.Int64 // nanoseconds, the time handling them summed
+}
+
+func newFairBuffer(cfg *Config) (*fairBuffer, error) {
+	switch {
+	case cfg.FairTopics != fairRoundRobin && cfg.FairTopics != fairDeficit:
+		return nil, fmt.Errorf("unknown -fair-topics %q, expected %s or %s", cfg.FairTopics, fairRoundRobin, fairDeficit)
+	case cfg.FairMaxTopics < 1:
+		return nil, fmt.Errorf("-fair-max-topics must be at least 1")
+	case cfg.Redis != "":
+		return nil, fmt.Errorf("-fair-topics doesn't work with -redis, whose queue is the buffer")
+	case cfg.BufferShards > 1:
+		return nil, fmt.Errorf("-fair-topics doesn't work with -buffer-shards, which splits the buffer its own way")
+	case cfg.Batch != "":
+		return nil, fmt.Errorf("-fair-topics doesn't work with -batch")
+	case cfg.Prefetch > 0:
+		return nil, fmt.Errorf("-fair-topics doesn't work with -prefetch, which would take items ahead of their turn")
+	case cfg.StrictMemory:
+		return nil, fmt.Errorf("-fair-topics doesn't work with -strict-memory, as the topics' queues only come as their items do")
+	case cfg.LagMaxItems > 0 || cfg.LagMaxAge > 0 || cfg.EvictAfter > 0:
+		return nil, fmt.Errorf("-fair-topics doesn't work with -lag-max-items, -lag-max-age or -evict-after, which watch a fixed set of buffers")
+	}
+	b := &fairBuffer{
+		deficit: cfg.FairTopics == fairDeficit,
+		quantum: int(cfg.FairQuantum),
+		weights: make(map[string]int),
+		size:    cfg.BufferSize,
+		max:     cfg.FairMaxTopics,
+		byTopic: make(map[string]*topicQueue),
+		added:   make(chan struct{}),
+	}
+	if b.quantum <= 0 {
+		b.quantum = fairQuantum
+	}
+	if cfg.FairKey != "" {
+		key, err := compileExpr(cfg.FairKey)
+		if err != nil {
+			return nil, fmt.Errorf("-fair-key: %v", err)
+		}
+		b.key = key
+	}
+	for _, s := range cfg.FairWeights {
+		topic, n, ok := strings.Cut(s, "=")
+		weight, err := strconv.Atoi(n)
+		if !ok || err != nil || weight < 1 {
+			return nil, fmt.Errorf("-fair-weight %q: expected <topic>=<weight>, the weight 1 or more", s)
+		}
+		b.weights[topic] = weight
+	}
+	// the items with no topic have a queue from the start, which is the
+	// pipeline's channel
+	b.queue("")
+	return b, nil
+}
+
+// the queue of a topic, added if there isn't one. Called with b.mu held,
+// or before the buffer is shared.
+func (b *fairBuffer) queue(topic string) *topicQueue {
+	if q := b.byTopic[topic]; q != nil {
+		return q
+	}
+	weight := b.weights[topic]
+	if weight == 0 {
+		weight = 1
+	}
+	q := &topicQueue{topic: topic, ch: make(chan Item, b.size), weight: weight}
+	b.queues = append(b.queues, q)
+	b.byTopic[topic] = q
+	b.byChan.Store((<-chan Item)(q.ch), q)
+	// wake the consumers waiting on the queues there were to wait on this
+	// one too
+	close(b.added)
+	b.added = make(chan struct{})
+	return q
+}
+
+// the topic an item counts under
+func (b *fairBuffer) topic(item *Item) string {
+	if b.key == nil {
+		return itemTopic(item)
+	}
+	v, err := b.key.eval(item)
+	if err != nil || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// the queue an item goes on
+func (b *fairBuffer) pick(item *Item) chan Item {
+	topic := b.topic(item)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.byTopic[topic] == nil && topic != "" {
+		// the no topic and other queues don't count against
+		// -fair-max-topics
+		named := len(b.byTopic) - 1
+		if b.byTopic[otherKey] != nil {
+			named--
+		}
+		if named >= b.max {
+			topic = otherKey
+		}
+	}
+	return b.queue(topic).ch
+}
+
+// the credit a turn gives a topic
+func (b *fairBuffer) turn(q *topicQueue) int {
+	if b.deficit {
+		return q.weight * b.quantum
+	}
+	return q.weight
+}
+
+// what an item costs out of a turn
+func (b *fairBuffer) cost(item *Item) int {
+	if b.deficit {
+		return int(item.memSize())
+	}
+	return 1
+}
+
+// the next item due, taken off the topic whose turn it is without
+// waiting. Finding none, it gives back the queues to wait on, the channel
+// closed when another is added, and whether every queue is closed and
+// drained.
+func (b *fairBuffer) try() (Item, *topicQueue, []*topicQueue, chan struct{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for empty := 0; empty < len(b.queues); {
+		q := b.queues[b.next]
+		if q.credit <= 0 {
+			q.credit += b.turn(q)
+			if q.credit <= 0 {
+				// still paying off an item taken on credit
+				b.next = (b.next + 1) % len(b.queues)
+				continue
+			}
+		}
+		select {
+		case item, ok := <-q.ch:
+			if ok {
+				if q.credit -= b.cost(&item); q.credit <= 0 {
+					b.next = (b.next + 1) % len(b.queues)
+				}
+				return item, q, nil, nil, false
+			}
+		default:
+		}
+		q.credit = 0
+		b.next = (b.next + 1) % len(b.queues)
+		empty++
+	}
+	drained := b.closed
+	for _, q := range b.queues {
+		drained = drained && len(q.ch) == 0
+	}
+	return Item{}, nil, append([]*topicQueue{}, b.queues...), b.added, drained
+}
+
+// take the next item for a consumer, and the queue it came off, reporting
+// false once stop is closed or every queue is closed and drained
+func (b *fairBuffer) take(stop <-chan struct{}) (Item, chan Item, bool) {
+	for {
+		select {
+		case <-stop:
+			return Item{}, nil, false
+		default:
+		}
+		item, q, queues, added, drained := b.try()
+		if q == nil && drained {
+			return Item{}, nil, false
+		}
+		if q == nil {
+			// every queue empty: wait on them all, for another, or to
+			// stop, and take what comes first off whichever it is, as
+			// there is no other topic to be fair to
+			cases := []reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(added)},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stop)},
+			}
+			for _, q := range queues {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.ch)})
+			}
+			chosen, v, ok := reflect.Select(cases)
+			if chosen < 2 || !ok {
+				// a closed queue tells nothing; try says once they all are
+				continue
+			}
+			q = queues[chosen-2]
+			item = v.Interface().(Item)
+			b.mu.Lock()
+			q.credit -= b.cost(&item)
+			b.mu.Unlock()
+		}
+		q.taken.Add(1)
+		q.wait.Add(int64(time.Since(item.Timestamp)))
+		return item, q.ch, true
+	}
+}
+
+// count the time a consumer took over an item off ch. Safe when nil.
+func (b *fairBuffer) handled(ch <-chan Item, took time.Duration) {
+	if b == nil {
+		return
+	}
+	if v, ok := b.byChan.Load(ch); ok {
+		v.(*topicQueue).service.Add(int64(took))
+	}
+}
+
+// which queue a channel is, or nil. Safe when nil.
+func (b *fairBuffer) queueOf(ch chan Item) *topicQueue {
+	if b == nil {
+		return nil
+	}
+	if v, ok := b.byChan.Load((<-chan Item)(ch)); ok {
+		return v.(*topicQueue)
+	}
+	return nil
+}
+
+// the queues, in the order they were added
+func (b *fairBuffer) all() []*topicQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*topicQueue{}, b.queues...)
+}
+
+// the items on all the queues, and the room they have between them
+func (b *fairBuffer) len() int {
+	n := 0
+	for _, q := range b.all() {
+		n += len(q.ch)
+	}
+	return n
+}
+
+func (b *fairBuffer) cap() int {
+	n := 0
+	for _, q := range b.all() {
+		n += cap(q.ch)
+	}
+	return n
+}
+
+func (b *fairBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, q := range b.queues {
+		close(q.ch)
+	}
+}
+
+// what a topic is called, for the summary
+func (q *topicQueue) name() string {
+	if q.topic == "" {
+		return "(no topic)"
+	}
+	return q.topic
+}
+
+// TopicStatus is what the admin API reports about a topic's queue with
+// -fair-topics
+type TopicStatus struct {
+	Topic   string `json:"topic"`
+	Weight  int    `json:"weight"`
+	Queued  int    `json:"queued"`
+	Taken   int64  `json:"taken"`
+	Wait    string `json:"avg_wait,omitempty"`
+	Service string `json:"avg_service,omitempty"`
+}
+
+// the topics, busiest first
+func (b *fairBuffer) status() []TopicStatus {
+	var topics []TopicStatus
+	for _, q := range b.all() {
+		st := TopicStatus{Topic: q.name(), Weight: q.weight, Queued: len(q.ch), Taken: q.taken.Load()}
+		if st.Taken > 0 {
+			st.Wait = (time.Duration(q.wait.Load() / st.Taken)).Round(time.Microsecond).String()
+			st.Service = (time.Duration(q.service.Load() / st.Taken)).Round(time.Microsecond).String()
+		}
+		topics = append(topics, st)
+	}
+	sort.SliceStable(topics, func(i, j int) bool { return topics[i].Taken > topics[j].Taken })
+	return topics
+}
+
+func (b *fairBuffer) printSummary(w io.Writer) {
+	how := fairRoundRobin
+	if b.deficit {
+		how = fmt.Sprintf("%s, %s a turn", fairDeficit, formatBytes(int64(b.quantum)))
+	}
+	topics := b.status()
+	var total int64
+	for _, t := range topics {
+		total += t.Taken
+	}
+	fmt.Fprintf(w, "fair topics (%s): %d items off %d queues\n", how, total, len(b.all()))
+	// none taken, the rest are too
+	for len(topics) > 0 && topics[len(topics)-1].Taken == 0 {
+		topics = topics[:len(topics)-1]
+	}
+	for i, t := range topics {
+		if i == fairSummaryTopics {
+			fmt.Fprintf(w, "  and %d more topics\n", len(topics)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %s: %d items (%.0f%%)", t.Topic, t.Taken, 100*float64(t.Taken)/float64(total))
+		if t.Weight != 1 {
+			fmt.Fprintf(w, ", weight %d", t.Weight)
+		}
+		fmt.Fprintf(w, ", waited %s and handled in %s on average\n", t.Wait, t.Service)
+	}
+}
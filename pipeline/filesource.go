@@ -0,0 +1,236 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fileSource reads items from files holding one json encoded item per
+// line. The path can be a glob such as /data/part-*.json for a partitioned
+// file set, whose files are read in name order, and which sharded runs
+// split between them file by file. The resume token is the byte offset of
+// the next line, along with the file's name when there is more than one,
+// so a checkpointed run can pick up part way through.
+type fileSource struct {
+	mu     sync.Mutex
+	files  []string
+	cur    int // index into files of the one being read
+	file   *os.File
+	r      *bufio.Reader
+	offset int64
+}
+
+func newFileSource(pattern string) (*fileSource, error) {
+	files := []string{pattern}
+	if strings.ContainsAny(pattern, "*?[") {
+		var err error
+		if files, err = filepath.Glob(pattern); err != nil {
+			return nil, fmt.Errorf("file source %q: %v", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("file source %q: no files match", pattern)
+		}
+		sort.Strings(files)
+	}
+	s := &fileSource{files: files}
+	if err := s.open(0, 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start reading the i'th file at off, called with mu held unless new
+func (s *fileSource) open(i int, off int64) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.cur, s.offset = i, off
+	if i >= len(s.files) {
+		return nil
+	}
+	f, err := os.Open(s.files[i])
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	if s.r == nil {
+		s.r = bufio.NewReader(f)
+	} else {
+		s.r.Reset(f)
+	}
+	return nil
+}
+
+func (s *fileSource) Next() (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.file != nil {
+		line, err := s.r.ReadBytes('\n')
+		s.offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) > 0 {
+			var item Item
+			if err := json.Unmarshal(line, &item); err != nil {
+				return nil, fmt.Errorf("%s at offset %d: %v", s.files[s.cur], s.offset-int64(len(line)), err)
+			}
+			return &item, nil
+		}
+		if err == io.EOF && s.cur+1 < len(s.files) {
+			if err := s.open(s.cur+1, 0); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// keep only this shard's share of a file set, every count'th file
+// starting at index. A single file can't be split this way, so it is left
+// to the pipeline to share out its items instead.
+func (s *fileSource) Shard(index, count int) bool {
+	if len(s.files) < 2 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mine []string
+	for i := index; i < len(s.files); i += count {
+		mine = append(mine, s.files[i])
+	}
+	s.files = mine
+	if err := s.open(0, 0); err != nil {
+		// left for Next to report as the end of the source
+		fmt.Printf("error opening %s: %v\n", mine[0], err)
+	}
+	return true
+}
+
+// bytes read so far out of the size of all the files
+func (s *fileSource) Progress() (done, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, path := range s.files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+		if i < s.cur {
+			done += fi.Size()
+		}
+	}
+	return done + s.offset, total
+}
+
+func (s *fileSource) Position() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) == 1 {
+		return strconv.FormatInt(s.offset, 10), nil
+	}
+	if s.cur >= len(s.files) {
+		return "done", nil
+	}
+	return fmt.Sprintf("%d %s", s.offset, s.files[s.cur]), nil
+}
+
+func (s *fileSource) Resume(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token == "done" {
+		return s.open(len(s.files), 0)
+	}
+	offset, name, _ := strings.Cut(token, " ")
+	off, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad file offset %q", token)
+	}
+	i := 0
+	if name != "" {
+		i = slices.Index(s.files, name)
+		if i < 0 {
+			return fmt.Errorf("%s isn't one of this source's files", name)
+		}
+	}
+	return s.open(i, off)
+}
+
+func (s *fileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// fileSink writes items to a file in the -sink-format format. The file is
+// replaced rather than appended to, since a parquet file can't be extended.
+type fileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	enc  itemEncoder
+}
+
+func newFileSink(path, format string) (*fileSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{file: f, w: bufio.NewWriter(f)}
+	if s.enc, err = newItemEncoder(format, s.w); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) Write(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(item)
+}
+
+// flush what has been written and fsync it. A parquet file still needs its
+// footer from Close before it can be read back.
+func (s *fileSink) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// finish off the format and flush everything to disk
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.enc.Close()
+	if ferr := s.w.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
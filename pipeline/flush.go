@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// barrier keeps track of the items in flight so Flush can wait for the
+// ones queued before it. Items are stamped with the current epoch as they
+// go onto a buffer, and each Flush closes the epoch and starts the next,
+// then waits until no item from its epoch or an earlier one is left. That
+// works the same however many buffers, pools and consumers there are, and
+// whatever order the consumers finish in.
+type barrier struct {
+	mu      sync.Mutex
+	epoch   int64           // the epoch new items join, from 1
+	pending map[int64]int64 // items still in flight, by epoch
+	waiters []flushWaiter
+}
+
+type flushWaiter struct {
+	epoch int64
+	done  chan struct{}
+}
+
+func newBarrier() *barrier {
+	return &barrier{epoch: 1, pending: make(map[int64]int64)}
+}
+
+// count an item going onto a buffer, returning its epoch
+func (b *barrier) enter() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending[b.epoch]++
+	return b.epoch
+}
+
+// count an item as done with. Items that never entered have epoch 0.
+func (b *barrier) leave(epoch int64) {
+	if epoch == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending[epoch]--; b.pending[epoch] <= 0 {
+		delete(b.pending, epoch)
+	}
+	n := 0
+	for _, w := range b.waiters {
+		if b.drained(w.epoch) {
+			close(w.done)
+		} else {
+			b.waiters[n] = w
+			n++
+		}
+	}
+	b.waiters = b.waiters[:n]
+}
+
+// whether every item up to and including epoch is done, called with b.mu
+// held
+func (b *barrier) drained(epoch int64) bool {
+	for e := range b.pending {
+		if e <= epoch {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush returns once every item that was on a buffer when it was called
+// has been handled, or dropped or dead-lettered, by the consumers. Items
+// produced meanwhile aren't waited for, so it can be called on a busy
+// pipeline. A Flush on a paused pipeline waits for it to resume or for ctx
+// to be done.
+//
+// An item waiting in a join counts as handled once the joiner has it. Over
+// redis another process may be the one handling the items, so there Flush
+// is an error.
+func (p *Pipeline) Flush(ctx context.Context) error {
+	if p.redis != nil {
+		return errors.New("flush isn't possible with a redis queue, which other processes may be consuming")
+	}
+	b := p.barrier
+	b.mu.Lock()
+	epoch := b.epoch
+	b.epoch++
+	if b.drained(epoch) {
+		b.mu.Unlock()
+		return nil
+	}
+	w := flushWaiter{epoch: epoch, done: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,257 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the first line of a golden file, saying how it was recorded
+const goldenHeader = "# go_producer_consumer golden output, -seed "
+
+// golden records what a run hands its sink with -golden-update, and with
+// -golden alone checks a run against that recording, so a change to the
+// routing, ordering or handling shows up as the items coming out
+// differently:
+//
+//	go_producer_consumer -seed 7 -delay 0 -handler exec:./enrich.py -golden enrich.golden -golden-update
+//	go_producer_consumer -delay 0 -handler exec:./enrich.py -golden enrich.golden
+//
+// Each item is recorded as a json line of what should come out the same
+// from one run to the next, leaving out timestamps, which consumer had the
+// item and how long it took. The lines are sorted, since the consumers
+// finish items in no particular order, unless the recording was made with
+// -golden-ordered for a run that always writes them in the same order,
+// such as one with a single consumer. The check replays the recording's
+// -seed unless given another, and a run that doesn't match it prints what
+// differs and exits 1.
+type golden struct {
+	path    string
+	update  bool
+	ordered bool
+	seed    int64
+
+	mu    sync.Mutex
+	lines []string
+	want  []string // the recording, when checking against it
+	// set once a check has found the run differs from the recording
+	mismatch bool
+}
+
+// an item as the golden file has it
+type goldenEntry struct {
+	ProducerID    int               `json:"ProducerId"`
+	Seq           int64             `json:"Seq,omitempty"`
+	ID            int               `json:"Id"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
+	Payload       json.RawMessage   `json:"Payload,omitempty"`
+	Schema        string            `json:"Schema,omitempty"`
+	SchemaVersion int               `json:"SchemaVersion,omitempty"`
+	Status        string            `json:"Status,omitempty"`
+	Fields        map[string]any    `json:"Fields,omitempty"`
+	Handled       []goldenHandling  `json:"Handled,omitempty"`
+	Sinks         []string          `json:"Sinks,omitempty"`
+}
+
+// the parts of a Provenance entry that don't change between runs
+type goldenHandling struct {
+	Pipeline string `json:"Pipeline"`
+	Handler  string `json:"Handler"`
+	Attempts int    `json:"Attempts"`
+}
+
+func newGolden(cfg *Config) (*golden, error) {
+	g := &golden{path: cfg.Golden, update: cfg.GoldenUpdate, ordered: cfg.GoldenOrdered, seed: cfg.Seed}
+	if g.update {
+		return g, nil
+	}
+	f, err := os.Open(g.path)
+	if err != nil {
+		return nil, fmt.Errorf("-golden: %v, record it with -golden-update", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		if line := sc.Text(); strings.HasPrefix(line, "#") {
+			_, g.ordered, _ = parseGoldenHeader(line)
+		} else if line != "" {
+			g.want = append(g.want, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("-golden: reading %s: %v", g.path, err)
+	}
+	return g, nil
+}
+
+// the seed a golden file was recorded with and whether its order counts
+func parseGoldenHeader(line string) (seed int64, ordered bool, ok bool) {
+	rest, ok := strings.CutPrefix(line, goldenHeader)
+	if !ok {
+		return 0, false, false
+	}
+	rest, ordered = strings.CutSuffix(rest, ", ordered")
+	seed, err := strconv.ParseInt(rest, 10, 64)
+	return seed, ordered, err == nil
+}
+
+// the seed to replay a golden file with, 0 if it can't be read
+func goldenSeed(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	seed, _, _ := parseGoldenHeader(strings.TrimSpace(line))
+	return seed
+}
+
+// note an item the pipeline is handing its sink, and the sinks a router
+// will give it to. Safe on nil.
+func (g *golden) add(item *Item, routed *sinkRouter) {
+	if g == nil {
+		return
+	}
+	e := goldenEntry{
+		ProducerID:    item.ProducerID,
+		Seq:           item.Seq,
+		ID:            item.ID,
+		Metadata:      item.Metadata,
+		Payload:       compactJSON(item.Payload),
+		Schema:        item.Schema,
+		SchemaVersion: item.SchemaVersion,
+	}
+	if r := item.Result; r != nil {
+		e.Status, e.Fields = r.Status, r.Fields
+		for _, pv := range r.Provenance {
+			e.Handled = append(e.Handled, goldenHandling{pv.Pipeline, pv.Handler, pv.Attempts})
+		}
+	}
+	if routed != nil {
+		e.Sinks = routed.route(item)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		// what can't be marshaled still has to count as coming out
+		b = []byte(strconv.Quote(fmt.Sprintf("item %d: %v", item.ID, err)))
+	}
+	g.mu.Lock()
+	g.lines = append(g.lines, string(b))
+	g.mu.Unlock()
+}
+
+// record the run, or check it against the recording, once the consumers
+// are done
+func (g *golden) finish(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.ordered {
+		sort.Strings(g.lines)
+		sort.Strings(g.want)
+	}
+	if g.update {
+		if err := g.write(); err != nil {
+			g.mismatch = true
+			fmt.Fprintf(w, "golden: error recording %s: %v\n", g.path, err)
+			return
+		}
+		fmt.Fprintf(w, "golden: recorded %d items to %s with -seed %d\n", len(g.lines), g.path, g.seed)
+		return
+	}
+	g.check(w, 5)
+}
+
+func (g *golden) write() error {
+	f, err := os.Create(g.path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	fmt.Fprintf(bw, "%s%d", goldenHeader, g.seed)
+	if g.ordered {
+		bw.WriteString(", ordered")
+	}
+	bw.WriteString("\n")
+	for _, line := range g.lines {
+		bw.WriteString(line)
+		bw.WriteString("\n")
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compare the run with the recording, printing up to show examples of
+// each difference
+func (g *golden) check(w io.Writer, show int) {
+	missing, unexpected := goldenDiff(g.want, g.lines)
+	if len(missing)+len(unexpected) == 0 {
+		if i := firstDifference(g.want, g.lines); i >= 0 {
+			g.mismatch = true
+			fmt.Fprintf(w, "golden: the same %d items as %s, but out of order from item %d:\n", len(g.lines), g.path, i+1)
+			fmt.Fprintf(w, "  - %s\n  + %s\n", g.want[i], g.lines[i])
+			return
+		}
+		fmt.Fprintf(w, "golden: all %d items match %s\n", len(g.lines), g.path)
+		return
+	}
+	g.mismatch = true
+	fmt.Fprintf(w, "golden: the run differs from %s: %d of its %d items missing, %d not in it\n",
+		g.path, len(missing), len(g.want), len(unexpected))
+	for i, line := range missing {
+		if i == show {
+			fmt.Fprintf(w, "  ... and %d more missing\n", len(missing)-show)
+			break
+		}
+		fmt.Fprintf(w, "  - %s\n", line)
+	}
+	for i, line := range unexpected {
+		if i == show {
+			fmt.Fprintf(w, "  ... and %d more not in it\n", len(unexpected)-show)
+			break
+		}
+		fmt.Fprintf(w, "  + %s\n", line)
+	}
+}
+
+// the lines only want has and only got has, counting repeats
+func goldenDiff(want, got []string) (missing, unexpected []string) {
+	counts := make(map[string]int, len(want))
+	for _, line := range want {
+		counts[line]++
+	}
+	for _, line := range got {
+		if counts[line] > 0 {
+			counts[line]--
+		} else {
+			unexpected = append(unexpected, line)
+		}
+	}
+	for _, line := range want {
+		if counts[line] > 0 {
+			counts[line]--
+			missing = append(missing, line)
+		}
+	}
+	return missing, unexpected
+}
+
+// where two lists of the same lines first differ, -1 if nowhere
+func firstDifference(a, b []string) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
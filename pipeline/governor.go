@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often the governor tops up its token bucket
+const governorTick = 10 * time.Millisecond
+
+// the most tokens the bucket can hold, whatever the rate
+const governorMaxBurst = 4096
+
+// governor coordinates all of the producers so that together they hit a
+// target rate, rather than each producer being limited on its own. Producers
+// call wait() before every item, which blocks until a token is available.
+// A rate of zero means unlimited, and the rate can be changed at any time.
+type governor struct {
+	tokens  chan struct{}
+	taken   int64 // atomic, tokens consumed by producers
+	created time.Time
+	done    chan struct{}
+
+	mu       sync.Mutex
+	rate     float64
+	start    time.Time // when the current rate took effect
+	base     int64     // taken when the current rate took effect
+	forgiven int64     // backlog we gave up on
+}
+
+// create a governor for the given aggregate rate in items/sec and start its
+// refill loop. Call stop() when the producers are finished.
+func newGovernor(rate float64) *governor {
+	now := time.Now()
+	g := &governor{
+		rate:    rate,
+		tokens:  make(chan struct{}, governorMaxBurst),
+		created: now,
+		start:   now,
+		done:    make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// run refills the bucket on every tick. Instead of adding a fixed number of
+// tokens per tick it measures how many items the producers have actually
+// taken and issues whatever is owed to match the target rate since start,
+// so timer jitter and short stalls are made up rather than lost. Debt beyond
+// one second's worth is forgiven so that a long stall on a full channel
+// doesn't turn into a huge burst afterwards.
+func (g *governor) run() {
+	ticker := time.NewTicker(governorTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			g.mu.Lock()
+			var owed int64
+			if g.rate <= 0 {
+				// unlimited, keep the bucket full so nobody stays blocked
+				owed = governorMaxBurst
+			} else {
+				burst := int64(g.rate * 2 * governorTick.Seconds())
+				burst = max(1, min(burst, governorMaxBurst))
+				maxDebt := max(int64(g.rate), burst)
+				want := int64(g.rate*now.Sub(g.start).Seconds()) - g.forgiven
+				owed = want - (atomic.LoadInt64(&g.taken) - g.base) - int64(len(g.tokens))
+				if owed > maxDebt {
+					g.forgiven += owed - maxDebt
+					owed = maxDebt
+				}
+				owed = min(owed, burst-int64(len(g.tokens)))
+			}
+			g.mu.Unlock()
+		refill:
+			for ; owed > 0; owed-- {
+				select {
+				case g.tokens <- struct{}{}:
+				default:
+					break refill
+				}
+			}
+		}
+	}
+}
+
+// block until the producer is allowed to create another item. A nil governor
+// never blocks, which keeps the unlimited case free of special handling. It
+// reports false if stop was closed, or the governor stopped, first, as no
+// more tokens will come once the refill loop is gone.
+func (g *governor) wait(stop <-chan struct{}) bool {
+	if g == nil {
+		return true
+	}
+	if g.currentRate() > 0 {
+		select {
+		case <-g.tokens:
+		case <-stop:
+			return false
+		case <-g.done:
+			return false
+		}
+	}
+	atomic.AddInt64(&g.taken, 1)
+	return true
+}
+
+// change the target rate, with zero meaning unlimited. Accounting restarts
+// from now so the new rate isn't skewed by what happened under the old one.
+func (g *governor) setRate(rate float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rate = rate
+	// throw away anything left over from the old rate so it can't become
+	// a burst under the new one
+	for len(g.tokens) > 0 {
+		select {
+		case <-g.tokens:
+		default:
+		}
+	}
+	g.start = time.Now()
+	g.base = atomic.LoadInt64(&g.taken)
+	g.forgiven = 0
+}
+
+func (g *governor) currentRate() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rate
+}
+
+// the rate the producers have actually achieved since the governor started
+func (g *governor) achieved() float64 {
+	return float64(atomic.LoadInt64(&g.taken)) / time.Since(g.created).Seconds()
+}
+
+// stop the refill loop
+func (g *governor) stop() {
+	close(g.done)
+}
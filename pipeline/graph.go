@@ -0,0 +1,412 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// graphMain runs go_producer_consumer graph, which draws the pipeline the
+// flags after -- would run: where its items come from, the buffers and
+// consumer pools they go through with their sizes, the handlers on the
+// way and the sinks at the end, as Graphviz DOT or a Mermaid flowchart:
+//
+//	go_producer_consumer graph -- -consumers 4 -route 'fast:Metadata.Priority == "high"' -pool fast=2 | dot -Tsvg > pipeline.svg
+//	go_producer_consumer graph -format mermaid -live localhost:8081 -- -consumers 4 -admin :8081
+//
+// With -live it asks the running pipeline's admin API for its stats twice,
+// -interval apart, and puts how many items are buffered and how fast they
+// are produced, routed and consumed on the graph. The admin token comes
+// from -token or $ADMIN_TOKEN.
+func graphMain(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	fs.SetOutput(out)
+	format := fs.String("format", "dot", "draw the graph as dot or mermaid")
+	live := fs.String("live", "", "annotate the graph from the admin API of the pipeline running it, as host:port, https://host:port or unix:<path>")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin API bearer token for -live (default $ADMIN_TOKEN)")
+	interval := fs.Duration("interval", time.Second, "how long -live watches the pipeline to measure its throughput")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *format != "dot" && *format != "mermaid" {
+		fmt.Fprintf(out, "unknown -format %q, expected dot or mermaid\n", *format)
+		return 2
+	}
+	cfg, err := parseConfig(fs.Args())
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(out, "graph: %v\n", err)
+		}
+		return 2
+	}
+	var rates *graphRates
+	if *live != "" {
+		if rates, err = measureLive(*live, *token, cfg.Name, *interval); err != nil {
+			fmt.Fprintf(out, "graph: %v\n", err)
+			return 1
+		}
+	}
+	t, err := newTopology(cfg, rates)
+	if err != nil {
+		fmt.Fprintf(out, "graph: %v\n", err)
+		return 2
+	}
+	if *format == "mermaid" {
+		t.writeMermaid(out)
+	} else {
+		t.writeDOT(out)
+	}
+	return 0
+}
+
+// topology is a pipeline drawn as boxes and the arrows between them
+type topology struct {
+	name  string
+	nodes []topoNode
+	edges []topoEdge
+}
+
+type topoNode struct {
+	id    string
+	kind  string // source, buffer, stage or sink, which decides its shape
+	lines []string
+}
+
+type topoEdge struct {
+	from, to string
+	label    string
+	dashed   bool // for what only some items take, or a copy of them
+}
+
+func (t *topology) node(id, kind string, lines ...string) {
+	t.nodes = append(t.nodes, topoNode{id: id, kind: kind, lines: lines})
+}
+
+func (t *topology) edge(from, to, label string, dashed bool) {
+	t.edges = append(t.edges, topoEdge{from, to, label, dashed})
+}
+
+// what a running pipeline was seen doing over an interval
+type graphRates struct {
+	st                 PipelineStatus
+	produced, consumed float64 // items a second
+	routed             map[string]float64
+}
+
+// take two looks at a running pipeline's stats, every apart
+func measureLive(admin, token, name string, every time.Duration) (*graphRates, error) {
+	client, base := adminClient(admin)
+	get := func() (PipelineStatus, error) {
+		var st PipelineStatus
+		req, err := http.NewRequest(http.MethodGet, base+"/pipelines/"+url.PathEscape(name)+"/stats", nil)
+		if err != nil {
+			return st, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return st, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			var e struct{ Error string }
+			json.NewDecoder(resp.Body).Decode(&e)
+			return st, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return st, json.NewDecoder(resp.Body).Decode(&st)
+	}
+	first, err := get()
+	if err != nil {
+		return nil, fmt.Errorf("-live: %v", err)
+	}
+	start := time.Now()
+	time.Sleep(every)
+	last, err := get()
+	if err != nil {
+		return nil, fmt.Errorf("-live: %v", err)
+	}
+	secs := time.Since(start).Seconds()
+	r := &graphRates{
+		st:       last,
+		produced: float64(last.Produced-first.Produced) / secs,
+		consumed: float64(last.Consumed-first.Consumed) / secs,
+		routed:   make(map[string]float64),
+	}
+	for pool, n := range last.Routes {
+		r.routed[pool] = float64(n-first.Routes[pool]) / secs
+	}
+	return r, nil
+}
+
+// draw the pipeline cfg describes, with what rates saw it doing if set
+func newTopology(cfg *Config, rates *graphRates) (*topology, error) {
+	t := &topology{name: cfg.Name}
+	perSec := func(v float64, what string) string {
+		return fmt.Sprintf("%s items/s %s", strconv.FormatFloat(v, 'f', 1, 64), what)
+	}
+
+	producers := fmt.Sprintf("%d producers", cfg.Producers)
+	if cfg.AutoProducers {
+		producers = "auto producers"
+	}
+	var src []string
+	switch {
+	case cfg.Ingest != "":
+		src = []string{"ingest on " + cfg.Ingest}
+		if !cfg.Daemon {
+			src = append(src, producers)
+		}
+	case cfg.Source != "":
+		src = []string{"source " + redactFlag("source", cfg.Source), producers}
+	default:
+		src = []string{producers, fmt.Sprintf("%d items each", cfg.ItemsPerProducer)}
+	}
+	if cfg.ProducerLanes > 0 {
+		src = append(src, fmt.Sprintf("lanes of %d, merged %s", cfg.ProducerLanes, cfg.Merge))
+	}
+	if rates != nil {
+		src = append(src, fmt.Sprintf("%d running", rates.st.Producers), perSec(rates.produced, "produced"))
+	}
+	t.node("producers", "source", src...)
+
+	// where the producers put the items bound for the default pool
+	from := "producers"
+	if cfg.Redis != "" {
+		t.node("redis", "buffer", "redis queue", redactFlag("redis", cfg.Redis))
+		from = "redis"
+	}
+	buffer := []string{"buffer", fmt.Sprintf("%d items", cfg.BufferSize)}
+	if cfg.BufferShards > 1 {
+		buffer[1] += fmt.Sprintf(" in %d shards", cfg.BufferShards)
+	}
+	if cfg.FairTopics != "" {
+		buffer[1] += " for each topic, taken " + cfg.FairTopics
+	}
+	if cfg.BufferBytes > 0 {
+		buffer = append(buffer, formatBytes(int64(cfg.BufferBytes)))
+	}
+	if rates != nil {
+		buffer = append(buffer, fmt.Sprintf("%d of %d buffered", rates.st.Buffered, rates.st.Capacity))
+	}
+	t.node("buffer", "buffer", buffer...)
+
+	sizes := make(map[string]int)
+	for _, s := range cfg.Pools {
+		name, size, err := parsePoolSize(s)
+		if err != nil {
+			return nil, err
+		}
+		sizes[name] = size
+	}
+	routed := func(pool string) string {
+		if rates == nil {
+			return ""
+		}
+		return perSec(rates.routed[pool], "")
+	}
+	label := func(parts ...string) string {
+		var kept []string
+		for _, s := range parts {
+			if s = strings.TrimSpace(s); s != "" {
+				kept = append(kept, s)
+			}
+		}
+		return strings.Join(kept, ", ")
+	}
+	var pools []string // consumer nodes, each of which writes to the sinks
+	ids := make(map[string]string)
+	for _, s := range cfg.Routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, err
+		}
+		if r.pool == defaultPool {
+			t.edge("producers", from, label(r.cond.String(), routed(defaultPool)), true)
+			continue
+		}
+		id, ok := ids[r.pool]
+		if !ok {
+			id = fmt.Sprintf("pool%d", len(ids)+1)
+			ids[r.pool] = id
+			size := max(sizes[r.pool], 1)
+			t.node(id+"_buffer", "buffer", "pool "+r.pool+" buffer", fmt.Sprintf("%d items", cfg.BufferSize))
+			t.node(id, "stage", consumerLines(cfg, "pool "+r.pool, size, cfg.Handler)...)
+			t.edge(id+"_buffer", id, "", false)
+			pools = append(pools, id)
+		}
+		t.edge("producers", id+"_buffer", label(r.cond.String(), routed(r.pool)), true)
+	}
+	for name := range sizes {
+		if _, ok := ids[name]; !ok && name != defaultPool {
+			return nil, fmt.Errorf("pool %q has no -route sending to it", name)
+		}
+	}
+	if cfg.CanaryHandler != "" {
+		t.node("canary_buffer", "buffer", "canary buffer", fmt.Sprintf("%d items", cfg.BufferSize))
+		t.node("canary", "stage", consumerLines(cfg, "canary", cfg.CanaryConsumers, cfg.CanaryHandler)...)
+		t.edge("producers", "canary_buffer", label(fmt.Sprintf("%g%%", cfg.CanaryPercent), routed(canaryPool)), true)
+		t.edge("canary_buffer", "canary", "", false)
+		pools = append(pools, "canary")
+	}
+	rest := ""
+	if len(cfg.Routes) > 0 || cfg.CanaryHandler != "" {
+		rest = label("the rest", routed(defaultPool))
+	}
+	if from == "producers" {
+		t.edge("producers", "buffer", rest, false)
+	} else {
+		t.edge("producers", from, rest, false)
+		t.edge(from, "buffer", "", false)
+	}
+
+	consumers := consumerLines(cfg, "consumers", cfg.Consumers, cfg.Handler)
+	if cfg.AutoConsumers {
+		consumers[0] = "auto consumers"
+	}
+	if rates != nil {
+		consumed := perSec(rates.consumed, "consumed")
+		if len(pools) > 0 {
+			// the pipeline only counts what all its pools consumed
+			consumed += " by every pool"
+		}
+		consumers = append(consumers, fmt.Sprintf("%d running", rates.st.Consumers), consumed)
+	}
+	t.node("consumers", "stage", consumers...)
+	t.edge("buffer", "consumers", "", false)
+	pools = append([]string{"consumers"}, pools...)
+	if cfg.JoinSource != "" {
+		t.node("join", "source", "join source "+redactFlag("join-source", cfg.JoinSource), "on "+cfg.JoinKey)
+		t.edge("join", "consumers", cfg.JoinType+" join", false)
+	}
+	if cfg.ShadowHandler != "" {
+		t.node("shadow", "stage", "shadow "+cfg.ShadowHandler, fmt.Sprintf("workers: %d", cfg.ShadowWorkers))
+		t.edge("consumers", "shadow", "copies", true)
+	}
+
+	def := "printed"
+	if cfg.Sink != "" {
+		def = "sink " + redactFlag("sink", cfg.Sink)
+	}
+	sinks := []string{defaultSink}
+	t.node("sink_"+defaultSink, "sink", def)
+	byStatus := make(map[string][]string)
+	for _, s := range cfg.NamedSinks {
+		name, spec, _ := strings.Cut(s, "=")
+		name = strings.TrimSpace(name)
+		sinks = append(sinks, name)
+		t.node("sink_"+graphID(name), "sink", "sink "+name, redactFlag("sink", spec))
+	}
+	for _, s := range cfg.SinkRoutes {
+		status, to, _ := strings.Cut(s, "=")
+		for _, name := range strings.Split(to, ",") {
+			name = strings.TrimSpace(name)
+			byStatus[name] = append(byStatus[name], strings.TrimSpace(status))
+		}
+	}
+	if cfg.DLQ != "" {
+		t.node("dlq", "sink", "dlq "+cfg.DLQ)
+	}
+	for _, id := range pools {
+		for _, name := range sinks {
+			statuses := byStatus[name]
+			switch {
+			case len(cfg.SinkRoutes) == 0 && name == defaultSink:
+				t.edge(id, "sink_"+defaultSink, "", false)
+			case len(statuses) > 0:
+				t.edge(id, "sink_"+graphID(name), strings.Join(statuses, ", "), true)
+			case name == defaultSink:
+				t.edge(id, "sink_"+defaultSink, "other statuses", false)
+			}
+		}
+		if cfg.DLQ != "" {
+			t.edge(id, "dlq", "dead letters", true)
+		}
+	}
+	return t, nil
+}
+
+// the lines of a pool of consumers' box
+func consumerLines(cfg *Config, what string, n int, handler string) []string {
+	lines := []string{fmt.Sprintf("%s: %d", what, n)}
+	if cfg.Filter != "" {
+		lines = append(lines, "filter "+cfg.Filter)
+	}
+	if handler != "" {
+		lines = append(lines, "handler "+handler)
+	}
+	if cfg.Batch != "" {
+		lines = append(lines, "batch "+cfg.Batch)
+	}
+	return lines
+}
+
+// a name made fit to be part of a node id
+func graphID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (t *topology) writeDOT(w io.Writer) {
+	shapes := map[string]string{"source": "ellipse", "buffer": "cylinder", "stage": "box", "sink": "folder"}
+	fmt.Fprintf(w, "digraph %s {\n\trankdir=LR;\n", strconv.Quote(t.name))
+	for _, n := range t.nodes {
+		fmt.Fprintf(w, "\t%s [shape=%s, label=%s];\n", n.id, shapes[n.kind], strconv.Quote(strings.Join(n.lines, "\n")))
+	}
+	for _, e := range t.edges {
+		var attrs []string
+		if e.label != "" {
+			attrs = append(attrs, "label="+strconv.Quote(e.label))
+		}
+		if e.dashed {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(w, "\t%s -> %s", e.from, e.to)
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintln(w, ";")
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func (t *topology) writeMermaid(w io.Writer) {
+	// Mermaid's labels take entities for what would otherwise end them
+	text := strings.NewReplacer(`"`, "#quot;", "|", "#124;", "<", "#lt;", ">", "#gt;").Replace
+	shapes := map[string][2]string{"source": {"([", "])"}, "buffer": {"[(", ")]"}, "stage": {"[", "]"}, "sink": {"[/", "/]"}}
+	fmt.Fprintln(w, "flowchart LR")
+	for _, n := range t.nodes {
+		lines := make([]string, len(n.lines))
+		for i, l := range n.lines {
+			lines[i] = text(l)
+		}
+		s := shapes[n.kind]
+		fmt.Fprintf(w, "\t%s%s\"%s\"%s\n", n.id, s[0], strings.Join(lines, "<br/>"), s[1])
+	}
+	for _, e := range t.edges {
+		arrow := "-->"
+		if e.dashed {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			fmt.Fprintf(w, "\t%s %s|\"%s\"| %s\n", e.from, arrow, text(e.label), e.to)
+		} else {
+			fmt.Fprintf(w, "\t%s %s %s\n", e.from, arrow, e.to)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+)
+
+// ContextHandler is a Handler that is also given a context for each call,
+// which says what the pipeline knows about the item beyond the item
+// itself, through ItemTopic, ItemProducer, ItemAttempt and ItemTraceID,
+// and has the call's deadline with -handler-timeout. It is cancelled when
+// the call is given up on, so a handler that watches it can stop. When the
+// handler is a ContextHandler it is used in place of Handle.
+type ContextHandler interface {
+	HandleContext(ctx context.Context, item *Item) (*Item, error)
+}
+
+// ContextSplitter is a Splitter that is given a context, as a
+// ContextHandler is
+type ContextSplitter interface {
+	SplitContext(ctx context.Context, item *Item) ([]Item, error)
+}
+
+// what a handler call's context carries
+type callInfo struct {
+	topic    string
+	producer int
+	attempt  int
+	traceID  string
+}
+
+type callInfoKey struct{}
+
+// the context for a handler's attempt at an item, counting from 1
+func handlerContext(item *Item, attempt int) context.Context {
+	info := &callInfo{
+		producer: item.ProducerID,
+		attempt:  attempt,
+		topic:    itemTopic(item),
+		traceID:  item.Metadata["trace_id"],
+	}
+	// a w3c traceparent is version-traceid-parentid-flags
+	if parts := strings.Split(item.Metadata["traceparent"], "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		info.traceID = parts[1]
+	}
+	return context.WithValue(context.Background(), callInfoKey{}, info)
+}
+
+// the topic an item came in on, its mqtt topic or else the topic in its
+// metadata
+func itemTopic(item *Item) string {
+	if topic := item.Metadata["mqtt_topic"]; topic != "" {
+		return topic
+	}
+	return item.Metadata["topic"]
+}
+
+func callInfoOf(ctx context.Context) *callInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*callInfo)
+	if info == nil {
+		return &callInfo{}
+	}
+	return info
+}
+
+// ItemTopic is the topic the item being handled came in on: the MQTT topic
+// of an mqtt source's items, or otherwise the topic in its metadata, if
+// it has one
+func ItemTopic(ctx context.Context) string {
+	return callInfoOf(ctx).topic
+}
+
+// ItemProducer is the ID of the producer that made the item being
+// handled, and whether the context is a handler call's at all
+func ItemProducer(ctx context.Context) (int, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*callInfo)
+	if !ok {
+		return 0, false
+	}
+	return info.producer, true
+}
+
+// ItemAttempt is which attempt at the item this call is, 1 for the first
+// and more as -retries tries it again, or 0 outside a handler call
+func ItemAttempt(ctx context.Context) int {
+	return callInfoOf(ctx).attempt
+}
+
+// ItemTraceID is the trace the item being handled belongs to, from the
+// traceparent or trace_id in its metadata, which ingest sets from a
+// request's traceparent header. It is "" for an item with neither.
+func ItemTraceID(ctx context.Context) string {
+	return callInfoOf(ctx).traceID
+}
+
+// call a handler with the context if it takes one
+func handleWith(ctx context.Context, h Handler, item *Item) (*Item, error) {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.HandleContext(ctx, item)
+	}
+	return h.Handle(item)
+}
+
+func splitWith(ctx context.Context, s Splitter, item *Item) ([]Item, error) {
+	if cs, ok := s.(ContextSplitter); ok {
+		return cs.SplitContext(ctx, item)
+	}
+	return s.Split(item)
+}
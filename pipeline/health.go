@@ -0,0 +1,139 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pinger is a sink that can check it is still connected, for the
+// readiness probe to ask
+type Pinger interface {
+	Ping() error
+}
+
+// healthCheck is what the /healthz and /readyz probes go by. The pipeline
+// isn't live when items are buffered but no consumer has taken one for
+// -stall-timeout, which is what deadlocked or hung consumers look like,
+// and a process in that state is better restarted. It isn't ready, though
+// it may be live, while the buffer is filled past -ready-buffer, while the
+// last -ready-sink-failures writes to the sink in a row failed, or while
+// the sink doesn't answer a ping, since more items sent then only wait or
+// fail.
+type healthCheck struct {
+	p            *Pipeline
+	stall        time.Duration
+	maxBuffer    float64 // the fraction of the buffer that may be full
+	sinkFailures int64
+
+	taken   atomic.Int64 // when a consumer last took an item, in unix ns
+	failing atomic.Int64 // sink writes failed in a row
+
+	mu       sync.Mutex
+	sinkErr  error // the last of those failures
+	failedAt time.Time
+}
+
+// how long failing sink writes keep the pipeline unready. Once it isn't
+// ready it gets no items to find out whether the sink is back, so it has
+// to be given another go after a while.
+const sinkRetryAfter = 30 * time.Second
+
+func newHealthCheck(p *Pipeline, cfg *Config) (*healthCheck, error) {
+	if cfg.ReadyBuffer < 0 || cfg.ReadyBuffer > 1 {
+		return nil, fmt.Errorf("-ready-buffer is a fraction of the buffer, from 0 to 1, not %g", cfg.ReadyBuffer)
+	}
+	h := &healthCheck{p: p, stall: cfg.StallTimeout, maxBuffer: cfg.ReadyBuffer, sinkFailures: int64(cfg.ReadySinkFailures)}
+	h.taken.Store(time.Now().UnixNano())
+	return h, nil
+}
+
+// note a consumer taking an item. Safe on a nil check.
+func (h *healthCheck) took() {
+	if h != nil {
+		h.taken.Store(time.Now().UnixNano())
+	}
+}
+
+// note how a write to the sink went. Safe on a nil check.
+func (h *healthCheck) wrote(err error) {
+	if h == nil {
+		return
+	}
+	if err == nil {
+		h.failing.Store(0)
+		return
+	}
+	h.mu.Lock()
+	h.sinkErr, h.failedAt = err, time.Now()
+	h.mu.Unlock()
+	h.failing.Add(1)
+}
+
+// why the pipeline isn't live, nil if it is
+func (h *healthCheck) live() error {
+	if h.stall <= 0 || h.p.buffered() == 0 {
+		return nil
+	}
+	if since := time.Since(time.Unix(0, h.taken.Load())); since > h.stall {
+		if h.p.gate.paused() {
+			return nil
+		}
+		return fmt.Errorf("consumers stalled: %d items buffered and none taken for %s", h.p.buffered(), since.Round(time.Second))
+	}
+	return nil
+}
+
+// why the pipeline shouldn't be sent items just now, nil if it can
+func (h *healthCheck) ready() error {
+	if err := h.live(); err != nil {
+		return err
+	}
+	st := h.p.status()
+	switch {
+	case st.State != "running":
+		return errors.New(st.State)
+	case st.Consumers == 0:
+		return errors.New("no consumers running")
+	case h.maxBuffer > 0 && st.Capacity > 0 && float64(st.Buffered) >= h.maxBuffer*float64(st.Capacity):
+		return fmt.Errorf("buffer saturated: %d of %d", st.Buffered, st.Capacity)
+	}
+	if n := h.failing.Load(); h.sinkFailures > 0 && n >= h.sinkFailures {
+		h.mu.Lock()
+		err, recent := h.sinkErr, time.Since(h.failedAt) < sinkRetryAfter
+		h.mu.Unlock()
+		if recent {
+			return fmt.Errorf("last %d sink writes failed: %v", n, err)
+		}
+	}
+	if pinger, ok := h.p.sink.(Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			return fmt.Errorf("sink unreachable: %v", err)
+		}
+	}
+	return nil
+}
+
+// how long a readiness probe waits on a sink's ping
+const pingTimeout = 2 * time.Second
+
+func (s *sqlSink) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+func (s *mqttSink) Ping() error {
+	select {
+	case <-s.c.done:
+		if s.c.err != nil {
+			return s.c.err
+		}
+		return errors.New("connection closed")
+	default:
+		return nil
+	}
+}
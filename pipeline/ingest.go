@@ -0,0 +1,423 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the most a single ingest request can carry, or a line of a streamed one
+const ingestMaxBody = 16 << 20
+
+// how often a streamed request's answer says how far it has got
+const ingestProgressEvery = time.Second
+
+// what an ingest request does with items the pipeline can't take
+const (
+	ingestBlock  = "block"  // wait until it can
+	ingestReject = "reject" // answer 429 with a Retry-After
+	ingestShed   = "shed"   // drop them
+)
+
+// how long an item waits for a producer to take it, while the buffer has
+// room, before -ingest-full reject or shed gives up on it
+const ingestFullWait = 100 * time.Millisecond
+
+// the seconds of consumption a Retry-After is worked out from, and the
+// longest it asks a client to wait
+const (
+	ingestRateWindow = 5
+	ingestRetryMax   = 30 * time.Second
+)
+
+// ingestServer takes items over HTTP with -ingest and is the pipeline's
+// source, so the producers hand on whatever is posted instead of making
+// items of their own. It never runs dry, only stopping once the pipeline
+// is drained, which makes it the way in for -daemon.
+//
+//	POST /items     json items or payloads, one per line or as an array,
+//	                all of them or none with ?atomic=true, see ProducerBatch,
+//	                streamed when sent as application/x-ndjson
+//	GET  /healthz   200 while the consumers are getting through items
+//	GET  /readyz    200 while items can be taken, 503 otherwise
+//
+// Whatever is posted is used as an item when it is a json encoded one, as
+// the file sink writes, and becomes the payload of a new item otherwise.
+// A request only returns once a producer has taken every item in it, so a
+// full buffer holds the clients back rather than piling items up in
+// memory; a request given up on is answered with how many items got in.
+// Holding a client back like that ties up its connection for as long as
+// the pipeline is full, so -ingest-full reject instead answers 429 as soon
+// as an item isn't taken, with a Retry-After of about as long as the
+// consumers, or the -rate, take to get through the buffered items, and
+// -ingest-full shed drops the items the pipeline has no room for.
+// A request sent as application/x-ndjson is streamed, for a client to
+// push any number of items over the one connection: its lines are read
+// only as the producers take their items, so a full pipeline holds the
+// client's writes back, and once it has gone on for a while the answer
+// comes as json lines too, saying every second how many items got in and
+// ending with a line with "done" and the status the request would have
+// been answered with.
+// An Idempotency-Key header keys the request's items after it, so that
+// with -dedup-window a client can send a request again when it never got
+// an answer without making its items twice. The probes, see healthCheck,
+// don't need the -ingest-auth credentials, since orchestrators can't
+// present them.
+type ingestServer struct {
+	p     *Pipeline
+	ln    net.Listener
+	srv   *http.Server
+	items chan *Item
+	count atomic.Int64 // numbers the items made from payloads
+	full  string       // -ingest-full
+
+	once sync.Once
+	done chan struct{} // closed once no more items are taken
+}
+
+func newIngestServer(p *Pipeline, cfg *Config) (*ingestServer, error) {
+	switch cfg.IngestFull {
+	case ingestBlock, ingestReject, ingestShed:
+	default:
+		return nil, fmt.Errorf("unknown -ingest-full %q, expected %s, %s or %s", cfg.IngestFull, ingestBlock, ingestReject, ingestShed)
+	}
+	security, err := newEndpointSecurity(cfg, "ingest", cfg.IngestTLS, cfg.IngestAuth, cfg.IngestToken)
+	if err != nil {
+		return nil, err
+	}
+	s := &ingestServer{p: p, items: make(chan *Item), full: cfg.IngestFull, done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.Handle("POST /items", security.wrap(http.HandlerFunc(s.post)))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.p.health.live(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unhealthy", "reason": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.ready(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "reason": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	// opened now so that a bad address is reported before the run starts
+	if s.ln, err = security.listen(cfg.Ingest, os.FileMode(cfg.SocketMode)); err != nil {
+		return nil, fmt.Errorf("-ingest: %v", err)
+	}
+	s.srv = &http.Server{Handler: mux}
+	return s, nil
+}
+
+// start answering requests, once the pipeline is all set up
+func (s *ingestServer) serve() {
+	go func() {
+		if err := s.srv.Serve(s.ln); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "ingest: %v\n", err)
+		}
+	}()
+}
+
+func (s *ingestServer) post(w http.ResponseWriter, r *http.Request) {
+	var stream *ingestStream
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/x-ndjson" {
+		stream = newIngestStream(w)
+	}
+	read := readValues(w, r, stream != nil)
+	accepted, shed := 0, 0
+	// ?atomic=true takes the request's items all together or none of them
+	var txn *ProducerBatch
+	if r.URL.Query().Get("atomic") == "true" {
+		txn = s.p.BeginBatch()
+		defer txn.Rollback()
+	}
+	so := func(err error) map[string]any {
+		resp := map[string]any{"accepted": accepted}
+		if shed > 0 {
+			resp["shed"] = shed
+		}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		return resp
+	}
+	answer := func(code int, err error) {
+		if stream.started() {
+			resp := so(err)
+			resp["done"], resp["status"] = true, code
+			stream.line(resp)
+			return
+		}
+		writeJSON(w, code, so(err))
+	}
+	// a request sent again with the same Idempotency-Key header gives its
+	// items the same keys, for -dedup-window to drop
+	key, index := r.Header.Get("Idempotency-Key"), 0
+	// and the trace the request is part of carries on with its items
+	traceparent := r.Header.Get("traceparent")
+	for {
+		values, err := read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			answer(http.StatusBadRequest, err)
+			return
+		}
+		for _, data := range values {
+			item, _ := decodeItem(data, int(s.count.Add(1)))
+			if key != "" && item.IdempotencyKey == "" {
+				item.IdempotencyKey = fmt.Sprintf("%s/%d", key, index)
+			}
+			index++
+			if traceparent != "" && item.Metadata["traceparent"] == "" {
+				if item.Metadata == nil {
+					item.Metadata = make(map[string]string)
+				}
+				item.Metadata["traceparent"] = traceparent
+			}
+			if txn != nil {
+				txn.Add(*item)
+				continue
+			}
+			// once shedding, the rest of the request is only taken if a
+			// producer is waiting for it
+			wait := ingestFullWait
+			if shed > 0 {
+				wait = 0
+			}
+			switch err := s.hand(r.Context(), item, wait); {
+			case err == nil:
+				accepted++
+				if stream.due() {
+					stream.line(so(nil))
+				}
+			case errors.Is(err, ErrBufferFull) && s.full == ingestShed:
+				s.p.drops.drop(*item, DropFull, "shed by -ingest-full")
+				s.p.settle(item)
+				shed++
+			case errors.Is(err, ErrBufferFull):
+				s.reject(w, answer)
+				return
+			default:
+				answer(http.StatusServiceUnavailable, err)
+				return
+			}
+		}
+	}
+	if txn != nil {
+		n := txn.Len()
+		if err := s.commit(r.Context(), txn); err != nil {
+			switch {
+			case !errors.Is(err, ErrBufferFull) || r.Context().Err() != nil:
+				answer(http.StatusServiceUnavailable, err)
+			case s.full == ingestShed:
+				// all of them or none, so none
+				for i := range txn.items {
+					s.p.drops.drop(txn.items[i], DropFull, "shed by -ingest-full, with the rest of its batch")
+					s.p.settle(&txn.items[i])
+				}
+				shed = n
+				answer(http.StatusAccepted, nil)
+			default:
+				s.reject(w, answer)
+			}
+			return
+		}
+		accepted = n
+	}
+	answer(http.StatusAccepted, nil)
+}
+
+// what reads a request's values, each call giving the next or the items
+// of an array: a json decoder over the body, or for a streamed request
+// one line at a time from a body of any length
+func readValues(w http.ResponseWriter, r *http.Request, lines bool) func() ([]json.RawMessage, error) {
+	if !lines {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, ingestMaxBody))
+		return func() ([]json.RawMessage, error) {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			return splitValues(raw)
+		}
+	}
+	sc := bufio.NewScanner(r.Body)
+	sc.Buffer(make([]byte, 64<<10), ingestMaxBody)
+	return func() ([]json.RawMessage, error) {
+		for sc.Scan() {
+			if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+				// copied, as the scanner reuses its buffer
+				return splitValues(append(json.RawMessage(nil), line...))
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// the items of a json array, or else the one value
+func splitValues(raw json.RawMessage) ([]json.RawMessage, error) {
+	values := []json.RawMessage{raw}
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// ingestStream answers a streamed request as it goes. Until the request
+// has gone on for ingestProgressEvery nothing is written, so a short one
+// is answered as any other, with its status.
+type ingestStream struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	last time.Time
+	sent bool
+}
+
+func newIngestStream(w http.ResponseWriter) *ingestStream {
+	rc := http.NewResponseController(w)
+	// otherwise answering an HTTP/1 request stops it being read
+	rc.EnableFullDuplex()
+	return &ingestStream{w: w, rc: rc, last: time.Now()}
+}
+
+// whether the answer has begun. Safe when nil.
+func (st *ingestStream) started() bool {
+	return st != nil && st.sent
+}
+
+// whether it's time to say how far the request has got. Safe when nil.
+func (st *ingestStream) due() bool {
+	return st != nil && time.Since(st.last) >= ingestProgressEvery
+}
+
+// write a line of the answer, beginning it if it hasn't yet
+func (st *ingestStream) line(v any) {
+	if !st.sent {
+		st.w.Header().Set("Content-Type", "application/x-ndjson")
+		st.w.WriteHeader(http.StatusOK)
+		st.sent = true
+	}
+	json.NewEncoder(st.w).Encode(v)
+	st.rc.Flush()
+	st.last = time.Now()
+}
+
+// hand an item to a producer, unless -ingest-full is block failing with
+// ErrBufferFull if none takes it within wait, or none is waiting for it
+// with the buffer full, as the producers are then held up for room
+func (s *ingestServer) hand(ctx context.Context, item *Item, wait time.Duration) error {
+	var full <-chan time.Time
+	if s.full != ingestBlock {
+		select {
+		case s.items <- item:
+			return nil
+		default:
+		}
+		if s.p.buffered() >= s.p.bufferCap() {
+			return ErrBufferFull
+		}
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		full = t.C
+	}
+	select {
+	case s.items <- item:
+		return nil
+	case <-s.done:
+		return fmt.Errorf("%w: not taking items, the pipeline is draining", ErrPipelineClosed)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-full:
+		return ErrBufferFull
+	}
+}
+
+// commit a ?atomic=true request's items, giving up after ingestFullWait
+// unless -ingest-full is block
+func (s *ingestServer) commit(ctx context.Context, txn *ProducerBatch) error {
+	if s.full != ingestBlock {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ingestFullWait)
+		defer cancel()
+	}
+	return txn.CommitContext(ctx)
+}
+
+// turn the rest of a request away with a 429, for it to be sent again
+// once there may be room
+func (s *ingestServer) reject(w http.ResponseWriter, answer func(int, error)) {
+	after := s.retryAfter()
+	w.Header().Set("Retry-After", strconv.Itoa(int(after/time.Second)))
+	answer(http.StatusTooManyRequests, fmt.Errorf("%w, try again in %s", ErrBufferFull, after))
+}
+
+// how long a client turned away should wait before trying again: about
+// as long as the consumers take to get through the buffered items at the
+// rate they have lately, or the governor to let as many through if its
+// -rate is slower. Consumers that have taken nothing lately, as when
+// paused, give no telling, so the client is told to wait the longest.
+func (s *ingestServer) retryAfter() time.Duration {
+	pace := s.p.stats.consumedRate(ingestRateWindow)
+	if pace <= 0 {
+		return ingestRetryMax
+	}
+	if rate := s.p.gov.currentRate(); rate > 0 {
+		pace = min(pace, rate)
+	}
+	wait := time.Duration(float64(s.p.buffered()+1) / pace * float64(time.Second))
+	// Retry-After is in whole seconds, so round up to the next
+	wait = (wait + time.Second - 1).Truncate(time.Second)
+	return min(max(wait, time.Second), ingestRetryMax)
+}
+
+// why the pipeline can't take items just now, nil if it can
+func (s *ingestServer) ready() error {
+	select {
+	case <-s.done:
+		return errors.New("draining")
+	default:
+	}
+	return s.p.health.ready()
+}
+
+// the next posted item, or io.EOF once the server has stopped taking them
+func (s *ingestServer) Next() (*Item, error) {
+	select {
+	case item := <-s.items:
+		return item, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+// stop taking items, which lets the producers finish
+func (s *ingestServer) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *ingestServer) Close() error {
+	s.stop()
+	err := s.srv.Close()
+	// in case it was never served
+	s.ln.Close()
+	return err
+}
@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// itemStream is the sink Items puts in the pipeline's, handing each item
+// it is given to the range loop over them
+type itemStream struct {
+	p    *Pipeline
+	ch   chan Item
+	done chan struct{} // closed once the loop stops
+	once sync.Once
+	err  error
+}
+
+// Items lets a program embedding the pipeline range over the items its
+// consumers have handled, in place of a sink:
+//
+//	go p.Run()
+//	for item := range p.Items(ctx) {
+//		...
+//	}
+//	if err := p.ItemsErr(); err != nil {
+//
+// It has to be called before Run, and only once, on a pipeline without a
+// -sink; otherwise the loop has nothing to range over. The consumers wait
+// for the loop to take each item, so a slow loop holds the pipeline back
+// as a slow sink would. The loop ends once the pipeline has finished and
+// every item is through it. Breaking out of it, or ctx being done, drains
+// the pipeline instead: the items its consumers handle after that fail to
+// be written, as with a sink that fails, and are counted as errors or
+// dead-lettered as -error-policy says. ItemsErr says why the loop ended.
+func (p *Pipeline) Items(ctx context.Context) func(yield func(Item) bool) {
+	if p.stream != nil {
+		return func(func(Item) bool) {}
+	}
+	s := &itemStream{p: p, ch: make(chan Item), done: make(chan struct{})}
+	p.stream = s
+	if p.sink != nil {
+		s.err = fmt.Errorf("pipeline %s writes its items to a -sink, so has none to range over", p.name)
+		close(s.done)
+	} else {
+		p.sink = s
+	}
+	return func(yield func(Item) bool) {
+		if s.err != nil {
+			return
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				s.stop(ctx.Err())
+				return
+			case item, ok := <-s.ch:
+				if !ok {
+					return
+				}
+				if !yield(item) {
+					s.stop(nil)
+					return
+				}
+			}
+		}
+	}
+}
+
+// ItemsErr is why the range over Items ended: nil once every item was
+// through it or the loop broke out, ctx's error if it was done first, or
+// why the items couldn't be ranged over at all
+func (p *Pipeline) ItemsErr() error {
+	if s := p.stream; s != nil {
+		select {
+		case <-s.done:
+			return s.err
+		default:
+			return nil
+		}
+	}
+	return errors.New("the pipeline's items weren't ranged over")
+}
+
+// stop handing items over, draining the pipeline
+func (s *itemStream) stop(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.p.drain()
+	})
+}
+
+func (s *itemStream) Write(item *Item) error {
+	out := *item
+	// a payload handed over with OwnPayload goes back to its pool once the
+	// item is settled, so the loop gets a copy of it
+	if out.release != nil {
+		out.Payload = append(json.RawMessage(nil), out.Payload...)
+		out.release = nil
+	}
+	select {
+	case s.ch <- out:
+		return nil
+	case <-s.done:
+		return fmt.Errorf("%w: the range over its items has stopped", ErrPipelineClosed)
+	}
+}
+
+// called once the consumers are done, ending the loop
+func (s *itemStream) Close() error {
+	close(s.ch)
+	return nil
+}
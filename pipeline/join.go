@@ -0,0 +1,297 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// the kinds of join, and what to do with lookup items that turn up after
+// the item they would have joined has given up waiting, which the drop
+// policy sees to
+const (
+	joinInner = "inner" // only items that found a match are passed on
+	joinLeft  = "left"  // unmatched items are passed on as they are
+
+	lateDrop = "drop"
+	lateDLQ  = "dlq"
+)
+
+// joiner combines the pipeline's items with a second stream of items read
+// from the join source, matching them on a key expression evaluated against
+// both. Items from either stream wait up to window for a partner. Pipeline
+// items that find one carry on with the partner's metadata added under
+// right.<key>, and its payload if they have none of their own; the ones
+// that don't are dropped on an inner join or passed on unchanged on a left
+// join. Join source items are kept for the window too, so one lookup item can
+// enrich every pipeline item with its key that arrives in that time.
+type joiner struct {
+	key    *expr
+	window time.Duration
+	kind   string
+	source Source
+	// emit passes a joined item on to the rest of the consumer
+	emit func(item Item, consumer int)
+	// drop discards unmatched items on an inner join, and late join
+	// source items
+	drop func(item Item, reason DropReason, detail string)
+
+	mu      sync.Mutex
+	pending map[string][]pendingItem // pipeline items waiting for a match
+	lookups map[string][]pendingItem // join source items, newest last
+	expired map[string]time.Time     // keys of pipeline items that gave up
+	stopped bool
+	drained bool // the join source has run dry
+	done    chan struct{}
+
+	joined, unmatched, lateCount int64
+}
+
+type pendingItem struct {
+	item     Item
+	consumer int
+	at       time.Time
+}
+
+func newJoiner(cfg *Config) (*joiner, error) {
+	if cfg.JoinKey == "" {
+		return nil, fmt.Errorf("-join-source needs a -join-key")
+	}
+	if cfg.JoinType != joinInner && cfg.JoinType != joinLeft {
+		return nil, fmt.Errorf("unknown join type %q, expected inner or left", cfg.JoinType)
+	}
+	if cfg.JoinWindow <= 0 {
+		return nil, fmt.Errorf("-join-window must be positive")
+	}
+	key, err := compileExpr(cfg.JoinKey)
+	if err != nil {
+		return nil, err
+	}
+	source, err := loadSource(cfg.JoinSource, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &joiner{
+		key:     key,
+		window:  cfg.JoinWindow,
+		kind:    cfg.JoinType,
+		source:  source,
+		pending: make(map[string][]pendingItem),
+		lookups: make(map[string][]pendingItem),
+		expired: make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// start reading the join source and expiring items that waited too long
+func (j *joiner) start() {
+	go j.read()
+	go j.sweep()
+}
+
+func (j *joiner) keyOf(item *Item) (string, error) {
+	v, err := j.key.eval(item)
+	if err != nil {
+		return "", fmt.Errorf("evaluating join key: %v", err)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// take an item from the pipeline, passing it straight on if a lookup item
+// with its key is waiting, or holding it until one arrives
+func (j *joiner) left(item Item, consumer int) error {
+	k, err := j.keyOf(&item)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	if ls := j.lookups[k]; len(ls) > 0 {
+		j.joined++
+		j.mu.Unlock()
+		j.emit(combine(item, ls[len(ls)-1].item), consumer)
+		return nil
+	}
+	j.pending[k] = append(j.pending[k], pendingItem{item, consumer, time.Now()})
+	j.mu.Unlock()
+	return nil
+}
+
+// take an item from the join source, releasing any pipeline items that
+// were waiting for it
+func (j *joiner) right(item Item) {
+	k, err := j.keyOf(&item)
+	if err != nil {
+		fmt.Printf("join source item %d: %v\n", item.ID, err)
+		return
+	}
+	now := time.Now()
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
+		return
+	}
+	waiting := j.pending[k]
+	delete(j.pending, k)
+	j.joined += int64(len(waiting))
+	late := len(waiting) == 0 && !j.expired[k].IsZero()
+	if late {
+		j.lateCount++
+	}
+	j.lookups[k] = append(j.lookups[k], pendingItem{item: item, at: now})
+	j.mu.Unlock()
+	if late {
+		j.drop(item, DropLate, fmt.Sprintf("join source item for key %q arrived after its match expired", k))
+		return
+	}
+	for _, w := range waiting {
+		j.emit(combine(w.item, item), w.consumer)
+	}
+}
+
+func (j *joiner) read() {
+	for {
+		item, err := j.source.Next()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("error reading from join source: %v\n", err)
+			}
+			j.mu.Lock()
+			j.drained = true
+			j.mu.Unlock()
+			return
+		}
+		j.mu.Lock()
+		stopped := j.stopped
+		j.mu.Unlock()
+		if stopped {
+			return
+		}
+		j.right(*item)
+	}
+}
+
+func (j *joiner) sweep() {
+	t := time.NewTicker(max(j.window/4, 10*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case now := <-t.C:
+			j.expire(now.Add(-j.window))
+		}
+	}
+}
+
+// give up on everything that arrived before cutoff
+func (j *joiner) expire(cutoff time.Time) {
+	var gaveUp []pendingItem
+	j.mu.Lock()
+	for k, ps := range j.pending {
+		n := 0
+		for _, p := range ps {
+			if p.at.Before(cutoff) {
+				gaveUp = append(gaveUp, p)
+				j.expired[k] = p.at
+			} else {
+				ps[n] = p
+				n++
+			}
+		}
+		if n == 0 {
+			delete(j.pending, k)
+		} else {
+			j.pending[k] = ps[:n]
+		}
+	}
+	for k, ls := range j.lookups {
+		n := 0
+		for _, l := range ls {
+			if !l.at.Before(cutoff) {
+				ls[n] = l
+				n++
+			}
+		}
+		if n == 0 {
+			delete(j.lookups, k)
+		} else {
+			j.lookups[k] = ls[:n]
+		}
+	}
+	// a late arrival is one within a window of its match giving up
+	for k, at := range j.expired {
+		if at.Before(cutoff.Add(-j.window)) {
+			delete(j.expired, k)
+		}
+	}
+	j.unmatched += int64(len(gaveUp))
+	j.mu.Unlock()
+	j.release(gaveUp)
+}
+
+// pass on unmatched items for a left join, or drop them for an inner one
+func (j *joiner) release(items []pendingItem) {
+	for _, p := range items {
+		if j.kind == joinLeft {
+			j.emit(p.item, p.consumer)
+		} else {
+			j.drop(p.item, DropUnmatched, fmt.Sprintf("no join match within %s", j.window))
+		}
+	}
+}
+
+// stop joining once the pipeline's consumers have finished. Items still
+// waiting get the rest of their window to find a match, unless the join
+// source has run dry and nothing more can turn up, and are then given up on.
+func (j *joiner) stop() {
+	for deadline := time.Now().Add(j.window); time.Now().Before(deadline); {
+		j.mu.Lock()
+		waiting := len(j.pending) > 0 && !j.drained
+		j.mu.Unlock()
+		if !waiting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
+		return
+	}
+	j.stopped = true
+	close(j.done)
+	var gaveUp []pendingItem
+	for _, ps := range j.pending {
+		gaveUp = append(gaveUp, ps...)
+	}
+	j.pending = make(map[string][]pendingItem)
+	j.unmatched += int64(len(gaveUp))
+	j.mu.Unlock()
+	j.release(gaveUp)
+}
+
+func (j *joiner) printSummary(w io.Writer) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fmt.Fprintf(w, "join (%s on %s): joined %d, unmatched %d, late %d\n",
+		j.kind, j.key, j.joined, j.unmatched, j.lateCount)
+}
+
+// add the join source item's metadata and payload to a pipeline item
+func combine(item, lookup Item) Item {
+	md := make(map[string]string, len(item.Metadata)+len(lookup.Metadata))
+	for k, v := range item.Metadata {
+		md[k] = v
+	}
+	for k, v := range lookup.Metadata {
+		md["right."+k] = v
+	}
+	item.Metadata = md
+	if item.Payload == nil {
+		item.Payload = lookup.Payload
+		item.Schema = lookup.Schema
+		item.SchemaVersion = lookup.SchemaVersion
+	}
+	return item
+}
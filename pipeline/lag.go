@@ -0,0 +1,211 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the events sent as a consumer group falls behind and catches up again
+const (
+	EventConsumerLag  = "consumer_lag"
+	EventLagRecovered = "lag_recovered"
+)
+
+// how often the lag monitor looks at the groups
+const lagCheckEvery = time.Second
+
+// lagMonitor watches how far behind each consumer group is, the default
+// pool and each routed one, by how many items wait on its buffer and how
+// long the oldest of them has waited. A group that goes past -lag-max-items
+// or -lag-max-age sends a consumer_lag event, and lag_recovered once it is
+// back under both, so a stuck group is noticed before its buffer fills.
+type lagMonitor struct {
+	maxItems int
+	maxAge   time.Duration
+	hooks    *eventHooks
+	groups   []*lagGroup
+	byChan   sync.Map // by the channel, which may be swapped for another
+	done     chan struct{}
+}
+
+// the lag of one consumer group. Its buffer is a queue, so the oldest item
+// on it is the one after the last taken, and the time each item was queued
+// at is kept by its place in the queue in a ring a little bigger than the
+// buffer.
+type lagGroup struct {
+	name    string
+	ch      chan Item
+	in, out atomic.Int64
+	queued  []atomic.Int64 // unix nanoseconds, by place in the queue
+
+	mu       sync.Mutex
+	behind   bool
+	alerts   int
+	maxItems int
+	maxAge   time.Duration
+}
+
+func newLagMonitor(cfg *Config, hooks *eventHooks) *lagMonitor {
+	return &lagMonitor{
+		maxItems: cfg.LagMaxItems,
+		maxAge:   cfg.LagMaxAge,
+		hooks:    hooks,
+		done:     make(chan struct{}),
+	}
+}
+
+// watch a group's buffer, the one its consumers take items off
+func (m *lagMonitor) watch(name string, ch chan Item) {
+	g := &lagGroup{name: name, ch: ch, queued: make([]atomic.Int64, cap(ch)+1024)}
+	m.groups = append(m.groups, g)
+	sort.Slice(m.groups, func(i, j int) bool { return m.groups[i].name < m.groups[j].name })
+	m.byChan.Store((<-chan Item)(ch), g)
+}
+
+// follow a group from its buffer to the one that replaced it, with the
+// items moved over in the same order. Called with nothing able to queue
+// items on either.
+func (m *lagMonitor) rewatch(old, ch chan Item) {
+	if m == nil {
+		return
+	}
+	v, ok := m.byChan.Load((<-chan Item)(old))
+	if !ok {
+		return
+	}
+	g := v.(*lagGroup)
+	g.mu.Lock()
+	if n := cap(ch) + 1024; n > len(g.queued) {
+		queued := make([]atomic.Int64, n)
+		for i := g.out.Load() + 1; i <= g.in.Load(); i++ {
+			queued[i%int64(n)].Store(g.queued[i%int64(len(g.queued))].Load())
+		}
+		g.queued = queued
+	}
+	g.ch = ch
+	g.mu.Unlock()
+	m.byChan.Store((<-chan Item)(ch), g)
+}
+
+func (m *lagMonitor) group(ch <-chan Item) *lagGroup {
+	if v, ok := m.byChan.Load(ch); ok {
+		return v.(*lagGroup)
+	}
+	return nil
+}
+
+// note an item put on a buffer. Safe on a nil monitor, and for buffers
+// that aren't a group's, such as the redis outbox.
+func (m *lagMonitor) queued(ch chan Item) {
+	if m == nil {
+		return
+	}
+	if g := m.group(ch); g != nil {
+		n := g.in.Add(1)
+		g.queued[n%int64(len(g.queued))].Store(time.Now().UnixNano())
+	}
+}
+
+// note an item taken off a buffer. Safe on a nil monitor.
+func (m *lagMonitor) taken(ch <-chan Item) {
+	if m == nil {
+		return
+	}
+	if g := m.group(ch); g != nil {
+		g.out.Add(1)
+	}
+}
+
+// how many items wait for the group and how long the oldest has
+func (g *lagGroup) lag() (int, time.Duration) {
+	g.mu.Lock()
+	ch, queued := g.ch, g.queued
+	g.mu.Unlock()
+	items := len(ch)
+	next := g.out.Load() + 1
+	if items == 0 || next > g.in.Load() {
+		return items, 0
+	}
+	at := queued[next%int64(len(queued))].Load()
+	return items, max(time.Since(time.Unix(0, at)), 0)
+}
+
+func (m *lagMonitor) start() {
+	go func() {
+		tick := time.NewTicker(lagCheckEvery)
+		defer tick.Stop()
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-tick.C:
+			}
+			for _, g := range m.groups {
+				m.check(g)
+			}
+		}
+	}()
+}
+
+func (m *lagMonitor) stop() {
+	close(m.done)
+}
+
+func (m *lagMonitor) check(g *lagGroup) {
+	items, age := g.lag()
+	behind := (m.maxItems > 0 && items > m.maxItems) || (m.maxAge > 0 && age > m.maxAge)
+	g.mu.Lock()
+	g.maxItems = max(g.maxItems, items)
+	g.maxAge = max(g.maxAge, age)
+	was := g.behind
+	g.behind = behind
+	if behind && !was {
+		g.alerts++
+	}
+	g.mu.Unlock()
+	if behind == was {
+		return
+	}
+	fields := map[string]any{"group": g.name, "items": items, "oldest_age": age.String()}
+	age = age.Round(time.Millisecond)
+	if behind {
+		fmt.Printf("consumer group %s is behind: %d items waiting, the oldest for %s\n", g.name, items, age)
+		m.hooks.emit(newEvent(EventConsumerLag, fields,
+			"consumer group %s is behind: %d items waiting, the oldest for %s", g.name, items, age))
+		return
+	}
+	fmt.Printf("consumer group %s has caught up\n", g.name)
+	m.hooks.emit(newEvent(EventLagRecovered, fields, "consumer group %s has caught up", g.name))
+}
+
+// the lag of each group right now, by name
+func (m *lagMonitor) snapshot() map[string]GroupLag {
+	lags := make(map[string]GroupLag, len(m.groups))
+	for _, g := range m.groups {
+		items, age := g.lag()
+		g.mu.Lock()
+		lags[g.name] = GroupLag{Items: items, OldestAge: age.String(), Behind: g.behind}
+		g.mu.Unlock()
+	}
+	return lags
+}
+
+// GroupLag is how far behind a consumer group is, for the admin API
+type GroupLag struct {
+	Items     int    `json:"items"`
+	OldestAge string `json:"oldest_age"`
+	Behind    bool   `json:"behind"`
+}
+
+func (m *lagMonitor) printSummary(w io.Writer) {
+	for _, g := range m.groups {
+		g.mu.Lock()
+		fmt.Fprintf(w, "consumer lag %s: at most %d items and %s behind, fell behind %d times\n",
+			g.name, g.maxItems, g.maxAge.Round(time.Millisecond), g.alerts)
+		g.mu.Unlock()
+	}
+}
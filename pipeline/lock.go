@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errLocked means another process holds a lock we tried for without waiting
+var errLocked = errors.New("locked")
+
+// runLocks stops two runs from using the same on-disk state at once. Every
+// file a run writes and would corrupt if shared, the checkpoint, the dead
+// letter file and a file sink, gets a <file>.lock next to it, and -lock
+// adds one more for state the pipeline can't see, such as a plugin's. A
+// second run either fails straight away or, with -standby, waits until
+// the first is done and then takes over, picking up from its checkpoint.
+//
+// On unix the locks are flock(2) locks, which the kernel drops when a run
+// dies, so there's nothing stale to clean up. Elsewhere they are files
+// created exclusively and removed on exit, so a crashed run can leave one
+// behind that has to go by hand.
+type runLocks struct {
+	files []*lockFile
+}
+
+// lockFile is one held lock
+type lockFile struct {
+	path string
+	file *os.File
+}
+
+// the lock files a run needs, sorted so that two runs wanting overlapping
+// sets take them in the same order
+func lockPaths(cfg *Config) []string {
+	set := make(map[string]bool)
+	for _, state := range []string{cfg.Checkpoint, cfg.DLQ} {
+		if state != "" {
+			set[state+".lock"] = true
+		}
+	}
+	if target, ok := strings.CutPrefix(cfg.Sink, "file:"); ok && target != "" {
+		set[target+".lock"] = true
+	}
+	if cfg.Lock != "" {
+		set[cfg.Lock] = true
+	}
+	paths := make([]string, 0, len(set))
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func acquireRunLocks(cfg *Config) (*runLocks, error) {
+	l := &runLocks{}
+	for _, path := range lockPaths(cfg) {
+		f, err := tryLock(path, false)
+		if err == errLocked && cfg.Standby {
+			fmt.Printf("%s is held by %s, waiting as a standby\n", path, lockHolder(path))
+			start := time.Now()
+			f, err = tryLock(path, true)
+			if err == nil {
+				fmt.Printf("took over %s after %v\n", path, time.Since(start).Round(time.Millisecond))
+			}
+		}
+		if err == errLocked {
+			err = fmt.Errorf("%s is held by %s, is another run using the same files? (-standby waits for it)", path, lockHolder(path))
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		// note who we are for whoever finds the lock held
+		f.file.Truncate(0)
+		f.file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		l.files = append(l.files, f)
+	}
+	return l, nil
+}
+
+// the pid written in a lock file, for messages
+func lockHolder(path string) string {
+	b, err := os.ReadFile(path)
+	if pid := strings.TrimSpace(string(b)); err == nil && pid != "" {
+		return "pid " + pid
+	}
+	return "another process"
+}
+
+func (l *runLocks) Close() error {
+	for _, f := range l.files {
+		unlock(f)
+	}
+	l.files = nil
+	return nil
+}
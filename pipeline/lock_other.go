@@ -0,0 +1,33 @@
+//go:build !unix
+
+package pipeline
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// without flock the lock is the file's existence, so waiting means
+// polling for it to go away
+func tryLock(path string, wait bool) (*lockFile, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return &lockFile{path: path, file: f}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if !wait {
+			return nil, errLocked
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func unlock(f *lockFile) {
+	f.file.Close()
+	os.Remove(f.path)
+}
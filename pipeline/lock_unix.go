@@ -0,0 +1,41 @@
+//go:build unix
+
+package pipeline
+
+import (
+	"os"
+	"syscall"
+)
+
+// take an flock on path, creating it if need be, either blocking until it
+// is free or failing with errLocked
+func tryLock(path string, wait bool) (*lockFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return &lockFile{path: path, file: f}, nil
+}
+
+// the file is left in place, removing it would race with a run that has
+// just opened it to wait on
+func unlock(f *lockFile) {
+	f.file.Close()
+}
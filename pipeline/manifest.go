@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest is the record of a run written to -manifest when it finishes,
+// enough to run the same experiment again and to compare it with others:
+// every flag's value, the seed the built-in producers drew their items
+// with, git-style hashes of the files read and written, what it ran on,
+// and the end-of-run report. Secrets given as flags are left out.
+type Manifest struct {
+	RunID    string
+	Name     string
+	Started  time.Time
+	Finished time.Time
+	Seed     int64
+	// the flags given, which with the seed repeat the run, and the value
+	// every flag had
+	Command []string
+	Config  map[string]string
+	Inputs  []ManifestFile `json:",omitempty"`
+	Outputs []ManifestFile `json:",omitempty"`
+	Env     ManifestEnv
+	Summary Report
+}
+
+// ManifestFile is a file a run read or wrote, with the hash git would give
+// its contents as a blob, so a recording can be told apart from another
+// of the same name, or found in a repository
+type ManifestFile struct {
+	Flag string
+	Path string
+	Size int64
+	Hash string `json:",omitempty"`
+	// why there is no hash, such as the file having gone
+	Error string `json:",omitempty"`
+}
+
+// ManifestEnv is what a run ran on
+type ManifestEnv struct {
+	GoVersion  string
+	OS         string
+	Arch       string
+	Hostname   string
+	CPUs       int
+	GOMAXPROCS int
+	// the commit the binary was built from, when the build recorded it
+	Revision  string            `json:",omitempty"`
+	Container string            `json:",omitempty"`
+	Vars      map[string]string `json:",omitempty"`
+}
+
+// the variables that change how the Go runtime behaves
+var manifestVars = []string{"GOMAXPROCS", "GOMEMLIMIT", "GOGC", "GODEBUG"}
+
+// note every flag's value, and the ones on the command line by name, with
+// anything secret taken out
+func (cfg *Config) recordFlags(fs *flag.FlagSet) {
+	cfg.flagValues = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		cfg.flagValues[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	fs.Visit(func(f *flag.Flag) {
+		cfg.flagsSet = append(cfg.flagsSet, f.Name)
+	})
+}
+
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, s := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, s) {
+			return "REDACTED"
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return value
+}
+
+// put together the manifest of a run that started at started and came to
+// report
+func newManifest(cfg *Config, started time.Time, report Report) Manifest {
+	m := Manifest{
+		RunID:    cfg.RunID,
+		Name:     cfg.Name,
+		Started:  started,
+		Finished: time.Now(),
+		Seed:     cfg.Seed,
+		Config:   cfg.flagValues,
+		Summary:  report,
+	}
+	set := append([]string(nil), cfg.flagsSet...)
+	sort.Strings(set)
+	for _, name := range set {
+		m.Command = append(m.Command, fmt.Sprintf("-%s=%s", name, cfg.flagValues[name]))
+	}
+	if !slices.Contains(set, "seed") {
+		m.Command = append(m.Command, fmt.Sprintf("-seed=%d", cfg.Seed))
+	}
+	hostname, _ := os.Hostname()
+	m.Env = ManifestEnv{
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		Hostname:   hostname,
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Container:  cfg.containerNote,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		modified := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				m.Env.Revision = s.Value
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && m.Env.Revision != "" {
+			m.Env.Revision += " (modified)"
+		}
+	}
+	for _, v := range manifestVars {
+		if s, ok := os.LookupEnv(v); ok {
+			if m.Env.Vars == nil {
+				m.Env.Vars = make(map[string]string)
+			}
+			m.Env.Vars[v] = s
+		}
+	}
+	files := func(name, spec string, plain bool) []ManifestFile {
+		path, ok := strings.CutPrefix(spec, "file:")
+		if plain {
+			path, ok = spec, spec != ""
+		}
+		if !ok {
+			return nil
+		}
+		paths := []string{path}
+		if strings.ContainsAny(path, "*?[") {
+			paths, _ = filepath.Glob(path)
+			sort.Strings(paths)
+		}
+		var out []ManifestFile
+		for _, path := range paths {
+			out = append(out, hashFile(name, path))
+		}
+		return out
+	}
+	m.Inputs = append(m.Inputs, files("config", cfg.ConfigFile, true)...)
+	m.Inputs = append(m.Inputs, files("source", cfg.Source, false)...)
+	m.Inputs = append(m.Inputs, files("join-source", cfg.JoinSource, false)...)
+	m.Outputs = append(m.Outputs, files("sink", cfg.Sink, false)...)
+	for _, s := range cfg.NamedSinks {
+		if name, spec, ok := strings.Cut(s, "="); ok {
+			m.Outputs = append(m.Outputs, files("named-sink "+name, spec, false)...)
+		}
+	}
+	m.Outputs = append(m.Outputs, files("record-produced", cfg.RecordProduced, true)...)
+	if cfg.GoldenUpdate {
+		m.Outputs = append(m.Outputs, files("golden", cfg.Golden, true)...)
+	} else {
+		m.Inputs = append(m.Inputs, files("golden", cfg.Golden, true)...)
+	}
+	m.Outputs = append(m.Outputs, files("dlq", cfg.DLQ, true)...)
+	m.Outputs = append(m.Outputs, files("report", cfg.Report, true)...)
+	return m
+}
+
+// the hash git gives a file's contents as a blob: the SHA-1 of a header
+// with its size and then the contents
+func hashFile(name, path string) ManifestFile {
+	mf := ManifestFile{Flag: name, Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		mf.Error = err.Error()
+		return mf
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		mf.Error = err.Error()
+		return mf
+	}
+	mf.Size = fi.Size()
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", mf.Size)
+	if _, err := io.Copy(h, f); err != nil {
+		mf.Error = err.Error()
+		return mf
+	}
+	mf.Hash = hex.EncodeToString(h.Sum(nil))
+	return mf
+}
+
+// write the manifest to -manifest, or to <run id>.json in it when it is a
+// directory
+func writeManifest(path string, m Manifest) error {
+	if fi, err := os.Stat(path); (err == nil && fi.IsDir()) || strings.HasSuffix(path, string(os.PathSeparator)) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		path = filepath.Join(path, m.RunID+".json")
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
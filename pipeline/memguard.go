@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// EventMemoryPressure is sent each time memory use goes over -memory-limit
+const EventMemoryPressure = "memory_pressure"
+
+// the ways the memory guard can measure the process
+const (
+	memoryHeap = "heap" // live and not yet swept heap objects, cheap and quick to fall after a GC
+	memoryRSS  = "rss"  // resident set size, from /proc on linux
+)
+
+// memGuard keeps a slow sink from running the process out of memory. It
+// samples memory use every -memory-interval and while it is over
+// -memory-limit the pipeline sheds every item matching -memory-shed, the
+// low priority ones, both as producers read them and as consumers take
+// them off the buffers. Producers holding any other item wait until memory
+// is back under the limit, so without a -memory-shed expression the guard
+// simply pauses the producers.
+type memGuard struct {
+	limit   int64
+	measure string
+	every   time.Duration
+	shed    *expr // nil means nothing may be shed
+	hooks   *eventHooks
+
+	over  atomic.Bool
+	used  atomic.Int64
+	gate  gate
+	done  chan struct{}
+	pages int64 // page size, for reading rss
+}
+
+func newMemGuard(cfg *Config, hooks *eventHooks) (*memGuard, error) {
+	g := &memGuard{
+		limit:   int64(cfg.MemoryLimit),
+		measure: cfg.MemoryMeasure,
+		every:   cfg.MemoryInterval,
+		hooks:   hooks,
+		done:    make(chan struct{}),
+		pages:   int64(os.Getpagesize()),
+	}
+	if g.measure != memoryHeap && g.measure != memoryRSS {
+		return nil, fmt.Errorf("unknown memory measure %q, expected heap or rss", g.measure)
+	}
+	if g.every <= 0 {
+		g.every = 100 * time.Millisecond
+	}
+	if cfg.MemoryShed != "" {
+		var err error
+		if g.shed, err = compileExpr(cfg.MemoryShed); err != nil {
+			return nil, fmt.Errorf("-memory-shed: %v", err)
+		}
+	}
+	if _, err := g.sample(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *memGuard) start() {
+	go func() {
+		ticker := time.NewTicker(g.every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+				g.check()
+			}
+		}
+	}()
+}
+
+func (g *memGuard) stop() {
+	close(g.done)
+	g.gate.unpause()
+}
+
+func (g *memGuard) check() {
+	used, err := g.sample()
+	if err != nil {
+		fmt.Printf("error measuring memory: %v\n", err)
+		return
+	}
+	g.used.Store(used)
+	over := used > g.limit
+	if over == g.over.Load() {
+		return
+	}
+	g.over.Store(over)
+	if !over {
+		fmt.Printf("memory back under the limit at %s\n", formatBytes(used))
+		g.gate.unpause()
+		return
+	}
+	g.gate.pause()
+	what := "pausing producers"
+	if g.shed != nil {
+		what = "shedding items matching " + g.shed.String()
+	}
+	fmt.Printf("memory at %s is over the %s limit, %s\n", formatBytes(used), formatBytes(g.limit), what)
+	g.hooks.emit(newEvent(EventMemoryPressure,
+		map[string]any{"bytes": used, "limit": g.limit, "measure": g.measure},
+		"memory at %s is over the %s limit", formatBytes(used), formatBytes(g.limit)))
+}
+
+func (g *memGuard) sample() (int64, error) {
+	if g.measure == memoryHeap {
+		s := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(s)
+		return int64(s[0].Value.Uint64()), nil
+	}
+	// the second field of statm is the resident size in pages
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, fmt.Errorf("reading rss: %v, try -memory-measure heap", err)
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("reading rss: unexpected statm %q", b)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("reading rss: %v", err)
+	}
+	return pages * g.pages, nil
+}
+
+// whether an item should be dropped to save memory right now. Called on
+// a nil guard it is always false.
+func (g *memGuard) shedding(item *Item) bool {
+	if g == nil || g.shed == nil || !g.over.Load() {
+		return false
+	}
+	ok, err := g.shed.match(item)
+	return err == nil && ok
+}
+
+// let a producer carry on with an item it is keeping, once memory allows
+func (g *memGuard) wait(stop <-chan struct{}) {
+	if g != nil {
+		g.gate.wait(stop)
+	}
+}
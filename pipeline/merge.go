@@ -0,0 +1,270 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// how -merge takes items off the producers' lanes
+const (
+	mergeFair     = "fair"     // round the lanes in turn, so each producer gets its share
+	mergePriority = "priority" // always the lowest numbered producer with an item waiting
+)
+
+// merger gives each built-in producer, with -producer-lanes, a channel of
+// its own for each buffer it routes items to. A stage for each buffer
+// merges the lanes feeding it onto it. A buffer that its consumers are
+// slow to empty then only holds up its own stage, and a producer only
+// waits when its own lane is full. Producers that route nothing there,
+// and the other producers' items bound for a fast pool, keep moving. A
+// fair stage goes round the lanes in turn, so one busy producer can't
+// crowd the buffer out for the rest, and a priority stage takes from the
+// lowest numbered producer that has an item, starving the others while it
+// keeps busy. Items given to the pipeline directly, with Produce or over
+// -ingest, don't go through the lanes.
+type merger struct {
+	p        *Pipeline
+	size     int
+	priority bool
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	stages map[chan Item]*mergeStage // by the buffer each feeds
+}
+
+// a merge stage, feeding one buffer from the lanes of the producers routing
+// items to it
+type mergeStage struct {
+	m    *merger
+	ch   chan Item
+	name string
+
+	mu     sync.Mutex
+	lanes  []*lane // by producer
+	added  chan struct{}
+	closed bool
+	// where the fair merge goes round the lanes from next, only used by
+	// the stage's goroutine
+	next int
+}
+
+// lane is a producer's channel to a merge stage
+type lane struct {
+	producer int
+	ch       chan Item
+	merged   atomic.Int64
+	// only the stage's goroutine uses it
+	drained bool
+}
+
+func newMerger(p *Pipeline, cfg *Config) (*merger, error) {
+	if cfg.Merge != mergeFair && cfg.Merge != mergePriority {
+		return nil, fmt.Errorf("unknown -merge %q, expected %s or %s", cfg.Merge, mergeFair, mergePriority)
+	}
+	if cfg.BufferShards > 1 {
+		return nil, fmt.Errorf("-producer-lanes doesn't work with -buffer-shards, which gives producers their own shards")
+	}
+	return &merger{p: p, size: cfg.ProducerLanes, priority: cfg.Merge == mergePriority, stages: make(map[chan Item]*mergeStage)}, nil
+}
+
+// put an item a producer routed to ch on its lane, waiting for room there.
+// It reports false if stop was closed first.
+func (m *merger) put(ch chan Item, myId int, item Item, stop <-chan struct{}) bool {
+	l := m.stage(ch).lane(myId)
+	select {
+	case l.ch <- item:
+		return true
+	case <-stop:
+		m.p.budget.release(item.size)
+		item.releasePayload()
+		return false
+	}
+}
+
+// the stage feeding ch, started the first time an item is routed to it
+func (m *merger) stage(ch chan Item) *mergeStage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stages[ch]
+	if s == nil {
+		s = &mergeStage{m: m, ch: ch, name: m.p.bufferName(ch), added: make(chan struct{})}
+		m.stages[ch] = s
+		m.wg.Add(1)
+		go s.run()
+	}
+	return s
+}
+
+func (s *mergeStage) lane(producer int) *lane {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.lanes), func(i int) bool { return s.lanes[i].producer >= producer })
+	if i < len(s.lanes) && s.lanes[i].producer == producer {
+		return s.lanes[i]
+	}
+	l := &lane{producer: producer, ch: make(chan Item, s.m.size)}
+	s.lanes = append(s.lanes, nil)
+	copy(s.lanes[i+1:], s.lanes[i:])
+	s.lanes[i] = l
+	// wake the stage to take from the new lane too
+	close(s.added)
+	s.added = make(chan struct{})
+	return l
+}
+
+// move the lanes' items onto the buffer until they are all closed and
+// empty. The buffer's own enqueue does the rest, waiting for room or
+// dropping as -buffer-full says.
+func (s *mergeStage) run() {
+	defer s.m.wg.Done()
+	for {
+		item, l, ok := s.take()
+		if !ok {
+			return
+		}
+		l.merged.Add(1)
+		s.m.p.enqueue(s.ch, item, nil)
+	}
+}
+
+// the lanes to look at, in the order to look at them
+func (s *mergeStage) order() ([]*lane, chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lanes := make([]*lane, 0, len(s.lanes))
+	for i := range s.lanes {
+		j := i
+		if !s.m.priority {
+			j = (s.next + i) % len(s.lanes)
+		}
+		if !s.lanes[j].drained {
+			lanes = append(lanes, s.lanes[j])
+		}
+	}
+	return lanes, s.added, s.closed
+}
+
+// the next item to merge, waiting for one if no lane has any. It reports
+// false once the lanes are closed and there are none left.
+func (s *mergeStage) take() (Item, *lane, bool) {
+	for {
+		lanes, added, closed := s.order()
+		for _, l := range lanes {
+			select {
+			case item, ok := <-l.ch:
+				if ok {
+					s.took(l)
+					return item, l, true
+				}
+				l.drained = true
+			default:
+			}
+		}
+		// nothing waiting: wait on every lane, and for a new one
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(added)}}
+		open := lanes[:0]
+		for _, l := range lanes {
+			if !l.drained {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.ch)})
+				open = append(open, l)
+			}
+		}
+		if closed && len(open) == 0 {
+			return Item{}, nil, false
+		}
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 0 {
+			continue
+		}
+		l := open[chosen-1]
+		if !ok {
+			l.drained = true
+			continue
+		}
+		s.took(l)
+		return v.Interface().(Item), l, true
+	}
+}
+
+// have the fair merge start after l next time
+func (s *mergeStage) took(l *lane) {
+	if s.m.priority {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.lanes {
+		if s.lanes[i] == l {
+			s.next = i + 1
+			return
+		}
+	}
+}
+
+// close the lanes once the producers are done with them, and wait for the
+// stages to have merged what is left on them
+func (m *merger) close() {
+	m.mu.Lock()
+	for _, s := range m.stages {
+		s.mu.Lock()
+		s.closed = true
+		for _, l := range s.lanes {
+			close(l.ch)
+		}
+		close(s.added)
+		s.mu.Unlock()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// how many items wait on the lanes
+func (m *merger) waiting() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, s := range m.stages {
+		s.mu.Lock()
+		for _, l := range s.lanes {
+			n += len(l.ch)
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (m *merger) sorted() []*mergeStage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stages := make([]*mergeStage, 0, len(m.stages))
+	for _, s := range m.stages {
+		stages = append(stages, s)
+	}
+	sort.Slice(stages, func(i, j int) bool { return stages[i].name < stages[j].name })
+	return stages
+}
+
+func (m *merger) printSummary(w io.Writer) {
+	how := mergeFair
+	if m.priority {
+		how = mergePriority
+	}
+	for _, s := range m.sorted() {
+		s.mu.Lock()
+		var total int64
+		by := make([]string, 0, len(s.lanes))
+		for _, l := range s.lanes {
+			n := l.merged.Load()
+			total += n
+			by = append(by, fmt.Sprintf("producer %d: %d", l.producer, n))
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(w, "merge %s onto %s: %d items from %d producer lanes of %d (%s)\n",
+			how, s.name, total, len(by), m.size, strings.Join(by, ", "))
+	}
+}
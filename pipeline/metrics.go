@@ -0,0 +1,252 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the key given to items once -metrics-max-keys keys are being tracked
+const otherKey = "other"
+
+// keyMetrics breaks the consumers' counts down by a key such as an mqtt
+// topic, from the -metrics-key expression. Only the first -metrics-max-keys
+// keys seen get series of their own and the rest share the other bucket,
+// so a key with millions of values can't make the exposition as big.
+type keyMetrics struct {
+	key *expr
+	max int
+
+	mu       sync.Mutex
+	keys     map[string]*keyCounts
+	overflow int64 // items that went into other for want of room
+}
+
+type keyCounts struct {
+	consumed int64
+	errors   int64
+	latency  time.Duration // sum of the queue latencies
+}
+
+func newKeyMetrics(cfg *Config) (*keyMetrics, error) {
+	key, err := compileExpr(cfg.MetricsKey)
+	if err != nil {
+		return nil, fmt.Errorf("-metrics-key: %v", err)
+	}
+	if cfg.MetricsMaxKeys < 1 {
+		return nil, fmt.Errorf("-metrics-max-keys must be at least 1")
+	}
+	return &keyMetrics{key: key, max: cfg.MetricsMaxKeys, keys: make(map[string]*keyCounts)}, nil
+}
+
+// the counts for an item's key, and whether it had to go in other for
+// want of room, called with m.mu held
+func (m *keyMetrics) counts(item *Item) (*keyCounts, bool) {
+	k := otherKey
+	if v, err := m.key.eval(item); err == nil && v != nil {
+		k = fmt.Sprint(v)
+	}
+	c := m.keys[k]
+	full := c == nil && k != otherKey && len(m.keys) >= m.max
+	if full {
+		k = otherKey
+		c = m.keys[k]
+	}
+	if c == nil {
+		c = &keyCounts{}
+		m.keys[k] = c
+	}
+	return c, full
+}
+
+// count an item a consumer took. Safe on nil metrics.
+func (m *keyMetrics) consumed(item *Item, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	c, full := m.counts(item)
+	if full {
+		m.overflow++
+	}
+	c.consumed++
+	c.latency += latency
+	m.mu.Unlock()
+}
+
+// count an item that failed. Safe on nil metrics.
+func (m *keyMetrics) failed(item *Item) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	c, _ := m.counts(item)
+	c.errors++
+	m.mu.Unlock()
+}
+
+func (m *keyMetrics) printSummary(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.keys)
+	if m.overflow > 0 {
+		n-- // the other bucket
+	}
+	fmt.Fprintf(w, "metrics keys: %d counted apart", n)
+	if m.overflow > 0 {
+		fmt.Fprintf(w, ", %d items counted as other past the -metrics-max-keys limit of %d", m.overflow, m.max)
+	}
+	fmt.Fprintln(w)
+}
+
+// serve every pipeline's stats in the Prometheus text format
+func (a *adminServer) metrics(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	pipes := make([]*Pipeline, 0, len(a.pipes))
+	for _, p := range a.pipes {
+		pipes = append(pipes, p)
+	}
+	a.mu.Unlock()
+	sort.Slice(pipes, func(i, j int) bool { return pipes[i].name < pipes[j].name })
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, pipes)
+}
+
+// a metric family: the HELP and TYPE lines and then its samples
+type promFamily struct {
+	name, kind, help string
+	samples          []promSample
+}
+
+type promSample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func writeMetrics(w io.Writer, pipes []*Pipeline) {
+	families := map[string]*promFamily{}
+	var order []string
+	add := func(name, kind, help string, value float64, labels ...string) {
+		f := families[name]
+		if f == nil {
+			f = &promFamily{name: name, kind: kind, help: help}
+			families[name] = f
+			order = append(order, name)
+		}
+		f.samples = append(f.samples, promSample{labels, value})
+	}
+	for _, p := range pipes {
+		st := p.status()
+		name := p.name
+		add("pc_produced_total", "counter", "Items put on a buffer.", float64(st.Produced), "pipeline", name)
+		add("pc_consumed_total", "counter", "Items taken by a consumer.", float64(st.Consumed), "pipeline", name)
+		add("pc_errors_total", "counter", "Items a handler or sink failed on.", float64(st.Errors), "pipeline", name)
+		add("pc_dead_lettered_total", "counter", "Items sent to the dead-letter queue.", float64(st.Dead), "pipeline", name)
+		for _, reason := range dropReasons {
+			add("pc_dropped_total", "counter", "Items discarded, by reason.", float64(st.Dropped[reason]), "pipeline", name, "reason", string(reason))
+		}
+		add("pc_buffered", "gauge", "Items waiting on the buffer.", float64(st.Buffered), "pipeline", name)
+		if p.prefetch != nil {
+			add("pc_prefetched", "gauge", "Items taken off the buffers by consumers ahead of handling them.", float64(st.Prefetched), "pipeline", name)
+		}
+		add("pc_producers", "gauge", "Running producers.", float64(st.Producers), "pipeline", name)
+		add("pc_consumers", "gauge", "Running consumers.", float64(st.Consumers), "pipeline", name)
+		lat := p.stats.latencies()
+		for _, q := range []float64{0.5, 0.9, 0.99} {
+			add("pc_queue_latency_seconds", "summary", "Time from an item being made to a consumer taking it.",
+				lat.quantile(q).Seconds(), "pipeline", name, "quantile", fmt.Sprint(q))
+		}
+		if r := p.routed; r != nil {
+			for _, sink := range r.names {
+				written, failed := r.sinks[sink].counts()
+				add("pc_sink_written_total", "counter", "Items written to a sink, by -named-sink name.", float64(written), "pipeline", name, "sink", sink)
+				add("pc_sink_errors_total", "counter", "Items a sink failed to write, by -named-sink name.", float64(failed), "pipeline", name, "sink", sink)
+			}
+		}
+		if s := p.shadow; s != nil {
+			outcomes := []struct {
+				name string
+				n    *atomic.Int64
+			}{{"same", &s.same}, {"different", &s.different}, {"failed", &s.failed}, {"skipped", &s.dropped}}
+			for _, o := range outcomes {
+				add("pc_shadow_items_total", "counter", "Items offered to the -shadow-handler, by how its handling compared.", float64(o.n.Load()), "pipeline", name, "outcome", o.name)
+			}
+		}
+		if c := p.canary; c != nil {
+			cs := st.Canary
+			add("pc_canary_percent", "gauge", "Share of the default pool's items sent to the -canary-handler.", cs.Percent, "pipeline", name)
+			for i, arm := range []struct {
+				name string
+				s    CanaryStats
+			}{{defaultPool, cs.Default}, {canaryPool, cs.Canary}} {
+				add("pc_canary_handled_total", "counter", "Items handled with -canary-handler set, by the pool that handled them.", float64(arm.s.Handled), "pipeline", name, "pool", arm.name)
+				add("pc_canary_errors_total", "counter", "Items failed on with -canary-handler set, by the pool that failed on them.", float64(arm.s.Failed), "pipeline", name, "pool", arm.name)
+				for _, q := range []float64{0.5, 0.9, 0.99} {
+					add("pc_canary_handle_seconds", "summary", "Time handling an item with -canary-handler set, by pool.",
+						c.quantile(i, q).Seconds(), "pipeline", name, "pool", arm.name, "quantile", fmt.Sprint(q))
+				}
+			}
+		}
+		if p.limits != nil {
+			for _, s := range p.limits.stages() {
+				add("pc_stage_in_use", "gauge", "How much of a stage's -concurrency limit is taken.", float64(s.inUse()), "pipeline", name, "stage", s.stage)
+				add("pc_stage_limit", "gauge", "A stage's -concurrency limit.", float64(s.limit), "pipeline", name, "stage", s.stage)
+			}
+		}
+		if p.ordered != nil {
+			add("pc_sink_order_waiting", "gauge", "Writes waiting for an earlier item with their -sink-order-key.", float64(p.ordered.parked.Load()), "pipeline", name)
+		}
+		for _, w := range p.behind {
+			add("pc_write_behind_items", "gauge", "Writes waiting in a -write-behind buffer.", float64(w.buffered()), "pipeline", name, "sink", w.name)
+			add("pc_write_behind_flushes_total", "counter", "Times a -write-behind buffer was written out.", float64(w.flushes.Load()), "pipeline", name, "sink", w.name)
+		}
+		if p.lag != nil {
+			for _, g := range p.lag.groups {
+				items, age := g.lag()
+				add("pc_group_lag_items", "gauge", "Items waiting for a consumer group.", float64(items), "pipeline", name, "group", g.name)
+				add("pc_group_lag_seconds", "gauge", "How long the oldest item waiting for a consumer group has waited.", age.Seconds(), "pipeline", name, "group", g.name)
+			}
+		}
+		if m := p.keyed; m != nil {
+			m.mu.Lock()
+			keys := make([]string, 0, len(m.keys))
+			for k := range m.keys {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				c := m.keys[k]
+				add("pc_key_consumed_total", "counter", "Items taken by a consumer, by -metrics-key.", float64(c.consumed), "pipeline", name, "key", k)
+				add("pc_key_errors_total", "counter", "Items failed on, by -metrics-key.", float64(c.errors), "pipeline", name, "key", k)
+				add("pc_key_latency_seconds_total", "counter", "Total queue latency of the items, by -metrics-key.", c.latency.Seconds(), "pipeline", name, "key", k)
+			}
+			add("pc_key_overflow_total", "counter", "Items counted under other because -metrics-max-keys keys were tracked already.", float64(m.overflow), "pipeline", name)
+			m.mu.Unlock()
+		}
+	}
+	for _, name := range order {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s{%s} %g\n", f.name, promLabels(s.labels), s.value)
+		}
+	}
+}
+
+func promLabels(pairs []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pairs[i], promEscape.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+var promEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,568 @@
+package pipeline
+
+import (
+	"bufio"
+	"crypto/tls"
+	bin "encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+const (
+	mqttDefaultPort = "1883"
+	mqttKeepAlive   = 30 * time.Second
+	// how long a publish or subscribe waits for the broker to answer
+	mqttAckTimeout = 30 * time.Second
+)
+
+// mqttSource subscribes to -mqtt-subscribe on the broker given as
+// mqtt:<host>[:port] and turns each message into an item. A message that
+// is a json encoded item, as the mqtt sink publishes, is used as is, and
+// anything else becomes the payload of a new item with the topic in its
+// mqtt_topic metadata.
+//
+// The -mqtt-qos level is mapped onto the pipeline's delivery guarantees:
+//
+//	0  at most once, nothing is acknowledged
+//	1  at least once, the PUBACK is only sent once the item has been handled
+//	2  exactly once from the broker, the PUBREC is sent once it has been handled
+//
+// With a fixed -mqtt-client-id the session outlives the connection, so a
+// restarted run is redelivered whatever it hadn't acknowledged. Without
+// one every run gets a clean session. The source never runs dry unless
+// -mqtt-idle is set, in which case it stops after that long without a
+// message.
+type mqttSource struct {
+	c    *mqttClient
+	idle time.Duration
+
+	mu    sync.Mutex
+	count int
+	// messages waiting on their handling before they can be acked, in the
+	// order they arrived since acks have to go back in that order
+	unacked []*mqttPending
+}
+
+type mqttPending struct {
+	id   uint16
+	qos  byte
+	done bool
+}
+
+func newMQTTSource(target string, cfg *Config) (*mqttSource, error) {
+	if cfg.MQTTSubscribe == "" {
+		return nil, errors.New("mqtt source needs -mqtt-subscribe")
+	}
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return nil, fmt.Errorf("-mqtt-qos must be 0, 1 or 2, not %d", cfg.MQTTQoS)
+	}
+	id, clean := cfg.MQTTClientID, false
+	if id == "" {
+		id, clean = "pc-"+cfg.RunID+"-sub", true
+	}
+	c, err := dialMQTT(target, id, clean, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.subscribe(cfg.MQTTSubscribe, byte(cfg.MQTTQoS)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &mqttSource{c: c, idle: cfg.MQTTIdle}, nil
+}
+
+func (s *mqttSource) Next() (*Item, error) {
+	var timeout <-chan time.Time
+	if s.idle > 0 {
+		timer := time.NewTimer(s.idle)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var m mqttMessage
+	select {
+	case m = <-s.c.messages:
+	case <-s.c.done:
+		return nil, s.c.err
+	case <-timeout:
+		return nil, io.EOF
+	}
+	s.mu.Lock()
+	s.count++
+	item := messageItem(m, s.count)
+	if m.qos > 0 {
+		p := &mqttPending{id: m.id, qos: m.qos}
+		s.unacked = append(s.unacked, p)
+		item.ack = func() { s.acknowledge(p) }
+	}
+	s.mu.Unlock()
+	return item, nil
+}
+
+// turn a message into an item, numbering those that aren't items already.
+// A payload that is the message's own, read into a pooled buffer, goes to
+// the item without being copied; otherwise the buffer is done with.
+func messageItem(m mqttMessage, n int) *Item {
+	item, made := decodeItem(m.payload, n)
+	if made {
+		item.Metadata = map[string]string{"mqtt_topic": m.topic}
+	}
+	if m.buf != nil {
+		if made && len(item.Payload) > 0 && len(m.payload) > 0 && &item.Payload[0] == &m.payload[0] {
+			item.OwnPayload(item.Payload, func([]byte) { ReleasePayloadBuffer(m.buf) })
+		} else {
+			ReleasePayloadBuffer(m.buf)
+		}
+	}
+	return item
+}
+
+// turn data sent from outside into an item: a json encoded item is used as
+// is, and anything else becomes the payload of a new item numbered n, in
+// which case made is true
+func decodeItem(data []byte, n int) (item *Item, made bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) == nil && fields["Id"] != nil && fields["Timestamp"] != nil {
+		var item Item
+		if json.Unmarshal(data, &item) == nil {
+			return &item, false
+		}
+	}
+	payload := json.RawMessage(data)
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(data))
+	}
+	return &Item{ID: n, Timestamp: time.Now(), Payload: payload}, true
+}
+
+// mark a message handled and send the acks that are now due
+func (s *mqttSource) acknowledge(p *mqttPending) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.done = true
+	for len(s.unacked) > 0 && s.unacked[0].done {
+		first := s.unacked[0]
+		s.unacked = s.unacked[1:]
+		kind := byte(mqttPuback)
+		if first.qos == 2 {
+			kind = mqttPubrec
+		}
+		if err := s.c.writeID(kind, 0, first.id); err != nil {
+			fmt.Printf("error acking mqtt message %d: %v\n", first.id, err)
+		}
+	}
+}
+
+func (s *mqttSource) Close() error {
+	return s.c.Close()
+}
+
+// mqttSink publishes each item as json to the -mqtt-publish topic. At QoS 1
+// and 2 a write only returns once the broker has confirmed it, so a failed
+// publish is counted as a failed item rather than lost silently.
+type mqttSink struct {
+	c     *mqttClient
+	topic string
+	qos   byte
+}
+
+func newMQTTSink(target string, cfg *Config) (*mqttSink, error) {
+	if cfg.MQTTPublish == "" {
+		return nil, errors.New("mqtt sink needs -mqtt-publish")
+	}
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return nil, fmt.Errorf("-mqtt-qos must be 0, 1 or 2, not %d", cfg.MQTTQoS)
+	}
+	// the sink's own session state isn't worth keeping, so it always
+	// starts clean, under a name that can't clash with the source's
+	id := cfg.MQTTClientID
+	if id == "" {
+		id = "pc-" + cfg.RunID
+	}
+	c, err := dialMQTT(target, id+"-pub", true, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &mqttSink{c: c, topic: cfg.MQTTPublish, qos: byte(cfg.MQTTQoS)}, nil
+}
+
+func (s *mqttSink) Write(item *Item) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.c.publish(s.topic, s.qos, b)
+}
+
+func (s *mqttSink) Close() error {
+	return s.c.Close()
+}
+
+// mqttMessage is a PUBLISH received from the broker
+type mqttMessage struct {
+	topic   string
+	id      uint16
+	qos     byte
+	payload []byte
+	// the packet the payload was read into, when it came from the pool
+	buf []byte
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client: enough to connect, subscribe,
+// publish at any QoS and keep the connection alive. A reader goroutine
+// hands received messages to the messages channel and acks to whoever is
+// waiting on them.
+type mqttClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	waiting map[uint16]chan byte
+
+	messages chan mqttMessage
+	done     chan struct{} // closed when the connection is lost or closed
+	err      error         // why, set before done is closed
+	closed   bool
+}
+
+// connect to host[:port], as plain TCP or TLS with -mqtt-tls, logging in
+// with -mqtt-user and $MQTT_PASSWORD if a user is given
+func dialMQTT(addr, clientID string, clean bool, cfg *Config) (*mqttClient, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, mqttDefaultPort)
+	}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if cfg.MQTTTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %v", err)
+	}
+	c := &mqttClient{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		waiting:  make(map[uint16]chan byte),
+		messages: make(chan mqttMessage),
+		done:     make(chan struct{}),
+	}
+
+	var vh []byte
+	vh = appendMQTTString(vh, "MQTT")
+	flags := byte(0)
+	if clean {
+		flags |= 0x02
+	}
+	var payload []byte
+	payload = appendMQTTString(payload, clientID)
+	if cfg.MQTTUser != "" {
+		flags |= 0xc0
+		payload = appendMQTTString(payload, cfg.MQTTUser)
+		payload = appendMQTTString(payload, os.Getenv("MQTT_PASSWORD"))
+	}
+	vh = append(vh, 4, flags)
+	vh = bin.BigEndian.AppendUint16(vh, uint16(mqttKeepAlive/time.Second))
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.write(mqttConnect<<4, append(vh, payload...)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: %v", err)
+	}
+	kind, body, err := c.read()
+	if err == nil && (kind>>4 != mqttConnack || len(body) != 2) {
+		err = fmt.Errorf("expected CONNACK, got packet type %d", kind>>4)
+	}
+	if err == nil && body[1] != 0 {
+		err = fmt.Errorf("broker refused the connection, return code %d", body[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+	go c.readLoop()
+	go c.keepAlive()
+	return c, nil
+}
+
+func (c *mqttClient) subscribe(filter string, qos byte) error {
+	id, ch := c.expect()
+	defer c.forget(id)
+	body := bin.BigEndian.AppendUint16(nil, id)
+	body = appendMQTTString(body, filter)
+	body = append(body, qos)
+	if err := c.write(mqttSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+	// the reader passes the first return code on in place of a packet type
+	code, err := c.await(id, ch)
+	if err != nil {
+		return fmt.Errorf("mqtt subscribe %s: %v", filter, err)
+	}
+	if code == 0x80 {
+		return fmt.Errorf("mqtt subscribe %s: refused by the broker", filter)
+	}
+	return nil
+}
+
+func (c *mqttClient) publish(topic string, qos byte, payload []byte) error {
+	body := appendMQTTString(nil, topic)
+	if qos == 0 {
+		return c.write(mqttPublish<<4, append(body, payload...))
+	}
+	id, ch := c.expect()
+	defer c.forget(id)
+	body = bin.BigEndian.AppendUint16(body, id)
+	if err := c.write(mqttPublish<<4|qos<<1, append(body, payload...)); err != nil {
+		return err
+	}
+	kind, err := c.await(id, ch)
+	if err != nil {
+		return fmt.Errorf("mqtt publish: %v", err)
+	}
+	if qos == 1 || kind != mqttPubrec {
+		return nil
+	}
+	// second half of the QoS 2 handshake, the id stays ours until PUBCOMP
+	if err := c.writeID(mqttPubrel, 0x02, id); err != nil {
+		return err
+	}
+	if _, err := c.await(id, ch); err != nil {
+		return fmt.Errorf("mqtt publish: %v", err)
+	}
+	return nil
+}
+
+// pick a free packet id and register to hear its acks, until forget
+func (c *mqttClient) expect() (uint16, chan byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.nextID++
+		if c.nextID != 0 && c.waiting[c.nextID] == nil {
+			break
+		}
+	}
+	ch := make(chan byte, 1)
+	c.waiting[c.nextID] = ch
+	return c.nextID, ch
+}
+
+func (c *mqttClient) forget(id uint16) {
+	c.mu.Lock()
+	delete(c.waiting, id)
+	c.mu.Unlock()
+}
+
+func (c *mqttClient) await(id uint16, ch chan byte) (byte, error) {
+	select {
+	case kind := <-ch:
+		return kind, nil
+	case <-c.done:
+		return 0, c.err
+	case <-time.After(mqttAckTimeout):
+		return 0, fmt.Errorf("no ack for packet %d after %v", id, mqttAckTimeout)
+	}
+}
+
+func (c *mqttClient) deliver(id uint16, kind byte) {
+	c.mu.Lock()
+	ch := c.waiting[id]
+	c.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- kind:
+		default:
+		}
+	}
+}
+
+func (c *mqttClient) readLoop() {
+	for {
+		// the broker answers our pings, so a silent connection is a dead one
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		kind, body, err := c.read()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch kind >> 4 {
+		case mqttPublish:
+			m, err := parseMQTTPublish(kind, body)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if payloadClass(cap(body)) >= 0 {
+				m.buf = body
+			}
+			select {
+			case c.messages <- m:
+			case <-c.done:
+				return
+			}
+		case mqttPuback, mqttPubrec, mqttPubcomp:
+			if len(body) >= 2 {
+				c.deliver(bin.BigEndian.Uint16(body), kind>>4)
+			}
+		case mqttPubrel:
+			// the broker is done with a QoS 2 message we already took
+			if len(body) >= 2 {
+				c.writeID(mqttPubcomp, 0, bin.BigEndian.Uint16(body))
+			}
+		case mqttSuback:
+			if len(body) >= 3 {
+				c.deliver(bin.BigEndian.Uint16(body), body[2])
+			}
+		}
+	}
+}
+
+func parseMQTTPublish(kind byte, body []byte) (mqttMessage, error) {
+	m := mqttMessage{qos: kind >> 1 & 3}
+	if len(body) < 2 {
+		return m, errors.New("mqtt: short PUBLISH")
+	}
+	n := int(bin.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < n {
+		return m, errors.New("mqtt: short PUBLISH")
+	}
+	m.topic, body = string(body[:n]), body[n:]
+	if m.qos > 0 {
+		if len(body) < 2 {
+			return m, errors.New("mqtt: short PUBLISH")
+		}
+		m.id, body = bin.BigEndian.Uint16(body), body[2:]
+	}
+	m.payload = body
+	return m, nil
+}
+
+func (c *mqttClient) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(mqttPingreq<<4, nil); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// note why the connection went and wake everyone waiting on it
+func (c *mqttClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		err = errors.New("mqtt connection closed")
+	}
+	c.err = fmt.Errorf("mqtt: %v", err)
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *mqttClient) Close() error {
+	c.write(mqttDisconnect<<4, nil)
+	c.fail(nil)
+	return nil
+}
+
+func (c *mqttClient) writeID(kind, flags byte, id uint16) error {
+	return c.write(kind<<4|flags, bin.BigEndian.AppendUint16(nil, id))
+}
+
+// write one packet, given its first header byte and the rest of it
+func (c *mqttClient) write(header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		pkt = append(pkt, b)
+		if n == 0 {
+			break
+		}
+	}
+	pkt = append(pkt, body...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(pkt)
+	return err
+}
+
+// read one packet, returning its first header byte and the rest of it
+func (c *mqttClient) read() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("mqtt: bad packet length")
+		}
+	}
+	// big messages are read into pooled buffers, which their items give
+	// back once settled
+	var body []byte
+	if header>>4 == mqttPublish {
+		body = NewPayloadBuffer(n)
+	} else {
+		body = make([]byte, n)
+	}
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = bin.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func FuzzDecodeItem(f *testing.F) {
+	f.Add([]byte(`{"Id":7,"Timestamp":"2026-01-02T03:04:05Z","ProducerId":1,"Payload":{"n":7}}`))
+	f.Add([]byte(`{"order": 42}`))
+	f.Add([]byte(`{"Id":"x","Timestamp":1}`))
+	f.Add([]byte("plain text"))
+	f.Add([]byte{0xff, 0xfe, '"'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		item, made := decodeItem(data, 3)
+		if item == nil {
+			t.Fatal("no item")
+		}
+		if made {
+			if item.ID != 3 {
+				t.Fatalf("a made item is numbered %d, expected 3", item.ID)
+			}
+			if !json.Valid(item.Payload) {
+				t.Fatalf("a made item's payload %q isn't json", item.Payload)
+			}
+		}
+	})
+}
+
+func FuzzMQTTRead(f *testing.F) {
+	// a CONNACK, a QoS 1 PUBLISH of "hi" to a/b and a PINGRESP
+	f.Add([]byte{0x20, 0x02, 0x00, 0x00})
+	f.Add([]byte{0x32, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x01, 'h', 'i'})
+	f.Add([]byte{0xd0, 0x00})
+	// a length that never ends, and one longer than the packet
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Add([]byte{0x30, 0x80, 0x01, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := &mqttClient{r: bufio.NewReader(bytes.NewReader(data))}
+		for read := 0; ; {
+			header, body, err := c.read()
+			if err != nil {
+				return
+			}
+			if read += len(body); read > len(data) {
+				t.Fatalf("read %d bytes of packets from %d", read, len(data))
+			}
+			if header>>4 == mqttPublish {
+				ReleasePayloadBuffer(body)
+			}
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notifier delivers the end-of-run report somewhere people will see it.
+// Implementations decide which rendering of the report suits them.
+type Notifier interface {
+	Notify(r Report) error
+}
+
+// slackNotifier posts the Markdown report to a Slack incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) Notify(r Report) error {
+	body, err := json.Marshal(map[string]string{"text": r.Markdown()})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails the HTML report. The password is read from the
+// SMTP_PASSWORD environment variable so it doesn't end up in shell history.
+type smtpNotifier struct {
+	addr string // host:port
+	from string
+	to   []string
+	user string
+}
+
+func (n *smtpNotifier) Notify(r Report) error {
+	html, err := r.HTML()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: producer/consumer run: %d items, %d errors\r\n", r.Consumed, r.Errors)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.WriteString(html)
+
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, err := net.SplitHostPort(n.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(n.addr, auth, n.from, n.to, msg.Bytes())
+}
+
+// build the notifiers asked for in the config
+func newNotifiers(cfg *Config) []Notifier {
+	var notifiers []Notifier
+	if cfg.NotifySlack != "" {
+		notifiers = append(notifiers, &slackNotifier{
+			url:    cfg.NotifySlack,
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	if cfg.NotifySMTP != "" {
+		notifiers = append(notifiers, &smtpNotifier{
+			addr: cfg.NotifySMTP,
+			from: cfg.NotifyFrom,
+			to:   strings.Split(cfg.NotifyTo, ","),
+			user: cfg.NotifySMTPUser,
+		})
+	}
+	return notifiers
+}
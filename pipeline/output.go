@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// what -output can be
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// RunOutput is the end-of-run summary as -output json writes it, in one
+// json document for a CI job to check against its budgets, e.g. with
+// jq -e '.LatencyMs.P99 < 50 and .SLOsMet'. It has the report's fields,
+// as -report writes them to a .json file, with the durations again in
+// milliseconds, and what identifies the run.
+type RunOutput struct {
+	Pipeline string
+	RunID    string
+	Seed     int64
+	Report
+	// items dead-lettered, and those dropped by why, filtered ones included
+	DeadLettered int64
+	Dropped      map[DropReason]int64 `json:",omitempty"`
+	ElapsedMs    float64
+	LatencyMs    struct{ P50, P90, P99, Max float64 }
+	// whether every SLO was met over the run taken together, true when
+	// there are none
+	SLOsMet bool
+	// match or mismatch, with -golden checking the run
+	Golden string `json:",omitempty"`
+}
+
+func newRunOutput(p *Pipeline, r Report) RunOutput {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	o := RunOutput{Pipeline: p.name, RunID: p.cfg.RunID, Seed: p.cfg.Seed, Report: r, ElapsedMs: ms(r.Elapsed), SLOsMet: true}
+	o.LatencyMs.P50, o.LatencyMs.P90, o.LatencyMs.P99, o.LatencyMs.Max = ms(r.P50), ms(r.P90), ms(r.P99), ms(r.Max)
+	for _, s := range r.SLOs {
+		o.SLOsMet = o.SLOsMet && s.Met
+	}
+	p.stats.mu.Lock()
+	o.DeadLettered = p.stats.dead
+	if len(p.stats.dropped) > 0 {
+		o.Dropped = make(map[DropReason]int64, len(p.stats.dropped))
+		for reason, n := range p.stats.dropped {
+			o.Dropped[reason] = n
+		}
+	}
+	p.stats.mu.Unlock()
+	if g := p.golden; g != nil && !g.update {
+		o.Golden = "match"
+		if g.mismatch {
+			o.Golden = "mismatch"
+		}
+	}
+	return o
+}
+
+// write the run's summary as json to -output-file, or to w
+func (p *Pipeline) writeOutput(w io.Writer, r Report) error {
+	b, err := json.MarshalIndent(newRunOutput(p, r), "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if p.cfg.OutputFile != "" {
+		return os.WriteFile(p.cfg.OutputFile, b, 0644)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// the -output json summary goes to stdout by itself, so what the run
+// prints along the way goes to stderr instead. Returns where the summary
+// goes.
+func summaryOnStdout(cfg *Config) io.Writer {
+	out := os.Stdout
+	if cfg.Output == outputJSON && cfg.OutputFile == "" {
+		os.Stdout = os.Stderr
+	}
+	return out
+}
+
+func validOutput(format string) error {
+	if format != outputText && format != outputJSON {
+		return fmt.Errorf("unknown -output %q, expected %s or %s", format, outputText, outputJSON)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package pipeline
+
+import (
+	"bytes"
+	bin "encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+)
+
+// rows are written out as a row group once they add up to about this many
+// bytes, which bounds how much the encoder holds in memory
+const parquetRowGroupSize = 4 << 20
+
+// the parts of the parquet format used here, numbered as in parquet.thrift
+const (
+	pqBoolean   = 0
+	pqInt32     = 1
+	pqInt64     = 2
+	pqDouble    = 5
+	pqByteArray = 6
+
+	pqRequired = 0
+	pqOptional = 1
+
+	pqUTF8            = 0
+	pqTimestampMicros = 10
+	pqJSON            = 19
+
+	pqPlain         = 0
+	pqRLE           = 3
+	pqUncompressed  = 0
+	pqDataPage      = 0
+	pqNoConversion  = -1
+	pqFormatVersion = 1
+)
+
+// parquetEncoder writes items as a Parquet file, so the output can be
+// queried directly by the usual analytics engines. The Item fields map to
+// columns of their own, Metadata, Payload and Result are kept whole as json
+// columns, and each top level field of a json object payload also gets a
+// payload_<field> column typed from the values seen in the first row group.
+// Fields that only turn up later, or whose values change type, are still in
+// the Payload column. Pages are plain encoded and uncompressed, which every
+// reader supports.
+type parquetEncoder struct {
+	w       *countingWriter
+	started bool
+	columns []parquetColumn
+	rows    []parquetRow
+	size    int // rough size of the buffered rows
+	groups  []parquetRowGroup
+	total   int64
+}
+
+type parquetRow struct {
+	item    Item
+	payload map[string]any
+}
+
+type parquetColumn struct {
+	name     string
+	typ      int32
+	conv     int32
+	optional bool
+	value    func(r *parquetRow) (any, bool)
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+type parquetChunk struct {
+	col    *parquetColumn
+	offset int64
+	size   int64
+	values int64
+}
+
+func newParquetEncoder(w io.Writer) *parquetEncoder {
+	return &parquetEncoder{w: &countingWriter{w: w}}
+}
+
+func (e *parquetEncoder) Encode(item *Item) error {
+	r := parquetRow{item: *item}
+	if len(item.Payload) > 0 && item.Payload[0] == '{' {
+		json.Unmarshal(item.Payload, &r.payload)
+	}
+	e.rows = append(e.rows, r)
+	e.size += 64 + len(item.Payload) + len(item.Schema)
+	for k, v := range item.Metadata {
+		e.size += len(k) + len(v)
+	}
+	if e.size >= parquetRowGroupSize {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *parquetEncoder) Close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	footer := e.footer()
+	if _, err := e.w.Write(footer); err != nil {
+		return err
+	}
+	var tail [8]byte
+	bin.LittleEndian.PutUint32(tail[:4], uint32(len(footer)))
+	copy(tail[4:], "PAR1")
+	_, err := e.w.Write(tail[:])
+	return err
+}
+
+func (e *parquetEncoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	if e.columns == nil {
+		e.columns = parquetColumns(e.rows)
+	}
+	_, err := e.w.Write([]byte("PAR1"))
+	return err
+}
+
+// write the buffered rows as a row group
+func (e *parquetEncoder) flush() error {
+	if len(e.rows) == 0 {
+		return nil
+	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	g := parquetRowGroup{rows: int64(len(e.rows))}
+	for i := range e.columns {
+		col := &e.columns[i]
+		page := col.encodePage(e.rows)
+		chunk := parquetChunk{col: col, offset: e.w.n, values: g.rows}
+		if _, err := e.w.Write(page); err != nil {
+			return err
+		}
+		chunk.size = e.w.n - chunk.offset
+		g.size += chunk.size
+		g.chunks = append(g.chunks, chunk)
+	}
+	e.groups = append(e.groups, g)
+	e.total += g.rows
+	e.rows, e.size = nil, 0
+	return nil
+}
+
+// the columns every file has, plus ones for the payload fields in rows
+func parquetColumns(rows []parquetRow) []parquetColumn {
+	cols := []parquetColumn{
+		{name: "Id", typ: pqInt64, conv: pqNoConversion, value: func(r *parquetRow) (any, bool) {
+			return int64(r.item.ID), true
+		}},
+		{name: "Timestamp", typ: pqInt64, conv: pqTimestampMicros, value: func(r *parquetRow) (any, bool) {
+			return r.item.Timestamp.UnixMicro(), true
+		}},
+		{name: "ProducerId", typ: pqInt64, conv: pqNoConversion, value: func(r *parquetRow) (any, bool) {
+			return int64(r.item.ProducerID), true
+		}},
+		{name: "Schema", typ: pqByteArray, conv: pqUTF8, optional: true, value: func(r *parquetRow) (any, bool) {
+			return r.item.Schema, r.item.Schema != ""
+		}},
+		{name: "SchemaVersion", typ: pqInt32, conv: pqNoConversion, optional: true, value: func(r *parquetRow) (any, bool) {
+			return int32(r.item.SchemaVersion), r.item.Schema != ""
+		}},
+		{name: "Metadata", typ: pqByteArray, conv: pqJSON, optional: true, value: func(r *parquetRow) (any, bool) {
+			if len(r.item.Metadata) == 0 {
+				return nil, false
+			}
+			b, _ := json.Marshal(r.item.Metadata)
+			return string(b), true
+		}},
+		{name: "Payload", typ: pqByteArray, conv: pqJSON, optional: true, value: func(r *parquetRow) (any, bool) {
+			return string(r.item.Payload), len(r.item.Payload) > 0
+		}},
+		{name: "Result", typ: pqByteArray, conv: pqJSON, optional: true, value: func(r *parquetRow) (any, bool) {
+			if r.item.Result == nil {
+				return nil, false
+			}
+			b, _ := json.Marshal(r.item.Result)
+			return string(b), true
+		}},
+	}
+	types := make(map[string]int32)
+	for _, r := range rows {
+		for k, v := range r.payload {
+			if _, ok := types[k]; ok || v == nil {
+				continue
+			}
+			switch v.(type) {
+			case float64:
+				types[k] = pqDouble
+			case bool:
+				types[k] = pqBoolean
+			default:
+				types[k] = pqByteArray
+			}
+		}
+	}
+	fields := make([]string, 0, len(types))
+	for k := range types {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		k, typ := k, types[k]
+		col := parquetColumn{name: "payload_" + k, typ: typ, conv: pqNoConversion, optional: true}
+		col.value = func(r *parquetRow) (any, bool) {
+			v, ok := r.payload[k]
+			if !ok || v == nil {
+				return nil, false
+			}
+			switch v := v.(type) {
+			case float64:
+				return v, typ == pqDouble
+			case bool:
+				return v, typ == pqBoolean
+			case string:
+				return v, typ == pqByteArray
+			}
+			b, _ := json.Marshal(v)
+			return string(b), typ == pqByteArray
+		}
+		if typ == pqByteArray {
+			col.conv = pqUTF8
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// encode one column of the rows as a single plain encoded data page,
+// header included
+func (c *parquetColumn) encodePage(rows []parquetRow) []byte {
+	var data bytes.Buffer
+	var defs []bool
+	var values []any
+	for i := range rows {
+		v, ok := c.value(&rows[i])
+		defs = append(defs, ok)
+		if ok {
+			values = append(values, v)
+		}
+	}
+	if c.optional {
+		levels := rleBits(defs)
+		bin.Write(&data, bin.LittleEndian, uint32(len(levels)))
+		data.Write(levels)
+	}
+	switch c.typ {
+	case pqBoolean:
+		packed := make([]byte, (len(values)+7)/8)
+		for i, v := range values {
+			if v.(bool) {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		data.Write(packed)
+	default:
+		for _, v := range values {
+			switch v := v.(type) {
+			case int32, int64:
+				bin.Write(&data, bin.LittleEndian, v)
+			case float64:
+				bin.Write(&data, bin.LittleEndian, math.Float64bits(v))
+			case string:
+				bin.Write(&data, bin.LittleEndian, uint32(len(v)))
+				data.WriteString(v)
+			}
+		}
+	}
+	var t thriftWriter
+	t.i32(1, pqDataPage)
+	t.i32(2, int32(data.Len()))
+	t.i32(3, int32(data.Len()))
+	t.structBegin(5)
+	t.i32(1, int32(len(rows)))
+	t.i32(2, pqPlain)
+	t.i32(3, pqRLE)
+	t.i32(4, pqRLE)
+	t.structEnd()
+	t.stop()
+	return append(t.buf.Bytes(), data.Bytes()...)
+}
+
+// encode definition levels of bit width 1 in the RLE/bit-packing hybrid,
+// using only RLE runs
+func rleBits(bits []bool) []byte {
+	var out []byte
+	for i := 0; i < len(bits); {
+		j := i
+		for j < len(bits) && bits[j] == bits[i] {
+			j++
+		}
+		out = bin.AppendUvarint(out, uint64(j-i)<<1)
+		if bits[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// the FileMetaData struct that ends the file
+func (e *parquetEncoder) footer() []byte {
+	var t thriftWriter
+	t.i32(1, pqFormatVersion)
+	t.listBegin(2, thriftStruct, len(e.columns)+1)
+	t.elemBegin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(e.columns)))
+	t.elemEnd()
+	for _, c := range e.columns {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		rep := int32(pqRequired)
+		if c.optional {
+			rep = pqOptional
+		}
+		t.i32(3, rep)
+		t.str(4, c.name)
+		if c.conv != pqNoConversion {
+			t.i32(6, c.conv)
+		}
+		t.elemEnd()
+	}
+	t.i64(3, e.total)
+	t.listBegin(4, thriftStruct, len(e.groups))
+	for _, g := range e.groups {
+		t.elemBegin()
+		t.listBegin(1, thriftStruct, len(g.chunks))
+		for _, ch := range g.chunks {
+			t.elemBegin()
+			t.i64(2, ch.offset)
+			t.structBegin(3)
+			t.i32(1, ch.col.typ)
+			t.listBegin(2, thriftI32, 2)
+			t.varint(pqPlain)
+			t.varint(pqRLE)
+			t.listBegin(3, thriftBinary, 1)
+			t.binary(ch.col.name)
+			t.i32(4, pqUncompressed)
+			t.i64(5, ch.values)
+			t.i64(6, ch.size)
+			t.i64(7, ch.size)
+			t.i64(9, ch.offset)
+			t.structEnd()
+			t.elemEnd()
+		}
+		t.i64(2, g.size)
+		t.i64(3, g.rows)
+		t.elemEnd()
+	}
+	t.str(6, "go_producer_consumer")
+	t.stop()
+	return t.buf.Bytes()
+}
+
+// countingWriter keeps track of the file offset, which the footer needs
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// the compact protocol types used by the parquet metadata
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes just enough of the thrift compact protocol for the
+// parquet metadata: i32, i64 and string fields, lists, and nested structs
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the previous field id of each open struct
+	prev int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if d := id - t.prev; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.prev = id
+}
+
+// write a zigzag varint
+func (t *thriftWriter) varint(v int64) {
+	var b [bin.MaxVarintLen64]byte
+	t.buf.Write(b[:bin.PutUvarint(b[:], uint64(v<<1)^uint64(v>>63))])
+}
+
+func (t *thriftWriter) binary(s string) {
+	var b [bin.MaxVarintLen64]byte
+	t.buf.Write(b[:bin.PutUvarint(b[:], uint64(len(s)))])
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		var b [bin.MaxVarintLen64]byte
+		t.buf.Write(b[:bin.PutUvarint(b[:], uint64(n))])
+	}
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+// start a struct that is a list element, and so has no field header
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, t.prev)
+	t.prev = 0
+}
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.prev = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"math/bits"
+	"sync"
+)
+
+// payloads smaller than this aren't worth pooling, and the pool keeps
+// buffers up to the largest class
+const (
+	pooledPayloadMin     = 64 << 10
+	pooledPayloadClasses = 11 // 64KB to 64MB, doubling
+)
+
+// payloadPools hold the payload buffers given back, by size class, so the
+// big payloads an mqtt source reads or an embedding program produces can
+// be read into memory used before instead of allocating for each item
+var payloadPools [pooledPayloadClasses]sync.Pool
+
+// the class a buffer of n bytes comes from, -1 when it isn't pooled
+func payloadClass(n int) int {
+	if n < pooledPayloadMin {
+		return -1
+	}
+	c := bits.Len(uint(n-1)) - bits.Len(pooledPayloadMin-1)
+	if c >= pooledPayloadClasses {
+		return -1
+	}
+	return c
+}
+
+// NewPayloadBuffer returns a buffer of n bytes for an item's payload,
+// reused from the pool when it is big enough to be pooled, or from the
+// reserve -strict-memory sets aside. It can be given back with
+// ReleasePayloadBuffer, or handed to the pipeline with the item, see
+// OwnPayload.
+func NewPayloadBuffer(n int) []byte {
+	if r := strictPayloads.Load(); r != nil && n <= r.size && n >= pooledPayloadMin {
+		return r.get(n)
+	}
+	c := payloadClass(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+	if b, ok := payloadPools[c].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, pooledPayloadMin<<c)
+}
+
+// ReleasePayloadBuffer gives a buffer from NewPayloadBuffer back to the
+// pool. Nothing may use it afterwards.
+func ReleasePayloadBuffer(b []byte) {
+	if r := strictPayloads.Load(); r != nil && r.put(b) {
+		return
+	}
+	c := payloadClass(cap(b))
+	if c < 0 || cap(b) != pooledPayloadMin<<c {
+		return
+	}
+	b = b[:0]
+	payloadPools[c].Put(&b)
+}
+
+// OwnPayload makes b the item's payload without copying it, handing it
+// over to the pipeline, which calls release with it once it is finished
+// with the item: when it is settled, having been handled, dropped or
+// dead-lettered, or once it is pushed to a -redis queue. Until then the
+// caller mustn't touch b. With a buffer from NewPayloadBuffer, release
+// can be ReleasePayloadBuffer, so a producer of big payloads reads each
+// one into a buffer the pipeline is done with rather than copying it into
+// a new one, as it has to when it reuses its own.
+func (item *Item) OwnPayload(b []byte, release func([]byte)) {
+	item.Payload = json.RawMessage(b)
+	item.release = nil
+	if release != nil {
+		item.release = func() { release(b) }
+	}
+}
+
+// give the item's payload back to whoever handed it over, once the
+// pipeline is finished with it
+func (item *Item) releasePayload() {
+	if item.release != nil {
+		release := item.release
+		item.release = nil
+		release()
+	}
+}
+
+// give the item a copy of its payload, letting go of the one handed over,
+// for an item that is kept after it is settled, as the joiner keeps them
+func (item *Item) detachPayload() {
+	if item.release != nil {
+		item.Payload = append(json.RawMessage(nil), item.Payload...)
+		item.releasePayload()
+	}
+}
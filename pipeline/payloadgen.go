@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+// how -payload-size draws each payload's size
+const (
+	sizeFixed     = "fixed"
+	sizeUniform   = "uniform"
+	sizeLogNormal = "lognormal"
+)
+
+// what -payload-fill fills payloads with
+const (
+	fillCompressible = "compressible"
+	fillRandom       = "random"
+)
+
+// the largest payload a log-normal size is drawn up to, as its tail is long
+const payloadGenMax = 1 << 30
+
+// payloadGen gives the built-in producers' items payloads of the sizes set
+// by -payload-size, to try the pipeline with items more like those it
+// will really have: to see how big the buffers get under -buffer-bytes,
+// how much -compress-above saves and how a sink copes with the bytes. A
+// size is fixed, e.g. fixed:4KB, uniform between two sizes, as
+// uniform:1KB..64KB, or log-normal, as lognormal:4KB,1.5 for a median of
+// 4KB and a sigma of 1.5, which gives the mostly small, sometimes huge
+// payloads real traffic tends to. Each payload is a JSON string, filled
+// with words that compress as text does, or with random characters that
+// hardly compress at all. The sizes and bytes come from the producer's
+// random numbers, so a -seed run makes the same payloads again.
+type payloadGen struct {
+	spec   string
+	kind   string
+	lo, hi int     // fixed and uniform
+	median float64 // lognormal
+	sigma  float64
+	random bool
+
+	made    atomic.Int64
+	bytes   atomic.Int64
+	largest atomic.Int64
+}
+
+// the words a compressible payload is made of
+var payloadWords = strings.Fields("reading sensor temp humidity status ok warn error value unit celsius " +
+	"device region north south east west batch online offline level high low normal alert count")
+
+// the characters a random payload is made of, any of which can go in a
+// JSON string as they are
+const payloadChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+func newPayloadGen(cfg *Config) (*payloadGen, error) {
+	g, err := parsePayloadSize(cfg.PayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.PayloadFill {
+	case fillCompressible:
+	case fillRandom:
+		g.random = true
+	default:
+		return nil, fmt.Errorf("unknown -payload-fill %q, expected %s or %s", cfg.PayloadFill, fillCompressible, fillRandom)
+	}
+	if cfg.SchemaVersion > 0 {
+		return nil, fmt.Errorf("-payload-size can't be used with -schema-version, which has the payloads follow the schema")
+	}
+	if cfg.Source != "" {
+		return nil, fmt.Errorf("-payload-size only sizes the built-in producers' payloads, not those from -source")
+	}
+	return g, nil
+}
+
+// parse a -payload-size, e.g. 4KB, fixed:4KB, uniform:1KB..64KB or
+// lognormal:4KB,1.5
+func parsePayloadSize(spec string) (*payloadGen, error) {
+	kind, args, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, args = sizeFixed, spec
+	}
+	size := func(s string) (int, error) {
+		var b byteSize
+		if err := b.Set(s); err != nil {
+			return 0, err
+		}
+		if b > payloadGenMax {
+			return 0, fmt.Errorf("payload size %s is over the %s most", formatBytes(int64(b)), formatBytes(payloadGenMax))
+		}
+		return int(b), nil
+	}
+	g := &payloadGen{spec: spec, kind: kind}
+	var err error
+	switch kind {
+	case sizeFixed:
+		g.lo, err = size(args)
+		g.hi = g.lo
+	case sizeUniform:
+		lo, hi, ok := strings.Cut(args, "..")
+		if !ok {
+			return nil, fmt.Errorf("bad -payload-size %q, expected uniform:<min>..<max>", spec)
+		}
+		if g.lo, err = size(lo); err == nil {
+			g.hi, err = size(hi)
+		}
+		if err == nil && g.hi < g.lo {
+			err = fmt.Errorf("the most, %s, is less than the least", hi)
+		}
+	case sizeLogNormal:
+		median, sigma, ok := strings.Cut(args, ",")
+		g.sigma = 1
+		if ok {
+			if _, err := fmt.Sscan(strings.TrimSpace(sigma), &g.sigma); err != nil || g.sigma < 0 {
+				return nil, fmt.Errorf("bad -payload-size %q, sigma %q isn't a number of 0 or more", spec, sigma)
+			}
+		}
+		var m int
+		m, err = size(median)
+		g.median = float64(m)
+	default:
+		return nil, fmt.Errorf("unknown -payload-size %q, expected fixed:<size>, uniform:<min>..<max> or lognormal:<median>[,<sigma>]", spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad -payload-size %q: %v", spec, err)
+	}
+	return g, nil
+}
+
+// the most a payload can be, or 0 if there is no telling, as for a
+// log-normal size
+func (g *payloadGen) most() int {
+	if g.kind == sizeLogNormal {
+		return 0
+	}
+	return max(g.hi, 2)
+}
+
+// draw a size for the next payload
+func (g *payloadGen) size(r *rand.Rand) int {
+	var n int
+	switch g.kind {
+	case sizeUniform:
+		n = g.lo + r.Intn(g.hi-g.lo+1)
+	case sizeLogNormal:
+		n = int(min(g.median*math.Exp(g.sigma*r.NormFloat64()), payloadGenMax))
+	default:
+		n = g.lo
+	}
+	// room for the quotes
+	return max(n, 2)
+}
+
+// give a built-in producer's item its payload, in a payload buffer it
+// hands back once the item is settled
+func (g *payloadGen) fill(item *Item, r *rand.Rand) {
+	n := g.size(r)
+	b := NewPayloadBuffer(n)
+	b[0], b[n-1] = '"', '"'
+	body := b[1 : n-1]
+	if g.random {
+		for i := 0; i < len(body); {
+			// ten characters from each draw
+			v := r.Int63()
+			for j := 0; j < 10 && i < len(body); j++ {
+				body[i] = payloadChars[v&63]
+				v >>= 6
+				i++
+			}
+		}
+	} else {
+		for i := 0; i < len(body); {
+			i += copy(body[i:], payloadWords[r.Intn(len(payloadWords))])
+			if i < len(body) {
+				body[i] = ' '
+				i++
+			}
+		}
+	}
+	item.OwnPayload(b, ReleasePayloadBuffer)
+	g.made.Add(1)
+	g.bytes.Add(int64(n))
+	for {
+		most := g.largest.Load()
+		if int64(n) <= most || g.largest.CompareAndSwap(most, int64(n)) {
+			break
+		}
+	}
+}
+
+func (g *payloadGen) printSummary(w io.Writer) {
+	made := g.made.Load()
+	fill := fillCompressible
+	if g.random {
+		fill = fillRandom
+	}
+	fmt.Fprintf(w, "payloads: %d made of %s %s bytes", made, g.spec, fill)
+	if made > 0 {
+		fmt.Fprintf(w, ", %s on average, the largest %s", formatBytes(g.bytes.Load()/made), formatBytes(g.largest.Load()))
+	}
+	fmt.Fprintln(w)
+}
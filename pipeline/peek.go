@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// the most items a peek shows, and how many of the latest items put on
+// the buffer are kept for it
+const (
+	peekMax  = 100
+	peekKeep = 1000
+)
+
+// queuedTail keeps copies of the latest items put on the default pool's
+// buffer, for peek to show the next ones waiting on it without taking
+// them off, as a channel can't be read any other way. The items on the
+// buffer are the last ones put on it, as many as it holds, so the next
+// ones waiting are found counting back from the latest kept. Producers
+// putting items on at the same moment may be noted in either order.
+// Items are copied in as they are queued, before a consumer can take
+// them and hand their payloads back to their pools.
+type queuedTail struct {
+	mu     sync.Mutex
+	recent []Item // a ring, oldest at next once full
+	next   int
+}
+
+func newQueuedTail() *queuedTail {
+	return &queuedTail{}
+}
+
+// note an item put on the buffer. Safe when nil.
+func (t *queuedTail) add(c Item) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.recent) < peekKeep {
+		t.recent = append(t.recent, c)
+	} else {
+		t.recent[t.next] = c
+		t.next = (t.next + 1) % peekKeep
+	}
+}
+
+// the first n of the last waiting items put on the buffer, or false if
+// more are waiting than are kept
+func (t *queuedTail) first(waiting, n int) ([]Item, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if waiting > len(t.recent) {
+		return nil, false
+	}
+	held := append(append([]Item{}, t.recent[t.next:]...), t.recent[:t.next]...)
+	held = held[len(held)-waiting:]
+	return held[:min(n, len(held))], true
+}
+
+// peek copies the first n items waiting on the default pool's buffer,
+// leaving them there, for an operator poking at a live pipeline with
+// pcctl shell. The pipeline needs -admin set to keep them.
+func (p *Pipeline) peek(n int) ([]Item, error) {
+	switch {
+	case p.shards != nil:
+		return nil, fmt.Errorf("a buffer split with -buffer-shards can't be peeked at")
+	case p.fair != nil:
+		return nil, fmt.Errorf("a buffer split into topics with -fair-topics can't be peeked at")
+	case p.strict != nil:
+		return nil, fmt.Errorf("-strict-memory has no room for the copies of the items a peek shows")
+	case p.redis != nil:
+		return nil, fmt.Errorf("a -redis pipeline's buffer is its queue, peek at it with LRANGE")
+	case p.queued == nil:
+		return nil, fmt.Errorf("pipeline %s doesn't keep the items it queues, it needs -admin", p.name)
+	}
+	waiting := len(p.defaultBuffer())
+	items, ok := p.queued.first(waiting, n)
+	if !ok {
+		return nil, fmt.Errorf("%d items wait on the buffer, more than the last %d queued that are kept to peek at", waiting, peekKeep)
+	}
+	for i := range items {
+		// shown as they were produced, not as they wait
+		if err := unpack(&items[i]); err != nil {
+			items[i].Payload = nil
+		}
+	}
+	return items, nil
+}
+
+func (a *adminServer) peek(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	n := 5
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > peekMax {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad n %q, expected 1 to %d items", s, peekMax))
+			return
+		}
+	}
+	items, err := p.peek(n)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if items == nil {
+		items = []Item{}
+	}
+	writeJSON(w, http.StatusOK, items)
+}
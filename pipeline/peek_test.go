@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+// a peek leaves the items on the buffer, and the buffer where it was, so a
+// resize shrinking it after can still wait for the consumers to drain it
+func TestPeekThenShrink(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-producers", "3", "-items", "10", "-consumers", "2", "-delay", "50ms", "-buffer", "20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as -admin would have it, without listening anywhere
+	p.queued = newQueuedTail()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+	for deadline := time.Now().Add(5 * time.Second); p.buffered() < 10; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the buffer only got to %d items", p.buffered())
+		}
+	}
+	ch := p.defaultBuffer()
+	items, err := p.peek(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("peek showed %d items, expected 3", len(items))
+	}
+	if p.defaultBuffer() != ch {
+		t.Fatalf("peek replaced the buffer")
+	}
+	start := time.Now()
+	if err := p.resizeBuffer(5); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > resizeDrainWait/2 {
+		t.Fatalf("shrinking the buffer took %s", took)
+	}
+	if c := cap(p.defaultBuffer()); c != 5 {
+		t.Fatalf("the buffer has room for %d items, expected 5", c)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the pipeline didn't finish")
+	}
+	if n := p.stats.consumedCount(); n != 30 {
+		t.Fatalf("consumed %d items, expected 30", n)
+	}
+}
+
+// the items a peek shows are the oldest of those put on the buffer that
+// are still waiting on it
+func TestQueuedTailFirst(t *testing.T) {
+	q := newQueuedTail()
+	for i := 1; i <= peekKeep+5; i++ {
+		q.add(Item{ID: i})
+	}
+	items, ok := q.first(4, 2)
+	if !ok || len(items) != 2 || items[0].ID != peekKeep+2 || items[1].ID != peekKeep+3 {
+		t.Fatalf("first(4, 2) = %v, %v", items, ok)
+	}
+	if items, ok := q.first(2, 5); !ok || len(items) != 2 {
+		t.Fatalf("first(2, 5) = %v, %v", items, ok)
+	}
+	if _, ok := q.first(peekKeep+1, 1); ok {
+		t.Fatalf("first showed items that weren't kept")
+	}
+}
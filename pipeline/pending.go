@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Pending is an item handed to Submit, for a caller that wants to know
+// what became of it, as a request waiting on its response does
+type Pending struct {
+	done chan struct{}
+
+	mu      sync.Mutex
+	out     []Item
+	err     error
+	settled bool
+}
+
+// Submit produces an item as Produce does and returns its Pending, whose
+// Result waits until the pipeline is finished with it. Items going
+// through -redis leave the process, so can't be followed.
+func (p *Pipeline) Submit(ctx context.Context, item Item) (*Pending, error) {
+	if p.redis != nil {
+		return nil, errors.New("items sent through -redis can't be followed to their result")
+	}
+	pd := &Pending{done: make(chan struct{})}
+	item.pending = pd
+	if err := p.Produce(ctx, item); err != nil {
+		return nil, err
+	}
+	return pd, nil
+}
+
+// Result waits until the item has been handled, dropped or dead-lettered,
+// and returns what handling made of it: the item the handler gave back,
+// or the pieces of a split item. The error is why the handler or the sink
+// failed on it, as the pipeline counts it, or a DropError for an item
+// that was dropped, which leave nothing. A split item whose pieces
+// weren't all written has the others along with the error.
+func (pd *Pending) Result() ([]Item, error) {
+	<-pd.done
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return pd.out, pd.err
+}
+
+// Done is closed once Result has the item's outcome
+func (pd *Pending) Done() <-chan struct{} {
+	return pd.done
+}
+
+// note something handling made of the item. Safe on nil, as are the rest.
+func (pd *Pending) output(item Item) {
+	if pd == nil {
+		return
+	}
+	// the item's payload may go back to its pool once it's settled
+	if item.release != nil {
+		item.Payload = append(json.RawMessage(nil), item.Payload...)
+		item.release = nil
+	}
+	item.pending = nil
+	pd.mu.Lock()
+	pd.out = append(pd.out, item)
+	pd.mu.Unlock()
+}
+
+// the item failed, or only one piece of it did
+func (pd *Pending) failed(err error, piece bool) {
+	if pd == nil {
+		return
+	}
+	pd.mu.Lock()
+	if pd.err == nil {
+		pd.err = err
+	}
+	if !piece {
+		pd.out = nil
+	}
+	pd.mu.Unlock()
+}
+
+// the pipeline is finished with the item
+func (pd *Pending) settle() {
+	if pd == nil {
+		return
+	}
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if !pd.settled {
+		pd.settled = true
+		close(pd.done)
+	}
+}
@@ -0,0 +1,1040 @@
+// Package pipeline is the producer/consumer pipeline behind the
+// go_producer_consumer command, for a program to embed. The config comes
+// from the command's flags, and the rest of the API works on the pipeline
+// New makes from it:
+//
+//	cfg, err := pipeline.ParseConfig([]string{"-consumers", "8", "-handler", "exec:./enrich.py"})
+//	p, err := pipeline.New(cfg)
+//	items := p.Items(ctx)
+//	go p.Run()
+//	for item := range items {
+//		...
+//	}
+//
+// A handler, source or sink written in Go is given to New as an option in
+// place of the flag naming a plugin:
+//
+//	p, err := pipeline.New(cfg, pipeline.WithHandler(enrich), pipeline.WithSink(store))
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Pipeline ties together everything a run needs: the channel between the
+// producers and consumers, and the optional pieces configured on top of it.
+// While it runs it can be paused, resized and drained, which is what the
+// admin API builds on.
+type Pipeline struct {
+	name string
+	cfg  *Config
+	// the producers write to input and the default consumers read from
+	// channel. They are the same channel unless a transport such as redis
+	// sits in between.
+	input   chan Item
+	channel chan Item
+	gov     *governor
+	stats   *Stats
+	// numbers the items printed for want of a sink
+	printed count32
+	slos    *sloTracker
+	hooks   *eventHooks
+	filter  *expr
+	schemas *SchemaRegistry
+	dlq     *deadLetterQueue
+	drops   *DropPolicy
+	barrier *barrier
+	trace   *tracer
+	seqs    *seqChecker
+	dedup   *dedupWindow
+	// takes items over HTTP with -ingest, and is then the source too
+	ingest *ingestServer
+	keyed  *keyMetrics
+	// the sinks items go to by their status, with -sink-route; the sink
+	// too then
+	routed *sinkRouter
+	health *healthCheck
+	// tells systemd how a -daemon is getting on, when it runs under it
+	systemd *sdNotifier
+	// -verbose, which SIGUSR2 switches
+	verbose atomic.Bool
+	// the item each consumer is handling, by consumer id
+	inflight sync.Map
+	// each built-in producer's random numbers, seeded from -seed and its id
+	// so that a run with the same seed makes the same items, by producer id
+	rands sync.Map
+	// where -record-produced writes the items made
+	record *fileSink
+	// sizes the batches consumers write to the sink with -batch, and the
+	// batch each batching consumer is filling, by consumer id
+	batcher *batchSizer
+	batches sync.Map
+	// the -write-behind buffers, and the hold on the item each consumer is
+	// on while they have them, by consumer id
+	behind []*writeBehind
+	holds  sync.Map
+	// keeps the writes for items with the same -sink-order-key in order;
+	// the sink too then
+	ordered *orderedSink
+	// how many handler calls and sink writes -concurrency lets run at once
+	limits *stageLimits
+	// tries -shadow-handler on the items the handler has handled
+	shadow *shadowHandler
+	// sends some of the default pool's items to -canary-handler
+	canary *canary
+	// takes items off the buffers ahead of the consumers with -prefetch
+	prefetch *prefetcher
+	// where the built-in producers make their items with -item-arena
+	arenas *itemArenas
+	// how the consumers' receives went with -consumer-spin
+	spins spinStats
+	// a resize of the buffer swaps input and channel under bufMu, which
+	// each item is queued under, noting the buffers it replaced; once the
+	// input is closed there are no more resizes. The producers wait on
+	// holdOff while a resize waits for a shrinking buffer to drain. The
+	// swap itself is made under swapMu too, for the consumers to find the
+	// new buffer by.
+	bufMu       sync.RWMutex
+	swapMu      sync.Mutex
+	retired     map[<-chan Item]bool
+	inputClosed bool
+	holdOff     chan struct{}
+	// checksums the payloads with -checksum
+	sums *checksums
+	// compresses big payloads while they're queued, with -compress-above
+	compress *compressor
+	// records or checks what's handed to the sink with -golden
+	golden *golden
+	// hands the handled items to a range over Items, in place of a sink
+	stream *itemStream
+	// looks for the pipeline stuck with items buffered, with -deadlock-after
+	deadlock *deadlockWatch
+	// watches the buffer fill to -watermark-high and drain to -watermark-low
+	marks *watermarks
+	// the default pool's buffer split up with -buffer-shards, channel
+	// being the first shard
+	shards *shardedBuffer
+	// or into a queue for each topic with -fair-topics, channel being the
+	// queue of the items with none
+	fair *fairBuffer
+	// sizes the pools given as auto
+	auto *autoSizer
+	// routing rules and the extra consumer pools they feed; items that
+	// match no rule use channel and the default consumers
+	routes []route
+	pools  map[string]*consumerPool
+	joiner *joiner
+	// saves the source position, when the source is checkpointed
+	checkpoint *checkpointer
+	redis      *redisTransport
+	// keeps other runs off the files this one writes
+	locks *runLocks
+	// this run's place in a -shard-dir group
+	member *shardMember
+	// bounds the bytes in the buffers when -buffer-bytes is set
+	budget *byteBudget
+	// sheds items or holds the producers back when memory runs short
+	memory *memGuard
+	// the memory set aside at startup with -strict-memory
+	strict *strictMemory
+	// makes the built-in producers' payloads with -payload-size
+	payloads *payloadGen
+	// merges the producers' own channels onto the buffers with
+	// -producer-lanes
+	merge *merger
+	// pauses consumers that keep failing, with -consumer-pause-after
+	pauses *consumerPauses
+	// how far behind each consumer group is, with -lag-max-items or
+	// -lag-max-age
+	lag *lagMonitor
+	// the latest items handed to the sink, for the admin API to show
+	tail *consumedTail
+	// the latest items put on the default pool's buffer, for peek
+	queued *queuedTail
+	// evicts items that wait on the buffers past -evict-after
+	evict *evictor
+	// where the -output json summary goes when there's no -output-file,
+	// stdout if nil
+	summaryOut io.Writer
+	// where the run's summaries are printed, stdout unless WithSummary says
+	summary io.Writer
+	// Run waits for Drain rather than the producers, see KeepOpen
+	keepOpen bool
+	// OnComplete, if set, is called once with the run's report after every
+	// stage has drained: the consumers, any routed pools, the redis queue,
+	// the joiner and a backfill's retries
+	OnComplete func(Report)
+	completed  sync.Once
+	// Classifier, if set, is asked the class of each handler and sink
+	// error before the error's own class and the -error-class rules
+	Classifier ErrorClassifier
+	errs       *errorPolicy
+	// keeps failed items on disk and reports progress in -backfill mode
+	backfill *backfill
+	// the extension points. A nil source means producers make random
+	// items, a nil handler means items are passed through untouched and a
+	// nil sink means items are printed as json.
+	source  Source
+	handler Handler
+	sink    Sink
+
+	gate gate
+	// the running workers. mu guards these along with closed and
+	// draining, and cond is signalled whenever a worker exits.
+	mu             sync.Mutex
+	cond           *sync.Cond
+	producers      map[int]*worker
+	consumers      map[int]*worker
+	nextProducerID int
+	nextConsumerID int
+	draining       bool // producers were told to stop early
+	closed         bool // the channel is closed, no more producers
+	committing     int  // producer batches being committed, see txn.go
+	// keeps the commits of batches from interleaving
+	commitMu sync.Mutex
+	txns     txnCounts
+}
+
+// worker is a running producer or consumer goroutine. Closing stop asks it
+// to finish up; it stays in its pool until its goroutine has returned.
+type worker struct {
+	stop     chan struct{}
+	stopping bool
+}
+
+func (w *worker) halt() {
+	if !w.stopping {
+		w.stopping = true
+		close(w.stop)
+	}
+}
+
+// the number of workers in a pool that haven't been asked to stop
+func active(pool map[int]*worker) int {
+	n := 0
+	for _, w := range pool {
+		if !w.stopping {
+			n++
+		}
+	}
+	return n
+}
+
+// gate lets the workers be paused. While paused, resume is a channel that
+// gets closed when the pipeline resumes.
+type gate struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) unpause() {
+	g.mu.Lock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resume != nil
+}
+
+// block while the gate is paused, or until stop is closed
+func (g *gate) wait(stop <-chan struct{}) {
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-stop:
+		}
+	}
+}
+
+// New builds a pipeline from cfg, loading any plugins it names, for a
+// program embedding it to start with Run. Unlike the command it doesn't
+// run the preflight checks, serve the admin API or handle signals, nor
+// bring GOMAXPROCS and the GC's memory limit down to a container's.
+func New(cfg *Config, opts ...Option) (*Pipeline, error) {
+	return newPipeline(cfg, opts...)
+}
+
+// Option gives New something a flag can't, such as a handler written in Go
+type Option func(*options)
+
+type options struct {
+	handler  Handler
+	source   Source
+	sink     Sink
+	summary  io.Writer
+	keepOpen bool
+}
+
+// WithHandler has the consumers handle items with h, in place of a
+// -handler plugin. It may also be a Splitter, ContextHandler or
+// ContextSplitter. As a plugin is, it is closed once the run is over if
+// it has a Close method.
+func WithHandler(h Handler) Option {
+	return func(o *options) { o.handler = h }
+}
+
+// WithSource has the producers take items from src, in place of a -source
+// plugin, until it returns io.EOF
+func WithSource(src Source) Option {
+	return func(o *options) { o.source = src }
+}
+
+// WithSink has the handled items written to sink, in place of a -sink
+func WithSink(sink Sink) Option {
+	return func(o *options) { o.sink = sink }
+}
+
+// WithSummary prints the summaries Run ends with to w rather than stdout,
+// none of them with io.Discard
+func WithSummary(w io.Writer) Option {
+	return func(o *options) { o.summary = w }
+}
+
+// KeepOpen has Run go on taking items from Produce and Submit once the
+// producers are done, or with -producers 0 none were started, until Drain
+// is called
+func KeepOpen() Option {
+	return func(o *options) { o.keepOpen = true }
+}
+
+// build a pipeline from the config, loading any plugins it names. If that
+// fails part way, what was already opened is closed again, the run locks
+// included, so the config can be fixed and tried again in the same process.
+func newPipeline(cfg *Config, opts ...Option) (_ *Pipeline, err error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	switch {
+	case o.handler != nil && cfg.Handler != "":
+		return nil, errors.New("-handler and WithHandler both give a handler")
+	case o.source != nil && cfg.Source != "":
+		return nil, errors.New("-source and WithSource both give a source")
+	case o.sink != nil && cfg.Sink != "":
+		return nil, errors.New("-sink and WithSink both give a sink")
+	}
+	p := &Pipeline{
+		name:      cfg.Name,
+		cfg:       cfg,
+		producers: make(map[int]*worker),
+		consumers: make(map[int]*worker),
+		summary:   os.Stdout,
+		keepOpen:  o.keepOpen,
+	}
+	if o.summary != nil {
+		p.summary = o.summary
+	}
+	p.cond = sync.NewCond(&p.mu)
+	// before anything opens the files the locks protect
+	if p.locks, err = acquireRunLocks(cfg); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			p.close()
+		}
+	}()
+	if cfg.Filter != "" {
+		if p.filter, err = compileExpr(cfg.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if p.hooks, err = newEventHooks(cfg); err != nil {
+		return nil, fmt.Errorf("setting up webhooks: %v", err)
+	}
+	p.schemas = NewSchemaRegistry()
+	registerBuiltinSchemas(p.schemas)
+	if p.dlq, err = newDeadLetterQueue(cfg.DLQ, cfg.DLQAlert, p.hooks); err != nil {
+		return nil, err
+	}
+	if cfg.BufferFull != fullBlock && cfg.BufferFull != fullDropNewest && cfg.BufferFull != fullDropOldest {
+		return nil, fmt.Errorf("unknown -buffer-full %q, expected block, drop or drop-oldest", cfg.BufferFull)
+	}
+	p.source = o.source
+	if cfg.Source != "" {
+		if p.source, err = loadSource(cfg.Source, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Ingest != "" {
+		if p.ingest, err = newIngestServer(p, cfg); err != nil {
+			return nil, err
+		}
+		p.source = p.ingest
+	}
+	if cfg.Backfill != "" {
+		// before sharding wraps the source and hides its size
+		if p.backfill, err = newBackfill(p, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.setupShard(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Checkpoint != "" {
+		if p.source == nil {
+			return nil, fmt.Errorf("-checkpoint needs a -source")
+		}
+		if p.checkpoint, err = newCheckpointer(cfg.Checkpoint, p.source, cfg.CheckpointInterval); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JoinSource != "" {
+		if p.joiner, err = newJoiner(cfg); err != nil {
+			return nil, err
+		}
+		p.joiner.emit = p.process
+	}
+	p.handler = o.handler
+	if cfg.Handler != "" {
+		if p.handler, err = loadHandler(cfg.Handler, cfg.WasmRuntime); err != nil {
+			return nil, err
+		}
+	}
+	if p.handler != nil && cfg.HandlerTimeout > 0 {
+		p.handler = withTimeout(p.handler, cfg.HandlerTimeout)
+	}
+	if cfg.ShadowHandler != "" {
+		if p.shadow, err = newShadowHandler(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Concurrency) > 0 || cfg.HandlerWeight != "" {
+		if p.limits, err = newStageLimits(cfg); err != nil {
+			return nil, err
+		}
+	}
+	p.sink = o.sink
+	if cfg.Sink != "" {
+		if p.sink, err = loadSink(cfg.Sink, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.NamedSinks) > 0 || len(cfg.SinkRoutes) > 0 {
+		if p.routed, err = newSinkRouter(cfg, p.sink); err != nil {
+			return nil, err
+		}
+		p.routed.limits = p.limits
+		p.sink = p.routed
+	}
+	if err := p.setupWriteBehind(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.SinkOrderKey != "" {
+		if p.ordered, err = newOrderedSink(p, cfg); err != nil {
+			return nil, err
+		}
+		p.sink = p.ordered
+	}
+	if cfg.ItemArena > 0 {
+		if p.arenas, err = newItemArenas(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PayloadSize != "" {
+		if p.payloads, err = newPayloadGen(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Checksum != "" {
+		if p.sums, err = newChecksums(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CompressAbove > 0 {
+		if p.compress, err = newCompressor(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Prefetch > 0 {
+		if p.prefetch, err = newPrefetcher(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AutoProducers || cfg.AutoConsumers {
+		p.auto = newAutoSizer(p, cfg)
+	}
+	if cfg.Batch != "" {
+		if p.sink == nil {
+			return nil, fmt.Errorf("-batch needs a -sink to write the batches to")
+		}
+		if p.batcher, err = newBatchSizer(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CheckpointInSink {
+		ts, ok := p.sink.(TransactionalSink)
+		if !ok {
+			return nil, fmt.Errorf("-checkpoint-in-sink needs a sink that can commit the checkpoint, such as sql")
+		}
+		if p.source == nil {
+			return nil, fmt.Errorf("-checkpoint-in-sink needs a -source")
+		}
+		if p.checkpoint, err = newSinkCheckpointer(ts, p.source, cfg.CheckpointInterval); err != nil {
+			return nil, err
+		}
+	}
+	// by default this channel can hold 10 items before the producers have
+	// to wait this will happen because the producers create items faster
+	// than the consumers can pull them out, because of the sleep in the
+	// consumer loop
+	p.channel = make(chan Item, cfg.BufferSize)
+	if cfg.BufferShards > 1 {
+		if p.shards, err = newShardedBuffer(cfg); err != nil {
+			return nil, err
+		}
+		p.channel = p.shards.shards[0]
+	}
+	if cfg.FairTopics != "" {
+		if p.fair, err = newFairBuffer(cfg); err != nil {
+			return nil, err
+		}
+		p.channel = p.fair.queues[0].ch
+	}
+	p.input = p.channel
+	if cfg.BufferBytes > 0 {
+		p.budget = newByteBudget(int64(cfg.BufferBytes))
+	}
+	if cfg.MemoryLimit > 0 {
+		if p.memory, err = newMemGuard(cfg, p.hooks); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.setupRoutes(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.CanaryHandler != "" {
+		if p.pools[canaryPool] != nil {
+			return nil, fmt.Errorf("pool %q is the -canary-handler's, a -route can't send to it", canaryPool)
+		}
+		if p.canary, err = newCanary(cfg, p.hooks); err != nil {
+			return nil, err
+		}
+		p.pools[canaryPool] = &consumerPool{
+			name:      canaryPool,
+			size:      cfg.CanaryConsumers,
+			channel:   make(chan Item, cfg.BufferSize),
+			consumers: make(map[int]*worker),
+		}
+	}
+	if cfg.ConsumerPauseAfter > 0 {
+		p.pauses = newConsumerPauses(cfg, p.hooks)
+	}
+	if cfg.ProducerLanes > 0 {
+		if p.merge, err = newMerger(p, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StrictMemory {
+		// once every pool has its buffer
+		if p.strict, err = newStrictMemory(p, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.WatermarkHigh > 0 {
+		if p.marks, err = newWatermarks(p, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DeadlockAfter > 0 {
+		p.deadlock = newDeadlockWatch(p, cfg)
+	}
+	if cfg.Admin != "" {
+		p.tail = newConsumedTail()
+		if !cfg.StrictMemory {
+			p.queued = newQueuedTail()
+		}
+	}
+	// the evictor goes by how long the oldest item on each buffer has
+	// waited, which the lag monitor keeps
+	if cfg.LagMaxItems > 0 || cfg.LagMaxAge > 0 || cfg.EvictAfter > 0 {
+		p.lag = newLagMonitor(cfg, p.hooks)
+		if p.shards != nil {
+			for i, ch := range p.shards.shards {
+				p.lag.watch(fmt.Sprintf("%s shard %d", defaultPool, i), ch)
+			}
+		} else {
+			p.lag.watch(defaultPool, p.channel)
+		}
+		for _, pool := range p.pools {
+			p.lag.watch(pool.name, pool.channel)
+		}
+	}
+	if cfg.EvictAfter > 0 {
+		if p.evict, err = newEvictor(p, cfg); err != nil {
+			return nil, err
+		}
+	}
+	p.gov = newGovernor(cfg.Rate)
+	p.stats = NewStats()
+	p.stats.sampleErrors(cfg.ErrorLogFirst, cfg.ErrorLogEvery)
+	p.barrier = newBarrier()
+	if cfg.CheckSequence {
+		p.seqs = newSeqChecker()
+	}
+	if cfg.DedupWindow > 0 {
+		p.dedup = newDedupWindow(cfg.DedupWindow)
+	}
+	p.verbose.Store(cfg.Verbose)
+	if p.health, err = newHealthCheck(p, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Daemon {
+		if p.systemd, err = newSDNotifier(p.health); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MetricsKey != "" {
+		if p.keyed, err = newKeyMetrics(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RecordProduced != "" {
+		if p.record, err = newFileSink(cfg.RecordProduced, formatNDJSON); err != nil {
+			return nil, fmt.Errorf("-record-produced: %v", err)
+		}
+	}
+	if cfg.Golden != "" {
+		if p.golden, err = newGolden(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Trace != "" {
+		if p.trace, err = newTracer(cfg.Trace); err != nil {
+			return nil, err
+		}
+	}
+	if p.drops, err = newDropPolicy(cfg, p.stats, p.deadLetter); err != nil {
+		return nil, err
+	}
+	p.drops.trace = p.trace
+	if p.errs, err = newErrorPolicy(cfg); err != nil {
+		return nil, err
+	}
+	if p.joiner != nil {
+		p.joiner.drop = p.drops.drop
+	}
+	if cfg.Redis != "" {
+		if p.redis, err = newRedisTransport(cfg, p.stats); err != nil {
+			return nil, err
+		}
+		p.redis.budget = p.budget
+		p.redis.failed = func(items []Item, err error) {
+			for i := range items {
+				p.deadLetter(copyItem(&items[i]), fmt.Sprintf("couldn't push to redis: %v", err))
+			}
+		}
+		if p.lag != nil {
+			p.redis.queued = func() { p.lag.queued(p.channel) }
+		}
+		p.input = make(chan Item, cfg.BufferSize)
+	}
+	p.slos = newSLOTracker(cfg.SLOs, p.stats, cfg.SLOWindow)
+	p.slos.OnBreach = func(b SLOBreach) {
+		fmt.Printf("slo %s breached: observed %s\n", b.SLO.Name, b.Observed)
+		p.hooks.emit(newEvent(EventSLOBreach,
+			map[string]any{"slo": b.SLO.Name, "observed": b.Observed.String()},
+			"slo %s breached: observed %s", b.SLO.Name, b.Observed))
+	}
+	return p, nil
+}
+
+// run the producers and consumers to completion, then report on the run
+func (p *Pipeline) Run() {
+	cfg := p.cfg
+
+	p.slos.start()
+	if p.joiner != nil {
+		p.joiner.start()
+	}
+	if p.checkpoint != nil {
+		p.checkpoint.start()
+	}
+	if p.backfill != nil {
+		p.backfill.begin()
+	}
+	if p.memory != nil {
+		p.memory.start()
+	}
+	if p.lag != nil {
+		p.lag.start()
+	}
+	if p.evict != nil {
+		p.evict.start()
+	}
+	if p.marks != nil {
+		p.marks.start()
+	}
+	if p.deadlock != nil {
+		p.deadlock.start()
+	}
+	if p.auto != nil {
+		p.auto.start()
+	}
+	if p.redis != nil {
+		go p.redis.pushAll(p.input)
+		if cfg.Consumers > 0 {
+			go p.redis.popAll(p.channel)
+		} else {
+			// a producer-only process mustn't take items off the queue
+			// that it has nobody to handle
+			go func() {
+				p.redis.wait()
+				close(p.channel)
+			}()
+		}
+	}
+	p.scale(cfg.Producers, cfg.Consumers)
+	p.mu.Lock()
+	p.startPools()
+	p.mu.Unlock()
+	if p.ingest != nil {
+		p.ingest.serve()
+	}
+	p.systemd.ready()
+
+	// wait for every producer to finish, including any added along the way,
+	// then close the channels so the consumers drain them and exit
+	p.mu.Lock()
+	for len(p.producers) > 0 || p.committing > 0 || p.keepOpen && !p.draining {
+		p.cond.Wait()
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.systemd.stopping()
+	p.hooks.emit(newEvent(EventEndOfStream, p.stats.fields(), "producers finished, draining"))
+	p.gov.stop()
+	if p.memory != nil {
+		p.memory.stop()
+	}
+	if p.marks != nil {
+		p.marks.stop()
+	}
+	if p.deadlock != nil {
+		p.deadlock.stop()
+	}
+	if p.auto != nil {
+		p.auto.stop()
+	}
+	if cfg.Rate > 0 || p.gov.currentRate() > 0 {
+		fmt.Fprintf(p.summary, "governor: target %.0f items/sec, achieved %.1f items/sec\n",
+			p.gov.currentRate(), p.gov.achieved())
+	}
+	if p.merge != nil {
+		p.merge.close()
+	}
+	p.bufMu.Lock()
+	p.inputClosed = true
+	switch {
+	case p.shards != nil:
+		p.shards.close()
+	case p.fair != nil:
+		p.fair.close()
+	default:
+		close(p.input)
+	}
+	p.bufMu.Unlock()
+	for _, pool := range p.pools {
+		close(pool.channel)
+	}
+	// a paused pipeline would never drain
+	p.gate.unpause()
+	p.mu.Lock()
+	for p.consuming() {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+	if p.evict != nil {
+		p.evict.stop()
+	}
+	p.flushBehind()
+	p.tail.close()
+	if p.lag != nil {
+		p.lag.stop()
+	}
+	if p.redis != nil {
+		p.redis.wait()
+	}
+	if p.joiner != nil {
+		p.joiner.stop()
+	}
+	if p.backfill != nil {
+		p.backfill.finish()
+	}
+	if p.checkpoint != nil {
+		p.checkpoint.stop()
+	}
+
+	p.close()
+	p.stats.finish()
+	p.slos.stop()
+	p.stats.printSummary(p.summary)
+	p.slos.printSummary(p.summary)
+	if p.joiner != nil {
+		p.joiner.printSummary(p.summary)
+	}
+	if p.seqs != nil {
+		p.seqs.printSummary(p.summary)
+	}
+	if p.keyed != nil {
+		p.keyed.printSummary(p.summary)
+	}
+	if p.lag != nil {
+		p.lag.printSummary(p.summary)
+	}
+	if p.evict != nil {
+		p.evict.printSummary(p.summary)
+	}
+	if p.marks != nil {
+		p.marks.printSummary(p.summary)
+	}
+	if p.deadlock != nil {
+		p.deadlock.printSummary(p.summary)
+	}
+	if p.merge != nil {
+		p.merge.printSummary(p.summary)
+	}
+	if p.pauses != nil {
+		p.pauses.printSummary(p.summary)
+	}
+	if p.routed != nil {
+		p.routed.printSummary(p.summary)
+	}
+	p.printWriteBehindSummary(p.summary)
+	if p.ordered != nil {
+		p.ordered.printSummary(p.summary)
+	}
+	if p.limits != nil {
+		p.limits.printSummary(p.summary)
+	}
+	if p.shadow != nil {
+		p.shadow.printSummary(p.summary)
+	}
+	if p.canary != nil {
+		p.canary.printSummary(p.summary)
+	}
+	if p.prefetch != nil {
+		p.prefetch.printSummary(p.summary)
+	}
+	if p.shards != nil {
+		p.shards.printSummary(p.summary)
+	}
+	if p.fair != nil {
+		p.fair.printSummary(p.summary)
+	}
+	if p.payloads != nil {
+		p.payloads.printSummary(p.summary)
+	}
+	if p.compress != nil {
+		p.compress.printSummary(p.summary)
+	}
+	if p.strict != nil {
+		p.strict.printSummary(p.summary)
+	}
+	if p.sums != nil {
+		p.sums.printSummary(p.summary)
+	}
+	if p.golden != nil {
+		p.golden.finish(p.summary)
+	}
+	if cfg.ConsumerSpin > 0 {
+		p.spins.printSummary(p.summary, cfg.ConsumerSpin)
+	}
+	if n, r := p.txns.committed.Load(), p.txns.rolledBack.Load(); n+r > 0 {
+		fmt.Fprintf(p.summary, "producer batches: %d committed with %d items, %d rolled back\n", n, p.txns.items.Load(), r)
+	}
+	if p.batcher != nil {
+		p.batcher.printSummary(p.summary)
+	}
+	p.hooks.emit(newEvent(EventRunComplete, p.stats.fields(), "run complete"))
+
+	report := newReport(p.stats, p.slos)
+	if len(p.pools) == 0 {
+		// the model is of one pool of consumers
+		report.Queueing = analyzeQueue(p.stats, cfg.BufferSize, cfg.Rate)
+	}
+	if report.Queueing != nil {
+		report.Queueing.printSummary(p.summary)
+	}
+	if cfg.Output == outputJSON {
+		w := p.summaryOut
+		if w == nil {
+			w = os.Stdout
+		}
+		if err := p.writeOutput(w, report); err != nil {
+			fmt.Printf("error writing the -output summary: %v\n", err)
+		}
+	}
+	p.completed.Do(func() {
+		if p.OnComplete != nil {
+			p.OnComplete(report)
+		}
+	})
+	if cfg.Report != "" {
+		if err := writeReport(cfg.Report, report); err != nil {
+			fmt.Printf("error writing report: %v\n", err)
+		}
+	}
+	if cfg.Manifest != "" {
+		if err := writeManifest(cfg.Manifest, newManifest(cfg, p.stats.start, report)); err != nil {
+			fmt.Printf("error writing manifest: %v\n", err)
+		}
+	}
+	for _, n := range newNotifiers(cfg) {
+		if err := n.Notify(report); err != nil {
+			fmt.Printf("error sending report: %v\n", err)
+		}
+	}
+	p.hooks.wait()
+}
+
+// start or stop workers until there are the given number of producers and
+// consumers. Workers are stopped newest first; a stopped consumer finishes
+// the item it is on. Producers can't be added once the pipeline is draining
+// or its producers have all finished, and -1 leaves a count alone.
+func (p *Pipeline) scale(producers, consumers int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if producers > active(p.producers) && (p.draining || p.closed) {
+		return fmt.Errorf("%w: %s is draining, can't add producers", ErrPipelineClosed, p.name)
+	}
+	if producers >= 0 {
+		p.resize(p.producers, producers, &p.nextProducerID, "producer", p.produce)
+	}
+	p.stats.setWorkers(producers, consumers)
+	if consumers >= 0 {
+		p.resize(p.consumers, consumers, &p.nextConsumerID, "consumer",
+			func(id int, stop <-chan struct{}) { p.consume(p.defaultBuffer(), id, stop) })
+	}
+	return nil
+}
+
+// grow or shrink one pool of workers, called with p.mu held
+func (p *Pipeline) resize(pool map[int]*worker, want int, nextID *int, role string,
+	work func(id int, stop <-chan struct{})) {
+	for n := active(pool); n < want; n++ {
+		id := *nextID
+		*nextID++
+		w := &worker{stop: make(chan struct{})}
+		pool[id] = w
+		go func() {
+			defer func() {
+				p.mu.Lock()
+				delete(pool, id)
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			}()
+			defer p.hooks.crashGuard(role, id)
+			work(id, w.stop)
+		}()
+	}
+	for n := active(pool); n > want; n-- {
+		newest := -1
+		for id, w := range pool {
+			if !w.stopping {
+				newest = max(newest, id)
+			}
+		}
+		pool[newest].halt()
+	}
+}
+
+// Drain stops the producers, takes no more items from Produce or Submit, and
+// has Run finish once the consumers have handled what is already on the
+// buffers. It doesn't wait for that.
+func (p *Pipeline) Drain() {
+	p.drain()
+}
+
+// stop all the producers early. The consumers carry on until everything
+// already in the channel has been handled, and then the run finishes.
+func (p *Pipeline) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draining = true
+	// letting go of a Run kept open for items
+	p.cond.Broadcast()
+	// producers of posted items finish by themselves once the ingest stops,
+	// after putting the item they hold on the buffer, which a halt would
+	// lose though its client was told it got in
+	if p.ingest != nil {
+		p.ingest.stop()
+		return
+	}
+	for _, w := range p.producers {
+		w.halt()
+	}
+}
+
+// reject an item, recording why
+func (p *Pipeline) deadLetter(item Item, reason string) {
+	p.trace.nack(&item, 0, nackDead)
+	if before := p.dlq.add(item, reason); before > 0 {
+		fmt.Printf("item %d dead-lettered again, %d times now: %s\n", item.ID, before+1, reason)
+	} else {
+		fmt.Printf("item %d dead-lettered: %s\n", item.ID, reason)
+	}
+	p.stats.recordDeadLetter()
+}
+
+// release the plugins and the dlq file once every consumer has finished,
+// and then the locks on them
+func (p *Pipeline) close() {
+	closers := []any{p.source, p.handler, p.sink, p.dlq, p.drops, p.trace}
+	if p.joiner != nil {
+		closers = append(closers, p.joiner.source)
+	}
+	if p.record != nil {
+		closers = append(closers, p.record)
+	}
+	if p.redis != nil {
+		closers = append(closers, p.redis)
+	}
+	if p.member != nil {
+		closers = append(closers, p.member)
+	}
+	if p.systemd != nil {
+		closers = append(closers, p.systemd)
+	}
+	if p.canary != nil {
+		closers = append(closers, p.canary)
+	}
+	if p.shadow != nil {
+		closers = append(closers, p.shadow)
+	}
+	if p.strict != nil {
+		closers = append(closers, p.strict)
+	}
+	for _, c := range closers {
+		if c, ok := c.(interface{ Close() error }); ok {
+			if err := c.Close(); err != nil {
+				fmt.Printf("error closing plugin: %v\n", err)
+			}
+		}
+	}
+	if p.locks != nil {
+		p.locks.Close()
+	}
+}
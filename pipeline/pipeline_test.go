@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// a New that fails lets go of the run locks it took, so the next can
+// have them
+func TestNewFailingReleasesLocks(t *testing.T) {
+	dlq := filepath.Join(t.TempDir(), "dlq.ndjson")
+	cfg, err := ParseConfig([]string{"-dlq", dlq, "-buffer-full", "sideways"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New took -buffer-full sideways")
+	}
+	cfg, err = ParseConfig([]string{"-dlq", dlq, "-producers", "1", "-items", "1", "-consumers", "1", "-delay", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Run()
+}
+
+// pipelines in one process keep their own counts, as the race detector
+// checks under go test -race
+func TestPipelinesRunTogether(t *testing.T) {
+	pipes := make([]*Pipeline, 2)
+	for i := range pipes {
+		cfg, err := ParseConfig([]string{"-producers", "2", "-items", "20", "-consumers", "2", "-delay", "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pipes[i], err = New(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	for _, p := range pipes {
+		go func() {
+			p.Run()
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	for i, p := range pipes {
+		if n := p.printed; n != 40 {
+			t.Errorf("pipeline %d printed %d items, expected 40", i, n)
+		}
+	}
+}
+
+// gives n items, then io.EOF
+type countingSource struct {
+	mu   sync.Mutex
+	n, i int
+}
+
+func (s *countingSource) Next() (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.i == s.n {
+		return nil, io.EOF
+	}
+	s.i++
+	return &Item{ID: s.i}, nil
+}
+
+// tags each item with the attempt it was handled on
+type attemptHandler struct{}
+
+func (attemptHandler) HandleContext(ctx context.Context, item *Item) (*Item, error) {
+	item.Seq = int64(ItemAttempt(ctx))
+	return item, nil
+}
+
+func (h attemptHandler) Handle(item *Item) (*Item, error) {
+	return h.HandleContext(context.Background(), item)
+}
+
+// keeps the items written to it
+type collectingSink struct {
+	mu    sync.Mutex
+	items []Item
+}
+
+func (s *collectingSink) Write(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = append(s.items, *item)
+	return nil
+}
+
+// a program can run its own handler, source and sink, written in Go,
+// but not alongside the flag giving one
+func TestNewWithOptions(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-producers", "1", "-consumers", "2", "-delay", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &collectingSink{}
+	p, err := New(cfg, WithSource(&countingSource{n: 10}), WithHandler(attemptHandler{}), WithSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Run()
+	if len(sink.items) != 10 {
+		t.Fatalf("the sink was written %d items, expected 10", len(sink.items))
+	}
+	for _, item := range sink.items {
+		if item.Seq != 1 {
+			t.Errorf("item %d was handled on attempt %d, expected 1", item.ID, item.Seq)
+		}
+	}
+
+	cfg, err = ParseConfig([]string{"-sink", "stdout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg, WithSink(sink)); err == nil {
+		t.Fatal("New took both -sink and WithSink")
+	}
+}
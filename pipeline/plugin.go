@@ -0,0 +1,465 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"plugin"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler processes an item on behalf of a consumer. It may return a
+// replacement item to pass on to the sink, or nil to pass the original
+// through unchanged. An error counts the item as failed.
+type Handler interface {
+	Handle(item *Item) (*Item, error)
+}
+
+// Splitter is a Handler that can turn one item into any number of items,
+// none included. When the handler is a Splitter it is used in place of
+// Handle, and the consumer passes the items on one at a time.
+type Splitter interface {
+	Split(item *Item) ([]Item, error)
+}
+
+// Source supplies items to the producers. Next returns io.EOF once there
+// are no more items.
+type Source interface {
+	Next() (*Item, error)
+}
+
+// Sink is where items end up after they have been handled
+type Sink interface {
+	Write(item *Item) error
+}
+
+// Handlers, sources and sinks can be loaded at runtime from a spec of the
+// form "plugin:<file.so>" or "exec:<command line>". Sources can also read
+// json lines from "file:<path>", see filesource.go, or rows of a query from
+// "sql:<driver>:<dsn>", see sqlsource.go, and sinks can write json lines or
+// parquet to "file:<path>", to a bucket with "s3:<bucket>", see s3.go, or
+// rows to a table with "sql:<driver>:<dsn>", see sqlsink.go.
+// Both can be an MQTT broker given as "mqtt:<host>[:port]", see mqtt.go.
+// Handlers can also be a WebAssembly module given as "wasm:<file.wasm>",
+// see wasm.go, or a Starlark script given as "starlark:<file.star>", see
+// script.go.
+//
+// A Go plugin is built with `go build -buildmode=plugin` and exports plain
+// functions that work on json encoded items, since a plugin can't import
+// this package's types:
+//
+//	func Handle(item []byte) ([]byte, error) // nil result keeps the item
+//	func Split(item []byte) ([]byte, error)  // optional, a json array of items
+//	func Next() ([]byte, error)              // io.EOF when finished
+//	func Write(item []byte) error
+//	func Position() (string, error)          // optional, for -checkpoint
+//	func Resume(token string) error          // optional, for -checkpoint
+//
+// An exec plugin is a long running subprocess that reads one json request
+// per line on stdin and answers each with one json response line on stdout:
+//
+//	{"op":"handle","item":{...}}  ->  {"item":{...}} or {} or {"error":"..."}
+//	                                  or {"items":[...]} to split the item,
+//	                                  with "result":{...} to set their Result
+//	{"op":"next"}                 ->  {"item":{...}} or {"eof":true}
+//	{"op":"write","item":{...}}   ->  {} or {"error":"..."}
+//	{"op":"position"}             ->  {"token":"..."}
+//	{"op":"resume","token":"..."} ->  {} or {"error":"..."}
+//
+// Sources only get position and resume requests when -checkpoint is used.
+//
+// Its stdin is closed when the run is over so it can exit cleanly.
+
+func loadHandler(spec string, wasmRuntime string) (Handler, error) {
+	kind, target, err := splitPluginSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "exec":
+		return startExecPlugin(target)
+	case "file", "mqtt", "sql":
+		return nil, fmt.Errorf("plugin spec %q: %s is only supported for sources and sinks", spec, kind)
+	case "s3":
+		return nil, fmt.Errorf("plugin spec %q: s3 is only supported for sinks", spec)
+	case "wasm":
+		return newWasmHandler(target, wasmRuntime)
+	case "starlark":
+		return newScriptHandler(target)
+	}
+	sym, err := lookupPlugin(target, "Handle")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(func([]byte) ([]byte, error))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: Handle has type %T", target, sym)
+	}
+	if sym, err := lookupPlugin(target, "Split"); err == nil {
+		split, ok := sym.(func([]byte) ([]byte, error))
+		if !ok {
+			return nil, fmt.Errorf("plugin %s: Split has type %T", target, sym)
+		}
+		return &goSplitter{goHandler: goHandler(fn), split: split}, nil
+	}
+	return goHandler(fn), nil
+}
+
+func loadSource(spec string, cfg *Config) (Source, error) {
+	kind, target, err := splitPluginSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "wasm", "starlark":
+		return nil, fmt.Errorf("plugin spec %q: %s is only supported for handlers", spec, kind)
+	case "s3":
+		return nil, fmt.Errorf("plugin spec %q: s3 is only supported for sinks", spec)
+	case "exec":
+		return startExecPlugin(target)
+	case "file":
+		return newFileSource(target)
+	case "sql":
+		return newSQLSource(target, cfg)
+	case "mqtt":
+		return newMQTTSource(target, cfg)
+	}
+	sym, err := lookupPlugin(target, "Next")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(func() ([]byte, error))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: Next has type %T", target, sym)
+	}
+	s := &goSource{next: fn}
+	if sym, err := lookupPlugin(target, "Position"); err == nil {
+		if s.position, ok = sym.(func() (string, error)); !ok {
+			return nil, fmt.Errorf("plugin %s: Position has type %T", target, sym)
+		}
+	}
+	if sym, err := lookupPlugin(target, "Resume"); err == nil {
+		if s.resume, ok = sym.(func(string) error); !ok {
+			return nil, fmt.Errorf("plugin %s: Resume has type %T", target, sym)
+		}
+	}
+	return s, nil
+}
+
+func loadSink(spec string, cfg *Config) (Sink, error) {
+	kind, target, err := splitPluginSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "wasm", "starlark":
+		return nil, fmt.Errorf("plugin spec %q: %s is only supported for handlers", spec, kind)
+	case "sql":
+		return newSQLSink(target, cfg)
+	case "exec":
+		return startExecPlugin(target)
+	case "file":
+		return newFileSink(target, cfg.SinkFormat)
+	case "s3":
+		return newS3Sink(target, cfg)
+	case "mqtt":
+		return newMQTTSink(target, cfg)
+	}
+	sym, err := lookupPlugin(target, "Write")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(func([]byte) error)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: Write has type %T", target, sym)
+	}
+	return goSink(fn), nil
+}
+
+func splitPluginSpec(spec string) (string, string, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	switch kind {
+	case "plugin", "exec", "wasm", "starlark", "file", "sql", "s3", "mqtt":
+	default:
+		ok = false
+	}
+	if !ok || target == "" {
+		return "", "", fmt.Errorf("plugin spec %q: expected plugin:<file.so>, exec:<command>, file:<path>, sql:<driver>:<dsn>, s3:<bucket>, mqtt:<host>[:port], wasm:<file.wasm> or starlark:<file.star>", spec)
+	}
+	return kind, target, nil
+}
+
+func lookupPlugin(path, name string) (plugin.Symbol, error) {
+	plug, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return plug.Lookup(name)
+}
+
+// the adapters from the json based plugin functions to our interfaces
+
+type goHandler func([]byte) ([]byte, error)
+
+func (h goHandler) Handle(item *Item) (*Item, error) {
+	in, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	out, err := h(in)
+	if err != nil || out == nil {
+		return nil, err
+	}
+	var result Item
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type goSplitter struct {
+	goHandler
+	split func([]byte) ([]byte, error)
+}
+
+func (h *goSplitter) Split(item *Item) ([]Item, error) {
+	in, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	out, err := h.split(in)
+	if err != nil {
+		return nil, err
+	}
+	var items []Item
+	if err := json.Unmarshal(out, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// goSource serializes calls to Next since several producers share the
+// one source and the plugin need not be thread safe
+type goSource struct {
+	mu       sync.Mutex
+	next     func() ([]byte, error)
+	position func() (string, error)
+	resume   func(string) error
+}
+
+func (s *goSource) Next() (*Item, error) {
+	s.mu.Lock()
+	data, err := s.next()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (s *goSource) Position() (string, error) {
+	if s.position == nil {
+		return "", errors.New("plugin doesn't export Position")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.position()
+}
+
+func (s *goSource) Resume(token string) error {
+	if s.resume == nil {
+		return errors.New("plugin doesn't export Resume")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resume(token)
+}
+
+type goSink func([]byte) error
+
+func (s goSink) Write(item *Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s(data)
+}
+
+type execRequest struct {
+	Op      string       `json:"op"`
+	Item    *Item        `json:"item,omitempty"`
+	Context *execContext `json:"context,omitempty"`
+	Token   string       `json:"token,omitempty"`
+}
+
+// what a handle request says about the call besides the item, from its
+// context
+type execContext struct {
+	Topic    string     `json:"topic,omitempty"`
+	Producer int        `json:"producer"`
+	Attempt  int        `json:"attempt"`
+	TraceID  string     `json:"trace_id,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+type execResponse struct {
+	Item   *Item   `json:"item,omitempty"`
+	Items  *[]Item `json:"items,omitempty"` // set, even if empty, to split
+	Result *Result `json:"result,omitempty"`
+	EOF    bool    `json:"eof,omitempty"`
+	Token  string  `json:"token,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// execPlugin talks to a subprocess over stdin/stdout. Requests are sent one
+// at a time, so the subprocess never has to deal with concurrency.
+type execPlugin struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	enc    *json.Encoder
+}
+
+func startExecPlugin(command string) (*execPlugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("exec: needs a command to run")
+	}
+	return startExecPluginArgs(args)
+}
+
+// start an exec plugin from its argv as it is, for a command whose
+// arguments may have spaces in them
+func startExecPluginArgs(args []string) (*execPlugin, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting plugin %q: %v", strings.Join(args, " "), err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &execPlugin{cmd: cmd, stdin: stdin, stdout: scanner, enc: json.NewEncoder(stdin)}, nil
+}
+
+func (e *execPlugin) call(req execRequest) (*execResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", e.cmd.Path, err)
+	}
+	if !e.stdout.Scan() {
+		err := e.stdout.Err()
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("plugin %s: %v", e.cmd.Path, err)
+	}
+	var resp execResponse
+	if err := json.Unmarshal(e.stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s: bad response: %v", e.cmd.Path, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+func (e *execPlugin) Handle(item *Item) (*Item, error) {
+	return e.HandleContext(context.Background(), item)
+}
+
+func (e *execPlugin) HandleContext(ctx context.Context, item *Item) (*Item, error) {
+	items, err := e.SplitContext(ctx, item)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+func (e *execPlugin) Split(item *Item) ([]Item, error) {
+	return e.SplitContext(context.Background(), item)
+}
+
+// handle an item, which the plugin may answer with a list of items. The
+// request has what the context says about the call.
+func (e *execPlugin) SplitContext(ctx context.Context, item *Item) ([]Item, error) {
+	req := execRequest{Op: "handle", Item: item}
+	if producer, ok := ItemProducer(ctx); ok {
+		req.Context = &execContext{Topic: ItemTopic(ctx), Producer: producer, Attempt: ItemAttempt(ctx), TraceID: ItemTraceID(ctx)}
+		if d, ok := ctx.Deadline(); ok {
+			req.Context.Deadline = &d
+		}
+	}
+	resp, err := e.call(req)
+	if err != nil {
+		return nil, err
+	}
+	items := []Item{*item}
+	switch {
+	case resp.Items != nil:
+		items = *resp.Items
+	case resp.Item != nil:
+		items = []Item{*resp.Item}
+	}
+	if resp.Result != nil {
+		for i := range items {
+			items[i].Result = resp.Result
+		}
+	}
+	return items, nil
+}
+
+func (e *execPlugin) Next() (*Item, error) {
+	resp, err := e.call(execRequest{Op: "next"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.EOF || resp.Item == nil {
+		return nil, io.EOF
+	}
+	return resp.Item, nil
+}
+
+func (e *execPlugin) Position() (string, error) {
+	resp, err := e.call(execRequest{Op: "position"})
+	if err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+func (e *execPlugin) Resume(token string) error {
+	_, err := e.call(execRequest{Op: "resume", Token: token})
+	return err
+}
+
+func (e *execPlugin) Write(item *Item) error {
+	_, err := e.call(execRequest{Op: "write", Item: item})
+	return err
+}
+
+// close stdin and wait for the subprocess to exit
+func (e *execPlugin) Close() error {
+	e.stdin.Close()
+	return e.cmd.Wait()
+}
@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// prefetcher takes up to -prefetch items off the buffer ahead of each
+// consumer, as AMQP's prefetch count does, so while a consumer handles
+// one item the next are already fetched for it and it doesn't have to
+// wait its turn on a buffer many consumers are taking from. A prefetched
+// item has left the buffer, so the buffer takes more from the producers
+// meanwhile. A consumer that is stopped still handles what was fetched for
+// it before it goes.
+type prefetcher struct {
+	depth int
+	// the local buffers by consumer, for an abort to salvage
+	bufs sync.Map
+
+	// items fetched and not yet handed to their consumer, items handed
+	// over, and those of them that were already there when it asked
+	held, taken, ready atomic.Int64
+}
+
+func newPrefetcher(cfg *Config) (*prefetcher, error) {
+	if cfg.Batch != "" {
+		return nil, fmt.Errorf("-prefetch doesn't work with -batch, whose consumers take several items at a time already")
+	}
+	return &prefetcher{depth: cfg.Prefetch}, nil
+}
+
+// start fetching from channel for a consumer, until stop is closed or
+// channel is, returning the consumer's local buffer, which is closed once
+// the fetching stops
+func (f *prefetcher) start(p *Pipeline, channel <-chan Item, myId int, stop <-chan struct{}) <-chan Item {
+	// the fetcher holds one more while it waits for room
+	local := make(chan Item, f.depth-1)
+	f.bufs.Store(myId, local)
+	go func() {
+		defer close(local)
+		for {
+			p.gate.wait(stop)
+			select {
+			case <-stop:
+				return
+			case element, ok := <-channel:
+				if !ok {
+					if next := p.replaced(channel); next != nil {
+						channel = next
+						continue
+					}
+					return
+				}
+				p.lag.taken(channel)
+				f.held.Add(1)
+				local <- element
+			}
+		}
+	}()
+	return local
+}
+
+// count an item handed to its consumer, which was ready for it or not.
+// Safe on a nil prefetcher.
+func (f *prefetcher) took(ready bool) {
+	if f == nil {
+		return
+	}
+	f.held.Add(-1)
+	f.taken.Add(1)
+	if ready {
+		f.ready.Add(1)
+	}
+}
+
+// a consumer is done with its local buffer
+func (f *prefetcher) stopped(myId int) {
+	f.bufs.Delete(myId)
+}
+
+// what is left in the consumers' local buffers, by consumer
+func (f *prefetcher) buffers() map[int]chan Item {
+	bufs := make(map[int]chan Item)
+	f.bufs.Range(func(k, v any) bool {
+		bufs[k.(int)] = v.(chan Item)
+		return true
+	})
+	return bufs
+}
+
+func (f *prefetcher) printSummary(w io.Writer) {
+	taken, ready := f.taken.Load(), f.ready.Load()
+	pct := 0.0
+	if taken > 0 {
+		pct = float64(ready) / float64(taken) * 100
+	}
+	fmt.Fprintf(w, "prefetch: up to %d items per consumer, %d of %d items (%.0f%%) were fetched before their consumer was ready for them\n",
+		f.depth, ready, taken, pct)
+}
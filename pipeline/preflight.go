@@ -0,0 +1,239 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long preflight gives each endpoint to take a connection
+const preflightTimeout = 3 * time.Second
+
+// preflightCheck looks, before anything is set up, at what the flags point
+// the run at: that the files it reads are there, that it can write the
+// files it writes, including those only written at the end such as the
+// report, that the commands and plugins it runs exist, and that the hosts
+// it connects to resolve and take a connection. A mistake then fails the
+// run straight away, with every problem found at once, rather than after
+// the producers have started and items go to a sink that isn't there. It
+// only looks: nothing is created, truncated or sent. A sql sink or source
+// isn't dialled here, as it pings its database as it opens, before any
+// producer starts. -skip-preflight does without it.
+type preflightCheck struct {
+	mu       sync.Mutex
+	problems []error
+	wg       sync.WaitGroup
+	dialled  map[string]bool
+}
+
+// check the config, returning the problems found joined together
+func preflight(cfg *Config) error {
+	c := &preflightCheck{dialled: make(map[string]bool)}
+	c.plugin("-source", cfg.Source, cfg)
+	c.plugin("-join-source", cfg.JoinSource, cfg)
+	c.plugin("-handler", cfg.Handler, cfg)
+	c.plugin("-canary-handler", cfg.CanaryHandler, cfg)
+	c.plugin("-shadow-handler", cfg.ShadowHandler, cfg)
+	c.plugin("-sink", cfg.Sink, cfg)
+	for _, s := range cfg.NamedSinks {
+		if name, spec, ok := strings.Cut(s, "="); ok {
+			c.plugin("-named-sink "+name, spec, cfg)
+		}
+	}
+	if cfg.Golden != "" && !cfg.GoldenUpdate {
+		c.readable("-golden", cfg.Golden)
+	}
+	c.readable("-webhook-template", cfg.WebhookTemplate)
+	outputs := []struct{ flag, path string }{
+		{"-record-produced", cfg.RecordProduced},
+		{"-dlq", cfg.DLQ},
+		{"-drop-log", cfg.DropLog},
+		{"-shadow-log", cfg.ShadowLog},
+		{"-checkpoint", cfg.Checkpoint},
+		{"-backfill", cfg.Backfill},
+		{"-lock", cfg.Lock},
+		{"-trace", cfg.Trace},
+		{"-salvage", cfg.Salvage},
+		{"-deadlock-dump", cfg.DeadlockDump},
+		{"-report", cfg.Report},
+		{"-output-file", cfg.OutputFile},
+	}
+	if cfg.GoldenUpdate {
+		outputs = append(outputs, struct{ flag, path string }{"-golden", cfg.Golden})
+	}
+	for _, o := range outputs {
+		c.writable(o.flag, o.path)
+	}
+	if info, err := os.Stat(cfg.Manifest); err == nil && info.IsDir() {
+		c.writableDir("-manifest", cfg.Manifest)
+	} else {
+		c.writable("-manifest", cfg.Manifest)
+	}
+	if cfg.Redis != "" {
+		if u, err := url.Parse(cfg.Redis); err == nil && u.Scheme == "redis" {
+			c.reachable("-redis", hostPort(u.Host, "6379"))
+		}
+	}
+	for _, hook := range cfg.Webhooks {
+		c.endpoint("-webhook", hook)
+	}
+	c.endpoint("-notify-slack", cfg.NotifySlack)
+	if cfg.NotifySMTP != "" {
+		c.reachable("-notify-smtp", cfg.NotifySMTP)
+	}
+	c.wg.Wait()
+	return errors.Join(c.problems...)
+}
+
+func (c *preflightCheck) fail(flag, what string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.problems = append(c.problems, fmt.Errorf("%s %s: %v", flag, what, err))
+}
+
+// look at what a plugin spec points at, by its kind
+func (c *preflightCheck) plugin(flag, spec string, cfg *Config) {
+	if spec == "" {
+		return
+	}
+	kind, target, err := splitPluginSpec(spec)
+	if err != nil {
+		// loading it says what is wrong
+		return
+	}
+	switch kind {
+	case "file":
+		if flag == "-source" || flag == "-join-source" {
+			c.readable(flag, target)
+		} else {
+			c.writable(flag, target)
+		}
+	case "plugin", "wasm", "starlark":
+		c.readable(flag, target)
+	case "exec":
+		if args := strings.Fields(target); len(args) > 0 {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				c.fail(flag, redactFlag(strings.TrimPrefix(flag, "-"), spec), err)
+			}
+		}
+	case "mqtt":
+		c.reachable(flag, hostPort(target, mqttDefaultPort))
+	case "s3":
+		host := fmt.Sprintf("%s.s3.%s.amazonaws.com:443", target, cfg.S3Region)
+		if cfg.S3Endpoint != "" {
+			if u, err := url.Parse(cfg.S3Endpoint); err == nil && u.Host != "" {
+				host = hostPort(u.Host, defaultPort(u.Scheme))
+			}
+		}
+		c.reachable(flag, host)
+	}
+}
+
+// a file to read, or a glob that must match at least one
+func (c *preflightCheck) readable(flag, path string) {
+	if path == "" {
+		return
+	}
+	if strings.ContainsAny(path, "*?[") {
+		if matches, err := filepath.Glob(path); err != nil || len(matches) == 0 {
+			c.fail(flag, path, errors.New("matches no files"))
+		}
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.fail(flag, path, err)
+		return
+	}
+	f.Close()
+}
+
+// a file to write: there already and open to writing, or in a directory
+// that a file can be made in
+func (c *preflightCheck) writable(flag, path string) {
+	if path == "" {
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			c.fail(flag, path, errors.New("is a directory"))
+			return
+		}
+		// opened without truncating it, so it is left as it was
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			c.fail(flag, path, err)
+			return
+		}
+		f.Close()
+		return
+	}
+	c.writableDir(flag, filepath.Dir(path))
+}
+
+func (c *preflightCheck) writableDir(flag, dir string) {
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		c.fail(flag, dir, errors.New("can't make a file in the directory"))
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// an http or https url's host
+func (c *preflightCheck) endpoint(flag, raw string) {
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		c.fail(flag, redactFlag(strings.TrimPrefix(flag, "-"), raw), errors.New("not a url"))
+		return
+	}
+	c.reachable(flag, hostPort(u.Host, defaultPort(u.Scheme)))
+}
+
+// a host:port that resolves and takes a connection, dialled alongside the
+// rest, once however many flags name it
+func (c *preflightCheck) reachable(flag, addr string) {
+	c.mu.Lock()
+	seen := c.dialled[addr]
+	c.dialled[addr] = true
+	c.mu.Unlock()
+	if seen {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		conn, err := net.DialTimeout("tcp", addr, preflightTimeout)
+		if err != nil {
+			c.fail(flag, addr, err)
+			return
+		}
+		conn.Close()
+	}()
+}
+
+// host with port added when it has none
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
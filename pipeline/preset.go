@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A preset is a named set of flags tuned together for one goal, so a new
+// user can pick -preset throughput rather than learn which dozen knobs
+// matter. Its flags go before the -config file's and the command line's,
+// so any of them set there still win:
+//
+//	go_producer_consumer -preset reliable -retries 10
+type preset struct {
+	about string
+	args  []string
+	// only with a -sink, since -batch needs one to write to
+	sinkArgs []string
+}
+
+var presets = map[string]preset{
+	"throughput": {
+		about: "big buffers and batched sink writes, with few quick retries and no waiting on mqtt acks",
+		args: []string{
+			"-buffer=1000",
+			"-consumers=auto",
+			"-retries=2",
+			"-retry-backoff=50ms",
+			"-mqtt-qos=0",
+		},
+		sinkArgs: []string{
+			"-batch=auto",
+			"-batch-max=1000",
+			"-batch-latency=250ms",
+		},
+	},
+	"low-latency": {
+		about: "a short buffer that consumers poll, unbatched, with one fast retry and slow handlers cut off",
+		args: []string{
+			"-buffer=16",
+			"-consumer-spin=50us",
+			"-retries=1",
+			"-retry-backoff=10ms",
+			"-handler-timeout=1s",
+			"-mqtt-qos=0",
+		},
+	},
+	"reliable": {
+		about: "patient retries, checksummed payloads, dedup, frequent checkpoints and exactly once mqtt",
+		args: []string{
+			"-retries=5",
+			"-retry-backoff=500ms",
+			"-checksum=crc32c",
+			"-dedup-window=10m",
+			"-checkpoint-interval=1s",
+			"-mqtt-qos=2",
+		},
+	},
+}
+
+// the flags the -preset named in args stands for, nil if there is none
+func presetArgs(args []string) ([]string, error) {
+	name := flagArg(args, "preset")
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown -preset %q, expected %s", name, presetNames())
+	}
+	out := append([]string(nil), p.args...)
+	if flagArg(args, "sink") != "" {
+		out = append(out, p.sinkArgs...)
+	}
+	return out, nil
+}
+
+func presetNames() string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// QueueAnalysis treats the run as an M/M/c queue, with items arriving at
+// the rate the producers offered them and each of c consumers serving
+// them at the rate it managed, and works out what that model expects of
+// the buffer: how busy the consumers are, how many items wait and for how
+// long. From that come suggestions for the consumer count and buffer size.
+// Real arrivals and service times are rarely exponential, so the numbers
+// are a guide rather than a prediction.
+type QueueAnalysis struct {
+	ArrivalRate float64 // items/sec the producers offered, 0 if they outran the consumers
+	ServiceRate float64 // items/sec one consumer handles
+	Consumers   int
+	Buffer      int
+	Utilization float64 // share of the consumers' capacity the arrivals need
+	QueueLength float64 // expected items waiting, when utilization is under 1
+	Wait        time.Duration
+	Served      int64 // items the rates were measured over
+	Suggestions []string
+	// whether the run was long enough for the suggestions
+	sized bool
+}
+
+// the utilization suggestions aim for, leaving room for bursts
+const queueTarget = 0.7
+
+// how many items have to be handled, over how long at least, before the
+// rates are steady enough to size by. A shorter run is still analysed,
+// but makes no suggestions.
+const (
+	queueMinServed = 100
+	queueMinTime   = time.Second
+)
+
+// analyze the run's stats, given the producers' -rate if they had one,
+// or return nil if there's too little to go on
+func analyzeQueue(stats *Stats, buffer int, rate float64) *QueueAnalysis {
+	q := queueModel(stats, buffer, rate)
+	if q != nil && !q.sized {
+		q.Suggestions = nil
+	}
+	return q
+}
+
+// the analysis with every suggestion the model makes
+func queueModel(stats *Stats, buffer int, rate float64) *QueueAnalysis {
+	stats.mu.Lock()
+	// items dropped for want of room were offered too
+	produced, served, service := stats.produced+stats.dropped[DropFull], stats.served, stats.service
+	producers, consumers, blocked := stats.producers, stats.consumers, stats.blocked
+	producing := stats.lastProduced.Sub(stats.start)
+	stats.mu.Unlock()
+	if served == 0 || service <= 0 || consumers < 1 || producing <= 0 {
+		return nil
+	}
+	q := &QueueAnalysis{
+		ServiceRate: float64(served) / service.Seconds(),
+		Consumers:   consumers,
+		Buffer:      buffer,
+		Served:      served,
+		sized:       served >= queueMinServed && producing >= queueMinTime,
+	}
+	// with a rate that is what they offered, even if they were held up
+	// giving it. Unlimited producers held up much of the time could have
+	// gone faster, by how much there's no telling.
+	switch held := blocked.Seconds() / (float64(max(1, producers)) * producing.Seconds()); {
+	case rate > 0:
+		q.ArrivalRate = rate
+	case held > 0.1:
+		q.Utilization = 1
+		q.Suggestions = append(q.Suggestions, fmt.Sprintf(
+			"the producers spent %.0f%% of their time waiting for room, so the consumers are the bottleneck with %s: add consumers, or set -rate to the rate expected for a sizing", 100*min(1, held), plural(consumers, "consumer")))
+		return q
+	default:
+		q.ArrivalRate = float64(produced) / producing.Seconds()
+	}
+	load := q.ArrivalRate / q.ServiceRate // consumers' worth of work
+	q.Utilization = load / float64(consumers)
+	need := int(math.Ceil(load / queueTarget))
+	if q.Utilization >= 1 {
+		q.Suggestions = append(q.Suggestions, fmt.Sprintf(
+			"add %s: the arrivals need %.0f%% of the consumers' capacity", plural(need-consumers, "consumer"), 100*q.Utilization))
+		return q
+	}
+	waiting := erlangC(consumers, load)
+	q.QueueLength = waiting * q.Utilization / (1 - q.Utilization)
+	q.Wait = time.Duration(q.QueueLength / q.ArrivalRate * float64(time.Second))
+	switch {
+	case q.Utilization > 0.85:
+		q.Suggestions = append(q.Suggestions, fmt.Sprintf(
+			"add %s to bring utilization down to %.0f%%", plural(need-consumers, "consumer"), 100*load/float64(need)))
+	case q.Utilization < 0.3 && need < consumers:
+		q.Suggestions = append(q.Suggestions, fmt.Sprintf(
+			"%s would do, these were only %.0f%% busy", plural(max(1, need), "consumer"), 100*q.Utilization))
+	}
+	// the buffer that the queue outgrows less than 1% of the time, from
+	// P(more than n waiting) = C * utilization^n
+	if want := int(math.Ceil(math.Log(0.01/waiting) / math.Log(q.Utilization))); waiting > 0.01 && want > buffer {
+		q.Suggestions = append(q.Suggestions, fmt.Sprintf(
+			"increase -buffer to %d so producers are held up less than 1%% of the time", want))
+	}
+	return q
+}
+
+// the probability that an item has to wait with c servers and the given
+// load in servers' worth of work, by the Erlang B recurrence, which doesn't
+// overflow the way the factorials would
+func erlangC(c int, load float64) float64 {
+	b := 1.0
+	for k := 1; k <= c; k++ {
+		b = load * b / (float64(k) + load*b)
+	}
+	rho := load / float64(c)
+	return b / (1 - rho*(1-b))
+}
+
+func (q *QueueAnalysis) printSummary(w io.Writer) {
+	if q.ArrivalRate > 0 {
+		fmt.Fprintf(w, "queueing: arrivals %.1f/sec, %.1f/sec per consumer, utilization %.0f%%",
+			q.ArrivalRate, q.ServiceRate, 100*q.Utilization)
+		if q.Utilization < 1 {
+			fmt.Fprintf(w, ", expect %.1f waiting for %s", q.QueueLength, q.Wait.Round(time.Microsecond))
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintf(w, "queueing: %.1f/sec per consumer, producers ahead of them\n", q.ServiceRate)
+	}
+	if !q.sized {
+		fmt.Fprintf(w, "queueing: no suggestions from %s, sizing takes %d over %s at least\n",
+			plural(int(q.Served), "item"), queueMinServed, queueMinTime)
+	}
+	for _, s := range q.Suggestions {
+		fmt.Fprintf(w, "suggestion: %s\n", s)
+	}
+}
+
+// n of a noun, which takes an s unless there's one
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
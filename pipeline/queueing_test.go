@@ -0,0 +1,40 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// a run's stats with served items handled by one consumer at 10ms each,
+// offered at 200/sec by producers that never waited
+func queueStats(served int) *Stats {
+	s := NewStats()
+	s.setWorkers(1, 1)
+	s.produced, s.served = int64(served), int64(served)
+	s.service = time.Duration(served) * 10 * time.Millisecond
+	s.lastProduced = s.start.Add(time.Duration(served) * 5 * time.Millisecond)
+	return s
+}
+
+func TestQueueSuggestionsNeedSamples(t *testing.T) {
+	if q := analyzeQueue(queueStats(40), 10, 0); q == nil || len(q.Suggestions) != 0 {
+		t.Fatalf("40 items gave %+v, expected an analysis without suggestions", q)
+	}
+	q := analyzeQueue(queueStats(400), 10, 0)
+	if q == nil || len(q.Suggestions) != 1 {
+		t.Fatalf("400 items gave %+v, expected a suggestion", q)
+	}
+	// twice the work one consumer can do needs three at the target
+	if want := "add 2 consumers:"; !strings.HasPrefix(q.Suggestions[0], want) {
+		t.Fatalf("suggested %q, expected it to start %q", q.Suggestions[0], want)
+	}
+}
+
+func TestPlural(t *testing.T) {
+	for n, want := range map[int]string{0: "0 consumers", 1: "1 consumer", 2: "2 consumers"} {
+		if got := plural(n, "consumer"); got != want {
+			t.Errorf("plural(%d) = %q, expected %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the ways the redis transport can use redis
+const (
+	redisList   = "list"   // LPUSH and BRPOP, each item delivered at most once
+	redisStream = "stream" // XADD and XREADGROUP, acked once handled
+)
+
+// redisTransport replaces the channel between the producers and the
+// consumers with a redis list or stream, so several processes can share one
+// queue: some can run only producers, some only consumers, or each a mix.
+// The producers still write to a local channel, which a pusher drains into
+// redis, and a popper moves items from redis to the consumers' channel, only
+// taking one when there's room so the backlog stays in redis. Items redis
+// won't take are pushed again with a backoff, and dead-lettered if it
+// still won't after redisPushTries.
+//
+// In stream mode the processes form a consumer group. Each item is acked
+// after it has been handled, and a process that restarts under the same
+// consumer name, set with -redis-consumer, is first given back the items it
+// had taken but not acked.
+//
+// The popper carries on until the local producers have finished and redis
+// has had nothing for it for the idle time, so a consumer-only process
+// should be given a long -redis-idle. A process started with no consumers
+// never takes items off the queue.
+//
+// When how many processes there are is known it is better to say so. Each
+// process then puts -redis-downstream end-of-stream markers on the queue
+// after its last item, one for every consuming process, and a process
+// with -redis-upstream set finishes as soon as it has had a marker from
+// that many processes. Since the queue only hands each marker to one
+// consumer, one that gets a second marker from the same process puts it
+// back for the others.
+type redisTransport struct {
+	key      string
+	mode     string
+	group    string
+	consumer string
+	idle     time.Duration
+
+	push, pop, ack *redisConn
+	stats          *Stats
+	// given back what items were charged once they are off the local queue
+	budget *byteBudget
+	// told of each item put on the consumers' channel, when set
+	queued func()
+	// closed once everything the producers wrote is in redis
+	flushed chan struct{}
+	// given the items that couldn't be pushed, when set
+	failed func([]Item, error)
+
+	downstream, upstream int
+	ended                map[string]bool // processes we have had a marker from
+}
+
+// how many times a batch is pushed before its items are given up on, and
+// the wait before the first retry, doubling after
+const (
+	redisPushTries   = 8
+	redisPushBackoff = 100 * time.Millisecond
+)
+
+// list entries with this prefix, and stream entries with an eos field,
+// are end-of-stream markers naming the process they came from
+const redisEOS = "eos:"
+
+func newRedisTransport(cfg *Config, stats *Stats) (*redisTransport, error) {
+	t := &redisTransport{
+		key:     cfg.RedisKey,
+		mode:    cfg.RedisMode,
+		group:   cfg.RedisGroup,
+		idle:    cfg.RedisIdle,
+		stats:   stats,
+		flushed: make(chan struct{}),
+
+		downstream: cfg.RedisDownstream,
+		upstream:   cfg.RedisUpstream,
+		ended:      make(map[string]bool),
+	}
+	if t.mode != redisList && t.mode != redisStream {
+		return nil, fmt.Errorf("unknown redis mode %q, expected list or stream", t.mode)
+	}
+	t.consumer = cfg.RedisConsumer
+	if t.consumer == "" {
+		host, _ := os.Hostname()
+		t.consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	var err error
+	for _, c := range []**redisConn{&t.push, &t.pop, &t.ack} {
+		if *c, err = dialRedis(cfg.Redis); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	if t.mode == redisStream {
+		_, err := t.push.do("XGROUP", "CREATE", t.key, t.group, "0", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			t.Close()
+			return nil, fmt.Errorf("creating redis consumer group: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// move items from the producers' channel into redis until it is closed
+func (t *redisTransport) pushAll(in <-chan Item) {
+	defer close(t.flushed)
+	for item := range in {
+		t.budget.release(item.size)
+		batch := []Item{item}
+	more:
+		for len(batch) < 100 {
+			select {
+			case item, ok := <-in:
+				if !ok {
+					break more
+				}
+				t.budget.release(item.size)
+				batch = append(batch, item)
+			default:
+				break more
+			}
+		}
+		t.pushBatch(batch)
+		// what is popped off the queue has payloads of its own
+		for i := range batch {
+			batch[i].releasePayload()
+		}
+	}
+	for i := 0; i < t.downstream; i++ {
+		if err := t.sendEnd(t.push, t.consumer); err != nil {
+			fmt.Printf("error sending end of stream to redis: %v\n", err)
+		}
+	}
+}
+
+// push a batch to redis, trying what didn't get there again with a backoff
+// while redis can't be reached, rather than losing it, and handing what
+// is still left after redisPushTries to failed
+func (t *redisTransport) pushBatch(batch []Item) {
+	backoff := redisPushBackoff
+	for try := 1; ; try++ {
+		n, err := t.send(batch)
+		if err == nil {
+			return
+		}
+		batch = batch[n:]
+		if try == redisPushTries {
+			fmt.Printf("error pushing to redis, giving up on %d items: %v\n", len(batch), err)
+			for range batch {
+				t.stats.recordError()
+			}
+			if t.failed != nil {
+				t.failed(batch, err)
+			}
+			return
+		}
+		fmt.Printf("error pushing to redis, trying %d items again in %s: %v\n", len(batch), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// queue an end-of-stream marker on behalf of a process
+func (t *redisTransport) sendEnd(c *redisConn, from string) error {
+	var err error
+	if t.mode == redisList {
+		_, err = c.do("LPUSH", t.key, redisEOS+from)
+	} else {
+		_, err = c.do("XADD", t.key, "*", "eos", from)
+	}
+	return err
+}
+
+// note a marker taken off the queue, passing it on if it's a repeat
+func (t *redisTransport) sawEnd(from string) {
+	if t.upstream == 0 {
+		return
+	}
+	if t.ended[from] {
+		if err := t.sendEnd(t.pop, from); err != nil {
+			fmt.Printf("error passing on end of stream: %v\n", err)
+		}
+		return
+	}
+	t.ended[from] = true
+	fmt.Printf("end of stream from %s, %d of %d\n", from, len(t.ended), t.upstream)
+}
+
+// put a batch on the queue, reporting how many of them got there: all or
+// none for a list, which takes them in one LPUSH, and those before the
+// one that failed for a stream
+func (t *redisTransport) send(batch []Item) (int, error) {
+	args := []string{"LPUSH", t.key}
+	for i, item := range batch {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return i, err
+		}
+		if t.mode == redisList {
+			args = append(args, string(b))
+			continue
+		}
+		if _, err := t.push.do("XADD", t.key, "*", "item", string(b)); err != nil {
+			return i, err
+		}
+	}
+	if t.mode == redisList {
+		if _, err := t.push.do(args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
+
+// move items from redis to the consumers' channel, closing it once the
+// producers have flushed and redis has run dry
+func (t *redisTransport) popAll(out chan<- Item) {
+	defer close(out)
+	var emptySince time.Time
+	// in stream mode, start with anything this consumer took but never
+	// acked, a page at a time from after the last entry of the one before,
+	// and then go on to new entries once a page comes back empty
+	from := ""
+	if t.mode == redisStream {
+		from = "0"
+	}
+	for {
+		items, last, err := t.fetch(from)
+		if err != nil {
+			fmt.Printf("error reading from redis: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if from != "" && from != ">" {
+			if last == "" {
+				from = ">"
+				continue
+			}
+			from = last
+		}
+		for _, item := range items {
+			out <- item
+			if t.queued != nil {
+				t.queued()
+			}
+		}
+		if t.upstream > 0 {
+			// everything the upstream processes sent came before their markers
+			if len(t.ended) >= t.upstream {
+				return
+			}
+			continue
+		}
+		if len(items) > 0 {
+			emptySince = time.Time{}
+			continue
+		}
+		select {
+		case <-t.flushed:
+		default:
+			continue
+		}
+		if emptySince.IsZero() {
+			emptySince = time.Now()
+		}
+		if time.Since(emptySince) >= t.idle {
+			return
+		}
+	}
+}
+
+// wait until the producers' items have all been pushed
+func (t *redisTransport) wait() {
+	<-t.flushed
+}
+
+// wait up to a second for items. In stream mode from is the entry to read
+// after, > for new ones, and the last entry read is returned with them,
+// even if it was a marker or skipped as bad.
+func (t *redisTransport) fetch(from string) ([]Item, string, error) {
+	if t.mode == redisList {
+		reply, err := t.pop.do("BRPOP", t.key, "1")
+		if err != nil || reply == nil {
+			return nil, "", err
+		}
+		kv, ok := reply.([]any)
+		if !ok || len(kv) != 2 {
+			return nil, "", fmt.Errorf("unexpected BRPOP reply %v", reply)
+		}
+		if from, ok := strings.CutPrefix(fmt.Sprint(kv[1]), redisEOS); ok {
+			t.sawEnd(from)
+			return nil, "", nil
+		}
+		var item Item
+		if err := json.Unmarshal([]byte(fmt.Sprint(kv[1])), &item); err != nil {
+			return nil, "", err
+		}
+		return []Item{item}, "", nil
+	}
+	reply, err := t.pop.do("XREADGROUP", "GROUP", t.group, t.consumer,
+		"COUNT", "100", "BLOCK", "1000", "STREAMS", t.key, from)
+	if err != nil || reply == nil {
+		return nil, "", err
+	}
+	last := ""
+	// [[key, [[id, [field, value, ...]], ...]]]
+	streams, _ := reply.([]any)
+	var items []Item
+	for _, s := range streams {
+		kv, _ := s.([]any)
+		if len(kv) != 2 {
+			continue
+		}
+		entries, _ := kv[1].([]any)
+		for _, e := range entries {
+			entry, _ := e.([]any)
+			if len(entry) > 0 {
+				last = fmt.Sprint(entry[0])
+			}
+			if len(entry) != 2 {
+				continue
+			}
+			id := fmt.Sprint(entry[0])
+			fields, _ := entry[1].([]any)
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fmt.Sprint(fields[i]) == "eos" {
+					t.sawEnd(fmt.Sprint(fields[i+1]))
+					t.acknowledge(id)
+					continue
+				}
+				if fmt.Sprint(fields[i]) != "item" {
+					continue
+				}
+				var item Item
+				if err := json.Unmarshal([]byte(fmt.Sprint(fields[i+1])), &item); err != nil {
+					fmt.Printf("skipping bad redis entry %s: %v\n", id, err)
+					t.acknowledge(id)
+					continue
+				}
+				item.ack = func() { t.acknowledge(id) }
+				items = append(items, item)
+			}
+		}
+	}
+	return items, last, nil
+}
+
+func (t *redisTransport) acknowledge(id string) {
+	if _, err := t.ack.do("XACK", t.key, t.group, id); err != nil {
+		fmt.Printf("error acking redis entry %s: %v\n", id, err)
+	}
+}
+
+func (t *redisTransport) Close() error {
+	for _, c := range []*redisConn{t.push, t.pop, t.ack} {
+		if c != nil {
+			c.conn.Close()
+		}
+	}
+	return nil
+}
+
+// redisConn is a minimal client for the redis protocol, just enough to
+// send commands and read the replies. Commands on one connection are
+// serialized, so blocking reads get a connection of their own.
+type redisConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// connect to redis://[:password@]host[:port][/db]
+func dialRedis(rawURL string) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" {
+		return nil, fmt.Errorf("bad redis url %q, expected redis://[:password@]host[:port][/db]", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if pw, ok := u.User.Password(); ok {
+		if _, err := c.do("AUTH", pw); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %v", err)
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := c.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select %s: %v", db, err)
+		}
+	}
+	return c, nil
+}
+
+// send a command and return its reply: a string, an int64, a []any, or
+// nil for a nil reply. Error replies come back as errors.
+func (c *redisConn) do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
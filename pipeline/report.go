@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Report is the end-of-run summary in a form that can be rendered for
+// people, either as Markdown (Slack, terminals) or as HTML (email).
+type Report struct {
+	Produced   int64
+	Consumed   int64
+	Errors     int64
+	Elapsed    time.Duration
+	Throughput float64 // consumed items/sec
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+	SLOs       []SLOResult
+	// the items produced and consumed in each second
+	Timeline *Timeline `json:",omitempty"`
+	// the commonest types of error, with the numbers in their messages
+	// taken out
+	ErrorTypes []ErrorCount `json:",omitempty"`
+	// errors by class, for those that have one
+	ErrorClasses map[ErrorClass]int64 `json:",omitempty"`
+	Queueing     *QueueAnalysis       `json:",omitempty"`
+	// the garbage collector's work over the whole process: collections,
+	// time the program was paused for them, and heap allocations
+	GCCycles uint32        `json:",omitempty"`
+	GCPause  time.Duration `json:",omitempty"`
+	Allocs   uint64        `json:",omitempty"`
+}
+
+// build the report for a finished run
+func newReport(stats *Stats, slos *sloTracker) Report {
+	stats.mu.Lock()
+	end := stats.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	r := Report{
+		Produced: stats.produced,
+		Consumed: stats.consumed,
+		Errors:   stats.errors,
+		Elapsed:  end.Sub(stats.start).Round(time.Millisecond),
+		P50:      stats.queue.quantile(0.50),
+		P90:      stats.queue.quantile(0.90),
+		P99:      stats.queue.quantile(0.99),
+		Max:      stats.queue.max,
+	}
+	if len(stats.classes) > 0 {
+		r.ErrorClasses = make(map[ErrorClass]int64, len(stats.classes))
+		for c, n := range stats.classes {
+			r.ErrorClasses[c] = n
+		}
+	}
+	r.Timeline = stats.timelineLocked()
+	if kinds := stats.errorKinds(); len(kinds) > 0 {
+		r.ErrorTypes = kinds[:min(10, len(kinds))]
+	}
+	stats.mu.Unlock()
+	if r.Elapsed > 0 {
+		r.Throughput = float64(r.Consumed) / r.Elapsed.Seconds()
+	}
+	if slos != nil {
+		r.SLOs = slos.results()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.GCCycles, r.GCPause, r.Allocs = ms.NumGC, time.Duration(ms.PauseTotalNs), ms.Mallocs
+	return r
+}
+
+// render the report as Markdown
+func (r Report) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*Producer/consumer run summary*\n\n")
+	fmt.Fprintf(&b, "| items produced | items consumed | errors | elapsed | throughput |\n")
+	fmt.Fprintf(&b, "|---|---|---|---|---|\n")
+	fmt.Fprintf(&b, "| %d | %d | %d | %s | %.1f/sec |\n\n",
+		r.Produced, r.Consumed, r.Errors, r.Elapsed, r.Throughput)
+	fmt.Fprintf(&b, "Queue latency: p50 %s, p90 %s, p99 %s, max %s\n", r.P50, r.P90, r.P99, r.Max)
+	if r.Timeline != nil {
+		fmt.Fprintf(&b, "Timeline: %s\n", r.Timeline)
+	}
+	if len(r.ErrorClasses) > 0 {
+		fmt.Fprintf(&b, "\nErrors by class: %s\n", formatClasses(r.ErrorClasses))
+	}
+	if len(r.ErrorTypes) > 0 {
+		b.WriteString("\nErrors by type:\n")
+		for _, e := range r.ErrorTypes {
+			fmt.Fprintf(&b, "- %d x `%s`\n", e.Count, e.Kind)
+		}
+	}
+	if q := r.Queueing; q != nil {
+		fmt.Fprintf(&b, "\nAs an M/M/c queue: %.1f arrivals/sec, %.1f/sec per consumer, %d consumers at %.0f%% utilization\n",
+			q.ArrivalRate, q.ServiceRate, q.Consumers, 100*q.Utilization)
+		for _, s := range q.Suggestions {
+			fmt.Fprintf(&b, "- %s\n", s)
+		}
+	}
+	if len(r.SLOs) > 0 {
+		b.WriteString("\n")
+		for _, s := range r.SLOs {
+			fmt.Fprintf(&b, "- SLO `%s`: %s (observed %s, %.1f%% of %d windows)\n",
+				s.Name, s.Verdict(), s.Observed, s.Attainment, s.Windows)
+		}
+	}
+	return b.String()
+}
+
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"mul100": func(f float64) float64 { return 100 * f },
+}).Parse(`<html><body>
+<h2>Producer/consumer run summary</h2>
+<table border="1" cellpadding="4">
+<tr><th>items produced</th><th>items consumed</th><th>errors</th><th>elapsed</th><th>throughput</th></tr>
+<tr><td>{{.Produced}}</td><td>{{.Consumed}}</td><td>{{.Errors}}</td><td>{{.Elapsed}}</td><td>{{printf "%.1f" .Throughput}}/sec</td></tr>
+</table>
+<p>Queue latency: p50 {{.P50}}, p90 {{.P90}}, p99 {{.P99}}, max {{.Max}}</p>
+{{with .Timeline}}<p>Timeline: {{.}}</p>{{end}}
+{{if .ErrorTypes}}<p>Errors by type:</p>
+<ul>
+{{range .ErrorTypes}}<li>{{.Count}} x <code>{{.Kind}}</code></li>
+{{end}}</ul>{{end}}
+{{with .Queueing}}<p>As an M/M/c queue: {{printf "%.1f" .ArrivalRate}} arrivals/sec, {{printf "%.1f" .ServiceRate}}/sec per consumer, {{.Consumers}} consumers at {{printf "%.0f%%" (mul100 .Utilization)}} utilization</p>
+{{if .Suggestions}}<ul>
+{{range .Suggestions}}<li>{{.}}</li>
+{{end}}</ul>{{end}}{{end}}
+{{if .SLOs}}<ul>
+{{range .SLOs}}<li>SLO <code>{{.Name}}</code>: {{.Verdict}} (observed {{.Observed}}, {{printf "%.1f" .Attainment}}% of {{.Windows}} windows)</li>
+{{end}}</ul>{{end}}
+</body></html>
+`))
+
+// render the report as an HTML document
+func (r Report) HTML() (string, error) {
+	var buf bytes.Buffer
+	if err := reportHTML.Execute(&buf, r); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// write the report to a file, picking the format from the extension. The
+// json form is what bench compare reads back, and a .csv file has just
+// the timeline.
+func writeReport(path string, r Report) error {
+	text := r.Markdown()
+	switch {
+	case strings.HasSuffix(path, ".csv"):
+		var b strings.Builder
+		if r.Timeline != nil {
+			r.Timeline.writeCSV(&b)
+		}
+		text = b.String()
+	case strings.HasSuffix(path, ".html"):
+		var err error
+		if text, err = r.HTML(); err != nil {
+			return err
+		}
+	case strings.HasSuffix(path, ".json"):
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	return os.WriteFile(path, []byte(text), 0644)
+}
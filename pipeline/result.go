@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"slices"
+	"time"
+)
+
+// Result is what handling an item came to, which goes on to the sink with
+// it. A handler sets Status, a word such as "valid" or "suspect", and
+// Fields it derived from the item, by putting a Result on the item it
+// returns, or for an exec plugin by answering {"result":{...}}. With
+// -provenance each handling of the item adds a Provenance entry, so the
+// sink's records say what touched them, including in a pipeline before
+// this one that handed the item on through a file or a transport.
+type Result struct {
+	Status     string         `json:"Status,omitempty"`
+	Fields     map[string]any `json:"Fields,omitempty"`
+	Provenance []Provenance   `json:"Provenance,omitempty"`
+}
+
+// Provenance is one handling of an item
+type Provenance struct {
+	Pipeline  string    `json:"Pipeline"`
+	Handler   string    `json:"Handler"`
+	Consumer  int       `json:"Consumer"`
+	HandledAt time.Time `json:"HandledAt"`
+	Took      string    `json:"Took"`
+	Attempts  int       `json:"Attempts"`
+}
+
+// carry the result of the item handled, from, over to what handling made of
+// it, out, unless the handler gave out a result of its own, and stamp it
+// with this handling when -provenance is on
+func (p *Pipeline) passResult(out *Item, from *Item, myId int, started time.Time, attempts int) {
+	switch {
+	case out.Result == nil && from.Result != nil:
+		r := *from.Result
+		out.Result = &r
+	case out.Result != nil:
+		// pieces of a split item may share one result
+		r := *out.Result
+		if len(r.Provenance) == 0 && from.Result != nil {
+			r.Provenance = from.Result.Provenance
+		}
+		out.Result = &r
+	}
+	if !p.cfg.Provenance {
+		return
+	}
+	if out.Result == nil {
+		out.Result = &Result{}
+	}
+	out.Result.Provenance = append(slices.Clip(out.Result.Provenance), Provenance{
+		Pipeline:  p.name,
+		Handler:   p.cfg.Handler,
+		Consumer:  myId,
+		HandledAt: started,
+		Took:      time.Since(started).String(),
+		Attempts:  attempts,
+	})
+}
@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the pool that items go to when no routing rule matches them
+const defaultPool = "default"
+
+// route sends the items matching cond to a named consumer pool
+type route struct {
+	pool string
+	cond *expr
+}
+
+// parse a -route flag of the form <pool>:<expression>, e.g.
+// fast:Metadata.Priority == "high"
+func parseRoute(s string) (route, error) {
+	pool, src, ok := strings.Cut(s, ":")
+	pool = strings.TrimSpace(pool)
+	if !ok || pool == "" {
+		return route{}, fmt.Errorf("route %q: expected <pool>:<expression>", s)
+	}
+	cond, err := compileExpr(src)
+	if err != nil {
+		return route{}, fmt.Errorf("route %q: %v", s, err)
+	}
+	return route{pool: pool, cond: cond}, nil
+}
+
+// parse a -pool flag of the form <pool>=<consumers>
+func parsePoolSize(s string) (string, int, error) {
+	name, n, ok := strings.Cut(s, "=")
+	size, err := strconv.Atoi(n)
+	if !ok || name == "" || err != nil || size < 1 {
+		return "", 0, fmt.Errorf("pool %q: expected <pool>=<consumers>", s)
+	}
+	return name, size, nil
+}
+
+// consumerPool is a set of consumers with a channel of their own, fed by
+// the routing rules that name it. The default pool is the pipeline's own
+// channels and consumers, which the admin API scales.
+type consumerPool struct {
+	name      string
+	size      int
+	channel   chan Item
+	consumers map[int]*worker
+}
+
+// build the routing rules and the extra consumer pools they send to.
+// Rules are tried in order and the first match wins.
+func (p *Pipeline) setupRoutes(cfg *Config) error {
+	sizes := make(map[string]int)
+	for _, s := range cfg.Pools {
+		name, size, err := parsePoolSize(s)
+		if err != nil {
+			return err
+		}
+		sizes[name] = size
+	}
+	p.pools = make(map[string]*consumerPool)
+	for _, s := range cfg.Routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return err
+		}
+		p.routes = append(p.routes, r)
+		if r.pool == defaultPool || p.pools[r.pool] != nil {
+			continue
+		}
+		size := sizes[r.pool]
+		if size == 0 {
+			size = 1
+		}
+		p.pools[r.pool] = &consumerPool{
+			name:      r.pool,
+			size:      size,
+			channel:   make(chan Item, cfg.BufferSize),
+			consumers: make(map[int]*worker),
+		}
+	}
+	for name := range sizes {
+		if name != defaultPool && p.pools[name] == nil {
+			return fmt.Errorf("pool %q has no -route sending to it", name)
+		}
+	}
+	return nil
+}
+
+// what a buffer is called, for saying where an item is
+// name a buffer, called with p.bufMu held
+func (p *Pipeline) bufferName(ch chan Item) string {
+	if ch == p.input && p.input != p.channel {
+		return "redis outbox"
+	}
+	for _, pool := range p.pools {
+		if ch == pool.channel {
+			return "buffer of pool " + pool.name
+		}
+	}
+	if p.shards != nil {
+		return fmt.Sprintf("buffer shard %d", p.shards.index(ch))
+	}
+	if q := p.fair.queueOf(ch); q != nil {
+		return "buffer topic " + q.name()
+	}
+	return "buffer"
+}
+
+// pick the channel an item should go to, counting a hit for the pool it
+// was routed to. An item whose rule can't be evaluated goes to the default
+// pool rather than being lost.
+func (p *Pipeline) route(item *Item) chan Item {
+	if len(p.routes) == 0 {
+		return p.routeDefault(item)
+	}
+	for _, r := range p.routes {
+		ok, err := r.cond.match(item)
+		if err != nil {
+			p.stats.errorf("error evaluating route to %s: %v", r.pool, err)
+			break
+		}
+		if ok {
+			if r.pool == defaultPool {
+				return p.routeDefault(item)
+			}
+			p.stats.recordRoute(r.pool)
+			return p.pools[r.pool].channel
+		}
+	}
+	return p.routeDefault(item)
+}
+
+// the default pool's channel, or the canary's for its share of the items
+func (p *Pipeline) routeDefault(item *Item) chan Item {
+	if p.canary.pick(item) {
+		p.stats.recordRoute(canaryPool)
+		return p.pools[canaryPool].channel
+	}
+	if len(p.routes) > 0 || p.canary != nil {
+		p.stats.recordRoute(defaultPool)
+	}
+	if p.shards != nil {
+		return p.shards.pick(item, p.source != nil)
+	}
+	if p.fair != nil {
+		return p.fair.pick(item)
+	}
+	p.bufMu.RLock()
+	defer p.bufMu.RUnlock()
+	return p.input
+}
+
+// start the consumers of every routed pool, called with p.mu held
+func (p *Pipeline) startPools() {
+	for _, pool := range p.pools {
+		ch := pool.channel
+		p.resize(pool.consumers, pool.size, &p.nextConsumerID, "consumer",
+			func(id int, stop <-chan struct{}) { p.consume(ch, id, stop) })
+	}
+}
+
+// whether any consumer, in any pool, is still running. Called with p.mu
+// held.
+func (p *Pipeline) consuming() bool {
+	if len(p.consumers) > 0 {
+		return true
+	}
+	for _, pool := range p.pools {
+		if len(pool.consumers) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// the metadata key a request's correlation ID goes in
+const correlationKey = "correlation_id"
+
+// Requester uses a pipeline as a work queue inside an application, sending
+// items through it as requests and waiting for each one's reply, with at
+// most a set number in flight at a time and no longer than a timeout to
+// wait. Each request has a correlation ID, in its metadata as
+// correlation_id, which the handler sees and the reply and any error
+// carry, so the two can be matched up in logs and dead letters.
+type Requester struct {
+	p       *Pipeline
+	timeout time.Duration
+	slots   chan struct{}
+	next    atomic.Uint64
+	prefix  string
+
+	// requests sent, and calls that timed out waiting for a slot or a reply
+	sent, timedOut atomic.Int64
+}
+
+// Reply is what the pipeline made of a request
+type Reply struct {
+	CorrelationID string
+	Items         []Item
+}
+
+// NewRequester has up to maxInFlight requests at a time go through the
+// pipeline, each waiting up to timeout for its reply, or as long as its
+// context allows with no timeout
+func (p *Pipeline) NewRequester(maxInFlight int, timeout time.Duration) (*Requester, error) {
+	if maxInFlight < 1 {
+		return nil, fmt.Errorf("a requester needs room for at least 1 request in flight")
+	}
+	return &Requester{
+		p:       p,
+		timeout: timeout,
+		slots:   make(chan struct{}, maxInFlight),
+		prefix:  strconv.FormatInt(time.Now().UnixNano(), 36) + "-",
+	}, nil
+}
+
+// Call sends an item through the pipeline as a request and waits for its
+// reply. It waits for a slot first when as many requests as allowed are
+// in flight. The item keeps a correlation_id it already has, and is
+// otherwise given one. The error is one the item failed with, as
+// Pending's Result has it, or ErrRequestTimeout. A request given up on
+// stays in the pipeline to be handled all the same, though nobody hears
+// what became of it, and it no longer takes up a slot.
+func (r *Requester) Call(ctx context.Context, item Item) (Reply, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	id := item.Metadata[correlationKey]
+	if id == "" {
+		id = r.prefix + strconv.FormatUint(r.next.Add(1), 10)
+		// leaving the caller's metadata alone
+		md := maps.Clone(item.Metadata)
+		if md == nil {
+			md = make(map[string]string, 1)
+		}
+		md[correlationKey] = id
+		item.Metadata = md
+	}
+	reply := Reply{CorrelationID: id}
+	select {
+	case r.slots <- struct{}{}:
+	case <-ctx.Done():
+		return reply, r.gaveUp(id, "waiting for a slot", ctx.Err())
+	}
+	defer func() { <-r.slots }()
+	r.sent.Add(1)
+	pd, err := r.p.Submit(ctx, item)
+	if err != nil {
+		return reply, fmt.Errorf("request %s: %w", id, err)
+	}
+	select {
+	case <-pd.Done():
+	case <-ctx.Done():
+		return reply, r.gaveUp(id, "waiting for its reply", ctx.Err())
+	}
+	reply.Items, err = pd.Result()
+	if err != nil {
+		return reply, fmt.Errorf("request %s: %w", id, err)
+	}
+	return reply, nil
+}
+
+// the error for a request whose context ended first, which is a timeout
+// when that's what ended it
+func (r *Requester) gaveUp(id, while string, err error) error {
+	if err == context.DeadlineExceeded {
+		r.timedOut.Add(1)
+		return fmt.Errorf("request %s: %w %s", id, ErrRequestTimeout, while)
+	}
+	return fmt.Errorf("request %s: gave up %s: %w", id, while, err)
+}
+
+// InFlight is how many requests are waiting for their replies
+func (r *Requester) InFlight() int {
+	return len(r.slots)
+}
+
+// Counts are the requests sent and the calls that timed out, whether
+// waiting for a slot or for the reply
+func (r *Requester) Counts() (sent, timedOut int64) {
+	return r.sent.Load(), r.timedOut.Load()
+}
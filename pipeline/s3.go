@@ -0,0 +1,494 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the smallest part S3 accepts in a multipart upload, other than the last
+const s3MinPart = 5 << 20
+
+// s3Sink batches items into objects in an S3 compatible bucket, given as
+// s3:<bucket>. Each object holds items in the -sink-format format, json
+// lines or parquet, and a new one is started once the current one reaches
+// -s3-object-size or has been open for -s3-flush-interval. Objects no
+// bigger than a part are sent with a single PUT; bigger ones go up as a
+// multipart upload whose parts are sent as they fill, so memory use is
+// bounded by the part size rather than the object size.
+//
+// An object isn't in the bucket until it is completed, so the pipeline
+// puts the sink behind a write-behind buffer, see bufferS3, and its items
+// are only settled once Sync has completed the object they went into. A
+// failed upload fails the whole batch, whose items are then retried or
+// dead-lettered like any other failed write.
+//
+// Object keys come from the -s3-key template, which is given the run ID,
+// the time the object was started, its sequence number in the run and the
+// file extension for the format. Credentials are read from the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// variables, and requests are signed with AWS signature version 4, which
+// MinIO and the other S3 lookalikes understand too.
+type s3Sink struct {
+	client   *s3Client
+	format   string
+	keys     *template.Template
+	runID    string
+	partSize int
+	maxSize  int64
+	interval time.Duration
+
+	mu      sync.Mutex
+	seq     int
+	key     string // key of the object being built, empty if none
+	started time.Time
+	enc     itemEncoder
+	buf     bytes.Buffer // encoded but not yet uploaded
+	sent    int64        // bytes of the object already uploaded as parts
+	upload  string       // multipart upload ID, once one has been started
+	parts   []s3Part
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// what the key template is executed with
+type s3KeyData struct {
+	RunID string
+	Time  time.Time
+	Seq   int
+	Ext   string
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func newS3Sink(bucket string, cfg *Config) (*s3Sink, error) {
+	keys, err := template.New("s3-key").Parse(cfg.S3Key)
+	if err != nil {
+		return nil, fmt.Errorf("-s3-key: %v", err)
+	}
+	client, err := newS3Client(bucket, cfg.S3Endpoint, cfg.S3Region)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newItemEncoder(cfg.SinkFormat, io.Discard); err != nil {
+		return nil, err
+	}
+	s := &s3Sink{
+		client:   client,
+		format:   cfg.SinkFormat,
+		keys:     keys,
+		runID:    cfg.RunID,
+		partSize: max(cfg.S3PartSize, s3MinPart),
+		maxSize:  cfg.S3ObjectSize,
+		interval: cfg.S3FlushInterval,
+		done:     make(chan struct{}),
+	}
+	if s.interval > 0 {
+		s.wg.Add(1)
+		go s.flushOld()
+	}
+	return s, nil
+}
+
+// add an item to the object being built. It is only in memory, or in a
+// part of an upload that isn't complete, until Sync; an upload that fails
+// takes the object's earlier items with it.
+func (s *s3Sink) Write(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(item)
+}
+
+// write the items, failing them all if an upload fails, as that throws
+// away what the object had of the ones before
+func (s *s3Sink) WriteBatch(items []Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range items {
+		if err := s.write(&items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// called with s.mu held
+func (s *s3Sink) write(item *Item) error {
+	if s.key == "" {
+		if err := s.begin(); err != nil {
+			return err
+		}
+	}
+	if err := s.enc.Encode(item); err != nil {
+		return err
+	}
+	if s.buf.Len() >= s.partSize {
+		if err := s.uploadPart(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.sent+int64(s.buf.Len()) >= s.maxSize {
+		return s.finish()
+	}
+	return nil
+}
+
+// start a new object, called with s.mu held
+func (s *s3Sink) begin() error {
+	s.seq++
+	s.started = time.Now()
+	var key strings.Builder
+	data := s3KeyData{RunID: s.runID, Time: s.started.UTC(), Seq: s.seq, Ext: s.format}
+	if err := s.keys.Execute(&key, data); err != nil {
+		return fmt.Errorf("-s3-key: %v", err)
+	}
+	s.key = key.String()
+	s.enc, _ = newItemEncoder(s.format, &s.buf)
+	return nil
+}
+
+// send the buffer as the next part, starting the multipart upload first if
+// this is the first one
+func (s *s3Sink) uploadPart() error {
+	if s.upload == "" {
+		id, err := s.client.createUpload(s.key)
+		if err != nil {
+			return err
+		}
+		s.upload = id
+	}
+	n := len(s.parts) + 1
+	etag, err := s.client.uploadPart(s.key, s.upload, n, s.buf.Bytes())
+	if err != nil {
+		s.abort()
+		return err
+	}
+	s.parts = append(s.parts, s3Part{PartNumber: n, ETag: etag})
+	s.sent += int64(s.buf.Len())
+	s.buf.Reset()
+	return nil
+}
+
+// complete the current object, called with s.mu held
+func (s *s3Sink) finish() error {
+	if s.key == "" {
+		return nil
+	}
+	err := s.enc.Close()
+	switch {
+	case err != nil:
+	case s.upload == "":
+		err = s.client.put(s.key, s.buf.Bytes())
+	case s.buf.Len() > 0:
+		if err = s.uploadPart(); err == nil {
+			err = s.client.completeUpload(s.key, s.upload, s.parts)
+		}
+	default:
+		err = s.client.completeUpload(s.key, s.upload, s.parts)
+	}
+	if err != nil && s.upload != "" {
+		s.abort()
+	}
+	s.reset()
+	return err
+}
+
+// give up on a multipart upload so its parts don't linger in the bucket
+func (s *s3Sink) abort() {
+	if err := s.client.abortUpload(s.key, s.upload); err != nil {
+		fmt.Printf("error aborting upload of %s: %v\n", s.key, err)
+	}
+	s.reset()
+}
+
+func (s *s3Sink) reset() {
+	s.key, s.upload, s.parts, s.sent, s.enc = "", "", nil, 0, nil
+	s.buf.Reset()
+}
+
+// how many items an s3 sink's write-behind buffer holds before it completes
+// the object they are in, when -write-behind doesn't say
+const s3BehindItems = 100000
+
+// put the s3 sinks -write-behind doesn't buffer already behind buffers of
+// their own, flushed every -s3-flush-interval, so their items are held back
+// from settling until the objects they went into are complete
+func (p *Pipeline) bufferS3(cfg *Config) error {
+	every := cfg.S3FlushInterval
+	if every <= 0 {
+		every = defaultWriteBehindEvery
+	}
+	wrap := func(name string, sink Sink) (Sink, error) {
+		if cfg.Batch != "" {
+			return nil, fmt.Errorf("-batch doesn't work with the s3 sink %s, which batches its items into objects and holds them until each is complete", name)
+		}
+		w := &writeBehind{p: p, name: name, sink: sink, max: s3BehindItems, every: every, done: make(chan struct{})}
+		p.behind = append(p.behind, w)
+		w.wg.Add(1)
+		go w.tick()
+		return w, nil
+	}
+	var err error
+	if p.routed != nil {
+		for name, rs := range p.routed.sinks {
+			if _, ok := rs.Sink.(*s3Sink); ok {
+				if rs.Sink, err = wrap(name, rs.Sink); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if _, ok := p.sink.(*s3Sink); ok {
+		p.sink, err = wrap(defaultSink, p.sink)
+	}
+	return err
+}
+
+// complete objects that have been open for longer than the flush interval
+func (s *s3Sink) flushOld() {
+	defer s.wg.Done()
+	t := time.NewTicker(max(s.interval/10, 100*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			if s.key != "" && time.Since(s.started) >= s.interval {
+				if err := s.finish(); err != nil {
+					fmt.Printf("error flushing to s3: %v\n", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// complete the object being built, so everything written so far is in the
+// bucket
+func (s *s3Sink) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish()
+}
+
+// upload whatever is left
+func (s *s3Sink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish()
+}
+
+// s3Client makes signed requests against one bucket
+type s3Client struct {
+	base      *url.URL // the bucket's url, objects are below it
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	http      *http.Client
+}
+
+// without an endpoint the bucket is addressed AWS style as a subdomain,
+// with one it goes in the path, which is what self-hosted stores expect
+func newS3Client(bucket, endpoint, region string) (*s3Client, error) {
+	c := &s3Client{
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		http:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("s3 sink needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	raw := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, region)
+	if endpoint != "" {
+		raw = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/"
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("bad s3 endpoint: %v", err)
+	}
+	c.base = u
+	return c, nil
+}
+
+func (c *s3Client) put(key string, body []byte) error {
+	_, err := c.do(http.MethodPut, key, nil, body)
+	return err
+}
+
+func (c *s3Client) createUpload(key string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.body, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("s3: bad CreateMultipartUpload response for %s", key)
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(key, upload string, n int, body []byte) (string, error) {
+	q := url.Values{"partNumber": {fmt.Sprint(n)}, "uploadId": {upload}}
+	resp, err := c.do(http.MethodPut, key, q, body)
+	if err != nil {
+		return "", err
+	}
+	return resp.header.Get("ETag"), nil
+}
+
+func (c *s3Client) completeUpload(key, upload string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {upload}}, body)
+	if err != nil {
+		return err
+	}
+	// a failed completion can still come back as a 200 with an error body
+	if bytes.Contains(resp.body, []byte("<Error>")) {
+		return fmt.Errorf("s3: completing upload of %s: %s", key, resp.body)
+	}
+	return nil
+}
+
+func (c *s3Client) abortUpload(key, upload string) error {
+	_, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {upload}}, nil)
+	return err
+}
+
+type s3Response struct {
+	header http.Header
+	body   []byte
+}
+
+func (c *s3Client) do(method, key string, query url.Values, body []byte) (*s3Response, error) {
+	u := *c.base
+	u.Path += key
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "uploads=", "uploads")
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(data))
+	}
+	return &s3Response{header: resp.Header, body: data}, nil
+}
+
+// add an AWS signature version 4 Authorization header to a request
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	// the query has to be sorted and strictly percent encoded, and a bare
+	// key like ?uploads signs as uploads=
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonQuery = append(canonQuery, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonQuery, "&"),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signed, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// percent encode everything but the unreserved characters, as AWS wants
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
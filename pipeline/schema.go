@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Schema describes one version of an item payload. Validate, when set,
+// checks that a payload really is of this version.
+type Schema struct {
+	Name     string
+	Version  int
+	Validate func(payload json.RawMessage) error
+}
+
+// Migration upgrades a payload from one schema version to the next
+type Migration func(payload json.RawMessage) (json.RawMessage, error)
+
+// SchemaRegistry knows every version of every payload schema and how to
+// move a payload from one version to the next. Producers stamp items with
+// the schema name and version they wrote, and consumers call Upgrade to
+// bring each payload up to the latest version before handling it.
+type SchemaRegistry struct {
+	mu         sync.RWMutex
+	schemas    map[string]map[int]Schema
+	migrations map[string]map[int]Migration // keyed by the version migrated from
+	latest     map[string]int
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		schemas:    make(map[string]map[int]Schema),
+		migrations: make(map[string]map[int]Migration),
+		latest:     make(map[string]int),
+	}
+}
+
+func (r *SchemaRegistry) Register(s Schema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemas[s.Name] == nil {
+		r.schemas[s.Name] = make(map[int]Schema)
+	}
+	r.schemas[s.Name][s.Version] = s
+	if s.Version > r.latest[s.Name] {
+		r.latest[s.Name] = s.Version
+	}
+}
+
+// register the migration from version from to version from+1 of a schema
+func (r *SchemaRegistry) RegisterMigration(name string, from int, m Migration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.migrations[name] == nil {
+		r.migrations[name] = make(map[int]Migration)
+	}
+	r.migrations[name][from] = m
+}
+
+// validate an item's payload against the schema it declares and migrate it
+// one version at a time up to the latest. Items that don't declare a schema
+// are left alone. The error explains exactly what didn't line up, since it
+// ends up as the reason on the item's dead letter.
+func (r *SchemaRegistry) Upgrade(item *Item) error {
+	if item.Schema == "" {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions, ok := r.schemas[item.Schema]
+	if !ok {
+		return fmt.Errorf("unknown schema %q", item.Schema)
+	}
+	latest := r.latest[item.Schema]
+	if item.SchemaVersion > latest {
+		return fmt.Errorf("schema %s v%d is newer than the latest known v%d",
+			item.Schema, item.SchemaVersion, latest)
+	}
+	s, ok := versions[item.SchemaVersion]
+	if !ok {
+		return fmt.Errorf("schema %s has no version %d", item.Schema, item.SchemaVersion)
+	}
+	if s.Validate != nil {
+		if err := s.Validate(item.Payload); err != nil {
+			return fmt.Errorf("payload is not valid %s v%d: %v", item.Schema, item.SchemaVersion, err)
+		}
+	}
+	for item.SchemaVersion < latest {
+		m, ok := r.migrations[item.Schema][item.SchemaVersion]
+		if !ok {
+			return fmt.Errorf("no migration for schema %s from v%d to v%d",
+				item.Schema, item.SchemaVersion, item.SchemaVersion+1)
+		}
+		payload, err := m(item.Payload)
+		if err != nil {
+			return fmt.Errorf("migrating %s v%d to v%d: %v",
+				item.Schema, item.SchemaVersion, item.SchemaVersion+1, err)
+		}
+		item.Payload = payload
+		item.SchemaVersion++
+	}
+	return nil
+}
+
+// the "reading" schema used by the built-in producers when -schema-version
+// is set. Version 1 is a bare celsius temperature, version 2 spells out both
+// units.
+type readingV1 struct {
+	Temp *float64 `json:"temp"`
+}
+
+type readingV2 struct {
+	TempC *float64 `json:"temp_c"`
+	TempF *float64 `json:"temp_f"`
+}
+
+func registerBuiltinSchemas(r *SchemaRegistry) {
+	r.Register(Schema{Name: "reading", Version: 1, Validate: func(p json.RawMessage) error {
+		var v readingV1
+		if err := json.Unmarshal(p, &v); err != nil {
+			return err
+		}
+		if v.Temp == nil {
+			return fmt.Errorf("missing temp")
+		}
+		return nil
+	}})
+	r.Register(Schema{Name: "reading", Version: 2, Validate: func(p json.RawMessage) error {
+		var v readingV2
+		if err := json.Unmarshal(p, &v); err != nil {
+			return err
+		}
+		if v.TempC == nil || v.TempF == nil {
+			return fmt.Errorf("missing temp_c or temp_f")
+		}
+		return nil
+	}})
+	r.RegisterMigration("reading", 1, func(p json.RawMessage) (json.RawMessage, error) {
+		var v1 readingV1
+		if err := json.Unmarshal(p, &v1); err != nil {
+			return nil, err
+		}
+		f := *v1.Temp*9/5 + 32
+		return json.Marshal(readingV2{TempC: v1.Temp, TempF: &f})
+	})
+}
+
+// build a "reading" payload of the given version for a random item
+func samplePayload(version int, value int) json.RawMessage {
+	temp := float64(value) / 2
+	var v any = readingV1{Temp: &temp}
+	if version >= 2 {
+		f := temp*9/5 + 32
+		v = readingV2{TempC: &temp, TempF: &f}
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
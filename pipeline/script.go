@@ -0,0 +1,1562 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scriptHandler runs a handler written in a small subset of Starlark, the
+// Python dialect used by Bazel, so handling logic can be changed without
+// recompiling. The script must define a handle function:
+//
+//	def handle(item):
+//	    if item["Id"] > 50:
+//	        item["Metadata"] = {"size": "big"}
+//	    elif item["ProducerId"] == 2:
+//	        fail("producer 2 is not allowed")
+//	    return item
+//
+// The item is a dict keyed by its json field names. The return value
+// decides what happens to it:
+//
+//	None, True or "ack"     the item, including any edits made to it, goes on
+//	a dict                  the dict replaces the item
+//	a list of dicts         each dict becomes an item, so [] drops the item
+//	False or "nack"         the item fails
+//	fail(msg)               the item fails with msg as the error
+//
+// Supported are def, if/elif/else, for, return, pass, assignment (including
+// +=), the usual operators, dict and list literals, and the builtins len,
+// str, int, float, print and fail, along with the common string, dict and
+// list methods. Numbers are all floats. As in Starlark, globals are frozen
+// once the script has loaded, which is what makes it safe for every consumer
+// to call handle at once.
+type scriptHandler struct {
+	path   string
+	handle *starFunc
+}
+
+func newScriptHandler(path string) (*scriptHandler, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := parseStar(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	globals := &starEnv{vars: map[string]any{}}
+	if _, _, err := execBlock(prog, globals); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, v := range globals.vars {
+		freeze(v)
+	}
+	fn, ok := globals.vars["handle"].(*starFunc)
+	if !ok || len(fn.params) != 1 {
+		return nil, fmt.Errorf("%s: script must define handle(item)", path)
+	}
+	return &scriptHandler{path: path, handle: fn}, nil
+}
+
+func (h *scriptHandler) Handle(item *Item) (*Item, error) {
+	d, err := itemToStar(item)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.handle.call(nil, []any{d})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", h.path, err)
+	}
+	if _, ok := result.(*starList); ok {
+		return nil, fmt.Errorf("%s: handle returned a list, which only works as a splitter", h.path)
+	}
+	return h.result(d, result)
+}
+
+// run handle, allowing it to return a list of items
+func (h *scriptHandler) Split(item *Item) ([]Item, error) {
+	d, err := itemToStar(item)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.handle.call(nil, []any{d})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", h.path, err)
+	}
+	l, ok := result.(*starList)
+	if !ok {
+		one, err := h.result(d, result)
+		if err != nil {
+			return nil, err
+		}
+		return []Item{*one}, nil
+	}
+	items := make([]Item, 0, len(l.elems))
+	for _, e := range l.elems {
+		ed, ok := e.(*starDict)
+		if !ok {
+			return nil, fmt.Errorf("%s: handle returned a list holding %s, expected dicts", h.path, starType(e))
+		}
+		one, err := starToItem(ed)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *one)
+	}
+	return items, nil
+}
+
+// turn what handle returned into the resulting item, d being the item
+// it was given
+func (h *scriptHandler) result(d *starDict, result any) (*Item, error) {
+	switch r := result.(type) {
+	case nil:
+	case bool:
+		if !r {
+			return nil, errors.New("nacked by script")
+		}
+	case string:
+		if r == "nack" {
+			return nil, errors.New("nacked by script")
+		}
+		if r != "ack" {
+			return nil, fmt.Errorf("%s: handle returned unknown result %q", h.path, r)
+		}
+	case *starDict:
+		d = r
+	default:
+		return nil, fmt.Errorf("%s: handle returned %s", h.path, starType(result))
+	}
+	return starToItem(d)
+}
+
+// convert an item to a dict by way of its json encoding, so every item
+// field is visible to the script under the same name plugins see
+func itemToStar(item *Item) (*starDict, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	var m any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return fromJSON(m).(*starDict), nil
+}
+
+func starToItem(d *starDict) (*Item, error) {
+	m := toJSON(d).(map[string]any)
+	// metadata values have to be strings, so anything else the script put
+	// there is stored in its str() form
+	if meta, ok := d.m["Metadata"].(*starDict); ok {
+		strs := make(map[string]string, len(meta.keys))
+		for _, k := range meta.keys {
+			strs[k] = starStr(meta.m[k])
+		}
+		m["Metadata"] = strs
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, fmt.Errorf("script result is not an item: %v", err)
+	}
+	return &item, nil
+}
+
+func fromJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		d := newStarDict()
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			d.set(k, fromJSON(v[k]))
+		}
+		return d
+	case []any:
+		l := &starList{}
+		for _, e := range v {
+			l.elems = append(l.elems, fromJSON(e))
+		}
+		return l
+	}
+	return v
+}
+
+func toJSON(v any) any {
+	switch v := v.(type) {
+	case *starDict:
+		m := make(map[string]any, len(v.keys))
+		for _, k := range v.keys {
+			m[k] = toJSON(v.m[k])
+		}
+		return m
+	case *starList:
+		out := make([]any, len(v.elems))
+		for i, e := range v.elems {
+			out[i] = toJSON(e)
+		}
+		return out
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return int64(v)
+		}
+	}
+	return v
+}
+
+// the runtime values, besides nil, bool, float64 and string
+
+type starDict struct {
+	m      map[string]any
+	keys   []string // insertion order, as in Starlark
+	frozen bool
+}
+
+func newStarDict() *starDict {
+	return &starDict{m: map[string]any{}}
+}
+
+func (d *starDict) set(k string, v any) {
+	if _, ok := d.m[k]; !ok {
+		d.keys = append(d.keys, k)
+	}
+	d.m[k] = v
+}
+
+type starList struct {
+	elems  []any
+	frozen bool
+}
+
+type starFunc struct {
+	name    string
+	params  []string
+	body    []stmt
+	globals *starEnv
+}
+
+type builtin struct {
+	name string
+	fn   func(args []any) (any, error)
+}
+
+func freeze(v any) {
+	switch v := v.(type) {
+	case *starDict:
+		if !v.frozen {
+			v.frozen = true
+			for _, e := range v.m {
+				freeze(e)
+			}
+		}
+	case *starList:
+		if !v.frozen {
+			v.frozen = true
+			for _, e := range v.elems {
+				freeze(e)
+			}
+		}
+	}
+}
+
+func starType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "NoneType"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *starDict:
+		return "dict"
+	case *starList:
+		return "list"
+	}
+	return "function"
+}
+
+func truth(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case *starDict:
+		return len(v.keys) > 0
+	case *starList:
+		return len(v.elems) > 0
+	}
+	return true
+}
+
+func starStr(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case *starDict:
+		parts := make([]string, len(v.keys))
+		for i, k := range v.keys {
+			parts[i] = strconv.Quote(k) + ": " + starRepr(v.m[k])
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case *starList:
+		parts := make([]string, len(v.elems))
+		for i, e := range v.elems {
+			parts[i] = starRepr(e)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *starFunc:
+		return "<function " + v.name + ">"
+	case *builtin:
+		return "<built-in " + v.name + ">"
+	}
+	return fmt.Sprint(v)
+}
+
+func starRepr(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return starStr(v)
+}
+
+// lexer
+
+type starTokKind int
+
+const (
+	stName starTokKind = iota
+	stNum
+	stStr
+	stOp
+	stNewline
+	stIndent
+	stDedent
+	stEOF
+)
+
+type starTok struct {
+	kind starTokKind
+	text string
+	line int
+}
+
+var starOps = map[string]bool{}
+
+func init() {
+	for _, op := range strings.Fields("== != <= >= // += -= < > + - * / % = ( ) [ ] { } : , .") {
+		starOps[op] = true
+	}
+}
+
+func lexStar(src string) ([]starTok, error) {
+	var toks []starTok
+	indents := []int{0}
+	depth := 0 // open brackets, inside which newlines don't count
+	lines := strings.Split(src, "\n")
+	for n, line := range lines {
+		lineno := n + 1
+		trimmed := strings.TrimLeft(line, " \t")
+		if depth == 0 {
+			if trimmed == "" || trimmed[0] == '#' {
+				continue
+			}
+			indent := len(line) - len(trimmed)
+			if indent > indents[len(indents)-1] {
+				indents = append(indents, indent)
+				toks = append(toks, starTok{stIndent, "", lineno})
+			}
+			for indent < indents[len(indents)-1] {
+				indents = indents[:len(indents)-1]
+				toks = append(toks, starTok{stDedent, "", lineno})
+			}
+			if indent != indents[len(indents)-1] {
+				return nil, fmt.Errorf("line %d: inconsistent indentation", lineno)
+			}
+		}
+		rs := []rune(line)
+		for i := len(rs) - len([]rune(trimmed)); i < len(rs); {
+			r := rs[i]
+			switch {
+			case r == ' ' || r == '\t' || r == '\r':
+				i++
+			case r == '#':
+				i = len(rs)
+			case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+				j := i
+				for j < len(rs) && (rs[j] == '_' || (rs[j] >= 'a' && rs[j] <= 'z') || (rs[j] >= 'A' && rs[j] <= 'Z') || (rs[j] >= '0' && rs[j] <= '9')) {
+					j++
+				}
+				toks = append(toks, starTok{stName, string(rs[i:j]), lineno})
+				i = j
+			case r >= '0' && r <= '9':
+				j := i
+				for j < len(rs) && ((rs[j] >= '0' && rs[j] <= '9') || rs[j] == '.') {
+					j++
+				}
+				toks = append(toks, starTok{stNum, string(rs[i:j]), lineno})
+				i = j
+			case r == '"' || r == '\'':
+				j := i + 1
+				var sb strings.Builder
+				for j < len(rs) && rs[j] != r {
+					if rs[j] == '\\' && j+1 < len(rs) {
+						j++
+						switch rs[j] {
+						case 'n':
+							sb.WriteRune('\n')
+						case 't':
+							sb.WriteRune('\t')
+						default:
+							sb.WriteRune(rs[j])
+						}
+					} else {
+						sb.WriteRune(rs[j])
+					}
+					j++
+				}
+				if j >= len(rs) {
+					return nil, fmt.Errorf("line %d: unterminated string", lineno)
+				}
+				toks = append(toks, starTok{stStr, sb.String(), lineno})
+				i = j + 1
+			default:
+				op := string(r)
+				if i+1 < len(rs) {
+					switch two := string(rs[i : i+2]); two {
+					case "==", "!=", "<=", ">=", "//", "+=", "-=":
+						op = two
+					}
+				}
+				if !starOps[op] {
+					return nil, fmt.Errorf("line %d: unexpected %q", lineno, op)
+				}
+				switch op {
+				case "(", "[", "{":
+					depth++
+				case ")", "]", "}":
+					depth--
+				}
+				toks = append(toks, starTok{stOp, op, lineno})
+				i += len([]rune(op))
+			}
+		}
+		if depth == 0 && len(toks) > 0 && toks[len(toks)-1].kind != stNewline &&
+			toks[len(toks)-1].kind != stIndent && toks[len(toks)-1].kind != stDedent {
+			toks = append(toks, starTok{stNewline, "", lineno})
+		}
+	}
+	for len(indents) > 1 {
+		indents = indents[:len(indents)-1]
+		toks = append(toks, starTok{stDedent, "", len(lines)})
+	}
+	return append(toks, starTok{stEOF, "", len(lines)}), nil
+}
+
+// syntax tree
+
+type stmt interface{}
+
+type (
+	defStmt struct {
+		name   string
+		params []string
+		body   []stmt
+	}
+	ifStmt struct {
+		conds  []starExpr
+		blocks [][]stmt
+		orelse []stmt
+	}
+	forStmt struct {
+		name string
+		iter starExpr
+		body []stmt
+	}
+	returnStmt struct{ value starExpr }
+	assignStmt struct {
+		target starExpr
+		op     string // "=", "+=" or "-="
+		value  starExpr
+	}
+	exprStmt struct{ e starExpr }
+	passStmt struct{}
+)
+
+type starExpr interface{}
+
+type (
+	litExpr   struct{ v any }
+	nameExpr  struct{ name string }
+	unaryExpr struct {
+		op string
+		x  starExpr
+	}
+	binExpr struct {
+		op   string
+		x, y starExpr
+	}
+	callExpr struct {
+		fn   starExpr
+		args []starExpr
+	}
+	indexExpr struct{ x, index starExpr }
+	attrExpr  struct {
+		x    starExpr
+		name string
+	}
+	dictExpr struct{ keys, values []starExpr }
+	listExpr struct{ elems []starExpr }
+)
+
+type starParser struct {
+	toks []starTok
+	pos  int
+}
+
+func parseStar(src string) ([]stmt, error) {
+	toks, err := lexStar(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &starParser{toks: toks}
+	var prog []stmt
+	for p.peek().kind != stEOF {
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		prog = append(prog, s)
+	}
+	return prog, nil
+}
+
+func (p *starParser) peek() starTok { return p.toks[p.pos] }
+
+func (p *starParser) next() starTok {
+	t := p.toks[p.pos]
+	if t.kind != stEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *starParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == stOp && t.text == op
+}
+
+func (p *starParser) isName(name string) bool {
+	t := p.peek()
+	return t.kind == stName && t.text == name
+}
+
+func (p *starParser) expectOp(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q", op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *starParser) errorf(format string, args ...any) error {
+	t := p.peek()
+	what := t.text
+	if t.kind == stNewline {
+		what = "end of line"
+	} else if t.kind == stEOF {
+		what = "end of file"
+	}
+	return fmt.Errorf("line %d: %s, got %q", t.line, fmt.Sprintf(format, args...), what)
+}
+
+func (p *starParser) endOfStmt() error {
+	t := p.peek()
+	if t.kind == stNewline {
+		p.pos++
+		return nil
+	}
+	if t.kind == stEOF || t.kind == stDedent {
+		return nil
+	}
+	return p.errorf("expected end of statement")
+}
+
+func (p *starParser) stmt() (stmt, error) {
+	switch {
+	case p.isName("def"):
+		p.next()
+		name := p.next()
+		if name.kind != stName {
+			return nil, fmt.Errorf("line %d: expected function name", name.line)
+		}
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		var params []string
+		for !p.isOp(")") {
+			t := p.next()
+			if t.kind != stName {
+				return nil, fmt.Errorf("line %d: expected parameter name", t.line)
+			}
+			params = append(params, t.text)
+			if !p.isOp(")") {
+				if err := p.expectOp(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.next()
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &defStmt{name: name.text, params: params, body: body}, nil
+	case p.isName("if"):
+		s := &ifStmt{}
+		for p.isName("if") || p.isName("elif") {
+			p.next()
+			cond, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.conds = append(s.conds, cond)
+			s.blocks = append(s.blocks, body)
+		}
+		if p.isName("else") {
+			p.next()
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.orelse = body
+		}
+		return s, nil
+	case p.isName("for"):
+		p.next()
+		name := p.next()
+		if name.kind != stName || !p.isName("in") {
+			return nil, fmt.Errorf("line %d: expected for <name> in <expr>", name.line)
+		}
+		p.next()
+		iter, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &forStmt{name: name.text, iter: iter, body: body}, nil
+	case p.isName("return"):
+		p.next()
+		s := &returnStmt{}
+		if t := p.peek(); t.kind != stNewline && t.kind != stEOF && t.kind != stDedent {
+			v, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			s.value = v
+		}
+		return s, p.endOfStmt()
+	case p.isName("pass"):
+		p.next()
+		return &passStmt{}, p.endOfStmt()
+	}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"=", "+=", "-="} {
+		if p.isOp(op) {
+			switch e.(type) {
+			case *nameExpr, *indexExpr:
+			default:
+				return nil, p.errorf("can't assign to this expression")
+			}
+			p.next()
+			v, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return &assignStmt{target: e, op: op, value: v}, p.endOfStmt()
+		}
+	}
+	return &exprStmt{e}, p.endOfStmt()
+}
+
+// parse the ':' and body that follows if, elif, else, for and def
+func (p *starParser) block() ([]stmt, error) {
+	if err := p.expectOp(":"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind != stNewline {
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		return []stmt{s}, nil
+	}
+	p.next()
+	if p.peek().kind != stIndent {
+		return nil, p.errorf("expected an indented block")
+	}
+	p.next()
+	var body []stmt
+	for p.peek().kind != stDedent && p.peek().kind != stEOF {
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	p.next()
+	return body, nil
+}
+
+func (p *starParser) expr() (starExpr, error) {
+	return p.or()
+}
+
+func (p *starParser) or() (starExpr, error) {
+	x, err := p.and()
+	for err == nil && p.isName("or") {
+		p.next()
+		var y starExpr
+		if y, err = p.and(); err == nil {
+			x = &binExpr{"or", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *starParser) and() (starExpr, error) {
+	x, err := p.not()
+	for err == nil && p.isName("and") {
+		p.next()
+		var y starExpr
+		if y, err = p.not(); err == nil {
+			x = &binExpr{"and", x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *starParser) not() (starExpr, error) {
+	if p.isName("not") {
+		p.next()
+		x, err := p.not()
+		return &unaryExpr{"not", x}, err
+	}
+	return p.comparison()
+}
+
+func (p *starParser) comparison() (starExpr, error) {
+	x, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.isOp("==") || p.isOp("!=") || p.isOp("<") || p.isOp("<=") || p.isOp(">") || p.isOp(">="):
+			op = p.next().text
+		case p.isName("in"):
+			p.next()
+			op = "in"
+		case p.isName("not") && p.toks[p.pos+1].kind == stName && p.toks[p.pos+1].text == "in":
+			p.pos += 2
+			op = "not in"
+		default:
+			return x, nil
+		}
+		y, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		x = &binExpr{op, x, y}
+	}
+}
+
+func (p *starParser) sum() (starExpr, error) {
+	x, err := p.term()
+	for err == nil && (p.isOp("+") || p.isOp("-")) {
+		op := p.next().text
+		var y starExpr
+		if y, err = p.term(); err == nil {
+			x = &binExpr{op, x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *starParser) term() (starExpr, error) {
+	x, err := p.unary()
+	for err == nil && (p.isOp("*") || p.isOp("/") || p.isOp("//") || p.isOp("%")) {
+		op := p.next().text
+		var y starExpr
+		if y, err = p.unary(); err == nil {
+			x = &binExpr{op, x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *starParser) unary() (starExpr, error) {
+	if p.isOp("-") {
+		p.next()
+		x, err := p.unary()
+		return &unaryExpr{"-", x}, err
+	}
+	return p.postfix()
+}
+
+func (p *starParser) postfix() (starExpr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("("):
+			p.next()
+			call := &callExpr{fn: x}
+			for !p.isOp(")") {
+				arg, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+				if !p.isOp(")") {
+					if err := p.expectOp(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			x = call
+		case p.isOp("["):
+			p.next()
+			index, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			x = &indexExpr{x, index}
+		case p.isOp("."):
+			p.next()
+			name := p.next()
+			if name.kind != stName {
+				return nil, fmt.Errorf("line %d: expected attribute name", name.line)
+			}
+			x = &attrExpr{x, name.text}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *starParser) primary() (starExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case stNum:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad number %q", t.line, t.text)
+		}
+		return &litExpr{f}, nil
+	case stStr:
+		return &litExpr{t.text}, nil
+	case stName:
+		switch t.text {
+		case "True":
+			return &litExpr{true}, nil
+		case "False":
+			return &litExpr{false}, nil
+		case "None":
+			return &litExpr{nil}, nil
+		}
+		return &nameExpr{t.text}, nil
+	case stOp:
+		switch t.text {
+		case "(":
+			x, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expectOp(")")
+		case "[":
+			l := &listExpr{}
+			for !p.isOp("]") {
+				e, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				l.elems = append(l.elems, e)
+				if !p.isOp("]") {
+					if err := p.expectOp(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return l, nil
+		case "{":
+			d := &dictExpr{}
+			for !p.isOp("}") {
+				k, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectOp(":"); err != nil {
+					return nil, err
+				}
+				v, err := p.expr()
+				if err != nil {
+					return nil, err
+				}
+				d.keys = append(d.keys, k)
+				d.values = append(d.values, v)
+				if !p.isOp("}") {
+					if err := p.expectOp(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return d, nil
+		}
+	}
+	p.pos--
+	return nil, p.errorf("unexpected token")
+}
+
+// interpreter
+
+type starEnv struct {
+	vars   map[string]any
+	parent *starEnv
+	// the call this is the locals of, nil for the globals
+	frame *starFrame
+}
+
+// the most calls deep a script can go. Without recursion it can only go
+// as deep as it has functions, but a script can have a lot of them.
+const starMaxDepth = 200
+
+// a function being called, and the call it was called from
+type starFrame struct {
+	fn    *starFunc
+	up    *starFrame
+	depth int
+}
+
+func (e *starEnv) lookup(name string) (any, bool) {
+	for ; e != nil; e = e.parent {
+		if v, ok := e.vars[name]; ok {
+			return v, true
+		}
+	}
+	if b, ok := starBuiltins[name]; ok {
+		return b, true
+	}
+	return nil, false
+}
+
+// failError is what fail() raises, so the message reaches the caller as is
+type failError struct{ msg string }
+
+func (e *failError) Error() string { return e.msg }
+
+var starBuiltins map[string]*builtin
+
+func init() {
+	starBuiltins = map[string]*builtin{
+		"len": {"len", func(args []any) (any, error) {
+			if len(args) != 1 {
+				return nil, errors.New("len takes one argument")
+			}
+			switch v := args[0].(type) {
+			case string:
+				return float64(len(v)), nil
+			case *starDict:
+				return float64(len(v.keys)), nil
+			case *starList:
+				return float64(len(v.elems)), nil
+			}
+			return nil, fmt.Errorf("len of %s", starType(args[0]))
+		}},
+		"str": {"str", func(args []any) (any, error) {
+			if len(args) != 1 {
+				return nil, errors.New("str takes one argument")
+			}
+			return starStr(args[0]), nil
+		}},
+		"int": {"int", func(args []any) (any, error) {
+			f, err := starNumber(args)
+			return math.Trunc(f), err
+		}},
+		"float": {"float", func(args []any) (any, error) {
+			return starNumber(args)
+		}},
+		"print": {"print", func(args []any) (any, error) {
+			parts := make([]string, len(args))
+			for i, a := range args {
+				parts[i] = starStr(a)
+			}
+			fmt.Println(strings.Join(parts, " "))
+			return nil, nil
+		}},
+		"fail": {"fail", func(args []any) (any, error) {
+			parts := make([]string, len(args))
+			for i, a := range args {
+				parts[i] = starStr(a)
+			}
+			return nil, &failError{strings.Join(parts, " ")}
+		}},
+	}
+}
+
+func starNumber(args []any) (float64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("expected one argument")
+	}
+	switch v := args[0].(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("can't convert %q to a number", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("can't convert %s to a number", starType(args[0]))
+}
+
+// call the function from the call caller, nil for the handler calling it.
+// Starlark doesn't allow recursion, which would otherwise run the Go stack
+// out and take the whole process with it, so a function already being
+// called is refused, as is going deeper than starMaxDepth.
+func (f *starFunc) call(caller *starFrame, args []any) (any, error) {
+	if len(args) != len(f.params) {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", f.name, len(f.params), len(args))
+	}
+	frame := &starFrame{fn: f, up: caller, depth: 1}
+	if caller != nil {
+		frame.depth = caller.depth + 1
+	}
+	for c := caller; c != nil; c = c.up {
+		if c.fn == f {
+			return nil, fmt.Errorf("%s called itself, and recursion isn't allowed", f.name)
+		}
+	}
+	if frame.depth > starMaxDepth {
+		return nil, fmt.Errorf("calling %s goes more than %d calls deep", f.name, starMaxDepth)
+	}
+	env := &starEnv{vars: make(map[string]any, len(args)), parent: f.globals, frame: frame}
+	for i, name := range f.params {
+		env.vars[name] = args[i]
+	}
+	v, _, err := execBlock(f.body, env)
+	return v, err
+}
+
+// run statements, reporting whether a return was hit along with its value
+func execBlock(body []stmt, env *starEnv) (any, bool, error) {
+	for _, s := range body {
+		v, returned, err := execStmt(s, env)
+		if err != nil || returned {
+			return v, returned, err
+		}
+	}
+	return nil, false, nil
+}
+
+func execStmt(s stmt, env *starEnv) (any, bool, error) {
+	switch s := s.(type) {
+	case *defStmt:
+		globals := env
+		for globals.parent != nil {
+			globals = globals.parent
+		}
+		env.vars[s.name] = &starFunc{name: s.name, params: s.params, body: s.body, globals: globals}
+	case *ifStmt:
+		for i, cond := range s.conds {
+			c, err := eval(cond, env)
+			if err != nil {
+				return nil, false, err
+			}
+			if truth(c) {
+				return execBlock(s.blocks[i], env)
+			}
+		}
+		return execBlock(s.orelse, env)
+	case *forStmt:
+		iter, err := eval(s.iter, env)
+		if err != nil {
+			return nil, false, err
+		}
+		var elems []any
+		switch it := iter.(type) {
+		case *starList:
+			elems = append(elems, it.elems...)
+		case *starDict:
+			for _, k := range it.keys {
+				elems = append(elems, k)
+			}
+		default:
+			return nil, false, fmt.Errorf("can't iterate over %s", starType(iter))
+		}
+		for _, e := range elems {
+			env.vars[s.name] = e
+			if v, returned, err := execBlock(s.body, env); err != nil || returned {
+				return v, returned, err
+			}
+		}
+	case *returnStmt:
+		if s.value == nil {
+			return nil, true, nil
+		}
+		v, err := eval(s.value, env)
+		return v, true, err
+	case *assignStmt:
+		v, err := eval(s.value, env)
+		if err != nil {
+			return nil, false, err
+		}
+		if s.op != "=" {
+			old, err := eval(s.target, env)
+			if err != nil {
+				return nil, false, err
+			}
+			if v, err = binary(s.op[:1], old, v); err != nil {
+				return nil, false, err
+			}
+		}
+		return nil, false, assign(s.target, v, env)
+	case *exprStmt:
+		_, err := eval(s.e, env)
+		return nil, false, err
+	case *passStmt:
+	}
+	return nil, false, nil
+}
+
+func assign(target starExpr, v any, env *starEnv) error {
+	switch t := target.(type) {
+	case *nameExpr:
+		env.vars[t.name] = v
+		return nil
+	case *indexExpr:
+		x, err := eval(t.x, env)
+		if err != nil {
+			return err
+		}
+		index, err := eval(t.index, env)
+		if err != nil {
+			return err
+		}
+		switch x := x.(type) {
+		case *starDict:
+			k, ok := index.(string)
+			if !ok {
+				return fmt.Errorf("dict keys must be strings, got %s", starType(index))
+			}
+			if x.frozen {
+				return errors.New("can't modify a frozen dict")
+			}
+			x.set(k, v)
+			return nil
+		case *starList:
+			i, err := listIndex(x, index)
+			if err != nil {
+				return err
+			}
+			if x.frozen {
+				return errors.New("can't modify a frozen list")
+			}
+			x.elems[i] = v
+			return nil
+		}
+		return fmt.Errorf("can't assign into %s", starType(x))
+	}
+	return errors.New("bad assignment")
+}
+
+func listIndex(l *starList, index any) (int, error) {
+	f, ok := index.(float64)
+	if !ok {
+		return 0, fmt.Errorf("list index must be a number, got %s", starType(index))
+	}
+	i := int(f)
+	if i < 0 {
+		i += len(l.elems)
+	}
+	if i < 0 || i >= len(l.elems) {
+		return 0, fmt.Errorf("list index %d out of range", int(f))
+	}
+	return i, nil
+}
+
+func eval(e starExpr, env *starEnv) (any, error) {
+	switch e := e.(type) {
+	case *litExpr:
+		return e.v, nil
+	case *nameExpr:
+		v, ok := env.lookup(e.name)
+		if !ok {
+			return nil, fmt.Errorf("undefined: %s", e.name)
+		}
+		return v, nil
+	case *unaryExpr:
+		x, err := eval(e.x, env)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "not" {
+			return !truth(x), nil
+		}
+		f, ok := x.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can't negate %s", starType(x))
+		}
+		return -f, nil
+	case *binExpr:
+		x, err := eval(e.x, env)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "and" && !truth(x) || e.op == "or" && truth(x) {
+			return x, nil
+		}
+		y, err := eval(e.y, env)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "and" || e.op == "or" {
+			return y, nil
+		}
+		return binary(e.op, x, y)
+	case *callExpr:
+		fn, err := eval(e.fn, env)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]any, len(e.args))
+		for i, a := range e.args {
+			if args[i], err = eval(a, env); err != nil {
+				return nil, err
+			}
+		}
+		switch fn := fn.(type) {
+		case *starFunc:
+			return fn.call(env.frame, args)
+		case *builtin:
+			return fn.fn(args)
+		}
+		return nil, fmt.Errorf("%s is not callable", starType(fn))
+	case *indexExpr:
+		x, err := eval(e.x, env)
+		if err != nil {
+			return nil, err
+		}
+		index, err := eval(e.index, env)
+		if err != nil {
+			return nil, err
+		}
+		switch x := x.(type) {
+		case *starDict:
+			k, _ := index.(string)
+			v, ok := x.m[k]
+			if !ok {
+				return nil, fmt.Errorf("key %s not in dict", starRepr(index))
+			}
+			return v, nil
+		case *starList:
+			i, err := listIndex(x, index)
+			if err != nil {
+				return nil, err
+			}
+			return x.elems[i], nil
+		case string:
+			i, err := listIndex(&starList{elems: make([]any, len(x))}, index)
+			if err != nil {
+				return nil, err
+			}
+			return x[i : i+1], nil
+		}
+		return nil, fmt.Errorf("can't index %s", starType(x))
+	case *attrExpr:
+		x, err := eval(e.x, env)
+		if err != nil {
+			return nil, err
+		}
+		return method(x, e.name)
+	case *dictExpr:
+		d := newStarDict()
+		for i := range e.keys {
+			k, err := eval(e.keys[i], env)
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", starType(k))
+			}
+			v, err := eval(e.values[i], env)
+			if err != nil {
+				return nil, err
+			}
+			d.set(ks, v)
+		}
+		return d, nil
+	case *listExpr:
+		l := &starList{}
+		for _, el := range e.elems {
+			v, err := eval(el, env)
+			if err != nil {
+				return nil, err
+			}
+			l.elems = append(l.elems, v)
+		}
+		return l, nil
+	}
+	return nil, errors.New("bad expression")
+}
+
+func binary(op string, x, y any) (any, error) {
+	xf, xnum := x.(float64)
+	yf, ynum := y.(float64)
+	switch op {
+	case "==":
+		return starEqual(x, y), nil
+	case "!=":
+		return !starEqual(x, y), nil
+	case "in", "not in":
+		var found bool
+		switch c := y.(type) {
+		case string:
+			s, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("'in <string>' needs a string, got %s", starType(x))
+			}
+			found = strings.Contains(c, s)
+		case *starDict:
+			k, _ := x.(string)
+			_, found = c.m[k]
+		case *starList:
+			for _, e := range c.elems {
+				if starEqual(x, e) {
+					found = true
+					break
+				}
+			}
+		default:
+			return nil, fmt.Errorf("'in' needs a string, dict or list, got %s", starType(y))
+		}
+		return found == (op == "in"), nil
+	case "<", "<=", ">", ">=":
+		var cmp int
+		xs, xstr := x.(string)
+		ys, ystr := y.(string)
+		switch {
+		case xnum && ynum:
+			cmp = compareFloat(xf, yf)
+		case xstr && ystr:
+			cmp = strings.Compare(xs, ys)
+		default:
+			return nil, fmt.Errorf("can't compare %s with %s", starType(x), starType(y))
+		}
+		switch op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	case "+":
+		switch xv := x.(type) {
+		case string:
+			if ys, ok := y.(string); ok {
+				return xv + ys, nil
+			}
+		case *starList:
+			if yl, ok := y.(*starList); ok {
+				return &starList{elems: append(append([]any{}, xv.elems...), yl.elems...)}, nil
+			}
+		}
+	}
+	if !xnum || !ynum {
+		return nil, fmt.Errorf("unsupported operands for %s: %s and %s", op, starType(x), starType(y))
+	}
+	switch op {
+	case "+":
+		return xf + yf, nil
+	case "-":
+		return xf - yf, nil
+	case "*":
+		return xf * yf, nil
+	}
+	if yf == 0 {
+		return nil, errors.New("division by zero")
+	}
+	switch op {
+	case "/":
+		return xf / yf, nil
+	case "//":
+		return math.Floor(xf / yf), nil
+	}
+	return xf - yf*math.Floor(xf/yf), nil
+}
+
+func starEqual(x, y any) bool {
+	switch xv := x.(type) {
+	case *starDict:
+		yv, ok := y.(*starDict)
+		if !ok || len(xv.keys) != len(yv.keys) {
+			return false
+		}
+		for k, v := range xv.m {
+			if w, ok := yv.m[k]; !ok || !starEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case *starList:
+		yv, ok := y.(*starList)
+		if !ok || len(xv.elems) != len(yv.elems) {
+			return false
+		}
+		for i := range xv.elems {
+			if !starEqual(xv.elems[i], yv.elems[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return x == y
+}
+
+// look up a method on a value, returning it bound to the value
+func method(x any, name string) (any, error) {
+	bind := func(fn func(args []any) (any, error)) (any, error) {
+		return &builtin{name: name, fn: fn}, nil
+	}
+	switch x := x.(type) {
+	case string:
+		switch name {
+		case "upper":
+			return bind(func([]any) (any, error) { return strings.ToUpper(x), nil })
+		case "lower":
+			return bind(func([]any) (any, error) { return strings.ToLower(x), nil })
+		case "strip":
+			return bind(func([]any) (any, error) { return strings.TrimSpace(x), nil })
+		case "startswith", "endswith":
+			return bind(func(args []any) (any, error) {
+				s, ok := firstString(args)
+				if !ok {
+					return nil, fmt.Errorf("%s takes a string", name)
+				}
+				if name == "startswith" {
+					return strings.HasPrefix(x, s), nil
+				}
+				return strings.HasSuffix(x, s), nil
+			})
+		}
+	case *starDict:
+		switch name {
+		case "get":
+			return bind(func(args []any) (any, error) {
+				k, ok := firstString(args)
+				if !ok {
+					return nil, errors.New("get takes a string key")
+				}
+				if v, ok := x.m[k]; ok {
+					return v, nil
+				}
+				if len(args) > 1 {
+					return args[1], nil
+				}
+				return nil, nil
+			})
+		case "keys":
+			return bind(func([]any) (any, error) {
+				l := &starList{}
+				for _, k := range x.keys {
+					l.elems = append(l.elems, k)
+				}
+				return l, nil
+			})
+		case "values":
+			return bind(func([]any) (any, error) {
+				l := &starList{}
+				for _, k := range x.keys {
+					l.elems = append(l.elems, x.m[k])
+				}
+				return l, nil
+			})
+		}
+	case *starList:
+		if name == "append" {
+			return bind(func(args []any) (any, error) {
+				if x.frozen {
+					return nil, errors.New("can't modify a frozen list")
+				}
+				x.elems = append(x.elems, args...)
+				return nil, nil
+			})
+		}
+	}
+	return nil, fmt.Errorf("%s has no method %s", starType(x), name)
+}
+
+func firstString(args []any) (string, bool) {
+	if len(args) == 0 {
+		return "", false
+	}
+	s, ok := args[0].(string)
+	return s, ok
+}
@@ -0,0 +1,14 @@
+package pipeline
+
+import "testing"
+
+func FuzzParseStar(f *testing.F) {
+	f.Add("def handle(item):\n    if item[\"ID\"] % 2 == 0:\n        return None\n    return item\n")
+	f.Add("x = [1, 2, 3]\nfor v in x:\n    pass\n")
+	f.Add("def f(:\n")
+	f.Add("if True:\nreturn\n")
+	f.Add("\t \tx = 'a\n")
+	f.Fuzz(func(t *testing.T, src string) {
+		parseStar(src)
+	})
+}
@@ -0,0 +1,163 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// seqChecker follows the sequence numbers of each producer's items as the
+// consumers get them, with -check-sequence. The built-in producers number
+// their items from 1, and sources can give items a Seq of their own. A
+// number past the next one expected opens a gap, which a late item may
+// fill again, counting as reordered; a number seen before is a duplicate.
+// Whatever gaps remain at the end are items that never arrived, and when
+// the producers are in the same process so are any numbers they made past
+// the last one that arrived. Producer ids need to be unique across
+// everything feeding the consumers, so with a redis queue and several
+// producing processes the counts get mixed up.
+type seqChecker struct {
+	mu        sync.Mutex
+	producers map[int]*seqStream
+}
+
+// what one producer's items have come to
+type seqStream struct {
+	next       int64     // the number expected next
+	made       int64     // the highest number made, by a producer in this process
+	gaps       []seqSpan // numbers not seen yet below next, in order
+	received   int64
+	duplicates int64
+	reordered  int64
+}
+
+// the numbers from through to, inclusive
+type seqSpan struct{ from, to int64 }
+
+func newSeqChecker() *seqChecker {
+	return &seqChecker{producers: make(map[int]*seqStream)}
+}
+
+func (c *seqChecker) stream(producer int) *seqStream {
+	s := c.producers[producer]
+	if s == nil {
+		s = &seqStream{next: 1}
+		c.producers[producer] = s
+	}
+	return s
+}
+
+// note a producer numbering an item
+func (c *seqChecker) number(item *Item, seq int64) {
+	item.Seq = seq
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stream(item.ProducerID)
+	s.made = max(s.made, seq)
+}
+
+// note an item reaching a consumer. Items without sequence numbers are
+// left out. Safe on a nil checker.
+func (c *seqChecker) observe(item *Item) {
+	if c == nil || item.Seq <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stream(item.ProducerID)
+	s.received++
+	seq := item.Seq
+	switch {
+	case seq == s.next:
+		s.next++
+	case seq > s.next:
+		s.gaps = append(s.gaps, seqSpan{s.next, seq - 1})
+		s.next = seq + 1
+	default:
+		if s.fill(seq) {
+			s.reordered++
+		} else {
+			s.duplicates++
+		}
+	}
+}
+
+// take seq out of the gaps, reporting whether it was in one
+func (s *seqStream) fill(seq int64) bool {
+	i := sort.Search(len(s.gaps), func(i int) bool { return s.gaps[i].to >= seq })
+	if i == len(s.gaps) || s.gaps[i].from > seq {
+		return false
+	}
+	g := s.gaps[i]
+	switch {
+	case g.from == g.to:
+		s.gaps = append(s.gaps[:i], s.gaps[i+1:]...)
+	case seq == g.from:
+		s.gaps[i].from++
+	case seq == g.to:
+		s.gaps[i].to--
+	default:
+		s.gaps = append(s.gaps[:i+1], s.gaps[i:]...)
+		s.gaps[i].to, s.gaps[i+1].from = seq-1, seq+1
+	}
+	return true
+}
+
+// the numbers missing in the gaps, and made after the last to arrive
+func (s *seqStream) missing() (gaps, tail int64) {
+	for _, g := range s.gaps {
+		gaps += g.to - g.from + 1
+	}
+	return gaps, max(0, s.made-(s.next-1))
+}
+
+// print a line per producer whose items didn't all arrive once and in
+// order, and a total
+func (c *seqChecker) printSummary(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]int, 0, len(c.producers))
+	for id := range c.producers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var received, missing, duplicates, reordered int64
+	for _, id := range ids {
+		s := c.producers[id]
+		gaps, tail := s.missing()
+		received, missing, duplicates, reordered = received+s.received, missing+gaps+tail, duplicates+s.duplicates, reordered+s.reordered
+		if gaps+tail == 0 && s.duplicates == 0 && s.reordered == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "sequence: producer %d: %d received up to %d, %d missing in %d gaps%s",
+			id, s.received, s.next-1, gaps, len(s.gaps), firstGaps(s.gaps))
+		if tail > 0 {
+			fmt.Fprintf(w, " and %d after the last received", tail)
+		}
+		fmt.Fprintf(w, ", %d duplicates, %d reordered\n", s.duplicates, s.reordered)
+	}
+	fmt.Fprintf(w, "sequence check: %d producers, %d received, %d missing, %d duplicates, %d reordered\n",
+		len(ids), received, missing, duplicates, reordered)
+}
+
+// the first few gaps, for a start on finding the lost items
+func firstGaps(gaps []seqSpan) string {
+	if len(gaps) == 0 {
+		return ""
+	}
+	var parts []string
+	for i, g := range gaps {
+		if i == 3 {
+			parts = append(parts, "...")
+			break
+		}
+		if g.from == g.to {
+			parts = append(parts, fmt.Sprint(g.from))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", g.from, g.to))
+		}
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// serviceMain runs go_producer_consumer service, which installs a -daemon
+// with the platform's service manager, as a systemd unit on Linux, a
+// launchd agent on macOS or a Windows service, and is what the service
+// manager then starts:
+//
+//	go_producer_consumer service install [-name pc] -- -ingest :8082 -sink file:/var/lib/pc/out.json
+//	go_producer_consumer service uninstall [-name pc]
+//	go_producer_consumer service run [-name pc] -- <flags>
+//
+// The flags after -- are the daemon's, with -daemon added. However the
+// service manager stops the service, with SIGTERM or a Windows service
+// stop, the pipeline is drained before the process exits.
+func serviceMain(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "usage: service install|uninstall|run [-name name] [-- daemon flags]")
+		return 2
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("service "+cmd, flag.ContinueOnError)
+	fs.SetOutput(out)
+	name := fs.String("name", "go_producer_consumer", "name of the service")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	var err error
+	switch cmd {
+	case "install":
+		var exe string
+		if exe, err = os.Executable(); err == nil {
+			err = installService(*name, serviceCommand(*name, exe, fs.Args()), out)
+		}
+	case "uninstall":
+		err = uninstallService(*name, out)
+	case "run":
+		return runService(*name, append([]string{"-daemon"}, fs.Args()...))
+	default:
+		fmt.Fprintf(out, "unknown service command %q, expected install, uninstall or run\n", cmd)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(out, "service %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// the command line the service manager starts the service with
+func serviceCommand(name, exe string, flags []string) []string {
+	return append([]string{exe, "service", "run", "-name", name, "--"}, flags...)
+}
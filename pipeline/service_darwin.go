@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// install a launchd agent that runs the daemon for the current user. launchd
+// stops it with SIGTERM, which drains the pipeline, and only kills it after
+// ExitTimeOut.
+func installService(name string, command []string, out io.Writer) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	escape := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+	var args bytes.Buffer
+	for _, arg := range command {
+		fmt.Fprintf(&args, "\t\t<string>%s</string>\n", escape(arg))
+	}
+	logFile := escape(filepath.Join(home, "Library", "Logs", name+".log"))
+	plist := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ExitTimeOut</key>
+	<integer>300</integer>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`, escape(name), args.String(), logFile, logFile)
+	path := agentPath(home, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s, start it with: launchctl load -w %s\n", path, path)
+	return nil
+}
+
+func uninstallService(name string, out io.Writer) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path := agentPath(home, name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "removed %s; if it is running, stop it with: launchctl remove %s\n", path, name)
+	return nil
+}
+
+func agentPath(home, name string) string {
+	return filepath.Join(home, "Library", "LaunchAgents", name+".plist")
+}
+
+// launchd runs the agent itself, and its SIGTERM drains the pipeline
+func runService(name string, args []string) int {
+	return run(args, nil)
+}
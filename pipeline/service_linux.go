@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where systemd looks for units installed by the administrator
+const systemdUnitDir = "/etc/systemd/system"
+
+// install a systemd unit that runs the daemon. It is a notify unit with a
+// watchdog, see systemd.go, so it is restarted if the consumers stall, and
+// tokens can be kept out of the unit in /etc/<name>.env.
+func installService(name string, command []string, out io.Writer) error {
+	words := make([]string, len(command))
+	for i, arg := range command {
+		words[i] = systemdQuote(arg)
+	}
+	unit := fmt.Sprintf(`[Unit]
+Description=go_producer_consumer daemon %[1]s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%[2]s
+EnvironmentFile=-/etc/%[1]s.env
+WatchdogSec=2min
+Restart=on-failure
+TimeoutStopSec=5min
+
+[Install]
+WantedBy=multi-user.target
+`, name, strings.Join(words, " "))
+	path := filepath.Join(systemdUnitDir, name+".service")
+	if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s, start it with: systemctl daemon-reload && systemctl enable --now %s\n", path, name)
+	return nil
+}
+
+func uninstallService(name string, out io.Writer) error {
+	path := filepath.Join(systemdUnitDir, name+".service")
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "removed %s; if it is running, stop it with: systemctl disable --now %s\n", path, name)
+	return nil
+}
+
+// systemd runs the service itself, and its SIGTERM drains the pipeline
+func runService(name string, args []string) int {
+	return run(args, nil)
+}
+
+// quote an argument for a unit's ExecStart line, which expands % and $
+// and splits on spaces
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"';\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
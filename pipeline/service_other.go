@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !windows
+
+package pipeline
+
+import (
+	"errors"
+	"io"
+)
+
+var errNoServiceManager = errors.New("no service manager is supported on this platform, run with -daemon under your own")
+
+func installService(name string, command []string, out io.Writer) error {
+	return errNoServiceManager
+}
+
+func uninstallService(name string, out io.Writer) error {
+	return errNoServiceManager
+}
+
+func runService(name string, args []string) int {
+	return run(args, nil)
+}
@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// the service control manager's API, called directly since the standard
+// library has no wrapper for it
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorServiceSpecific = 1066
+	// StartServiceCtrlDispatcher's error when not started as a service
+	errorNotService = 1063
+
+	// how long to tell the manager each pending step may take, in ms
+	serviceWaitHint = 30000
+)
+
+// SERVICE_STATUS
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// register the daemon with the service control manager, to start with
+// Windows
+func installService(name string, command []string, out io.Writer) error {
+	words := make([]string, len(command))
+	for i, arg := range command {
+		words[i] = syscall.EscapeArg(arg)
+	}
+	cmd := exec.Command("sc.exe", "create", name, "binPath=", strings.Join(words, " "), "start=", "auto")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sc create: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	fmt.Fprintf(out, "created service %s, start it with: sc.exe start %s\n", name, name)
+	return nil
+}
+
+func uninstallService(name string, out io.Writer) error {
+	if b, err := exec.Command("sc.exe", "delete", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("sc delete: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	fmt.Fprintf(out, "deleted service %s\n", name)
+	return nil
+}
+
+// winService runs the pipeline for the service control manager, which
+// starts a service by calling its ServiceMain on a thread of its own and
+// stops it with a control, which drains the pipeline rather than kill it.
+type winService struct {
+	name *uint16
+	args []string
+	code int
+
+	mu       sync.Mutex
+	handle   uintptr
+	status   serviceStatus
+	pipe     *Pipeline
+	stopping bool
+}
+
+// run the daemon as a Windows service, or just run it when started from a
+// console rather than by the service control manager
+func runService(name string, args []string) int {
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	w := &winService{name: namep, args: args}
+	table := []serviceTableEntry{{namep, syscall.NewCallback(w.main)}, {nil, 0}}
+	// blocks until the service has stopped
+	if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		if err == syscall.Errno(errorNotService) {
+			return run(args, nil)
+		}
+		fmt.Printf("error starting service: %v\n", err)
+		return 1
+	}
+	return w.code
+}
+
+// ServiceMain
+func (w *winService) main(argc, argv uintptr) uintptr {
+	h, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(w.name)), syscall.NewCallback(w.control), 0)
+	if h == 0 {
+		fmt.Printf("error registering service handler: %v\n", err)
+		w.code = 1
+		return 0
+	}
+	w.mu.Lock()
+	w.handle = h
+	w.mu.Unlock()
+	w.setState(serviceStartPending, 0)
+	w.code = run(w.args, w.started)
+	w.setState(serviceStopped, w.code)
+	return 0
+}
+
+func (w *winService) started(p *Pipeline) {
+	w.mu.Lock()
+	w.pipe = p
+	stopping := w.stopping
+	w.mu.Unlock()
+	if stopping {
+		// stopped while it was starting up
+		p.shutdown(p.cfg.DrainTimeout)
+		return
+	}
+	w.setState(serviceRunning, 0)
+}
+
+// HandlerEx
+func (w *winService) control(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		w.setState(serviceStopPending, 0)
+		w.mu.Lock()
+		p := w.pipe
+		w.stopping = true
+		w.mu.Unlock()
+		if p != nil {
+			go p.shutdown(p.cfg.DrainTimeout)
+		}
+		go w.draining()
+	case serviceControlInterrogate:
+		w.mu.Lock()
+		procSetServiceStatus.Call(w.handle, uintptr(unsafe.Pointer(&w.status)))
+		w.mu.Unlock()
+	}
+	return 0
+}
+
+// keep telling the manager the stop is making progress while a long drain
+// goes on, so it isn't taken for hung
+func (w *winService) draining() {
+	for {
+		time.Sleep(serviceWaitHint * time.Millisecond / 3)
+		w.mu.Lock()
+		pending := w.status.CurrentState == serviceStopPending
+		w.mu.Unlock()
+		if !pending {
+			return
+		}
+		w.setState(serviceStopPending, 0)
+	}
+}
+
+func (w *winService) setState(state uint32, code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := &w.status
+	s.ServiceType = serviceWin32OwnProcess
+	s.CurrentState = state
+	s.ControlsAccepted = 0
+	s.WaitHint = 0
+	switch state {
+	case serviceRunning:
+		s.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+		s.CheckPoint = 0
+	case serviceStartPending, serviceStopPending:
+		// the manager wants to see a pending state making progress
+		s.CheckPoint++
+		s.WaitHint = serviceWaitHint
+	default:
+		s.CheckPoint = 0
+	}
+	s.Win32ExitCode, s.ServiceSpecificExitCode = 0, 0
+	if code != 0 {
+		s.Win32ExitCode, s.ServiceSpecificExitCode = errorServiceSpecific, uint32(code)
+	}
+	procSetServiceStatus.Call(w.handle, uintptr(unsafe.Pointer(s)))
+}
@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shadowHandler runs a second handler, given with -shadow-handler, on the
+// same items as the primary one, so new processing logic can be tried on
+// live traffic without it touching anything. Each item is offered to the
+// shadow once the primary has handled it, along with what the primary
+// made of it; what the shadow makes of it is only compared with that and
+// thrown away. The offer never waits: when -shadow-buffer items are
+// already waiting for the shadow's -shadow-workers the item is skipped, so
+// a slow or stuck shadow can't hold the pipeline up. The items it does
+// differently go to -shadow-log as json lines.
+type shadowHandler struct {
+	handler Handler
+	jobs    chan shadowJob
+	wg      sync.WaitGroup
+
+	mu  sync.Mutex
+	log *os.File
+	enc *json.Encoder
+
+	same, different, failed, dropped atomic.Int64
+}
+
+type shadowJob struct {
+	item    Item
+	primary []Item
+	err     error
+}
+
+// ShadowDiff is an item the shadow handler did differently from the
+// primary one
+type ShadowDiff struct {
+	Time         time.Time
+	Item         Item
+	Primary      []Item `json:",omitempty"`
+	PrimaryError string `json:",omitempty"`
+	Shadow       []Item `json:",omitempty"`
+	ShadowError  string `json:",omitempty"`
+}
+
+func newShadowHandler(cfg *Config) (*shadowHandler, error) {
+	if cfg.ShadowWorkers < 1 || cfg.ShadowBuffer < 1 {
+		return nil, fmt.Errorf("-shadow-workers and -shadow-buffer must be at least 1")
+	}
+	h, err := loadHandler(cfg.ShadowHandler, cfg.WasmRuntime)
+	if err != nil {
+		return nil, fmt.Errorf("shadow handler: %v", err)
+	}
+	s := &shadowHandler{handler: h, jobs: make(chan shadowJob, cfg.ShadowBuffer)}
+	if cfg.ShadowLog != "" {
+		if s.log, err = os.OpenFile(cfg.ShadowLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			if c, ok := h.(io.Closer); ok {
+				c.Close()
+			}
+			return nil, err
+		}
+		s.enc = json.NewEncoder(s.log)
+	}
+	for range cfg.ShadowWorkers {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return s, nil
+}
+
+// offer the shadow an item with what the primary handler made of it, or
+// the error it failed with. Safe on a nil shadow. The canary's items
+// aren't offered, since they weren't handled by the primary.
+func (s *shadowHandler) offer(item Item, primary []Item, err error) {
+	if s == nil || item.canary {
+		return
+	}
+	// through json, so the shadow can't change the item's metadata or
+	// payload under the pipeline
+	b, merr := json.Marshal(item)
+	var c Item
+	if merr == nil {
+		merr = json.Unmarshal(b, &c)
+	}
+	if merr != nil {
+		s.dropped.Add(1)
+		return
+	}
+	select {
+	case s.jobs <- shadowJob{c, primary, err}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *shadowHandler) work() {
+	defer s.wg.Done()
+	for job := range s.jobs {
+		shadow, err := s.handle(job.item)
+		switch {
+		case err != nil && job.err == nil:
+			s.failed.Add(1)
+		case (err == nil) == (job.err == nil) && sameItems(job.primary, shadow):
+			s.same.Add(1)
+			continue
+		default:
+			s.different.Add(1)
+		}
+		d := ShadowDiff{Time: time.Now(), Item: job.item, Primary: job.primary, Shadow: shadow}
+		if job.err != nil {
+			d.PrimaryError = job.err.Error()
+		}
+		if err != nil {
+			d.ShadowError = err.Error()
+		}
+		s.record(d)
+	}
+}
+
+// handle an item as process does, without the retries
+func (s *shadowHandler) handle(item Item) ([]Item, error) {
+	if sp, ok := s.handler.(Splitter); ok {
+		return sp.Split(&item)
+	}
+	out, err := s.handler.Handle(&item)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return []Item{item}, nil
+	}
+	return []Item{*out}, nil
+}
+
+// whether two handlings came to the same items, going by their json
+// without the provenance, which differs by when and where they ran
+func sameItems(a, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		for _, it := range []*Item{&x, &y} {
+			if it.Result != nil {
+				r := *it.Result
+				r.Provenance = nil
+				it.Result = &r
+			}
+		}
+		bx, err1 := json.Marshal(x)
+		by, err2 := json.Marshal(y)
+		if err1 != nil || err2 != nil || !bytes.Equal(bx, by) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *shadowHandler) record(d ShadowDiff) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enc == nil {
+		return
+	}
+	if err := s.enc.Encode(d); err != nil {
+		fmt.Printf("error writing shadow log: %v\n", err)
+		s.enc = nil
+	}
+}
+
+// let the workers finish what is waiting and close the shadow handler
+func (s *shadowHandler) Close() error {
+	close(s.jobs)
+	s.wg.Wait()
+	var err error
+	if c, ok := s.handler.(io.Closer); ok {
+		err = c.Close()
+	}
+	if s.log != nil {
+		if cerr := s.log.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *shadowHandler) printSummary(w io.Writer) {
+	same, diff, failed, dropped := s.same.Load(), s.different.Load(), s.failed.Load(), s.dropped.Load()
+	fmt.Fprintf(w, "shadow handler: %d of %d items the same, %d different, %d failed only in the shadow, %d skipped while it was busy\n",
+		same, same+diff+failed, diff, failed, dropped)
+}
@@ -0,0 +1,300 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partitioned is a Source that can split itself between sharded runs,
+// such as a file source over a set of files. Shard is called before the
+// first Next and reports false if the source can't be split, in which case
+// the pipeline shares out its items instead.
+type Partitioned interface {
+	Source
+	Shard(index, count int) bool
+}
+
+// parse a -shard flag of the form <index>/<count>, counting from zero
+func parseShard(s string) (int, int, error) {
+	i, n, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count {
+		return 0, 0, fmt.Errorf("shard %q: expected <index>/<count> with 0 <= index < count", s)
+	}
+	return index, count, nil
+}
+
+// work out this run's shard, from -shard or by joining the group in
+// -shard-dir, and split the source accordingly. Every run in the group
+// reads the same source and keeps only its own share, so together they
+// see each item once.
+func (p *Pipeline) setupShard(cfg *Config) error {
+	if cfg.Shard == "" && cfg.ShardDir == "" {
+		return nil
+	}
+	if p.source == nil {
+		return errors.New("sharding needs a -source to split")
+	}
+	var index, count int
+	var err error
+	if cfg.Shard != "" {
+		if index, count, err = parseShard(cfg.Shard); err != nil {
+			return err
+		}
+	} else {
+		if p.member, err = joinShardGroup(cfg.ShardDir, cfg.RunID, cfg.ShardSettle); err != nil {
+			return err
+		}
+		index, count = p.member.index, p.member.count
+	}
+	if ps, ok := p.source.(Partitioned); ok && ps.Shard(index, count) {
+		fmt.Printf("running shard %d of %d, splitting the source's partitions\n", index, count)
+		return nil
+	}
+	key, err := compileExpr(cfg.ShardKey)
+	if err != nil {
+		return fmt.Errorf("-shard-key: %v", err)
+	}
+	s := &shardSource{Source: p.source, key: key, index: index, count: count}
+	if r, ok := p.source.(Resumable); ok {
+		p.source = &resumableShardSource{shardSource: s, r: r}
+	} else {
+		p.source = s
+	}
+	fmt.Printf("running shard %d of %d, keeping items by %s\n", index, count, key)
+	return nil
+}
+
+// shardSource passes on only the items whose shard key hashes to this
+// shard. The key has to come out the same in every run for an item, which
+// the ID does for files and tables but not for sources that number items
+// as they arrive.
+type shardSource struct {
+	Source
+	key          *expr
+	index, count int
+}
+
+func (s *shardSource) Next() (*Item, error) {
+	for {
+		item, err := s.Source.Next()
+		if err != nil {
+			return nil, err
+		}
+		v, err := s.key.eval(item)
+		if err != nil {
+			return nil, fmt.Errorf("evaluating shard key: %v", err)
+		}
+		h := fnv.New32a()
+		io.WriteString(h, fmt.Sprint(v))
+		if int(h.Sum32()%uint32(s.count)) == s.index {
+			return item, nil
+		}
+	}
+}
+
+func (s *shardSource) Close() error {
+	if c, ok := s.Source.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// resumableShardSource keeps a sharded source checkpointable. The
+// position after a skipped item is as good as after a kept one.
+type resumableShardSource struct {
+	*shardSource
+	r Resumable
+}
+
+func (s *resumableShardSource) Position() (string, error) { return s.r.Position() }
+func (s *resumableShardSource) Resume(token string) error { return s.r.Resume(token) }
+
+// how often members touch their heartbeat files, and how stale one can
+// get before its member counts as gone
+const (
+	shardHeartbeat = time.Second
+	shardExpiry    = 5 * time.Second
+)
+
+// shardMember is this run's place in a group of runs sharing a directory,
+// normally on a shared filesystem. Each member keeps a heartbeat file of
+// its own fresh, and the first member to finish waiting -shard-settle for
+// the others writes the group file, which fixes the membership at
+// whoever had turned up, in name order. A run that starts later takes the
+// place of a member whose heartbeat has gone stale, so a crashed shard is
+// simply restarted, and fails if there's no such place. Once the last
+// member leaves the group file goes, and the next group can be a
+// different size.
+type shardMember struct {
+	dir          string
+	name         string
+	index, count int
+	done         chan struct{}
+	wg           sync.WaitGroup
+}
+
+func joinShardGroup(dir, name string, settle time.Duration) (*shardMember, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m := &shardMember{dir: dir, name: name, done: make(chan struct{})}
+	if err := m.touch(); err != nil {
+		return nil, err
+	}
+	// the heartbeat has to keep going while we wait for the others, or
+	// they would take us for gone
+	m.wg.Add(1)
+	go m.beat()
+	formed, err := m.locked(m.claim)
+	if err == nil && !formed {
+		fmt.Printf("waiting %v for the other shards in %s\n", settle, dir)
+		time.Sleep(settle)
+		_, err = m.locked(func() (bool, error) {
+			if formed, err := m.claim(); formed || err != nil {
+				return formed, err
+			}
+			return true, m.form()
+		})
+	}
+	if err != nil {
+		close(m.done)
+		m.wg.Wait()
+		os.Remove(m.heartbeatPath())
+		return nil, err
+	}
+	return m, nil
+}
+
+// run fn holding the group's lock
+func (m *shardMember) locked(fn func() (bool, error)) (bool, error) {
+	l, err := tryLock(filepath.Join(m.dir, "group.lock"), true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock(l)
+	return fn()
+}
+
+func (m *shardMember) heartbeatPath() string {
+	return filepath.Join(m.dir, m.name+".member")
+}
+
+func (m *shardMember) groupPath() string {
+	return filepath.Join(m.dir, "group")
+}
+
+func (m *shardMember) touch() error {
+	return os.WriteFile(m.heartbeatPath(), nil, 0644)
+}
+
+// the members with fresh heartbeats
+func (m *shardMember) live() (map[string]bool, error) {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.member"))
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < shardExpiry {
+			live[strings.TrimSuffix(filepath.Base(path), ".member")] = true
+		}
+	}
+	return live, nil
+}
+
+// take our place in the group if it has been formed, reporting false if
+// it hasn't been yet. Called with the group lock held.
+func (m *shardMember) claim() (bool, error) {
+	data, err := os.ReadFile(m.groupPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	members := strings.Fields(string(data))
+	if i := slices.Index(members, m.name); i >= 0 {
+		m.index, m.count = i, len(members)
+		return true, nil
+	}
+	live, err := m.live()
+	if err != nil {
+		return false, err
+	}
+	for i, name := range members {
+		if !live[name] {
+			fmt.Printf("taking over shard %d from %s\n", i, name)
+			members[i] = m.name
+			m.index, m.count = i, len(members)
+			return true, m.writeGroup(members)
+		}
+	}
+	return false, fmt.Errorf("the shard group in %s already has all %d members running", m.dir, len(members))
+}
+
+// fix the group as the live members. Called with the group lock held.
+func (m *shardMember) form() error {
+	live, err := m.live()
+	if err != nil {
+		return err
+	}
+	live[m.name] = true
+	members := make([]string, 0, len(live))
+	for name := range live {
+		members = append(members, name)
+	}
+	slices.Sort(members)
+	m.index, m.count = slices.Index(members, m.name), len(members)
+	return m.writeGroup(members)
+}
+
+func (m *shardMember) writeGroup(members []string) error {
+	tmp := m.groupPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(members, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.groupPath())
+}
+
+func (m *shardMember) beat() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(shardHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(m.heartbeatPath(), now, now); err != nil {
+				fmt.Printf("error updating shard heartbeat: %v\n", err)
+			}
+		}
+	}
+}
+
+// leave the group, breaking it up if we were the last one in it
+func (m *shardMember) Close() error {
+	close(m.done)
+	m.wg.Wait()
+	_, err := m.locked(func() (bool, error) {
+		os.Remove(m.heartbeatPath())
+		live, err := m.live()
+		if err == nil && len(live) == 0 {
+			err = os.Remove(m.groupPath())
+		}
+		return false, err
+	})
+	return err
+}
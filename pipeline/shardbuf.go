@@ -0,0 +1,201 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// how long a consumer whose own shard is empty waits on it before looking
+// at the other shards again
+const shardLookEvery = time.Millisecond
+
+// shardedBuffer splits the default pool's buffer into -buffer-shards
+// channels of its own, so that at high producer and consumer counts they
+// don't all queue on one channel's lock. A built-in producer puts its
+// items on the shard of its ID and a source's items go round the shards
+// in turn; each consumer takes from the shard of its ID first, and from
+// the others when its own is empty, so no shard is left behind whatever
+// the counts. Items that go to different shards can be handled out of
+// the order they were produced in.
+type shardedBuffer struct {
+	shards []chan Item
+	next   atomic.Uint64
+
+	// items a consumer took off a shard not its own, and the times one
+	// found every shard empty and waited
+	stolen, waited atomic.Int64
+}
+
+func newShardedBuffer(cfg *Config) (*shardedBuffer, error) {
+	switch {
+	case cfg.Redis != "":
+		return nil, fmt.Errorf("-buffer-shards doesn't work with -redis, whose queue is the buffer")
+	case cfg.Batch != "":
+		return nil, fmt.Errorf("-buffer-shards doesn't work with -batch")
+	case cfg.Prefetch > 0:
+		return nil, fmt.Errorf("-buffer-shards doesn't work with -prefetch")
+	}
+	// the shards hold -buffer between them
+	size := (cfg.BufferSize + cfg.BufferShards - 1) / cfg.BufferShards
+	b := &shardedBuffer{shards: make([]chan Item, cfg.BufferShards)}
+	for i := range b.shards {
+		b.shards[i] = make(chan Item, size)
+	}
+	return b, nil
+}
+
+// the shard an item goes on
+func (b *shardedBuffer) pick(item *Item, fromSource bool) chan Item {
+	n := uint64(len(b.shards))
+	if fromSource {
+		return b.shards[(b.next.Add(1)-1)%n]
+	}
+	return b.shards[uint64(item.ProducerID)%n]
+}
+
+// try each shard once without waiting, the consumer's own first, for an
+// item, reporting how many shards were closed and drained
+func (b *shardedBuffer) try(home int) (Item, chan Item, int) {
+	closed := 0
+	for i := range b.shards {
+		ch := b.shards[(home+i)%len(b.shards)]
+		select {
+		case element, ok := <-ch:
+			if ok {
+				if i > 0 {
+					b.stolen.Add(1)
+				}
+				return element, ch, 0
+			}
+			closed++
+		default:
+		}
+	}
+	return Item{}, nil, closed
+}
+
+// take the next item for a consumer, and the shard it came off, reporting
+// false once stop is closed or every shard is closed and drained. It
+// spins over the shards first with -consumer-spin, as take does.
+func (b *shardedBuffer) take(p *Pipeline, myId int, stop <-chan struct{}) (Item, chan Item, bool) {
+	home := myId % len(b.shards)
+	var deadline time.Time
+	if spin := p.cfg.ConsumerSpin; spin > 0 {
+		deadline = time.Now().Add(spin)
+	}
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return Item{}, nil, false
+		default:
+		}
+		element, ch, closed := b.try(home)
+		if ch != nil {
+			if !deadline.IsZero() {
+				p.spins.caught.Add(1)
+			}
+			return element, ch, true
+		}
+		if closed == len(b.shards) {
+			return Item{}, nil, false
+		}
+		if !deadline.IsZero() {
+			if i%64 != 63 || time.Now().Before(deadline) {
+				runtime.Gosched()
+				continue
+			}
+			deadline = time.Time{}
+			p.spins.parked.Add(1)
+		}
+		break
+	}
+	b.waited.Add(1)
+	own := b.shards[home]
+	for {
+		look := time.NewTimer(shardLookEvery)
+		select {
+		case <-stop:
+			look.Stop()
+			return Item{}, nil, false
+		case element, ok := <-own:
+			look.Stop()
+			if ok {
+				return element, own, true
+			}
+			// all the shards are closed together, so the others just
+			// need draining
+			own = nil
+		case <-look.C:
+		}
+		element, ch, closed := b.try(home)
+		if ch != nil {
+			return element, ch, true
+		}
+		if closed == len(b.shards) {
+			return Item{}, nil, false
+		}
+	}
+}
+
+// the items on all the shards, and the room they have between them
+func (b *shardedBuffer) len() int {
+	n := 0
+	for _, ch := range b.shards {
+		n += len(ch)
+	}
+	return n
+}
+
+func (b *shardedBuffer) cap() int {
+	n := 0
+	for _, ch := range b.shards {
+		n += cap(ch)
+	}
+	return n
+}
+
+func (b *shardedBuffer) close() {
+	for _, ch := range b.shards {
+		close(ch)
+	}
+}
+
+// which shard a channel is, or -1
+func (b *shardedBuffer) index(ch chan Item) int {
+	for i, s := range b.shards {
+		if s == ch {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *shardedBuffer) printSummary(w io.Writer) {
+	fmt.Fprintf(w, "buffer shards: %d of %d items each, %d items taken off another consumer's shard, %d waits with every shard empty\n",
+		len(b.shards), cap(b.shards[0]), b.stolen.Load(), b.waited.Load())
+}
+
+// the items waiting on the default pool's buffer, all its shards with
+// -buffer-shards or its topics' queues with -fair-topics
+func (p *Pipeline) buffered() int {
+	if p.shards != nil {
+		return p.shards.len()
+	}
+	if p.fair != nil {
+		return p.fair.len()
+	}
+	return len(p.defaultBuffer())
+}
+
+func (p *Pipeline) bufferCap() int {
+	if p.shards != nil {
+		return p.shards.cap()
+	}
+	if p.fair != nil {
+		return p.fair.cap()
+	}
+	return cap(p.defaultBuffer())
+}
@@ -0,0 +1,183 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// an item a consumer is in the middle of, kept in Pipeline.inflight by
+// consumer id for the abort report
+type inflightItem struct {
+	item  Item
+	since time.Time
+}
+
+// drain the pipeline for a shutdown. If timeout passes before the drain is
+// done the run is aborted: what was left where is printed, the items that
+// never made it are written to the -salvage file when there is one, and
+// the process exits with 1. A timeout of 0 waits for the drain however
+// long it takes.
+func (p *Pipeline) shutdown(timeout time.Duration) {
+	p.drain()
+	if timeout <= 0 {
+		return
+	}
+	time.AfterFunc(timeout, func() {
+		fmt.Printf("drain took over %s, aborting\n", timeout)
+		p.abort(os.Stdout)
+		os.Exit(1)
+	})
+}
+
+// report what an aborted run leaves unfinished and salvage what it can
+func (p *Pipeline) abort(w io.Writer) {
+	var salvage *os.File
+	var enc *json.Encoder
+	if p.cfg.Salvage != "" {
+		var err error
+		if salvage, err = os.OpenFile(p.cfg.Salvage, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			fmt.Fprintf(w, "error opening salvage file: %v\n", err)
+		} else {
+			defer salvage.Close()
+			enc = json.NewEncoder(salvage)
+		}
+	}
+	saved := 0
+	save := func(item Item, reason string) {
+		if enc == nil {
+			return
+		}
+		unpack(&item)
+		if err := enc.Encode(DeadLetter{Item: item, Reason: reason, Time: time.Now()}); err != nil {
+			fmt.Fprintf(w, "error writing salvage file: %v\n", err)
+			enc = nil
+			return
+		}
+		saved++
+	}
+
+	// take whatever is left off each buffer
+	type buffer struct {
+		name string
+		ch   chan Item
+	}
+	buffers := []buffer{{"buffer", p.defaultBuffer()}}
+	if p.shards != nil {
+		buffers = buffers[:0]
+		for i, ch := range p.shards.shards {
+			buffers = append(buffers, buffer{fmt.Sprintf("buffer shard %d", i), ch})
+		}
+	}
+	if p.fair != nil {
+		buffers = buffers[:0]
+		for _, q := range p.fair.all() {
+			buffers = append(buffers, buffer{"buffer topic " + q.name(), q.ch})
+		}
+	}
+	if p.input != p.channel {
+		buffers = append(buffers, buffer{"redis outbox", p.input})
+	}
+	for _, pool := range p.pools {
+		buffers = append(buffers, buffer{"pool " + pool.name, pool.channel})
+	}
+	for _, b := range buffers {
+		n := 0
+	take:
+		for {
+			select {
+			case item, ok := <-b.ch:
+				if !ok {
+					break take
+				}
+				save(item, "left on the "+b.name)
+				n++
+			default:
+				break take
+			}
+		}
+		fmt.Fprintf(w, "  %s: %d items left\n", b.name, n)
+	}
+	if p.prefetch != nil {
+		n := 0
+		for id, ch := range p.prefetch.buffers() {
+		drain:
+			for {
+				select {
+				case item, ok := <-ch:
+					if !ok {
+						break drain
+					}
+					save(item, fmt.Sprintf("prefetched by consumer %d", id))
+					n++
+				default:
+					break drain
+				}
+			}
+		}
+		fmt.Fprintf(w, "  prefetched: %d items left\n", n)
+	}
+
+	// handled items that a batch never wrote to the sink
+	batched := 0
+	p.batches.Range(func(_, v any) bool {
+		for _, e := range v.(*consumerBatch).take() {
+			save(e.original, "handled but its batch wasn't written")
+			batched++
+		}
+		return true
+	})
+	if batched > 0 {
+		fmt.Fprintf(w, "  batches: %d items not written to the sink\n", batched)
+	}
+
+	// handled items whose writes were still in a write-behind buffer, which
+	// aren't settled, so a transport redelivers them
+	for _, b := range p.behind {
+		n := 0
+		seen := make(map[*itemHold]bool)
+		for _, e := range b.take() {
+			if !seen[e.hold] {
+				seen[e.hold] = true
+				save(e.original, "handled but its write-behind buffer wasn't flushed")
+			}
+			n++
+		}
+		if n > 0 {
+			fmt.Fprintf(w, "  write-behind %s: %d writes not flushed to the sink\n", b.name, n)
+		}
+	}
+
+	var busy []int
+	p.inflight.Range(func(k, _ any) bool {
+		busy = append(busy, k.(int))
+		return true
+	})
+	sort.Ints(busy)
+	if len(busy) == 0 {
+		fmt.Fprintln(w, "  no consumer was in the middle of an item")
+	}
+	for _, id := range busy {
+		v, ok := p.inflight.Load(id)
+		if !ok {
+			continue
+		}
+		f := v.(*inflightItem)
+		fmt.Fprintf(w, "  consumer %d: on item %d of producer %d for %s\n",
+			id, f.item.ID, f.item.ProducerID, time.Since(f.since).Round(time.Millisecond))
+		// it may have been finished by now, so it could be in the sink too
+		save(f.item, fmt.Sprintf("in flight on consumer %d, may have been handled", id))
+	}
+	if enc != nil {
+		fmt.Fprintf(w, "salvaged %d items to %s\n", saved, p.cfg.Salvage)
+	}
+}
+
+// note which item a consumer is on, returning the func that clears it
+func (p *Pipeline) working(myId int, item Item) func() {
+	p.inflight.Store(myId, &inflightItem{item: item, since: time.Now()})
+	return func() { p.inflight.Delete(myId) }
+}
@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"syscall"
+)
+
+// handleSignals sets what signals do while the pipeline runs:
+//
+//	SIGINT, SIGTERM  drain, aborting if -drain-timeout passes first; a second exits straight away
+//	SIGUSR1          print the pipeline's status and every goroutine's stack to stderr
+//	SIGUSR2          switch -verbose logging on or off
+//	SIGHUP           read the -config file again and apply what can change while running
+//
+// SIGINT and SIGTERM drain rather than kill so that what is buffered gets
+// handled, which is how service managers and Kubernetes ask a process to
+// stop. There is no SIGUSR1, SIGUSR2 or SIGHUP on Windows.
+func (p *Pipeline) handleSignals() {
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, controlSignals...)...)
+	go func() {
+		loaded := p.cfg
+		draining := false
+		for sig := range sigs {
+			switch {
+			case sig != os.Interrupt && sig != syscall.SIGTERM:
+				loaded = p.control(sig, loaded)
+			case draining:
+				fmt.Printf("%s: exiting now\n", sig)
+				os.Exit(1)
+			default:
+				draining = true
+				fmt.Printf("%s: draining, signal again to exit now\n", sig)
+				p.shutdown(loaded.DrainTimeout)
+			}
+		}
+	}()
+}
+
+// print the pipeline's state and what every goroutine is doing, for a
+// look at a run that seems stuck
+func (p *Pipeline) dumpState(w io.Writer) {
+	b, _ := json.MarshalIndent(p.status(), "", "  ")
+	fmt.Fprintf(w, "pipeline %s:\n%s\n", p.name, b)
+	pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// log a line about an item when -verbose logging is on
+func (p *Pipeline) logf(format string, args ...any) {
+	if p.verbose.Load() {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// read the -config file again, on top of the command line as at the start,
+// and apply the settings that can change while the pipeline runs: the
+// rate, the pool sizes, the error log sampling, verbose logging and the
+// drain timeout. Anything else that changed is reported as waiting for a
+// restart. old is the config as last loaded, and what is now loaded is
+// returned.
+func (p *Pipeline) reload(old *Config) *Config {
+	if old.ConfigFile == "" {
+		fmt.Println("reload: there is no -config file to read")
+		return old
+	}
+	cfg, err := parseConfig(old.args)
+	if err != nil {
+		fmt.Printf("reload: %v, keeping the settings as they were\n", err)
+		return old
+	}
+	cfg.RunID = old.RunID
+	var applied []string
+	if cfg.Rate != old.Rate {
+		p.gov.setRate(cfg.Rate)
+		applied = append(applied, fmt.Sprintf("rate %g", cfg.Rate))
+	}
+	producers, consumers := -1, -1
+	if cfg.Producers != old.Producers && !cfg.AutoProducers && !old.AutoProducers {
+		producers = cfg.Producers
+	}
+	if cfg.Consumers != old.Consumers && !cfg.AutoConsumers && !old.AutoConsumers {
+		consumers = cfg.Consumers
+	}
+	if producers >= 0 || consumers >= 0 {
+		if err := p.scale(producers, consumers); err != nil {
+			fmt.Printf("reload: %v\n", err)
+		} else {
+			applied = append(applied, fmt.Sprintf("%d producers, %d consumers", cfg.Producers, cfg.Consumers))
+		}
+	}
+	if cfg.ErrorLogFirst != old.ErrorLogFirst || cfg.ErrorLogEvery != old.ErrorLogEvery {
+		p.stats.sampleErrors(cfg.ErrorLogFirst, cfg.ErrorLogEvery)
+		applied = append(applied, "error log sampling")
+	}
+	if cfg.Verbose != old.Verbose {
+		p.verbose.Store(cfg.Verbose)
+		applied = append(applied, fmt.Sprintf("verbose %t", cfg.Verbose))
+	}
+	if cfg.DrainTimeout != old.DrainTimeout {
+		applied = append(applied, fmt.Sprintf("drain timeout %s", cfg.DrainTimeout))
+	}
+	// whatever else changed waits for a restart
+	var waiting []string
+	live := map[string]bool{"Rate": true, "ErrorLogFirst": true, "ErrorLogEvery": true, "Verbose": true, "DrainTimeout": true}
+	if producers >= 0 || cfg.Producers == old.Producers {
+		live["Producers"], live["AutoProducers"] = true, true
+	}
+	if consumers >= 0 || cfg.Consumers == old.Consumers {
+		live["Consumers"], live["AutoConsumers"] = true, true
+	}
+	was, now := reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < now.NumField(); i++ {
+		field := now.Type().Field(i)
+		if !field.IsExported() || live[field.Name] {
+			continue
+		}
+		if !reflect.DeepEqual(was.Field(i).Interface(), now.Field(i).Interface()) {
+			waiting = append(waiting, field.Name)
+			// so it is reported again next time rather than forgotten
+			now.Field(i).Set(was.Field(i))
+		}
+	}
+	if len(applied) == 0 && len(waiting) == 0 {
+		fmt.Printf("reload: %s has no changes\n", cfg.ConfigFile)
+	}
+	if len(applied) > 0 {
+		fmt.Printf("reload: applied %s\n", strings.Join(applied, ", "))
+	}
+	if len(waiting) > 0 {
+		fmt.Printf("reload: %s changed, which needs a restart to take effect\n", strings.Join(waiting, ", "))
+	}
+	return cfg
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package pipeline
+
+import "os"
+
+// Windows has no signals to control a run with besides stopping it
+var controlSignals []os.Signal
+
+func (p *Pipeline) control(sig os.Signal, loaded *Config) *Config {
+	return loaded
+}
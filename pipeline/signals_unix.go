@@ -0,0 +1,27 @@
+//go:build unix
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// the signals that control a run besides stopping it
+var controlSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP}
+
+// act on one of the controlSignals, returning the config as now loaded
+func (p *Pipeline) control(sig os.Signal, loaded *Config) *Config {
+	switch sig {
+	case syscall.SIGUSR1:
+		p.dumpState(os.Stderr)
+	case syscall.SIGUSR2:
+		on := !p.verbose.Load()
+		p.verbose.Store(on)
+		fmt.Printf("verbose logging %s\n", map[bool]string{true: "on", false: "off"}[on])
+	case syscall.SIGHUP:
+		return p.reload(loaded)
+	}
+	return loaded
+}
@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+// simulation is a discrete-event model of the pipeline: the same producers,
+// buffer and consumers, and the same -rate, -buffer-full and -ttl, but
+// nothing sleeps. Each thing that would take time is an event at a point
+// on a virtual clock, and the clock jumps straight to the next event, so a
+// run that would take ten minutes takes as long as it takes to work through
+// its events. Items aren't really handled, the consumers just take
+// -delay over each one, which makes it a way to try out buffer sizes and
+// worker counts before running anything for real.
+type simulation struct {
+	cfg    *Config
+	stats  *Stats
+	start  time.Time
+	now    time.Duration // virtual time since the start
+	events simEvents
+	seq    int64 // orders events at the same time by when they were scheduled
+
+	buffer    []time.Duration // when each queued item was made
+	blocked   []simBlocked    // producers waiting for room, in order
+	idle      int             // consumers with nothing to do
+	left      []int           // items each producer has still to make
+	nextToken time.Duration   // when the rate lets the next item be made
+	end       time.Duration   // when the last consumer finished
+	rand      *rand.Rand      // from -seed, so a simulation can be repeated
+}
+
+type simBlocked struct {
+	producer int
+	made     time.Duration
+}
+
+type simEvent struct {
+	at       time.Duration
+	seq      int64
+	producer int // -1 for a consumer finishing an item
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	return e[i].at < e[j].at || e[i].at == e[j].at && e[i].seq < e[j].seq
+}
+func (e simEvents) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x any)   { *e = append(*e, x.(simEvent)) }
+func (e *simEvents) Pop() any {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+// check that the config only uses what the simulation models
+func newSimulation(cfg *Config) (*simulation, error) {
+	switch {
+	case cfg.Source != "" || cfg.Redis != "" || cfg.MQTTSubscribe != "" || cfg.JoinSource != "":
+		return nil, errors.New("-simulate only models the built-in producers, not a source, queue or join")
+	case len(cfg.Routes) > 0 || cfg.Batch != "" || cfg.AutoProducers || cfg.AutoConsumers:
+		return nil, errors.New("-simulate doesn't model routing, batching or auto sizing")
+	case cfg.SimulateDelays != "fixed" && cfg.SimulateDelays != "exponential":
+		return nil, fmt.Errorf("-simulate-delays %q: expected fixed or exponential", cfg.SimulateDelays)
+	case cfg.Consumers < 1:
+		return nil, errors.New("-simulate needs at least one consumer")
+	case cfg.ProducerLanes > 0:
+		return nil, errors.New("-simulate doesn't model -producer-lanes")
+	case cfg.EvictAfter > 0:
+		return nil, errors.New("-simulate doesn't model -evict-after, though it does -ttl")
+	}
+	switch cfg.BufferFull {
+	case fullBlock, fullDropNewest, fullDropOldest:
+	default:
+		return nil, fmt.Errorf("-buffer-full %q: expected %s, %s or %s", cfg.BufferFull, fullBlock, fullDropNewest, fullDropOldest)
+	}
+	s := &simulation{cfg: cfg, stats: NewStats(), idle: cfg.Consumers, left: make([]int, cfg.Producers),
+		rand: rand.New(rand.NewSource(cfg.Seed))}
+	s.start = s.stats.start
+	s.stats.clock = func() time.Time { return s.start.Add(s.now) }
+	s.stats.setWorkers(cfg.Producers, cfg.Consumers)
+	for i := range s.left {
+		s.left[i] = cfg.ItemsPerProducer
+	}
+	return s, nil
+}
+
+func (s *simulation) schedule(at time.Duration, producer int) {
+	s.seq++
+	heap.Push(&s.events, simEvent{at: at, seq: s.seq, producer: producer})
+}
+
+// run the model to the end and fill in the stats, with the virtual clock
+// as their start and end
+func (s *simulation) run() {
+	for i := range s.left {
+		s.next(i)
+	}
+	for s.events.Len() > 0 {
+		e := heap.Pop(&s.events).(simEvent)
+		s.now = e.at
+		if e.producer < 0 {
+			s.consumerFree()
+		} else {
+			s.make(e.producer)
+		}
+	}
+	s.stats.end = s.start.Add(s.end)
+}
+
+// schedule a producer's next item, once the rate allows
+func (s *simulation) next(producer int) {
+	if s.left[producer] == 0 {
+		return
+	}
+	at := s.now
+	if s.cfg.Rate > 0 {
+		at = max(at, s.nextToken)
+		s.nextToken = at + time.Duration(float64(time.Second)/s.cfg.Rate)
+	}
+	s.schedule(at, producer)
+}
+
+// a producer makes an item and tries to queue it
+func (s *simulation) make(producer int) {
+	s.left[producer]--
+	made := s.now
+	switch {
+	case s.idle > 0 && len(s.buffer) == 0:
+		// straight to a waiting consumer
+		s.produced()
+		s.take(made)
+	case len(s.buffer) < s.cfg.BufferSize:
+		s.produced()
+		s.buffer = append(s.buffer, made)
+	case s.cfg.BufferFull == fullDropNewest:
+		s.stats.recordDrop(DropFull)
+	case s.cfg.BufferFull == fullDropOldest && len(s.buffer) > 0:
+		s.stats.recordDrop(DropFull)
+		s.produced()
+		s.buffer = append(s.buffer[1:], made)
+	default:
+		// waits for room, and makes no more until then
+		s.blocked = append(s.blocked, simBlocked{producer, made})
+		return
+	}
+	s.next(producer)
+}
+
+// a consumer starts on an item made at made
+func (s *simulation) take(made time.Duration) {
+	s.idle--
+	age := s.now - made
+	s.stats.recordConsumed(age)
+	if s.cfg.TTL > 0 && age > s.cfg.TTL {
+		s.stats.recordDrop(DropExpired)
+	}
+	d := s.cfg.ConsumeDelay
+	if s.cfg.SimulateDelays == "exponential" {
+		d = time.Duration(s.rand.ExpFloat64() * float64(d))
+	}
+	s.stats.recordService(1, d)
+	s.schedule(s.now+d, -1)
+}
+
+// count an item going onto the buffer, at the virtual time the stats'
+// clock reads
+func (s *simulation) produced() {
+	s.stats.recordProduced()
+}
+
+// a consumer finishes an item and takes the next, letting a blocked
+// producer in behind it
+func (s *simulation) consumerFree() {
+	s.idle++
+	s.end = s.now
+	if len(s.buffer) > 0 {
+		made := s.buffer[0]
+		s.buffer = s.buffer[1:]
+		s.take(made)
+	}
+	if len(s.blocked) > 0 && (len(s.buffer) < s.cfg.BufferSize || s.idle > 0) {
+		b := s.blocked[0]
+		s.blocked = s.blocked[1:]
+		s.produced()
+		s.stats.blocked += s.now - b.made
+		if s.idle > 0 && len(s.buffer) == 0 {
+			s.take(b.made)
+		} else {
+			s.buffer = append(s.buffer, b.made)
+		}
+		s.next(b.producer)
+	}
+}
+
+// simulate the run the config describes and print its summary, like a
+// real run would, and how long it took in real time
+func simulate(cfg *Config, w io.Writer) error {
+	s, err := newSimulation(cfg)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	s.run()
+	s.stats.printSummary(w)
+	report := newReport(s.stats, nil)
+	if report.Queueing = analyzeQueue(s.stats, cfg.BufferSize, cfg.Rate); report.Queueing != nil {
+		report.Queueing.printSummary(w)
+	}
+	fmt.Fprintf(w, "simulated %s in %s\n", s.end.Round(time.Millisecond), time.Since(started).Round(time.Millisecond))
+	if cfg.Report != "" {
+		if err := writeReport(cfg.Report, report); err != nil {
+			fmt.Fprintf(w, "error writing report: %v\n", err)
+		}
+	}
+	if cfg.Manifest != "" {
+		if err := writeManifest(cfg.Manifest, newManifest(cfg, started, report)); err != nil {
+			fmt.Fprintf(w, "error writing manifest: %v\n", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package pipeline
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// how many writes -sink-writers lets wait on each writer before the
+// consumers handing them over wait too
+const orderLaneMax = 64
+
+// orderedSink writes to the sink from -sink-writers goroutines of its own
+// while keeping the writes for items with the same -sink-order-key in
+// order, as upserts to a database need. Each item is given a ticket in
+// its key's queue as it is put on a buffer, and what handling it comes to
+// is only written once every item with that key put on a buffer before it
+// has been settled; until then the writes wait, and the consumer moves on
+// to its next item. Items with different keys are written in parallel,
+// each key always by the same writer. As with -write-behind, an item is
+// only settled once its writes are done.
+//
+// The order is the one the items were put on the buffers in, which is the
+// order a producer made them in, and the source's order with a single
+// producer.
+type orderedSink struct {
+	p     *Pipeline
+	sink  Sink
+	key   *expr
+	lanes []*orderLane
+
+	mu      sync.Mutex
+	next    uint64
+	tickets map[uint64]*orderTicket // the open ones
+	keys    map[string][]uint64     // tickets by key, oldest first
+
+	writes, waited, parked atomic.Int64
+}
+
+// an item's place in its key's queue
+type orderTicket struct {
+	key    string
+	lane   int
+	head   bool         // first in the queue, so its writes go straight out
+	parked []orderWrite // writes waiting for the items before it
+}
+
+type orderWrite struct {
+	batchEntry
+	hold *itemHold
+}
+
+// one writer, which does the writes handed to it one after another
+type orderLane struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	jobs []orderWrite
+	busy bool
+	quit bool
+	done chan struct{}
+}
+
+func newOrderedSink(p *Pipeline, cfg *Config) (*orderedSink, error) {
+	if p.sink == nil {
+		return nil, fmt.Errorf("-sink-order-key needs a -sink to write to")
+	}
+	if cfg.Batch != "" {
+		return nil, fmt.Errorf("-sink-order-key doesn't work with -batch, whose batches are written by the consumers")
+	}
+	if cfg.Redis != "" {
+		return nil, fmt.Errorf("-sink-order-key can't keep items in order across a redis queue")
+	}
+	if cfg.SinkWriters < 1 {
+		return nil, fmt.Errorf("-sink-writers must be at least 1")
+	}
+	key, err := compileExpr(cfg.SinkOrderKey)
+	if err != nil {
+		return nil, fmt.Errorf("-sink-order-key: %v", err)
+	}
+	s := &orderedSink{
+		p:       p,
+		sink:    p.sink,
+		key:     key,
+		tickets: make(map[uint64]*orderTicket),
+		keys:    make(map[string][]uint64),
+	}
+	for range cfg.SinkWriters {
+		l := &orderLane{done: make(chan struct{})}
+		l.cond = sync.NewCond(&l.mu)
+		s.lanes = append(s.lanes, l)
+		go s.run(l)
+	}
+	return s, nil
+}
+
+// give an item its ticket as it goes on a buffer. Safe on a nil sink.
+func (s *orderedSink) register(item *Item) {
+	if s == nil {
+		return
+	}
+	v, err := s.key.eval(item)
+	if err != nil {
+		// it is written whenever it is handled
+		s.p.stats.errorf("error evaluating sink order key of item %d: %v", item.ID, err)
+		return
+	}
+	k := fmt.Sprint(v)
+	h := fnv.New32a()
+	io.WriteString(h, k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	item.order = s.next
+	q := s.keys[k]
+	s.tickets[s.next] = &orderTicket{key: k, lane: int(h.Sum32() % uint32(len(s.lanes))), head: len(q) == 0}
+	s.keys[k] = append(q, s.next)
+}
+
+// take the ticket of an item that has been settled, or never made it onto
+// a buffer, out of its key's queue, letting the writes of the next item
+// with the key go. Safe on a nil sink.
+func (s *orderedSink) finished(item *Item) {
+	if s == nil || item.order == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tickets[item.order]
+	if t == nil {
+		return
+	}
+	delete(s.tickets, item.order)
+	if !t.head {
+		return
+	}
+	// the tickets after it that are already finished go too, as they
+	// can't have had writes waiting
+	q := s.keys[t.key]
+	for len(q) > 0 && s.tickets[q[0]] == nil {
+		q = q[1:]
+	}
+	if len(q) == 0 {
+		delete(s.keys, t.key)
+		return
+	}
+	s.keys[t.key] = q
+	next := s.tickets[q[0]]
+	next.head = true
+	// handed over with the lock held, so they go before any write the
+	// item's consumer makes after this
+	for _, w := range next.parked {
+		s.parked.Add(-1)
+		s.lanes[next.lane].push(w)
+	}
+	next.parked = nil
+}
+
+// take a write for the item a consumer is on, which goes to the key's
+// writer once the items before it are settled
+func (s *orderedSink) queue(e batchEntry, hold *itemHold) error {
+	s.mu.Lock()
+	t := s.tickets[e.original.order]
+	s.mu.Unlock()
+	if t == nil {
+		return s.write(&e, hold)
+	}
+	if !hold.add() {
+		return s.write(&e, nil)
+	}
+	// wait for room before taking the lock, which the writers need
+	s.lanes[t.lane].waitRoom()
+	s.writes.Add(1)
+	w := orderWrite{e, hold}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.head {
+		s.lanes[t.lane].push(w)
+		return nil
+	}
+	s.waited.Add(1)
+	s.parked.Add(1)
+	t.parked = append(t.parked, w)
+	return nil
+}
+
+// an item whose consumer has moved on, such as one the joiner emits late,
+// is written straight away
+func (s *orderedSink) Write(item *Item) error {
+	return s.p.limits.write(s.sink, item)
+}
+
+// write to the sink, or to its write-behind buffer, which then holds the
+// item in turn
+func (s *orderedSink) write(e *batchEntry, hold *itemHold) error {
+	if bs, ok := s.sink.(behindSink); ok && hold != nil {
+		return bs.queue(*e, hold)
+	}
+	return s.p.limits.write(s.sink, &e.item)
+}
+
+func (s *orderedSink) run(l *orderLane) {
+	defer close(l.done)
+	for {
+		l.mu.Lock()
+		for len(l.jobs) == 0 && !l.quit {
+			l.cond.Wait()
+		}
+		if len(l.jobs) == 0 {
+			l.mu.Unlock()
+			return
+		}
+		w := l.jobs[0]
+		l.jobs = l.jobs[1:]
+		l.busy = true
+		l.cond.Broadcast()
+		l.mu.Unlock()
+
+		err := s.p.retry(&w.original, 0, func() error { return s.write(&w.batchEntry, w.hold) })
+		s.p.health.wrote(err)
+		if err != nil {
+			s.p.deliverFailed(fmt.Errorf("error writing item %d to sink: %w", w.item.ID, err), w.original, w.piece)
+		}
+		w.hold.release()
+
+		l.mu.Lock()
+		l.busy = false
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}
+}
+
+// hand a write to the writer, however many it has waiting, since the
+// writers hand over the writes that were waiting for theirs too
+func (l *orderLane) push(w orderWrite) {
+	l.mu.Lock()
+	l.jobs = append(l.jobs, w)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *orderLane) waitRoom() {
+	l.mu.Lock()
+	for len(l.jobs) >= orderLaneMax && !l.quit {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+}
+
+// wait until every writer has done what it was given, including what one
+// writer's writes let go on another. Safe on a nil sink.
+func (s *orderedSink) wait() {
+	if s == nil {
+		return
+	}
+	for idle := false; !idle; {
+		idle = true
+		for _, l := range s.lanes {
+			l.mu.Lock()
+			for len(l.jobs) > 0 || l.busy {
+				idle = false
+				l.cond.Wait()
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (s *orderedSink) Ping() error {
+	if p, ok := s.sink.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// finish the writes handed over and close the sink
+func (s *orderedSink) Close() error {
+	for _, l := range s.lanes {
+		l.mu.Lock()
+		l.quit = true
+		l.cond.Broadcast()
+		l.mu.Unlock()
+		<-l.done
+	}
+	if c, ok := s.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *orderedSink) printSummary(w io.Writer) {
+	fmt.Fprintf(w, "sink order: %d writes by %d writers, %d waited for an earlier item with their key\n",
+		s.writes.Load(), len(s.lanes), s.waited.Load())
+}
@@ -0,0 +1,171 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// the name -sink-route rules give the -sink by
+const defaultSink = "default"
+
+// sinkRouter lets a handler pick where what it made of an item goes.
+// Sinks of their own are given names with -named-sink, and -sink-route
+// rules send items by the Status the handler put in their Result to one or
+// more of them, e.g. valid to a table and suspect to a file for review.
+// Items with a status no rule names go to the -sink, or are printed when
+// there is none. Each sink counts what it wrote and failed to. An item
+// that one of its sinks fails on counts as failed, and a retry writes it
+// to all of them again.
+type sinkRouter struct {
+	sinks  map[string]*routedSink
+	names  []string            // of the sinks, in order
+	routes map[string][]string // sinks by status
+	limits *stageLimits
+}
+
+type routedSink struct {
+	Sink
+	written, failed atomic.Int64
+}
+
+// what the sink wrote and failed to, including through its write-behind
+// buffer when it has one
+func (s *routedSink) counts() (written, failed int64) {
+	written, failed = s.written.Load(), s.failed.Load()
+	if w, ok := s.Sink.(*writeBehind); ok {
+		written += w.written.Load()
+		failed += w.failed.Load()
+	}
+	return written, failed
+}
+
+// printSink is where unrouted items go without a -sink, printed as the
+// consumers print them when there's no sink at all
+type printSink struct {
+	n atomic.Int64
+}
+
+func (s *printSink) Write(item *Item) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("element %d is: %s\n", s.n.Add(1), b)
+	return nil
+}
+
+// build the router from -named-sink and -sink-route, around the -sink,
+// which may be nil
+func newSinkRouter(cfg *Config, def Sink) (*sinkRouter, error) {
+	if def == nil {
+		def = &printSink{}
+	}
+	r := &sinkRouter{
+		sinks:  map[string]*routedSink{defaultSink: {Sink: def}},
+		names:  []string{defaultSink},
+		routes: make(map[string][]string),
+	}
+	for _, s := range cfg.NamedSinks {
+		name, spec, ok := strings.Cut(s, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || spec == "" {
+			r.Close()
+			return nil, fmt.Errorf("named sink %q: expected <name>=<sink>", s)
+		}
+		if r.sinks[name] != nil {
+			r.Close()
+			return nil, fmt.Errorf("named sink %q: there is already a sink named %s", s, name)
+		}
+		sink, err := loadSink(spec, cfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("named sink %s: %v", name, err)
+		}
+		r.sinks[name] = &routedSink{Sink: sink}
+		r.names = append(r.names, name)
+	}
+	for _, s := range cfg.SinkRoutes {
+		status, to, ok := strings.Cut(s, "=")
+		status = strings.TrimSpace(status)
+		if !ok || status == "" || to == "" {
+			r.Close()
+			return nil, fmt.Errorf("sink route %q: expected <status>=<sink>[,<sink>...]", s)
+		}
+		for _, name := range strings.Split(to, ",") {
+			name = strings.TrimSpace(name)
+			if r.sinks[name] == nil {
+				r.Close()
+				return nil, fmt.Errorf("sink route %q: no sink named %s, see -named-sink", s, name)
+			}
+			r.routes[status] = append(r.routes[status], name)
+		}
+	}
+	return r, nil
+}
+
+// the sinks an item goes to
+func (r *sinkRouter) route(item *Item) []string {
+	if item.Result != nil {
+		if names, ok := r.routes[item.Result.Status]; ok {
+			return names
+		}
+	}
+	return r.names[:1]
+}
+
+func (r *sinkRouter) Write(item *Item) error {
+	var errs []error
+	for _, name := range r.route(item) {
+		s := r.sinks[name]
+		if err := r.limits.write(s.Sink, item); err != nil {
+			s.failed.Add(1)
+			errs = append(errs, fmt.Errorf("sink %s: %w", name, err))
+			continue
+		}
+		s.written.Add(1)
+	}
+	return errors.Join(errs...)
+}
+
+// healthy when every sink that can say is
+func (r *sinkRouter) Ping() error {
+	for _, name := range r.names {
+		if p, ok := r.sinks[name].Sink.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				return fmt.Errorf("sink %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *sinkRouter) Close() error {
+	var errs []error
+	for _, name := range r.names {
+		if c, ok := r.sinks[name].Sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %v", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *sinkRouter) printSummary(w io.Writer) {
+	names := append([]string(nil), r.names...)
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		written, failed := r.sinks[name].counts()
+		parts[i] = fmt.Sprintf("%s %d written", name, written)
+		if failed > 0 {
+			parts[i] += fmt.Sprintf(", %d failed", failed)
+		}
+	}
+	fmt.Fprintf(w, "sinks: %s\n", strings.Join(parts, "; "))
+}
@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SLO is a latency objective on the queue latency, e.g. p99 < 200ms.
+type SLO struct {
+	Name       string // the text it was declared with, e.g. "p99<200ms"
+	Percentile float64
+	Threshold  time.Duration
+}
+
+// parse an SLO declaration of the form p<percentile><<duration>, e.g.
+// "p99<200ms" or "p99.9<1s"
+func parseSLO(s string) (SLO, error) {
+	spec := strings.ReplaceAll(s, " ", "")
+	name, limit, ok := strings.Cut(spec, "<")
+	if !ok || !strings.HasPrefix(name, "p") {
+		return SLO{}, fmt.Errorf("slo %q: expected the form p99<200ms", s)
+	}
+	pct, err := strconv.ParseFloat(name[1:], 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return SLO{}, fmt.Errorf("slo %q: bad percentile %q", s, name[1:])
+	}
+	threshold, err := time.ParseDuration(limit)
+	if err != nil {
+		return SLO{}, fmt.Errorf("slo %q: %v", s, err)
+	}
+	return SLO{Name: spec, Percentile: pct, Threshold: threshold}, nil
+}
+
+// sloList lets the -slo flag be given more than once
+type sloList []SLO
+
+func (l *sloList) String() string {
+	names := make([]string, len(*l))
+	for i, slo := range *l {
+		names[i] = slo.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *sloList) Set(s string) error {
+	slo, err := parseSLO(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, slo)
+	return nil
+}
+
+// SLOBreach is passed to the breach callback when an SLO goes from being
+// met to being violated.
+type SLOBreach struct {
+	SLO      SLO
+	Observed time.Duration // latency at the SLO percentile in the window
+	Window   time.Time     // end of the window that breached
+}
+
+// compliance counters for one SLO
+type sloState struct {
+	SLO
+	windows  int // windows that had traffic
+	met      int // windows where the SLO held
+	breached bool
+}
+
+// sloTracker evaluates every SLO over consecutive windows of queue latency
+// taken from a Stats. OnBreach, if set, is called once each time an SLO
+// starts being violated; it does not fire again until the SLO recovers.
+type sloTracker struct {
+	mu       sync.Mutex
+	stats    *Stats
+	states   []*sloState
+	interval time.Duration
+	OnBreach func(SLOBreach)
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func newSLOTracker(slos []SLO, stats *Stats, interval time.Duration) *sloTracker {
+	t := &sloTracker{
+		stats:    stats,
+		interval: interval,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	for _, slo := range slos {
+		t.states = append(t.states, &sloState{SLO: slo})
+	}
+	return t
+}
+
+// start evaluating windows in the background
+func (t *sloTracker) start() {
+	go func() {
+		defer close(t.finished)
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				t.evaluate(time.Now())
+				return
+			case now := <-ticker.C:
+				t.evaluate(now)
+			}
+		}
+	}()
+}
+
+// check the latest window against every SLO. Empty windows are skipped so
+// an idle pipeline neither meets nor breaches its objectives.
+func (t *sloTracker) evaluate(now time.Time) {
+	w := t.stats.takeWindow()
+	if w.total == 0 {
+		return
+	}
+	var breaches []SLOBreach
+	t.mu.Lock()
+	for _, st := range t.states {
+		observed := w.quantile(st.Percentile / 100)
+		st.windows++
+		if observed <= st.Threshold {
+			st.met++
+			st.breached = false
+			continue
+		}
+		if !st.breached {
+			st.breached = true
+			breaches = append(breaches, SLOBreach{SLO: st.SLO, Observed: observed, Window: now})
+		}
+	}
+	t.mu.Unlock()
+	for _, b := range breaches {
+		if t.OnBreach != nil {
+			t.OnBreach(b)
+		}
+	}
+}
+
+// evaluate the final partial window and stop the background loop
+func (t *sloTracker) stop() {
+	close(t.done)
+	<-t.finished
+}
+
+// SLOResult is how well one SLO held up over a run
+type SLOResult struct {
+	Name       string
+	Met        bool          // whether the whole run taken together met it
+	Observed   time.Duration // run-wide latency at the SLO percentile
+	Windows    int
+	Attainment float64 // percent of windows that met the SLO
+}
+
+// work out the attainment of each SLO, both as the share of windows that
+// met it and whether the whole run taken together met it
+func (t *sloTracker) results() []SLOResult {
+	all := t.stats.latencies()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var results []SLOResult
+	for _, st := range t.states {
+		attainment := 100.0
+		if st.windows > 0 {
+			attainment = 100 * float64(st.met) / float64(st.windows)
+		}
+		overall := all.quantile(st.Percentile / 100)
+		results = append(results, SLOResult{
+			Name:       st.Name,
+			Met:        overall <= st.Threshold,
+			Observed:   overall,
+			Windows:    st.windows,
+			Attainment: attainment,
+		})
+	}
+	return results
+}
+
+func (r SLOResult) Verdict() string {
+	if r.Met {
+		return "met"
+	}
+	return "MISSED"
+}
+
+func (t *sloTracker) printSummary(w io.Writer) {
+	for _, r := range t.results() {
+		fmt.Fprintf(w, "slo %s: %s over the run (observed %s), %.1f%% of %d windows met\n",
+			r.Name, r.Verdict(), r.Observed, r.Attainment, r.Windows)
+	}
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// spinStats count how the consumers' receives went with -consumer-spin:
+// the items taken while spinning, and the times a consumer gave up and
+// parked on the channel instead
+type spinStats struct {
+	caught, parked atomic.Int64
+}
+
+// take the next item off a channel for a consumer, reporting false once
+// stop or the channel is closed. With -consumer-spin the consumer polls
+// the channel for that long first, yielding between tries, rather than
+// parking on it straight away: the item is noticed the moment it arrives
+// instead of once the scheduler wakes the consumer, at the cost of a
+// core kept busy while there is nothing to do.
+func (p *Pipeline) take(channel <-chan Item, stop <-chan struct{}) (Item, bool) {
+	if spin := p.cfg.ConsumerSpin; spin > 0 {
+		deadline := time.Now().Add(spin)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return Item{}, false
+			case element, ok := <-channel:
+				if ok {
+					p.spins.caught.Add(1)
+				}
+				return element, ok
+			default:
+			}
+			// the clock costs more than a try, so look at it now and then
+			if i%64 == 63 && time.Now().After(deadline) {
+				break
+			}
+			runtime.Gosched()
+		}
+		p.spins.parked.Add(1)
+	}
+	select {
+	case <-stop:
+		return Item{}, false
+	case element, ok := <-channel:
+		return element, ok
+	}
+}
+
+func (s *spinStats) printSummary(w io.Writer, spin time.Duration) {
+	caught, parked := s.caught.Load(), s.parked.Load()
+	fmt.Fprintf(w, "consumer spin: %d items caught within %s of spinning, %d times parked on the buffer instead\n",
+		caught, spin, parked)
+}
@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransactionalSink is a Sink that can keep the source position itself, in
+// the same transaction as the items it covers. The pipeline hands it the
+// items as usual and, each time the checkpoint moves, asks it to commit
+// every item up to that point together with the new position, so after a
+// crash the sink and the position can't disagree: nothing committed is
+// read again and nothing read is lost.
+type TransactionalSink interface {
+	Sink
+	// Committed returns the position saved by the last commit, "" if none
+	Committed() (string, error)
+	// Commit makes the items numbered up to through permanent, along with
+	// token as the source position after them
+	Commit(through int64, token string) error
+}
+
+// sqlSink inserts each item as a row of -sql-table, which needs columns
+// id, ts, producer and item, the last holding the whole item as json. It
+// is given as sql:<driver>:<dsn> like the sql source, with the same need
+// for the driver to be linked in.
+//
+// With -checkpoint-in-sink the rows aren't inserted as they arrive but held
+// until the checkpoint moves, and then inserted in one transaction that
+// also records the position in -sql-offsets, a table of name and position
+// text columns, under the -sql-table name.
+type sqlSink struct {
+	db      *sql.DB
+	table   string
+	insert  string
+	offsets string // "" unless the sink keeps the checkpoint
+	// postgres numbers its placeholders, the other common drivers don't
+	numbered bool
+
+	mu      sync.Mutex
+	pending []sqlRow // rows waiting for a commit
+}
+
+type sqlRow struct {
+	seq  int64
+	args []any
+}
+
+func newSQLSink(target string, cfg *Config) (*sqlSink, error) {
+	driver, dsn, ok := strings.Cut(target, ":")
+	if !ok || driver == "" {
+		return nil, fmt.Errorf("sql sink %q: expected sql:<driver>:<dsn>", target)
+	}
+	if cfg.SQLTable == "" {
+		return nil, fmt.Errorf("sql sink needs -sql-table")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql sink: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql sink: %v", err)
+	}
+	s := &sqlSink{
+		db:       db,
+		table:    cfg.SQLTable,
+		numbered: driver == "postgres" || driver == "pgx",
+	}
+	s.insert = s.rebind("INSERT INTO " + s.table + " (id, ts, producer, item) VALUES (?, ?, ?, ?)")
+	if cfg.CheckpointInSink {
+		s.offsets = cfg.SQLOffsets
+	}
+	return s, nil
+}
+
+func (s *sqlSink) row(item *Item) ([]any, error) {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return []any{item.ID, item.Timestamp.UTC(), item.ProducerID, string(b)}, nil
+}
+
+func (s *sqlSink) Write(item *Item) error {
+	args, err := s.row(item)
+	if err != nil {
+		return err
+	}
+	if s.offsets == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, err := s.db.ExecContext(ctx, s.insert, args...)
+		return err
+	}
+	s.mu.Lock()
+	s.pending = append(s.pending, sqlRow{item.seq, args})
+	s.mu.Unlock()
+	return nil
+}
+
+// insert the items in one transaction, or hold them for the next commit
+// when the sink keeps the checkpoint
+func (s *sqlSink) WriteBatch(items []Item) error {
+	rows := make([]sqlRow, len(items))
+	for i := range items {
+		args, err := s.row(&items[i])
+		if err != nil {
+			return err
+		}
+		rows[i] = sqlRow{items[i].seq, args}
+	}
+	if s.offsets != "" {
+		s.mu.Lock()
+		s.pending = append(s.pending, rows...)
+		s.mu.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, row := range rows {
+		if _, err := tx.ExecContext(ctx, s.insert, row.args...); err != nil {
+			return fmt.Errorf("sql sink: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSink) Committed() (string, error) {
+	var token string
+	err := s.db.QueryRow(s.rebind("SELECT position FROM "+s.offsets+" WHERE name = ?"), s.table).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, err
+}
+
+// insert the rows up to through and move the position in one transaction.
+// If it fails the rows are kept for the next try.
+func (s *sqlSink) Commit(through int64, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var keep []sqlRow
+	for _, row := range s.pending {
+		if row.seq > through {
+			keep = append(keep, row)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, s.insert, row.args...); err != nil {
+			return fmt.Errorf("sql sink: %v", err)
+		}
+	}
+	res, err := tx.ExecContext(ctx, s.rebind("UPDATE "+s.offsets+" SET position = ? WHERE name = ?"), token, s.table)
+	if err != nil {
+		return fmt.Errorf("sql sink: saving position: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if _, err := tx.ExecContext(ctx, s.rebind("INSERT INTO "+s.offsets+" (name, position) VALUES (?, ?)"), s.table, token); err != nil {
+			return fmt.Errorf("sql sink: saving position: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sql sink: %v", err)
+	}
+	s.pending = keep
+	return nil
+}
+
+// number the ? placeholders in a query for the drivers that need it
+func (s *sqlSink) rebind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlSink) Close() error {
+	s.mu.Lock()
+	left := len(s.pending)
+	s.mu.Unlock()
+	if left > 0 {
+		fmt.Printf("sql sink: %d rows never committed, they will be read again next run\n", left)
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlSource pages through the results of a query, turning each row into an
+// item whose payload is a json object of the row's columns. It is given as
+// sql:<driver>:<dsn>, with the query in -sql-query. The driver has to be
+// linked into the binary, which means building with a file that blank
+// imports it, e.g.
+//
+//	import _ "github.com/lib/pq"
+//
+// Paging is by keyset on the -sql-key column rather than by OFFSET, so each
+// page is a cheap index range scan however far in we are, and the last key
+// read doubles as the resume token for -checkpoint. In tail mode the source
+// never runs dry: once it has caught up it polls for rows with a greater
+// key, which suits append-only tables.
+type sqlSource struct {
+	db    *sql.DB
+	query string // with the key placeholder filled in
+	first string // the query for the first page, when there's no key yet
+	key   string
+	tail  time.Duration
+
+	mu      sync.Mutex
+	page    []*Item
+	pageKey []any
+	last    any // key of the last item handed out, nil before the first
+}
+
+func newSQLSource(target string, cfg *Config) (*sqlSource, error) {
+	driver, dsn, ok := strings.Cut(target, ":")
+	if !ok || driver == "" {
+		return nil, fmt.Errorf("sql source %q: expected sql:<driver>:<dsn>", target)
+	}
+	if cfg.SQLQuery == "" || cfg.SQLKey == "" {
+		return nil, fmt.Errorf("sql source needs -sql-query and -sql-key")
+	}
+	if cfg.SQLBatch < 1 {
+		return nil, fmt.Errorf("-sql-batch must be at least 1")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sql source: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sql source: %v", err)
+	}
+	// postgres numbers its placeholders, the other common drivers don't
+	placeholder := "?"
+	if driver == "postgres" || driver == "pgx" {
+		placeholder = "$1"
+	}
+	base := fmt.Sprintf("SELECT * FROM (%s) AS q", cfg.SQLQuery)
+	order := fmt.Sprintf(" ORDER BY %s LIMIT %d", cfg.SQLKey, cfg.SQLBatch)
+	return &sqlSource{
+		db:    db,
+		first: base + order,
+		query: base + fmt.Sprintf(" WHERE %s > %s", cfg.SQLKey, placeholder) + order,
+		key:   cfg.SQLKey,
+		tail:  cfg.SQLTail,
+	}, nil
+}
+
+func (s *sqlSource) Next() (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.page) == 0 {
+		n, err := s.fetch()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			break
+		}
+		if s.tail <= 0 {
+			return nil, io.EOF
+		}
+		time.Sleep(s.tail)
+	}
+	item := s.page[0]
+	s.last = s.pageKey[0]
+	s.page, s.pageKey = s.page[1:], s.pageKey[1:]
+	return item, nil
+}
+
+// read the next page of rows after the last key
+func (s *sqlSource) fetch() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var rows *sql.Rows
+	var err error
+	if s.last == nil {
+		rows, err = s.db.QueryContext(ctx, s.first)
+	} else {
+		rows, err = s.db.QueryContext(ctx, s.query, s.last)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("sql source: %v", err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	keyCol := -1
+	for i, c := range cols {
+		if strings.EqualFold(c, s.key) {
+			keyCol = i
+		}
+	}
+	if keyCol < 0 {
+		return 0, fmt.Errorf("sql source: query has no %s column", s.key)
+	}
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return 0, fmt.Errorf("sql source: %v", err)
+		}
+		row := make(map[string]any, len(cols))
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				vals[i] = string(b)
+			}
+			row[c] = vals[i]
+		}
+		payload, err := json.Marshal(row)
+		if err != nil {
+			return 0, fmt.Errorf("sql source: %v", err)
+		}
+		item := &Item{Timestamp: time.Now(), Payload: payload}
+		if id, ok := vals[keyCol].(int64); ok {
+			item.ID = int(id)
+		}
+		s.page = append(s.page, item)
+		s.pageKey = append(s.pageKey, vals[keyCol])
+	}
+	return len(s.page), rows.Err()
+}
+
+// the resume token is the last key handed out, as text
+func (s *sqlSource) Position() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return "", nil
+	}
+	return fmt.Sprint(s.last), nil
+}
+
+// carry on after the key in token. Numeric keys are turned back into
+// numbers so the comparison in the page query stays numeric.
+func (s *sqlSource) Resume(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.page, s.pageKey = nil, nil
+	s.last = nil
+	if token != "" {
+		if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+			s.last = n
+		} else {
+			s.last = token
+		}
+	}
+	return nil
+}
+
+func (s *sqlSource) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,329 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of linear sub-buckets per power of two in the histogram, which
+// keeps every bucket within about 6% of the value it records
+const histSubBuckets = 16
+
+// histogram is a fixed size log-linear latency histogram with microsecond
+// resolution. It uses the same memory no matter how many items are recorded,
+// so it is safe for runs of any length. It is not thread safe on its own.
+type histogram struct {
+	counts [1024]uint64
+	total  uint64
+	max    time.Duration
+}
+
+func histIndex(v uint64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	e := bits.Len64(v) - 5
+	m := v >> uint(e)
+	return histSubBuckets + e*histSubBuckets + int(m-histSubBuckets)
+}
+
+// the largest value that lands in bucket i
+func histValue(i int) uint64 {
+	if i < histSubBuckets {
+		return uint64(i)
+	}
+	e := (i - histSubBuckets) / histSubBuckets
+	m := uint64((i-histSubBuckets)%histSubBuckets + histSubBuckets)
+	return ((m + 1) << uint(e)) - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histIndex(uint64(d/time.Microsecond))]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// return the latency at quantile q (0 < q <= 1), or zero if nothing has
+// been recorded
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.total))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			d := time.Duration(histValue(i)) * time.Microsecond
+			if d > h.max {
+				d = h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// Stats collects counters and latencies for a whole run. All of the methods
+// are thread safe so producers and consumers can share a single Stats.
+type Stats struct {
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	produced int64
+	consumed int64
+	errors   int64
+	dead     int64
+	// items discarded, by why
+	dropped map[DropReason]int64
+	// items given to a splitting handler, and the items it split them into
+	splitIn, splitOut int64
+	// hits per routing destination pool
+	routes map[string]int64
+	// queue latency is the time from item creation until a consumer
+	// pulled it off the channel
+	queue histogram
+	// window holds the latencies recorded since the last takeWindow call
+	window histogram
+	// for the queueing analysis: the time consumers spent on the items
+	// they served, the time producers spent waiting for room, when the
+	// last item went onto a buffer and the size of the pools
+	served               int64
+	service, blocked     time.Duration
+	lastProduced         time.Time
+	producers, consumers int
+	// items produced and consumed in each second since start
+	producedPerSec, consumedPerSec []int64
+	// samples the error messages and counts them by type
+	errs errorSampler
+	// errors by class, where they have one, and retries made
+	classes map[ErrorClass]int64
+	retries int64
+	// the clock the per-second counts go by, time.Now unless a simulation
+	// drives a virtual one
+	clock func() time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{start: time.Now(), clock: time.Now}
+}
+
+func (s *Stats) recordProduced() {
+	s.mu.Lock()
+	s.produced++
+	s.lastProduced = s.clock()
+	s.producedPerSec = bumpSecond(s.producedPerSec, s.start, s.lastProduced)
+	s.mu.Unlock()
+}
+
+// count n items that consumers took d over between them
+func (s *Stats) recordService(n int, d time.Duration) {
+	s.mu.Lock()
+	s.served += int64(n)
+	s.service += d
+	s.mu.Unlock()
+}
+
+// count an error of a class
+func (s *Stats) recordErrorClass(c ErrorClass) {
+	s.mu.Lock()
+	if s.classes == nil {
+		s.classes = make(map[ErrorClass]int64)
+	}
+	s.classes[c]++
+	s.mu.Unlock()
+}
+
+// count a retry after a retriable error
+func (s *Stats) recordRetry() {
+	s.mu.Lock()
+	s.retries++
+	s.mu.Unlock()
+}
+
+// count time a producer spent waiting for room on a buffer
+func (s *Stats) recordBlocked(d time.Duration) {
+	s.mu.Lock()
+	s.blocked += d
+	s.mu.Unlock()
+}
+
+// note how many producers and consumers there are, -1 leaving a count as
+// it was
+func (s *Stats) setWorkers(producers, consumers int) {
+	s.mu.Lock()
+	s.producers = pick(producers, s.producers)
+	s.consumers = pick(consumers, s.consumers)
+	s.mu.Unlock()
+}
+
+func (s *Stats) recordConsumed(latency time.Duration) {
+	s.mu.Lock()
+	s.consumed++
+	s.consumedPerSec = bumpSecond(s.consumedPerSec, s.start, s.clock())
+	s.queue.record(latency)
+	s.window.record(latency)
+	s.mu.Unlock()
+}
+
+// count an item that a consumer failed to handle
+func (s *Stats) recordError() {
+	s.mu.Lock()
+	s.errors++
+	s.mu.Unlock()
+}
+
+// count an item sent to the dead-letter queue
+func (s *Stats) recordDeadLetter() {
+	s.mu.Lock()
+	s.dead++
+	s.mu.Unlock()
+}
+
+// count an item the drop policy discarded
+func (s *Stats) recordDrop(reason DropReason) {
+	s.mu.Lock()
+	if s.dropped == nil {
+		s.dropped = make(map[DropReason]int64)
+	}
+	s.dropped[reason]++
+	s.mu.Unlock()
+}
+
+// how many items have been dropped for a reason so far
+func (s *Stats) droppedCount(reason DropReason) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped[reason]
+}
+
+// count an item that a handler split into n items
+func (s *Stats) recordSplit(n int) {
+	s.mu.Lock()
+	s.splitIn++
+	s.splitOut += int64(n)
+	s.mu.Unlock()
+}
+
+// count an item sent to a pool by the routing rules
+func (s *Stats) recordRoute(pool string) {
+	s.mu.Lock()
+	if s.routes == nil {
+		s.routes = make(map[string]int64)
+	}
+	s.routes[pool]++
+	s.mu.Unlock()
+}
+
+// return the latencies recorded since the previous call and start a new
+// window
+func (s *Stats) takeWindow() histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.window
+	s.window = histogram{}
+	return w
+}
+
+// return a copy of the full run queue latency histogram
+func (s *Stats) latencies() histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue
+}
+
+// how many items the consumers have taken so far
+func (s *Stats) consumedCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.consumed
+}
+
+// mark the end of the run so the summary reports a stable duration
+func (s *Stats) finish() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+}
+
+// called with s.mu held
+func (s *Stats) totalDropped() int64 {
+	var n int64
+	for _, c := range s.dropped {
+		n += c
+	}
+	return n
+}
+
+// the headline numbers of the run, for attaching to events
+func (s *Stats) fields() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"produced": s.produced,
+		"consumed": s.consumed,
+		"errors":   s.errors,
+		"dead":     s.dead,
+		"dropped":  s.totalDropped(),
+		"p50":      s.queue.quantile(0.50).String(),
+		"p99":      s.queue.quantile(0.99).String(),
+	}
+}
+
+// print the end-of-run summary
+func (s *Stats) printSummary(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(s.start)
+	fmt.Fprintf(w, "run summary: produced %d, consumed %d, errors %d in %s (%.1f items/sec)\n",
+		s.produced, s.consumed, s.errors, elapsed.Round(time.Millisecond),
+		float64(s.consumed)/elapsed.Seconds())
+	if s.dead > 0 {
+		fmt.Fprintf(w, "dead-lettered: %d\n", s.dead)
+	}
+	if len(s.classes) > 0 || s.retries > 0 {
+		fmt.Fprintf(w, "errors by class: %s, after %d retries\n", formatClasses(s.classes), s.retries)
+	}
+	if len(s.dropped) > 0 {
+		fmt.Fprintf(w, "dropped: %s\n", formatDrops(s.dropped))
+	}
+	if s.splitIn > 0 {
+		fmt.Fprintf(w, "split: %d items into %d\n", s.splitIn, s.splitOut)
+	}
+	if len(s.routes) > 0 {
+		pools := make([]string, 0, len(s.routes))
+		for pool := range s.routes {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+		var hits []string
+		for _, pool := range pools {
+			hits = append(hits, fmt.Sprintf("%s %d", pool, s.routes[pool]))
+		}
+		fmt.Fprintf(w, "routed: %s\n", strings.Join(hits, ", "))
+	}
+	fmt.Fprintf(w, "queue latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		s.queue.quantile(0.50), s.queue.quantile(0.90),
+		s.queue.quantile(0.99), s.queue.max)
+	if t := s.timelineLocked(); t != nil {
+		fmt.Fprintf(w, "timeline: %s\n", t)
+	}
+	s.printErrors(w)
+}
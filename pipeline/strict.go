@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// strictMemory is -strict-memory: the memory the pipeline's items take is
+// set aside when it starts, rather than growing with the load, for a box
+// with little to spare where running out part way is worse than not
+// starting. The buffers are channels made at their size anyway, and with
+// it they are bounded by -buffer-bytes too and can't be resized. Payloads
+// are capped at -payload-max, and the buffers NewPayloadBuffer hands out
+// come from a reserve made up front with room for every payload the
+// buffers and consumers can hold at once. Each batching consumer makes
+// its batch once at the largest it can be, and reuses it. What would
+// grow without a bound, such as the dedup window, or add consumers, such
+// as auto sizing, can't be used with it.
+type strictMemory struct {
+	payloadMax int
+	reserve    *payloadReserve
+	// the buffers' size, in items and in bytes
+	items int
+	bytes int64
+}
+
+// payloadReserve is the payload buffers made for -strict-memory, each big
+// enough for the largest payload
+type payloadReserve struct {
+	size int
+	free chan *[]byte
+	// buffers asked for with the reserve used up, which had to be made
+	short atomic.Int64
+}
+
+// the reserve of the pipeline running with -strict-memory, nil if there is
+// none. NewPayloadBuffer has no pipeline to ask, so it is the process's.
+var strictPayloads atomic.Pointer[payloadReserve]
+
+// check that -strict-memory has the limits it needs and that they agree,
+// before anything is started
+func checkStrictMemory(cfg *Config) error {
+	switch {
+	case cfg.BufferBytes <= 0:
+		return errors.New("-strict-memory needs -buffer-bytes, to fix what the items on the buffers may take")
+	case cfg.PayloadMax <= 0:
+		return errors.New("-strict-memory needs -payload-max, to size the payload buffers it sets aside")
+	case int64(cfg.PayloadMax)+itemOverhead > int64(cfg.BufferBytes):
+		return fmt.Errorf("-payload-max %s doesn't leave room for an item in -buffer-bytes %s", formatBytes(int64(cfg.PayloadMax)), formatBytes(int64(cfg.BufferBytes)))
+	case cfg.MemoryLimit > 0 && cfg.MemoryLimit < cfg.BufferBytes:
+		return fmt.Errorf("-memory-limit %s is less than the %s -buffer-bytes sets aside", formatBytes(int64(cfg.MemoryLimit)), formatBytes(int64(cfg.BufferBytes)))
+	case cfg.AutoProducers || cfg.AutoConsumers || strings.Contains(cfg.WatermarkAction, "scale"):
+		return errors.New("-strict-memory can't be used with auto sizing or -watermark-action scale, which add consumers as they go")
+	case cfg.DedupWindow > 0:
+		return errors.New("-strict-memory can't be used with -dedup-window, whose keys grow with the items")
+	case cfg.JoinSource != "":
+		return errors.New("-strict-memory can't be used with -join-source, which holds items until their partner comes")
+	}
+	if cfg.Batch != "" {
+		most := cfg.BatchMax
+		if cfg.Batch != "auto" {
+			most, _ = strconv.Atoi(cfg.Batch)
+		}
+		if most > cfg.BufferSize {
+			return fmt.Errorf("batches of up to %d items can't fill from a -buffer of %d", most, cfg.BufferSize)
+		}
+	}
+	return nil
+}
+
+// set aside the payload buffers, one for each payload that fits in the
+// buffers' bytes and one more for each consumer's item in hand
+func newStrictMemory(p *Pipeline, cfg *Config) (*strictMemory, error) {
+	s := &strictMemory{payloadMax: int(cfg.PayloadMax), items: p.bufferCap(), bytes: int64(cfg.BufferBytes)}
+	consumers := cfg.Consumers
+	for _, pool := range p.pools {
+		s.items += cap(pool.channel)
+		consumers += pool.size
+	}
+	if payloadClass(s.payloadMax) < 0 {
+		// small payloads are made as they come, and count against
+		// -buffer-bytes like the rest of the item
+		return s, nil
+	}
+	size := pooledPayloadMin << payloadClass(s.payloadMax)
+	n := int(s.bytes/int64(size)) + consumers
+	if cfg.MemoryLimit > 0 && int64(n)*int64(size) > int64(cfg.MemoryLimit) {
+		return nil, fmt.Errorf("-strict-memory would set aside %d payload buffers of %s, more than -memory-limit %s",
+			n, formatBytes(int64(size)), formatBytes(int64(cfg.MemoryLimit)))
+	}
+	r := &payloadReserve{size: size, free: make(chan *[]byte, n)}
+	for range n {
+		b := make([]byte, 0, size)
+		r.free <- &b
+	}
+	if !strictPayloads.CompareAndSwap(nil, r) {
+		return nil, errors.New("-strict-memory is already set for another pipeline in this process")
+	}
+	s.reserve = r
+	return s, nil
+}
+
+// a buffer of n bytes from the reserve, or a new one if it is used up, so
+// a producer is never stuck waiting on a handler that keeps its payload
+func (r *payloadReserve) get(n int) []byte {
+	select {
+	case b := <-r.free:
+		return (*b)[:n]
+	default:
+		r.short.Add(1)
+		return make([]byte, n, r.size)
+	}
+}
+
+// take a buffer back into the reserve, reporting whether it was one of
+// its size and so taken back, or dropped as the reserve was full
+func (r *payloadReserve) put(b []byte) bool {
+	if cap(b) != r.size {
+		return false
+	}
+	b = b[:0]
+	select {
+	case r.free <- &b:
+	default:
+	}
+	return true
+}
+
+// why an item's payload is too big to take, or "" if it isn't. Safe when
+// nil.
+func (s *strictMemory) oversized(item *Item) string {
+	if s == nil || len(item.Payload) <= s.payloadMax {
+		return ""
+	}
+	return fmt.Sprintf("payload of %s is over -payload-max %s", formatBytes(int64(len(item.Payload))), formatBytes(int64(s.payloadMax)))
+}
+
+// let go of the reserve, for the next pipeline to set up its own
+func (s *strictMemory) Close() error {
+	if s.reserve != nil {
+		strictPayloads.CompareAndSwap(s.reserve, nil)
+	}
+	return nil
+}
+
+func (s *strictMemory) printSummary(w io.Writer) {
+	fmt.Fprintf(w, "strict memory: buffers fixed at %d items and %s", s.items, formatBytes(s.bytes))
+	if r := s.reserve; r != nil {
+		fmt.Fprintf(w, ", %d payload buffers of %s set aside", cap(r.free), formatBytes(int64(r.size)))
+		if short := r.short.Load(); short > 0 {
+			fmt.Fprintf(w, ", %d more made when they ran out", short)
+		}
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotifier tells systemd how a -daemon is doing over the socket in
+// $NOTIFY_SOCKET, as sd_notify does, so a unit of Type=notify is only
+// started once the pipeline is taking items. When the unit sets
+// WatchdogSec the watchdog is pinged at half that interval, but only
+// while the health check finds the pipeline live, so consumers that
+// deadlock get the process restarted.
+type sdNotifier struct {
+	conn     net.Conn
+	health   *healthCheck
+	interval time.Duration // between watchdog pings, 0 without a watchdog
+	done     chan struct{}
+}
+
+// a notifier for the socket systemd gave, nil when not run by systemd
+func newSDNotifier(health *healthCheck) (*sdNotifier, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil, nil
+	}
+	if addr[0] == '@' {
+		// an abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFY_SOCKET: %v", err)
+	}
+	n := &sdNotifier{conn: conn, health: health, done: make(chan struct{})}
+	// the watchdog is meant for this process unless WATCHDOG_PID says
+	// otherwise
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 &&
+		(pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.interval = time.Duration(usec) * time.Microsecond / 2
+	}
+	return n, nil
+}
+
+func (n *sdNotifier) send(state string) {
+	if _, err := n.conn.Write([]byte(state)); err != nil {
+		fmt.Printf("error notifying systemd: %v\n", err)
+	}
+}
+
+// report the pipeline ready and start pinging the watchdog. Safe on a nil
+// notifier.
+func (n *sdNotifier) ready() {
+	if n == nil {
+		return
+	}
+	n.send("READY=1\nSTATUS=taking items")
+	if n.interval > 0 {
+		go n.watch()
+	}
+}
+
+func (n *sdNotifier) watch() {
+	tick := time.NewTicker(n.interval)
+	defer tick.Stop()
+	stalled := false
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-tick.C:
+		}
+		if err := n.health.live(); err != nil {
+			// no ping, so systemd restarts us if it doesn't clear up
+			n.send("STATUS=" + err.Error())
+			stalled = true
+			continue
+		}
+		if stalled {
+			n.send("WATCHDOG=1\nSTATUS=taking items")
+			stalled = false
+		} else {
+			n.send("WATCHDOG=1")
+		}
+	}
+}
+
+// report the pipeline draining. Safe on a nil notifier.
+func (n *sdNotifier) stopping() {
+	if n != nil {
+		n.send("STOPPING=1\nSTATUS=draining")
+	}
+}
+
+// stop pinging the watchdog, as the run is over
+func (n *sdNotifier) Close() error {
+	close(n.done)
+	return n.conn.Close()
+}
@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// how many of the latest consumed items the tail keeps to start with
+const tailRecent = 100
+
+// how many items a follower can fall behind by before it misses some
+const tailFollowBuffer = 256
+
+// consumedTail lets the admin API show the items the consumers hand the
+// sink, for an operator to watch a running pipeline with pcctl consume.
+// It keeps the latest consumed items to start with, and hands what comes
+// after to whoever follows it. A follower that can't keep up misses items
+// rather than holding the consumers up. Items are copied in, payload and
+// all, as theirs go back to their pools once they are settled.
+type consumedTail struct {
+	mu        sync.Mutex
+	recent    []Item // a ring, oldest at next once full
+	next      int
+	followers map[chan Item]*atomic.Int64 // to the items each missed
+	closed    bool
+}
+
+func newConsumedTail() *consumedTail {
+	return &consumedTail{followers: make(map[chan Item]*atomic.Int64)}
+}
+
+// a copy of an item that is still good once the item goes back to its
+// pool, payload and all, and that settles nothing
+func copyItem(item *Item) Item {
+	c := *item
+	c.Payload = append(json.RawMessage(nil), item.Payload...)
+	c.Metadata = maps.Clone(item.Metadata)
+	c.release, c.pending, c.ack = nil, nil, nil
+	return c
+}
+
+// note an item handed to the sink. Safe when nil.
+func (t *consumedTail) add(item *Item) {
+	if t == nil {
+		return
+	}
+	c := copyItem(item)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.recent) < tailRecent {
+		t.recent = append(t.recent, c)
+	} else {
+		t.recent[t.next] = c
+		t.next = (t.next + 1) % tailRecent
+	}
+	for ch, missed := range t.followers {
+		select {
+		case ch <- c:
+		default:
+			missed.Add(1)
+		}
+	}
+}
+
+// the last n items consumed, oldest first, and if follow, a channel of
+// those consumed after, closed once the pipeline finishes or stop is
+// called
+func (t *consumedTail) follow(n int, follow bool) (last []Item, ch chan Item, missed *atomic.Int64, stop func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held := append(append([]Item{}, t.recent[t.next:]...), t.recent[:t.next]...)
+	last = held[max(len(held)-n, 0):]
+	if !follow || t.closed {
+		return last, nil, nil, func() {}
+	}
+	ch, missed = make(chan Item, tailFollowBuffer), new(atomic.Int64)
+	t.followers[ch] = missed
+	return last, ch, missed, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.followers[ch]; ok {
+			delete(t.followers, ch)
+			close(ch)
+		}
+	}
+}
+
+// end the followers' streams, once nothing more is consumed. Safe when
+// nil.
+func (t *consumedTail) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for ch := range t.followers {
+		delete(t.followers, ch)
+		close(ch)
+	}
+}
+
+// GET /pipelines/{name}/consumed?last=10&follow=true, the items consumed
+// as json lines, the last few and then, with follow, the rest as they
+// come until the pipeline finishes
+func (a *adminServer) consumed(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	if p.tail == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("pipeline %s doesn't keep its consumed items", p.name))
+		return
+	}
+	n := 10
+	if s := r.URL.Query().Get("last"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad last %q, expected a number of items", s))
+			return
+		}
+	}
+	last, ch, missed, stop := p.tail.follow(n, r.URL.Query().Get("follow") == "true")
+	defer stop()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for i := range last {
+		enc.Encode(&last[i])
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if ch == nil {
+		return
+	}
+	var told int64
+	for {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				return
+			}
+			// say when items went by without the follower seeing them
+			if m := missed.Load(); m > told {
+				enc.Encode(map[string]int64{"missed": m - told})
+				told = m
+			}
+			if err := enc.Encode(&item); err != nil {
+				return
+			}
+			if flusher != nil && len(ch) == 0 {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
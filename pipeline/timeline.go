@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// the widest a timeline's sparkline is drawn, with each character taking
+// in more seconds on longer runs
+const sparkWidth = 60
+
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// Timeline is how many items were produced and consumed in each second of
+// the run, so bursts, stalls and the warm-up show up rather than being
+// averaged away in the throughput
+type Timeline struct {
+	Produced []int64
+	Consumed []int64
+}
+
+// count an item in the second since start that now falls in
+func bumpSecond(counts []int64, start, now time.Time) []int64 {
+	sec := int(now.Sub(start) / time.Second)
+	if sec < 0 {
+		sec = 0
+	}
+	for len(counts) <= sec {
+		counts = append(counts, 0)
+	}
+	counts[sec]++
+	return counts
+}
+
+// the items consumed a second over the last n whole seconds
+func (s *Stats) consumedRate(n int) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := int(s.clock().Sub(s.start) / time.Second)
+	var sum int64
+	for sec := max(now-n, 0); sec < now && sec < len(s.consumedPerSec); sec++ {
+		sum += s.consumedPerSec[sec]
+	}
+	return float64(sum) / float64(max(min(n, now), 1))
+}
+
+// the timeline so far, both series padded to the same length
+func (s *Stats) timelineLocked() *Timeline {
+	n := max(len(s.producedPerSec), len(s.consumedPerSec))
+	if n == 0 {
+		return nil
+	}
+	t := &Timeline{Produced: make([]int64, n), Consumed: make([]int64, n)}
+	copy(t.Produced, s.producedPerSec)
+	copy(t.Consumed, s.consumedPerSec)
+	return t
+}
+
+// a line of bars, one for each second or, on runs longer than sparkWidth
+// seconds, for as many seconds as it takes to fit, scaled to the busiest
+func sparkline(counts []int64) string {
+	per := (len(counts) + sparkWidth - 1) / sparkWidth
+	var sums []int64
+	var peak int64
+	for i := 0; i < len(counts); i += per {
+		var sum int64
+		for _, n := range counts[i:min(i+per, len(counts))] {
+			sum += n
+		}
+		sums = append(sums, sum)
+		peak = max(peak, sum)
+	}
+	var b strings.Builder
+	for _, sum := range sums {
+		i := 0
+		if peak > 0 {
+			i = int(sum * int64(len(sparkBars)-1) / peak)
+		}
+		b.WriteRune(sparkBars[i])
+	}
+	return b.String()
+}
+
+func peak(counts []int64) int64 {
+	var p int64
+	for _, n := range counts {
+		p = max(p, n)
+	}
+	return p
+}
+
+// the sparklines of the timeline, with how many seconds each bar stands
+// for and the busiest second of each series
+func (t *Timeline) String() string {
+	per := (len(t.Produced) + sparkWidth - 1) / sparkWidth
+	unit := "1s"
+	if per > 1 {
+		unit = fmt.Sprintf("%ds", per)
+	}
+	return fmt.Sprintf("produced %s (peak %d/s), consumed %s (peak %d/s), a bar per %s",
+		sparkline(t.Produced), peak(t.Produced), sparkline(t.Consumed), peak(t.Consumed), unit)
+}
+
+// write the timeline as csv, a row per second
+func (t *Timeline) writeCSV(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "second,produced,consumed"); err != nil {
+		return err
+	}
+	for i := range t.Produced {
+		if _, err := fmt.Fprintf(w, "%d,%d,%d\n", i, t.Produced[i], t.Consumed[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the ways a network endpoint can authenticate its clients
+const (
+	authNone  = "none"
+	authToken = "token" // Authorization: Bearer <token>
+	authMTLS  = "mtls"  // client certificate signed by -tls-client-ca
+)
+
+// endpointSecurity is the TLS and authentication setup for one network
+// listener. The certificate, key and client CA are shared by every listener,
+// while each endpoint decides for itself whether to use TLS and how to
+// authenticate, so e.g. admin can require mTLS while metrics stay open.
+type endpointSecurity struct {
+	name  string
+	tls   *tls.Config // nil for plain TCP
+	auth  string
+	token string
+}
+
+// build the security settings for an endpoint from the shared TLS flags
+func newEndpointSecurity(cfg *Config, name string, useTLS bool, auth, token string) (*endpointSecurity, error) {
+	s := &endpointSecurity{name: name, auth: auth, token: token}
+	switch auth {
+	case authNone:
+	case authToken:
+		if token == "" {
+			return nil, fmt.Errorf("%s: token auth needs a token", name)
+		}
+	case authMTLS:
+		if !useTLS || cfg.TLSClientCA == "" {
+			return nil, fmt.Errorf("%s: mtls auth needs TLS and -tls-client-ca", name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown auth %q, expected none, token or mtls", name, auth)
+	}
+	if !useTLS {
+		return s, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, fmt.Errorf("%s: TLS needs -tls-cert and -tls-key", name)
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	s.tls = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found in %s", name, cfg.TLSClientCA)
+		}
+		s.tls.ClientCAs = pool
+		s.tls.ClientAuth = tls.VerifyClientCertIfGiven
+		if auth == authMTLS {
+			s.tls.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return s, nil
+}
+
+// open the endpoint's listener, wrapped in TLS when enabled. An address of
+// the form unix:<path> listens on a Unix domain socket instead of TCP, for
+// same-host clients that shouldn't need a port opened. A stale socket left
+// by a previous run is removed first, the socket file gets socketMode
+// permissions, and it is unlinked again when the listener is closed.
+func (s *endpointSecurity) listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		ln, err = listenUnix(path, socketMode)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	return ln, nil
+}
+
+// wrap an HTTP handler so that unauthenticated requests are rejected
+func (s *endpointSecurity) wrap(next http.Handler) http.Handler {
+	if s.auth == authNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.check(r); err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *endpointSecurity) check(r *http.Request) error {
+	if s.auth == authMTLS {
+		// the TLS handshake already verified the chain; this just makes
+		// sure there was one
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return errors.New("missing or bad token")
+	}
+	return nil
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// only remove it if nobody is answering, so a second instance
+		// can't steal the socket from a running one
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
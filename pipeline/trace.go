@@ -0,0 +1,356 @@
+package pipeline
+
+import (
+	"bufio"
+	bin "encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// what happened to an item, as a trace records it
+type traceKind byte
+
+const (
+	traceEnqueue traceKind = iota + 1 // put on a buffer by a producer
+	traceDequeue                      // taken off by a consumer
+	traceStart                        // the consumer starts handling it
+	traceEnd                          // and is done
+	traceAck                          // settled, so the checkpoint and transport hear of it
+	traceNack                         // failed, dead-lettered or dropped
+	traceRetry                        // tried again after an error
+)
+
+var traceKindNames = map[traceKind]string{
+	traceEnqueue: "enqueue", traceDequeue: "dequeue", traceStart: "start",
+	traceEnd: "end", traceAck: "ack", traceNack: "nack", traceRetry: "retry",
+}
+
+// why an item was nacked
+const (
+	nackFailed byte = iota
+	nackDead
+	nackDropped
+)
+
+var nackNames = []string{"failed", "dead-lettered", "dropped"}
+
+// the header of a trace file, followed by the unix time in nanoseconds the
+// trace starts at, as a varint
+const traceMagic = "pctrace1"
+
+// tracer writes every item's lifecycle to a -trace file. Each record is
+// the kind, as a byte, then as uvarints the item's trace number, the
+// producer or consumer it happened on and the nanoseconds since the
+// record before, and for a nack a byte saying why. Items are numbered in
+// the order they are first seen, since their IDs needn't be unique. The
+// methods are safe on a nil tracer, which records nothing.
+//
+// Besides the file, the tracer keeps where each item got to, for the
+// admin API to say where an item is.
+type tracer struct {
+	next atomic.Uint64
+
+	mu    sync.Mutex
+	start time.Time
+	last  time.Duration
+	f     *os.File
+	w     *bufio.Writer
+	buf   [3*bin.MaxVarintLen64 + 2]byte
+	err   error
+	// where each item got to, kept under mu too
+	places *itemPlaces
+}
+
+func newTracer(path string) (*tracer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("-trace: %v", err)
+	}
+	t := &tracer{start: time.Now(), f: f, w: bufio.NewWriterSize(f, 64<<10), places: newItemPlaces()}
+	t.w.WriteString(traceMagic)
+	n := bin.PutVarint(t.buf[:], t.start.UnixNano())
+	t.w.Write(t.buf[:n])
+	return t, nil
+}
+
+// give an item its trace number, if it hasn't one
+func (t *tracer) number(item *Item) {
+	if t != nil && item.trace == 0 {
+		item.trace = t.next.Add(1)
+	}
+}
+
+func (t *tracer) record(kind traceKind, item *Item, worker int) {
+	t.write(kind, item, worker, 0, "")
+}
+
+// record an item put on the named buffer
+func (t *tracer) enqueue(item *Item, worker int, buffer string) {
+	t.write(traceEnqueue, item, worker, 0, buffer)
+}
+
+func (t *tracer) nack(item *Item, worker int, why byte) {
+	t.write(traceNack, item, worker, why, "")
+}
+
+func (t *tracer) write(kind traceKind, item *Item, worker int, why byte, buffer string) {
+	if t == nil {
+		return
+	}
+	t.number(item)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.places.note(kind, item, worker, why, buffer)
+	if t.err != nil {
+		return
+	}
+	now := time.Since(t.start)
+	b := t.buf[:0]
+	b = append(b, byte(kind))
+	b = bin.AppendUvarint(b, item.trace)
+	b = bin.AppendUvarint(b, uint64(max(0, worker)))
+	b = bin.AppendUvarint(b, uint64(now-t.last))
+	if kind == traceNack {
+		b = append(b, why)
+	}
+	t.last = now
+	if _, err := t.w.Write(b); err != nil {
+		t.err = err
+		fmt.Printf("error writing trace, no more will be recorded: %v\n", err)
+	}
+}
+
+func (t *tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.w.Flush(); err != nil {
+		t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
+
+// a record read back from a trace file
+type traceRecord struct {
+	kind   traceKind
+	item   uint64
+	worker int
+	at     time.Duration // since the start of the trace
+	why    byte
+}
+
+// read a whole trace file, returning when it started and its records
+func readTrace(path string) (time.Time, []traceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != traceMagic {
+		return time.Time{}, nil, fmt.Errorf("%s is not a trace file", path)
+	}
+	ns, err := bin.ReadVarint(r)
+	if err != nil {
+		return time.Time{}, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var records []traceRecord
+	var at time.Duration
+	for {
+		kind, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		rec := traceRecord{kind: traceKind(kind)}
+		var worker, delta uint64
+		if err == nil {
+			rec.item, err = bin.ReadUvarint(r)
+		}
+		if err == nil {
+			worker, err = bin.ReadUvarint(r)
+		}
+		if err == nil {
+			delta, err = bin.ReadUvarint(r)
+		}
+		if err == nil && rec.kind == traceNack {
+			rec.why, err = r.ReadByte()
+		}
+		if err != nil {
+			// a run that was killed leaves a partial record at the end
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				fmt.Printf("trace ends part way through a record, ignoring it\n")
+				break
+			}
+			return time.Time{}, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		at += time.Duration(delta)
+		rec.worker, rec.at = int(worker), at
+		records = append(records, rec)
+	}
+	return time.Unix(0, ns), records, nil
+}
+
+// traceMain runs go_producer_consumer trace view or trace chrome,
+// returning the exit code
+func traceMain(args []string, out io.Writer) int {
+	if len(args) > 0 && args[0] == "chrome" {
+		return chromeMain(args[1:], out)
+	}
+	if len(args) == 0 || args[0] != "view" {
+		fmt.Fprintln(out, "usage: go_producer_consumer trace view|chrome [flags] <file>")
+		return 2
+	}
+	fs := flag.NewFlagSet("trace view", flag.ContinueOnError)
+	fs.SetOutput(out)
+	items := fs.Int("items", 20, "how many item timelines to show, the slowest first")
+	only := fs.Uint64("item", 0, "show only the timeline of this trace number")
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(out, "trace view needs a trace file")
+		return 2
+	}
+	start, records, err := readTrace(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	viewTrace(out, start, records, *items, *only)
+	return 0
+}
+
+// print the aggregate statistics of a trace and the timelines of its
+// slowest items
+func viewTrace(w io.Writer, start time.Time, records []traceRecord, items int, only uint64) {
+	byItem := make(map[uint64][]traceRecord)
+	counts := make(map[traceKind]int)
+	nacks := make([]int, len(nackNames))
+	for _, rec := range records {
+		byItem[rec.item] = append(byItem[rec.item], rec)
+		counts[rec.kind]++
+		if rec.kind == traceNack && int(rec.why) < len(nacks) {
+			nacks[rec.why]++
+		}
+	}
+	if only != 0 {
+		if recs, ok := byItem[only]; ok {
+			printTimeline(w, only, recs)
+		} else {
+			fmt.Fprintf(w, "no item %d in the trace\n", only)
+		}
+		return
+	}
+	var end time.Duration
+	if len(records) > 0 {
+		end = records[len(records)-1].at
+	}
+	fmt.Fprintf(w, "trace from %s, %s long, %d items, %d records\n",
+		start.Format(time.RFC3339), end.Round(time.Millisecond), len(byItem), len(records))
+	var kinds []string
+	for k := traceEnqueue; k <= traceRetry; k++ {
+		kinds = append(kinds, fmt.Sprintf("%s %d", traceKindNames[k], counts[k]))
+	}
+	fmt.Fprintf(w, "records: %s\n", strings.Join(kinds, ", "))
+	if counts[traceNack] > 0 {
+		var why []string
+		for i, n := range nacks {
+			if n > 0 {
+				why = append(why, fmt.Sprintf("%s %d", nackNames[i], n))
+			}
+		}
+		fmt.Fprintf(w, "nacks: %s\n", strings.Join(why, ", "))
+	}
+
+	// how long items spent in each stage, and in all
+	var queued, handling, total histogram
+	type slow struct {
+		item uint64
+		took time.Duration
+	}
+	var slowest []slow
+	for id, recs := range byItem {
+		first := map[traceKind]time.Duration{}
+		for _, rec := range recs {
+			if _, ok := first[rec.kind]; !ok {
+				first[rec.kind] = rec.at
+			}
+		}
+		if in, ok := first[traceEnqueue]; ok {
+			if out, ok := first[traceDequeue]; ok {
+				queued.record(out - in)
+			}
+		}
+		if s, ok := first[traceStart]; ok {
+			if e, ok := first[traceEnd]; ok {
+				handling.record(e - s)
+			}
+		}
+		took := recs[len(recs)-1].at - recs[0].at
+		total.record(took)
+		slowest = append(slowest, slow{id, took})
+	}
+	for _, h := range []struct {
+		name string
+		h    *histogram
+	}{{"queued", &queued}, {"handling", &handling}, {"in all", &total}} {
+		if h.h.total > 0 {
+			fmt.Fprintf(w, "%-9s p50 %s, p90 %s, p99 %s, max %s\n", h.name+":",
+				h.h.quantile(0.50), h.h.quantile(0.90), h.h.quantile(0.99), h.h.max)
+		}
+	}
+	sort.Slice(slowest, func(i, j int) bool {
+		if slowest[i].took != slowest[j].took {
+			return slowest[i].took > slowest[j].took
+		}
+		return slowest[i].item < slowest[j].item
+	})
+	if items > len(slowest) {
+		items = len(slowest)
+	}
+	if items > 0 {
+		fmt.Fprintf(w, "\nslowest %d items:\n", items)
+	}
+	for _, s := range slowest[:items] {
+		printTimeline(w, s.item, byItem[s.item])
+	}
+}
+
+// print one item's records, each relative to the first
+func printTimeline(w io.Writer, item uint64, recs []traceRecord) {
+	var steps []string
+	for _, rec := range recs {
+		step := traceKindNames[rec.kind]
+		if step == "" {
+			step = fmt.Sprintf("kind %d", rec.kind)
+		}
+		step += " +" + (rec.at - recs[0].at).Round(time.Microsecond).String()
+		switch rec.kind {
+		case traceEnqueue:
+			step += fmt.Sprintf(" by producer %d", rec.worker)
+		case traceDequeue, traceStart, traceEnd, traceRetry:
+			step += fmt.Sprintf(" by consumer %d", rec.worker)
+		case traceNack:
+			if int(rec.why) < len(nackNames) {
+				step += " (" + nackNames[rec.why] + ")"
+			}
+		}
+		steps = append(steps, step)
+	}
+	fmt.Fprintf(w, "item %d at %s: %s\n", item, recs[0].at.Round(time.Microsecond), strings.Join(steps, ", "))
+}
@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBatchDone is returned when a batch is used after it was committed or
+// rolled back
+var ErrBatchDone = errors.New("batch already committed or rolled back")
+
+// ProducerBatch stages items for a pipeline so that they reach its
+// consumers as a group or not at all. Added items are held in the batch
+// until Commit puts every one of them on the buffers, or Rollback throws
+// them away, so a consumer never sees part of a batch that isn't
+// committed. A batch is for one goroutine at a time.
+//
+// Committing waits until the buffers have room for the whole batch and
+// then puts it on them in one go, between the items of other producers
+// but never interleaved with another batch. A commit given up on while
+// waiting for room has put nothing on them. A batch bigger than a buffer
+// can't wait for room like that, so its items are put on as room frees up,
+// though still without being given up on part way.
+type ProducerBatch struct {
+	p     *Pipeline
+	items []Item
+	done  bool
+	// requeued dead letters are meant to go through again, so aren't
+	// duplicates whatever -dedup-window says
+	redeliver bool
+	// the items committed that -dedup-window or -buffer-full dropped
+	dropped []error
+}
+
+// what became of the batches, for the summary
+type txnCounts struct {
+	committed, rolledBack, items atomic.Int64
+}
+
+// BeginBatch starts a batch of items to produce together
+func (p *Pipeline) BeginBatch() *ProducerBatch {
+	return &ProducerBatch{p: p}
+}
+
+// Produce puts a single item on the buffers, waiting for room until ctx
+// is done. It fails with ErrPipelineClosed once the pipeline is draining,
+// ErrBufferFull if ctx is done first, and a DropError when -dedup-window
+// drops the item as a duplicate, -payload-max as too big or -buffer-full
+// drop for want of room, the last of which is ErrBufferFull too.
+func (p *Pipeline) Produce(ctx context.Context, item Item) error {
+	b := p.BeginBatch()
+	if err := b.Add(item); err != nil {
+		return err
+	}
+	if err := b.CommitContext(ctx); err != nil {
+		return err
+	}
+	if len(b.dropped) > 0 {
+		return b.dropped[0]
+	}
+	return nil
+}
+
+// ProduceBatch puts a chunk of items on the buffers together, for a
+// source that reads them that way. It is a ProducerBatch committed in one
+// go: the items reach the consumers all of them or none, with the one
+// commit's locking for the lot rather than a Produce's for each. It fails
+// as Produce does, with the DropErrors of the items dropped joined
+// together.
+func (p *Pipeline) ProduceBatch(ctx context.Context, items []Item) error {
+	b := &ProducerBatch{p: p, items: make([]Item, 0, len(items))}
+	var errs []error
+	for _, item := range items {
+		if err := b.Add(item); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := b.CommitContext(ctx); err != nil {
+		return err
+	}
+	return errors.Join(append(errs, b.dropped...)...)
+}
+
+// Add stages an item in the batch, or drops it with a DropError if its
+// payload is over -payload-max
+func (b *ProducerBatch) Add(item Item) error {
+	if b.done {
+		return ErrBatchDone
+	}
+	if why := b.p.strict.oversized(&item); why != "" {
+		b.p.drops.drop(item, DropInvalid, why)
+		b.p.settle(&item)
+		return &DropError{ID: item.ID, Reason: DropInvalid, Detail: why}
+	}
+	if item.Timestamp.IsZero() {
+		item.Timestamp = time.Now()
+	}
+	b.items = append(b.items, item)
+	return nil
+}
+
+// Len is how many items the batch holds
+func (b *ProducerBatch) Len() int {
+	return len(b.items)
+}
+
+// Rollback throws the batch's items away
+func (b *ProducerBatch) Rollback() {
+	if !b.done {
+		b.done = true
+		b.items = nil
+		b.p.txns.rolledBack.Add(1)
+	}
+}
+
+// Commit puts every item of the batch on the buffers, waiting as long as
+// it takes for room
+func (b *ProducerBatch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext commits the batch unless ctx is done before there is room
+// for it, in which case nothing is put on the buffers and the batch can be
+// committed again or rolled back
+func (b *ProducerBatch) CommitContext(ctx context.Context) error {
+	if b.done {
+		return ErrBatchDone
+	}
+	p := b.p
+	// committing holds the buffers open, as a running producer does
+	p.mu.Lock()
+	if p.draining || p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %s is draining, can't commit a batch", ErrPipelineClosed, p.name)
+	}
+	p.committing++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.committing--
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+
+	p.commitMu.Lock()
+	defer p.commitMu.Unlock()
+	chans := make([]chan Item, len(b.items))
+	room := make(map[chan Item]int)
+	for i := range b.items {
+		chans[i] = p.route(&b.items[i])
+		room[chans[i]]++
+	}
+	if err := waitForRoom(ctx, room); err != nil {
+		return fmt.Errorf("%w, gave up waiting for room: %w", ErrBufferFull, err)
+	}
+	// past here the batch goes on whole, whatever ctx says, taking the
+	// buffers' lock the once rather than for each item
+	p.lockInput(nil)
+	defer p.bufMu.RUnlock()
+	produced := 0
+	for i := range b.items {
+		item := &b.items[i]
+		if !b.redeliver && !p.dedup.admit(item) {
+			p.drops.drop(*item, DropDuplicate, "")
+			p.settle(item)
+			b.dropped = append(b.dropped, &DropError{ID: item.ID, Reason: DropDuplicate})
+			continue
+		}
+		if p.record != nil {
+			if err := p.record.Write(item); err != nil {
+				fmt.Printf("error recording produced item: %v\n", err)
+			}
+		}
+		if p.budget != nil {
+			item.size = item.memSize()
+			p.budget.acquire(item.size, nil)
+		}
+		if _, dropped := p.enqueueLocked(chans[i], *item, nil); dropped {
+			b.dropped = append(b.dropped, &DropError{ID: item.ID, Reason: DropFull})
+			continue
+		}
+		produced++
+	}
+	b.done = true
+	p.txns.committed.Add(1)
+	p.txns.items.Add(int64(produced))
+	b.items = nil
+	return nil
+}
+
+// wait until each channel has room for as many items as need, or as much
+// room as it will ever have if it holds fewer
+func waitForRoom(ctx context.Context, need map[chan Item]int) error {
+	for {
+		full := false
+		for ch, n := range need {
+			if cap(ch)-len(ch) < min(n, cap(ch)) {
+				full = true
+			}
+		}
+		if !full {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
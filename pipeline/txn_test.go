@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// a pipeline that isn't running yet, for its buffer to fill
+func idlePipeline(t *testing.T, args ...string) *Pipeline {
+	t.Helper()
+	cfg, err := ParseConfig(append([]string{"-producers", "0", "-consumers", "1", "-delay", "0"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Run)
+	return p
+}
+
+func TestProduceBatchReportsFullDrops(t *testing.T) {
+	p := idlePipeline(t, "-buffer", "1", "-buffer-full", "drop")
+	err := p.ProduceBatch(context.Background(), []Item{{ID: 1}, {ID: 2}, {ID: 3}})
+	if !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("got %v, expected ErrBufferFull", err)
+	}
+	var drop *DropError
+	if !errors.As(err, &drop) || drop.Reason != DropFull || drop.ID != 2 {
+		t.Fatalf("got %v, expected item 2 dropped for room first", err)
+	}
+	if n := p.buffered(); n != 1 {
+		t.Fatalf("%d items on the buffer, expected 1", n)
+	}
+}
+
+func TestProduceSettlesDuplicates(t *testing.T) {
+	p := idlePipeline(t, "-dedup-window", "1m")
+	item := Item{ID: 1, IdempotencyKey: "once"}
+	if _, err := p.Submit(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	pd := &Pending{done: make(chan struct{})}
+	item.pending = pd
+	err := p.Produce(context.Background(), item)
+	var drop *DropError
+	if !errors.As(err, &drop) || drop.Reason != DropDuplicate {
+		t.Fatalf("got %v, expected a duplicate dropped", err)
+	}
+	select {
+	case <-pd.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the duplicate was never settled")
+	}
+}
@@ -0,0 +1,260 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// verifyMain runs go_producer_consumer verify, which checks what a run
+// produced, as recorded by -record-produced, against what reached the sink,
+// and returns 1 if anything is missing, duplicated or corrupted, so it can
+// gate a CI job:
+//
+//	go_producer_consumer -check-sequence -record-produced in.json -sink file:out.json -drop-log drops.json
+//	go_producer_consumer verify -produced in.json -consumed out.json -excused drops.json
+//
+// Items are matched by producer and sequence number when they have one,
+// which -check-sequence gives the built-in producers, and by id otherwise.
+// Items in -excused files, drop logs or dlq files, were discarded on
+// purpose and aren't counted as missing.
+func verifyMain(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(out)
+	produced := fs.String("produced", "", "the items the run produced, written by -record-produced")
+	consumed := fs.String("consumed", "", "the json lines the sink wrote, a glob for several files")
+	var excused stringList
+	fs.Var(&excused, "excused", "drop log or dlq file of items discarded on purpose (repeatable)")
+	content := fs.Bool("content", true, "compare the items' contents as well as that they arrived")
+	show := fs.Int("show", 5, "how many examples of each problem to print")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if *produced == "" || *consumed == "" {
+		fmt.Fprintln(out, "verify needs -produced and -consumed")
+		return 2
+	}
+	v := &verifier{produced: make(map[verifyKey]*verifyEntry)}
+	if err := readItems(*produced, v.addProduced); err != nil {
+		fmt.Fprintf(out, "reading -produced: %v\n", err)
+		return 2
+	}
+	for _, path := range excused {
+		if err := readExcused(path, v.excuse); err != nil {
+			fmt.Fprintf(out, "reading -excused: %v\n", err)
+			return 2
+		}
+	}
+	if err := readItems(*consumed, func(item *Item) { v.addConsumed(item, *content) }); err != nil {
+		fmt.Fprintf(out, "reading -consumed: %v\n", err)
+		return 2
+	}
+	if v.report(out, *show) {
+		return 1
+	}
+	return 0
+}
+
+// verifier tallies items by key. The same key can be produced more than
+// once when items are matched by id, so it counts rather than just marking
+// each one seen.
+type verifier struct {
+	produced map[verifyKey]*verifyEntry
+	shared   int // produced items that shared a key with another
+	// keys of each kind of problem, in the order they were found
+	duplicated, corrupted, unexpected []verifyKey
+}
+
+type verifyEntry struct {
+	produced, excused, consumed int
+	contents                    map[string]bool // what the produced items held
+}
+
+// what identifies an item between the recording and the sink
+type verifyKey struct {
+	producer int
+	seq      int64 // 0 when matched by id
+	id       int
+}
+
+func keyOf(item *Item) verifyKey {
+	if item.Seq > 0 {
+		return verifyKey{producer: item.ProducerID, seq: item.Seq}
+	}
+	return verifyKey{id: item.ID}
+}
+
+func (k verifyKey) String() string {
+	if k.seq > 0 {
+		return fmt.Sprintf("producer %d seq %d", k.producer, k.seq)
+	}
+	return fmt.Sprintf("id %d", k.id)
+}
+
+func (k verifyKey) less(o verifyKey) bool {
+	if k.producer != o.producer {
+		return k.producer < o.producer
+	}
+	if k.seq != o.seq {
+		return k.seq < o.seq
+	}
+	return k.id < o.id
+}
+
+// the parts of an item a sink should have kept as they were
+func verifyContent(item *Item) string {
+	b, _ := json.Marshal(struct {
+		Timestamp     string
+		Metadata      map[string]string
+		Payload       json.RawMessage
+		Schema        string
+		SchemaVersion int
+	}{item.Timestamp.UTC().Format("2006-01-02T15:04:05.999999999Z"), item.Metadata, compactJSON(item.Payload), item.Schema, item.SchemaVersion})
+	return string(b)
+}
+
+// a payload with its whitespace taken out, since sinks needn't keep it
+func compactJSON(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return raw
+	}
+	return b.Bytes()
+}
+
+func (v *verifier) entry(key verifyKey) *verifyEntry {
+	e := v.produced[key]
+	if e == nil {
+		e = &verifyEntry{contents: make(map[string]bool)}
+		v.produced[key] = e
+	}
+	return e
+}
+
+func (v *verifier) addProduced(item *Item) {
+	e := v.entry(keyOf(item))
+	if e.produced++; e.produced == 2 {
+		v.shared += 2
+	} else if e.produced > 2 {
+		v.shared++
+	}
+	e.contents[verifyContent(item)] = true
+}
+
+func (v *verifier) excuse(item *Item) {
+	if e, ok := v.produced[keyOf(item)]; ok {
+		e.excused++
+	}
+}
+
+func (v *verifier) addConsumed(item *Item, content bool) {
+	key := keyOf(item)
+	e, ok := v.produced[key]
+	if !ok {
+		v.unexpected = append(v.unexpected, key)
+		return
+	}
+	if e.consumed++; e.consumed == e.produced+1 {
+		v.duplicated = append(v.duplicated, key)
+	}
+	if content && !e.contents[verifyContent(item)] {
+		v.corrupted = append(v.corrupted, key)
+	}
+}
+
+// print what was found, reporting whether there was a problem
+func (v *verifier) report(w io.Writer, show int) bool {
+	var missing []verifyKey
+	var produced, excused, extra int
+	for key, e := range v.produced {
+		produced += e.produced
+		// excused items may have reached the sink anyway, a dlq'd item
+		// that succeeded on a retry for one
+		excused += min(e.excused, max(0, e.produced-e.consumed))
+		if n := e.produced - e.excused - e.consumed; n > 0 {
+			for range n {
+				missing = append(missing, key)
+			}
+		}
+		if e.consumed > e.produced {
+			extra += e.consumed - e.produced
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].less(missing[j]) })
+	fmt.Fprintf(w, "verify: %d produced, %d excused, %d missing, %d duplicated, %d corrupted, %d never produced\n",
+		produced, excused, len(missing), extra, len(v.corrupted), len(v.unexpected))
+	if v.shared > 0 {
+		fmt.Fprintf(w, "%d produced items share an id, so they were only counted; number them with -check-sequence to match them one for one\n", v.shared)
+	}
+	for _, problem := range []struct {
+		name string
+		keys []verifyKey
+	}{{"missing", missing}, {"duplicated", v.duplicated}, {"corrupted", v.corrupted}, {"never produced", v.unexpected}} {
+		if len(problem.keys) == 0 || show <= 0 {
+			continue
+		}
+		var keys []string
+		for _, k := range problem.keys[:min(show, len(problem.keys))] {
+			keys = append(keys, k.String())
+		}
+		more := ""
+		if len(problem.keys) > show {
+			more = fmt.Sprintf(" and %d more", len(problem.keys)-show)
+		}
+		fmt.Fprintf(w, "%s: %s%s\n", problem.name, strings.Join(keys, ", "), more)
+	}
+	return len(missing) > 0 || extra > 0 || len(v.corrupted) > 0 || len(v.unexpected) > 0
+}
+
+// call f with each item in json lines files matching pattern
+func readItems(pattern string, f func(*Item)) error {
+	src, err := newFileSource(pattern)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	for {
+		item, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f(item)
+	}
+}
+
+// call f with each item in a drop log or dlq file, whose lines both hold
+// the item under "item"
+func readExcused(path string, f func(*Item)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry struct {
+			Item Item `json:"item"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		f(&entry.Item)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often a wasm handler checks whether its module file has changed
+const wasmReloadCheck = time.Second
+
+// wasmHandler runs a WebAssembly module as the handler. The module is a WASI
+// command that speaks the same line based json protocol as exec plugins
+// (see plugin.go), so it can be written in any language that compiles to
+// WASI. It is run by an external runtime such as wasmtime, which gives it
+// no filesystem or network access unless asked to, so a misbehaving handler
+// can't reach outside its sandbox.
+//
+// The module file is watched, and when it changes a fresh instance is
+// started and swapped in. In-flight items finish on the old instance before
+// it is shut down, so nothing is lost across a swap.
+type wasmHandler struct {
+	path    string
+	runtime string
+
+	mu      sync.RWMutex
+	proc    *execPlugin
+	modTime time.Time
+
+	checkMu sync.Mutex
+	checked time.Time
+}
+
+func newWasmHandler(path, runtime string) (*wasmHandler, error) {
+	w := &wasmHandler{path: path, runtime: runtime}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if w.proc, err = w.start(); err != nil {
+		return nil, err
+	}
+	w.modTime = info.ModTime()
+	w.checked = time.Now()
+	return w, nil
+}
+
+func (w *wasmHandler) start() (*execPlugin, error) {
+	proc, err := startExecPluginArgs([]string{w.runtime, "run", w.path})
+	if err != nil {
+		return nil, fmt.Errorf("wasm handler %s: %v", w.path, err)
+	}
+	return proc, nil
+}
+
+func (w *wasmHandler) Handle(item *Item) (*Item, error) {
+	w.reloadIfChanged()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.proc.Handle(item)
+}
+
+func (w *wasmHandler) Split(item *Item) ([]Item, error) {
+	w.reloadIfChanged()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.proc.Split(item)
+}
+
+// swap in a new instance if the module file has been modified. A module
+// that fails to start leaves the old instance running.
+func (w *wasmHandler) reloadIfChanged() {
+	w.checkMu.Lock()
+	defer w.checkMu.Unlock()
+	if time.Since(w.checked) < wasmReloadCheck {
+		return
+	}
+	w.checked = time.Now()
+	info, err := os.Stat(w.path)
+	if err != nil || !info.ModTime().After(w.modTime) {
+		return
+	}
+	proc, err := w.start()
+	if err != nil {
+		fmt.Printf("not reloading: %v\n", err)
+		return
+	}
+	w.mu.Lock()
+	old := w.proc
+	w.proc = proc
+	w.modTime = info.ModTime()
+	w.mu.Unlock()
+	fmt.Printf("wasm handler %s reloaded\n", w.path)
+	old.Close()
+}
+
+func (w *wasmHandler) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.proc.Close()
+}
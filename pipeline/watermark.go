@@ -0,0 +1,219 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the events sent when the buffer crosses its watermarks
+const (
+	EventHighWatermark = "high_watermark"
+	EventLowWatermark  = "low_watermark"
+)
+
+// what -watermark-action can do when the buffer crosses the high
+// watermark, undone once it is back down to the low one
+const (
+	watermarkPause = "pause" // hold the producers off
+	watermarkScale = "scale" // add -watermark-scale consumers
+)
+
+// how often the buffer's occupancy is looked at
+const watermarkCheckEvery = 50 * time.Millisecond
+
+// WatermarkCrossing is the buffer filling up to its high watermark, or
+// draining back down to its low one, as passed to OnWatermark callbacks
+type WatermarkCrossing struct {
+	High      bool
+	Buffered  int
+	Capacity  int
+	Occupancy float64
+}
+
+// watermarks watch how full the default pool's buffer is. Once it fills to
+// -watermark-high it counts as high until it drains down to -watermark-low,
+// and only then as low again, so an occupancy that wavers around one of
+// them doesn't cross back and forth. Each crossing calls the OnWatermark
+// callbacks, sends an event and applies -watermark-action.
+type watermarks struct {
+	p         *Pipeline
+	high, low float64
+	pause     bool
+	scale     int
+
+	gate gate
+	done chan struct{}
+
+	mu        sync.Mutex
+	callbacks []func(WatermarkCrossing)
+	above     bool
+	since     time.Time
+	added     int // consumers added by the scale action
+	highs     int
+	lows      int
+	aboveFor  time.Duration
+}
+
+func newWatermarks(p *Pipeline, cfg *Config) (*watermarks, error) {
+	w := &watermarks{p: p, high: cfg.WatermarkHigh, low: cfg.WatermarkLow, done: make(chan struct{})}
+	if w.high > 1 || w.low < 0 || w.low >= w.high {
+		return nil, fmt.Errorf("-watermark-low must be at least 0 and under -watermark-high, which must be at most 1")
+	}
+	for _, a := range strings.Split(cfg.WatermarkAction, ",") {
+		switch strings.TrimSpace(a) {
+		case "":
+		case watermarkPause:
+			w.pause = true
+		case watermarkScale:
+			if cfg.AutoConsumers {
+				return nil, fmt.Errorf("-watermark-action scale doesn't work with -consumers auto, which sizes the consumers itself")
+			}
+			if cfg.WatermarkScale < 1 {
+				return nil, fmt.Errorf("-watermark-scale must be at least 1")
+			}
+			w.scale = cfg.WatermarkScale
+		default:
+			return nil, fmt.Errorf("unknown -watermark-action %q, expected pause or scale", a)
+		}
+	}
+	return w, nil
+}
+
+// OnWatermark has fn called each time the buffer fills to -watermark-high
+// or drains back to -watermark-low. It is called from the goroutine
+// watching the buffer, so it should be quick. It does nothing without
+// -watermark-high.
+func (p *Pipeline) OnWatermark(fn func(WatermarkCrossing)) {
+	if p.marks == nil {
+		return
+	}
+	p.marks.mu.Lock()
+	p.marks.callbacks = append(p.marks.callbacks, fn)
+	p.marks.mu.Unlock()
+}
+
+func (w *watermarks) start() {
+	go func() {
+		tick := time.NewTicker(watermarkCheckEvery)
+		defer tick.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-tick.C:
+				w.check()
+			}
+		}
+	}()
+}
+
+// stop watching, letting any producers held off go
+func (w *watermarks) stop() {
+	close(w.done)
+	w.gate.unpause()
+	w.mu.Lock()
+	if w.above {
+		w.aboveFor += time.Since(w.since)
+		w.above = false
+	}
+	w.mu.Unlock()
+}
+
+// hold a producer off while the pause action is on. Safe on nil.
+func (w *watermarks) wait(stop <-chan struct{}) {
+	if w != nil {
+		w.gate.wait(stop)
+	}
+}
+
+func (w *watermarks) check() {
+	c := WatermarkCrossing{Buffered: w.p.buffered(), Capacity: w.p.bufferCap()}
+	if c.Capacity == 0 {
+		return
+	}
+	c.Occupancy = float64(c.Buffered) / float64(c.Capacity)
+	w.mu.Lock()
+	switch {
+	case !w.above && c.Occupancy >= w.high:
+		w.above, w.since = true, time.Now()
+		w.highs++
+		c.High = true
+	case w.above && c.Occupancy <= w.low:
+		w.above = false
+		w.aboveFor += time.Since(w.since)
+		w.lows++
+	default:
+		w.mu.Unlock()
+		return
+	}
+	callbacks := w.callbacks
+	w.mu.Unlock()
+
+	w.act(c.High)
+	what, event := "drained to the low", EventLowWatermark
+	if c.High {
+		what, event = "filled to the high", EventHighWatermark
+	}
+	fmt.Printf("buffer %s watermark, at %d of %d items (%.0f%%)\n", what, c.Buffered, c.Capacity, c.Occupancy*100)
+	w.p.hooks.emit(newEvent(event,
+		map[string]any{"buffered": c.Buffered, "capacity": c.Capacity, "occupancy": c.Occupancy},
+		"buffer %s watermark, at %.0f%%", what, c.Occupancy*100))
+	for _, fn := range callbacks {
+		fn(c)
+	}
+}
+
+// apply -watermark-action on crossing the high watermark, or undo it on
+// crossing back to the low one
+func (w *watermarks) act(high bool) {
+	if w.pause {
+		if high {
+			w.gate.pause()
+		} else {
+			w.gate.unpause()
+		}
+	}
+	if w.scale == 0 {
+		return
+	}
+	w.p.mu.Lock()
+	n := active(w.p.consumers)
+	w.p.mu.Unlock()
+	switch {
+	case high:
+		if err := w.p.scale(-1, n+w.scale); err != nil {
+			fmt.Printf("error adding consumers at the high watermark: %v\n", err)
+			return
+		}
+		w.added += w.scale
+	case w.added > 0:
+		// only the consumers it added, in case they were scaled down since
+		remove := min(w.added, n-1)
+		w.added = 0
+		if remove > 0 {
+			if err := w.p.scale(-1, n-remove); err != nil {
+				fmt.Printf("error removing consumers at the low watermark: %v\n", err)
+			}
+		}
+	}
+}
+
+// the watermark the buffer is at, for the admin API
+func (w *watermarks) state() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.above {
+		return "high"
+	}
+	return "low"
+}
+
+func (w *watermarks) printSummary(out io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(out, "watermarks: filled to %.0f%% %d times and drained to %.0f%% %d times, above the high watermark for %s\n",
+		w.high*100, w.highs, w.low*100, w.lows, w.aboveFor.Round(time.Millisecond))
+}
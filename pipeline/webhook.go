@@ -0,0 +1,196 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the pipeline events that can be sent to webhooks
+const (
+	EventEndOfStream = "end_of_stream" // the producers are done, the consumers still draining
+	EventRunComplete = "run_complete"
+	EventSLOBreach   = "slo_breach"
+	EventWorkerCrash = "worker_crash"
+)
+
+// Event is something noteworthy that happened during a run. It is the data
+// passed to webhook templates, and the default webhook body is the event
+// marshalled as json.
+type Event struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+func newEvent(typ string, fields map[string]any, format string, args ...any) Event {
+	return Event{
+		Type:    typ,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, args...),
+		Fields:  fields,
+	}
+}
+
+// webhook posts events to a single URL. If a template is set, the request
+// body is the template executed with the Event, otherwise it is the json
+// encoded Event. When a secret is set the body is signed with HMAC-SHA256
+// and the hex digest sent in the X-Signature-256 header, GitHub style.
+type webhook struct {
+	url      string
+	template *template.Template
+	secret   []byte
+	retries  int
+	backoff  time.Duration
+	client   *http.Client
+}
+
+// render the request body for an event
+func (w *webhook) body(ev Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(ev)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, ev); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// deliver an event, retrying with exponential backoff on network errors,
+// 429s and 5xx responses. Other 4xx responses are not retried since sending
+// the same body again won't help.
+func (w *webhook) send(ev Event) error {
+	body, err := w.body(ev)
+	if err != nil {
+		return fmt.Errorf("rendering webhook body: %v", err)
+	}
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ev, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// make a single delivery attempt, reporting whether a failure is worth
+// retrying
+func (w *webhook) post(ev Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", ev.Type)
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("webhook %s: %s", w.url, resp.Status)
+}
+
+// eventHooks fans events out to the configured webhooks. Deliveries happen
+// in the background so a slow receiver never holds up the pipeline; call
+// wait() before exiting so that in-flight deliveries get to finish.
+type eventHooks struct {
+	webhooks []*webhook
+	events   map[string]bool // nil means every event
+	wg       sync.WaitGroup
+}
+
+// build the hooks from the webhook settings in the config
+func newEventHooks(cfg *Config) (*eventHooks, error) {
+	h := &eventHooks{}
+	if len(cfg.Webhooks) == 0 {
+		return h, nil
+	}
+	var tmpl *template.Template
+	if cfg.WebhookTemplate != "" {
+		text, err := os.ReadFile(cfg.WebhookTemplate)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err = template.New("webhook").Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.WebhookEvents != "" {
+		h.events = make(map[string]bool)
+		for _, typ := range strings.Split(cfg.WebhookEvents, ",") {
+			h.events[strings.TrimSpace(typ)] = true
+		}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, url := range cfg.Webhooks {
+		h.webhooks = append(h.webhooks, &webhook{
+			url:      url,
+			template: tmpl,
+			secret:   []byte(cfg.WebhookSecret),
+			retries:  cfg.WebhookRetries,
+			backoff:  500 * time.Millisecond,
+			client:   client,
+		})
+	}
+	return h, nil
+}
+
+// send an event to every webhook that wants it
+func (h *eventHooks) emit(ev Event) {
+	if h == nil || (h.events != nil && !h.events[ev.Type]) {
+		return
+	}
+	for _, w := range h.webhooks {
+		h.wg.Add(1)
+		go func(w *webhook) {
+			defer h.wg.Done()
+			if err := w.send(ev); err != nil {
+				fmt.Printf("error sending %s event: %v\n", ev.Type, err)
+			}
+		}(w)
+	}
+}
+
+// wait for all in-flight deliveries
+func (h *eventHooks) wait() {
+	if h != nil {
+		h.wg.Wait()
+	}
+}
+
+// deferred by every worker goroutine so that a panicking producer or
+// consumer is reported as a worker_crash event instead of taking down the
+// whole process. The crashed worker stays stopped; the rest carry on.
+func (h *eventHooks) crashGuard(role string, id int) {
+	if r := recover(); r != nil {
+		fmt.Printf("%s %d crashed: %v\n", role, id, r)
+		h.emit(newEvent(EventWorkerCrash, map[string]any{"role": role, "id": id},
+			"%s %d crashed: %v", role, id, r))
+	}
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// how many finished items a trace remembers the fate of for the admin
+// API's where query, besides every item still in the pipeline
+const whereKeepFinished = 100000
+
+// ItemPlace is where an item is in the pipeline, or what became of it, as
+// the -trace records so far tell it
+type ItemPlace struct {
+	Trace      uint64    `json:"trace"` // the item's trace number
+	ID         int       `json:"id"`
+	ProducerID int       `json:"producer_id"`
+	State      string    `json:"state"`
+	Where      string    `json:"where"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// the states an ItemPlace can be in
+const (
+	placeQueued   = "queued"
+	placeInFlight = "in flight"
+	placeHandled  = "handled"
+	placeAcked    = "acked"
+)
+
+// itemPlaces keeps the latest ItemPlace of every item a tracer has seen
+// that isn't finished, and of the last whereKeepFinished that are. Its
+// methods are called with the tracer's lock held.
+type itemPlaces struct {
+	byTrace  map[uint64]*ItemPlace
+	finished []uint64 // oldest first
+}
+
+func newItemPlaces() *itemPlaces {
+	return &itemPlaces{byTrace: make(map[uint64]*ItemPlace)}
+}
+
+// bring an item's place up to date with a record about it
+func (ps *itemPlaces) note(kind traceKind, item *Item, worker int, why byte, buffer string) {
+	pl := ps.byTrace[item.trace]
+	if pl == nil {
+		pl = &ItemPlace{Trace: item.trace, ID: item.ID, ProducerID: item.ProducerID}
+		ps.byTrace[item.trace] = pl
+	}
+	pl.Since = time.Now()
+	switch kind {
+	case traceEnqueue:
+		pl.State, pl.Where = placeQueued, "on the "+buffer
+	case traceDequeue, traceStart:
+		pl.State, pl.Where = placeInFlight, fmt.Sprintf("at consumer %d", worker)
+		pl.Attempts = max(pl.Attempts, 1)
+	case traceRetry:
+		pl.Attempts++
+	case traceEnd:
+		pl.State, pl.Where = placeHandled, fmt.Sprintf("by consumer %d, not acked yet", worker)
+	case traceNack:
+		if int(why) < len(nackNames) {
+			pl.State = nackNames[why]
+		}
+		pl.Where = ""
+		if pl.Attempts > 0 {
+			pl.Where = fmt.Sprintf("at attempt %d", pl.Attempts)
+		}
+	case traceAck:
+		// a nacked item is settled too, which mustn't hide why
+		if pl.State != nackNames[nackDead] && pl.State != nackNames[nackDropped] && pl.State != nackNames[nackFailed] {
+			pl.State, pl.Where = placeAcked, ""
+		}
+		ps.finished = append(ps.finished, item.trace)
+		if len(ps.finished) > whereKeepFinished {
+			delete(ps.byTrace, ps.finished[0])
+			ps.finished = ps.finished[1:]
+		}
+	}
+}
+
+// the places of the item with a trace number, or of the items with an ID,
+// which needn't be unique, the latest first
+func (t *tracer) where(trace uint64, id int, byID bool) []ItemPlace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var found []ItemPlace
+	if !byID {
+		if pl := t.places.byTrace[trace]; pl != nil {
+			found = append(found, *pl)
+		}
+		return found
+	}
+	for _, pl := range t.places.byTrace {
+		if pl.ID == id {
+			found = append(found, *pl)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Trace > found[j].Trace })
+	return found
+}
+
+// GET /pipelines/{name}/where?id=42 or ?trace=7 reports where an item is
+func (a *adminServer) where(w http.ResponseWriter, r *http.Request, p *Pipeline) {
+	if p.trace == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("pipeline %s isn't run with -trace, which where needs", p.name))
+		return
+	}
+	q := r.URL.Query()
+	var found []ItemPlace
+	if s := q.Get("trace"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad trace number %q", s))
+			return
+		}
+		found = p.trace.where(n, 0, false)
+	} else if s := q.Get("id"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad id %q", s))
+			return
+		}
+		found = p.trace.where(0, id, true)
+	} else {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected ?id=<item id> or ?trace=<trace number>"))
+		return
+	}
+	if len(found) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such item among those still in the pipeline or the last %d finished", whereKeepFinished))
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
@@ -0,0 +1,382 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Syncer is a sink that can make sure what it has been given so far is
+// stored durably, as the file sink does by flushing and fsyncing its file
+// and the s3 sink by completing the object it is building
+type Syncer interface {
+	Sync() error
+}
+
+// how often a write-behind buffer is flushed when -write-behind doesn't say
+const defaultWriteBehindEvery = time.Second
+
+// writeBehind buffers the writes to a slow sink so consumers can go on to
+// their next item without waiting for each one, set up per sink with
+// -write-behind <sink>=<items>[,<interval>]. The buffer is written out, in
+// one batch when the sink can take one, once it holds that many items,
+// every interval, and when the pipeline drains or shuts down, and then the
+// sink is synced if it can be. Only after that are the items the writes
+// came from settled, so an item is never acked or checkpointed before
+// what it came to is durably in the sink, and what an aborted run leaves
+// in a buffer is redelivered or salvaged rather than lost.
+type writeBehind struct {
+	p     *Pipeline
+	name  string
+	sink  Sink
+	max   int
+	every time.Duration
+
+	mu      sync.Mutex
+	pending []behindWrite
+	// one flush at a time, so the writes reach the sink in order
+	flushMu sync.Mutex
+	done    chan struct{}
+	stop    sync.Once
+	wg      sync.WaitGroup
+
+	written, failed, flushes atomic.Int64
+}
+
+// a write waiting in a buffer, and the item it holds back from settling
+type behindWrite struct {
+	batchEntry
+	hold *itemHold
+}
+
+// itemHold keeps a handled item from being settled until the consumer is
+// done with it and every write-behind buffer it made writes to has
+// flushed them
+type itemHold struct {
+	p    *Pipeline
+	item Item
+	n    atomic.Int32
+}
+
+// hold the item for one more write, unless it has been settled already,
+// which happens when the joiner emits for a consumer that has moved on
+func (h *itemHold) add() bool {
+	for {
+		n := h.n.Load()
+		if n == 0 {
+			return false
+		}
+		if h.n.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (h *itemHold) release() {
+	if h.n.Add(-1) == 0 {
+		h.p.settle(&h.item)
+	}
+}
+
+// a sink that can take a write to do later, which is a write-behind buffer
+// or the router when some of its sinks are
+type behindSink interface {
+	queue(e batchEntry, hold *itemHold) error
+}
+
+// wrap the sinks -write-behind names in their buffers
+func (p *Pipeline) setupWriteBehind(cfg *Config) error {
+	if len(cfg.WriteBehind) > 0 && cfg.Batch != "" {
+		return fmt.Errorf("-write-behind and -batch both buffer writes to the sink, use one or the other")
+	}
+	for _, s := range cfg.WriteBehind {
+		name, spec, ok := strings.Cut(s, "=")
+		name = strings.TrimSpace(name)
+		size, every, _ := strings.Cut(spec, ",")
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if !ok || name == "" || err != nil || n < 1 {
+			return fmt.Errorf("write-behind %q: expected <sink>=<items>[,<interval>]", s)
+		}
+		w := &writeBehind{p: p, name: name, max: n, every: defaultWriteBehindEvery, done: make(chan struct{})}
+		if every != "" {
+			if w.every, err = time.ParseDuration(strings.TrimSpace(every)); err != nil || w.every <= 0 {
+				return fmt.Errorf("write-behind %q: bad interval %q", s, every)
+			}
+		}
+		switch {
+		case p.routed != nil:
+			rs := p.routed.sinks[name]
+			if rs == nil {
+				return fmt.Errorf("write-behind %q: no sink named %s", s, name)
+			}
+			if _, ok := rs.Sink.(*writeBehind); ok {
+				return fmt.Errorf("write-behind %q: sink %s is already buffered", s, name)
+			}
+			w.sink, rs.Sink = rs.Sink, w
+		case name != defaultSink:
+			return fmt.Errorf("write-behind %q: no sink named %s, see -named-sink", s, name)
+		case p.sink == nil:
+			return fmt.Errorf("write-behind %q: there is no -sink to buffer", s)
+		case len(p.behind) > 0:
+			return fmt.Errorf("write-behind %q: sink %s is already buffered", s, name)
+		default:
+			w.sink, p.sink = p.sink, w
+		}
+		p.behind = append(p.behind, w)
+		w.wg.Add(1)
+		go w.tick()
+	}
+	return p.bufferS3(cfg)
+}
+
+// the hold for an item a consumer is about to handle, which it releases
+// when it is done with it in place of settling it; nil without
+// -write-behind or -sink-order-key, when items are settled straight away
+func (p *Pipeline) holdFor(myId int, item Item) *itemHold {
+	if len(p.behind) == 0 && p.ordered == nil {
+		return nil
+	}
+	h := &itemHold{p: p, item: item}
+	h.n.Store(1)
+	p.holds.Store(myId, h)
+	return h
+}
+
+// the hold for the item the consumer is on, nil if there is none, such as
+// for what the joiner emits when it stops
+func (p *Pipeline) holdOf(myId int) *itemHold {
+	if len(p.behind) == 0 && p.ordered == nil {
+		return nil
+	}
+	h, _ := p.holds.Load(myId)
+	hold, _ := h.(*itemHold)
+	return hold
+}
+
+// settle the item a consumer is done with once its writes are flushed
+func (p *Pipeline) doneWith(myId int, hold *itemHold) {
+	p.holds.Delete(myId)
+	hold.release()
+}
+
+// write out every buffer, which the pipeline does once its consumers have
+// drained, so what they wrote is in the sinks and their items are settled
+// before the checkpoint is saved for the last time. Settling items lets
+// the -sink-order-key writers go on with the writes that waited for them,
+// which may fill the buffers again.
+func (p *Pipeline) flushBehind() {
+	for _, w := range p.behind {
+		w.stopTicking()
+	}
+	for {
+		p.ordered.wait()
+		n := 0
+		for _, w := range p.behind {
+			n += w.buffered()
+			w.flush()
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func (w *writeBehind) queue(e batchEntry, hold *itemHold) error {
+	if !hold.add() {
+		return w.Write(&e.item)
+	}
+	w.mu.Lock()
+	w.pending = append(w.pending, behindWrite{e, hold})
+	full := len(w.pending) >= w.max
+	w.mu.Unlock()
+	// the consumer that fills the buffer writes it out, which holds the
+	// consumers back when the sink can't keep up
+	if full {
+		w.flush()
+	}
+	return nil
+}
+
+// a write that can't wait, with no item to hold back, goes after the
+// buffered ones
+func (w *writeBehind) Write(item *Item) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.flushLocked()
+	return w.writeOne(item)
+}
+
+func (w *writeBehind) tick() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *writeBehind) flush() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.flushLocked()
+}
+
+// write out the buffer, called with flushMu held. If the sink turns the
+// writes down they are tried one at a time, as a batch is, so only the
+// items it objects to count as failed.
+func (w *writeBehind) flushLocked() {
+	w.mu.Lock()
+	writes := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+	w.flushes.Add(1)
+	items := make([]Item, len(writes))
+	for i, e := range writes {
+		items[i] = e.item
+	}
+	retry := writes
+	var err error
+	if bs, ok := w.sink.(BatchSink); ok {
+		err = w.p.limits.writeBatch(bs, items)
+	} else {
+		for i := range items {
+			if err = w.p.limits.write(w.sink, &items[i]); err != nil {
+				retry = writes[i:]
+				break
+			}
+		}
+	}
+	// what did go through has to be synced before its items can settle
+	if err == nil || len(retry) < len(writes) {
+		if serr := w.sync(); serr != nil {
+			err, retry = serr, writes
+		}
+	}
+	w.p.health.wrote(err)
+	if err == nil {
+		w.written.Add(int64(len(writes)))
+		for _, e := range writes {
+			e.hold.release()
+		}
+		return
+	}
+	w.written.Add(int64(len(writes) - len(retry)))
+	for _, e := range writes[:len(writes)-len(retry)] {
+		e.hold.release()
+	}
+	for _, e := range retry {
+		err := w.p.retry(&e.original, 0, func() error { return w.writeOne(&e.item) })
+		if err != nil {
+			w.failed.Add(1)
+			w.p.deliverFailed(fmt.Errorf("error writing item %d to sink %s: %w", e.item.ID, w.name, err), e.original, e.piece)
+		} else {
+			w.written.Add(1)
+		}
+		e.hold.release()
+	}
+}
+
+func (w *writeBehind) writeOne(item *Item) error {
+	if err := w.p.limits.write(w.sink, item); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+func (w *writeBehind) sync() error {
+	if s, ok := w.sink.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// how many writes are waiting in the buffer
+func (w *writeBehind) buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// what an aborted run leaves in the buffer, forgetting it
+func (w *writeBehind) take() []behindWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	writes := w.pending
+	w.pending = nil
+	return writes
+}
+
+func (w *writeBehind) Ping() error {
+	if p, ok := w.sink.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func (w *writeBehind) stopTicking() {
+	w.stop.Do(func() { close(w.done) })
+	w.wg.Wait()
+}
+
+// flush what is left and close the sink
+func (w *writeBehind) Close() error {
+	w.stopTicking()
+	w.flush()
+	if c, ok := w.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// the router writes an item to its unbuffered sinks straight away and
+// only queues it for the buffered ones once those writes have worked, so a
+// retry of the item doesn't queue it twice
+func (r *sinkRouter) queue(e batchEntry, hold *itemHold) error {
+	var behind []*writeBehind
+	var errs []error
+	for _, name := range r.route(&e.item) {
+		s := r.sinks[name]
+		if w, ok := s.Sink.(*writeBehind); ok {
+			behind = append(behind, w)
+			continue
+		}
+		if err := r.limits.write(s.Sink, &e.item); err != nil {
+			s.failed.Add(1)
+			errs = append(errs, fmt.Errorf("sink %s: %w", name, err))
+			continue
+		}
+		s.written.Add(1)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	for _, w := range behind {
+		if err := w.queue(e, hold); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", w.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) printWriteBehindSummary(w io.Writer) {
+	for _, b := range p.behind {
+		fmt.Fprintf(w, "write-behind %s: %d written in %d flushes", b.name, b.written.Load(), b.flushes.Load())
+		if n := b.failed.Load(); n > 0 {
+			fmt.Fprintf(w, ", %d failed", n)
+		}
+		fmt.Fprintln(w)
+	}
+}